@@ -0,0 +1,91 @@
+// Copyright 2023 NJWS Inc.
+
+// Foliage cron package.
+// Provides stateful functions for managing the runtime's cron schedules at runtime
+package cron
+
+import (
+	"fmt"
+
+	"github.com/foliagecp/easyjson"
+
+	"github.com/foliagecp/sdk/statefun"
+	sfPlugins "github.com/foliagecp/sdk/statefun/plugins"
+)
+
+/*
+Creates or replaces the cron schedule with the id of the function.
+
+Request:
+
+	payload: json - required
+		cron: string - required // Cron expression, e.g. "*\/5 * * * *" or "@every 30s"
+		typename: string - required // Typename of the function to be signaled on each tick
+		id: string - required // Id of the function to be signaled on each tick
+		payload: json - optional // Payload template, see statefun.CronSchedule
+		options: json - optional
+
+Reply:
+
+	status: string - "ok" | "failed"
+	result: string - error description if failed
+*/
+func SetSchedule(runtime *statefun.Runtime) statefun.FunctionLogicHandler {
+	return func(executor sfPlugins.StatefunExecutor, contextProcessor *sfPlugins.StatefunContextProcessor) {
+		payload := contextProcessor.Payload
+
+		schedule := statefun.CronSchedule{
+			ScheduleID: contextProcessor.Self.ID,
+			Cron:       payload.GetByPath("cron").AsStringDefault(""),
+			Typename:   payload.GetByPath("typename").AsStringDefault(""),
+			ID:         payload.GetByPath("id").AsStringDefault(""),
+		}
+		if payload.GetByPath("payload").IsObject() {
+			schedule.PayloadTemplate = payload.GetByPath("payload").GetPtr()
+		}
+		if payload.GetByPath("options").IsObject() {
+			schedule.Options = payload.GetByPath("options").GetPtr()
+		}
+
+		var err error
+		if len(schedule.Typename) == 0 || len(schedule.ID) == 0 {
+			err = fmt.Errorf("typename and id of the target function must be defined")
+		} else {
+			err = runtime.SetCronSchedule(schedule)
+		}
+		reply(contextProcessor, err)
+	}
+}
+
+/*
+Deletes the cron schedule with the id of the function.
+
+Reply:
+
+	status: string - "ok" | "failed"
+	result: string - error description if failed
+*/
+func DeleteSchedule(runtime *statefun.Runtime) statefun.FunctionLogicHandler {
+	return func(executor sfPlugins.StatefunExecutor, contextProcessor *sfPlugins.StatefunContextProcessor) {
+		reply(contextProcessor, runtime.DeleteCronSchedule(contextProcessor.Self.ID))
+	}
+}
+
+func reply(contextProcessor *sfPlugins.StatefunContextProcessor, err error) {
+	if contextProcessor.Reply == nil {
+		return
+	}
+	result := easyjson.NewJSONObject()
+	if err == nil {
+		result.SetByPath("status", easyjson.NewJSON("ok"))
+	} else {
+		result.SetByPath("status", easyjson.NewJSON("failed"))
+		result.SetByPath("result", easyjson.NewJSON(err.Error()))
+	}
+	contextProcessor.Reply.With(&result)
+}
+
+func RegisterAllFunctionTypes(runtime *statefun.Runtime) {
+	statefun.NewFunctionType(runtime, "functions.cron.schedule.set", SetSchedule(runtime), *statefun.NewFunctionTypeConfig().SetServiceState(true))
+	statefun.NewFunctionType(runtime, "functions.cron.schedule.delete", DeleteSchedule(runtime), *statefun.NewFunctionTypeConfig().SetServiceState(true))
+}
@@ -31,7 +31,7 @@ func ReplyQueryID(queryID string, result *easyjson.JSON, contextProcessor *sfplu
 			contextProcessor.Reply.With(result)
 		} else {
 			if len(contextProcessor.Caller.Typename) == 0 || len(contextProcessor.Caller.ID) == 0 { // Signal was sent from a NATS cli
-				sfSystem.MsgOnErrorReturn(contextProcessor.Signal(plugins.JetstreamGlobalSignal, QueryResultTopic, queryID, result, nil)) // Publish result to NATS special query reply topic (no JetStream)
+				sfSystem.MsgOnErrorReturn(contextProcessor.Signal(plugins.NatsCoreGlobalSignal, QueryResultTopic, queryID, result, nil)) // Publish result to NATS special query reply topic (no JetStream)
 			} // else do not reply to a signal from another statefun
 		}
 	} else {
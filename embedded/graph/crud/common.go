@@ -1,6 +1,8 @@
 package crud
 
 import (
+	"github.com/foliagecp/easyjson"
+
 	"github.com/foliagecp/sdk/statefun"
 )
 
@@ -35,6 +37,16 @@ const (
 var (
 	llAPIVertexCUDNames = []string{"functions.graph.api.vertex.create", "functions.graph.api.vertex.update", "functions.graph.api.vertex.delete"}
 	llAPILinkCUDNames   = []string{"functions.graph.api.link.create", "functions.graph.api.link.update", "functions.graph.api.link.delete"}
+
+	createObjectPayloadSchema, _ = easyjson.JSONFromString(`{
+		"type": "object",
+		"required": ["origin_type"],
+		"properties": {
+			"prefix": {"type": "string"},
+			"origin_type": {"type": "string", "minLength": 1},
+			"body": {"type": "object"}
+		}
+	}`)
 )
 
 func RegisterAllFunctionTypes(runtime *statefun.Runtime) {
@@ -47,7 +59,7 @@ func RegisterAllFunctionTypes(runtime *statefun.Runtime) {
 	statefun.NewFunctionType(runtime, "functions.cmdb.api.types.link.update", UpdateTypesLink, *statefun.NewFunctionTypeConfig().SetServiceState(true).SetMaxIdHandlers(-1))
 	statefun.NewFunctionType(runtime, "functions.cmdb.api.types.link.delete", DeleteTypesLink, *statefun.NewFunctionTypeConfig().SetServiceState(true).SetMaxIdHandlers(-1))
 
-	statefun.NewFunctionType(runtime, "functions.cmdb.api.object.create", CreateObject, *statefun.NewFunctionTypeConfig().SetServiceState(true).SetMaxIdHandlers(-1))
+	statefun.NewFunctionType(runtime, "functions.cmdb.api.object.create", CreateObject, *statefun.NewFunctionTypeConfig().SetServiceState(true).SetMaxIdHandlers(-1).SetPayloadSchema(&createObjectPayloadSchema))
 	statefun.NewFunctionType(runtime, "functions.cmdb.api.object.update", UpdateObject, *statefun.NewFunctionTypeConfig().SetServiceState(true).SetMaxIdHandlers(-1))
 	statefun.NewFunctionType(runtime, "functions.cmdb.api.object.delete", DeleteObject, *statefun.NewFunctionTypeConfig().SetServiceState(true).SetMaxIdHandlers(-1))
 
@@ -55,12 +67,13 @@ func RegisterAllFunctionTypes(runtime *statefun.Runtime) {
 	statefun.NewFunctionType(runtime, "functions.cmdb.api.objects.link.update", UpdateObjectsLink, *statefun.NewFunctionTypeConfig().SetServiceState(true).SetMaxIdHandlers(-1))
 	statefun.NewFunctionType(runtime, "functions.cmdb.api.objects.link.delete", DeleteObjectsLink, *statefun.NewFunctionTypeConfig().SetServiceState(true).SetMaxIdHandlers(-1))
 
-	// Low-Level API Registration
-	statefun.NewFunctionType(runtime, llAPIVertexCUDNames[0], LLAPIVertexCreate, *statefun.NewFunctionTypeConfig().SetServiceState(true).SetMaxIdHandlers(-1))
-	statefun.NewFunctionType(runtime, llAPIVertexCUDNames[1], LLAPIVertexUpdate, *statefun.NewFunctionTypeConfig().SetServiceState(true).SetMaxIdHandlers(-1))
-	statefun.NewFunctionType(runtime, llAPIVertexCUDNames[2], LLAPIVertexDelete, *statefun.NewFunctionTypeConfig().SetServiceState(true).SetMaxIdHandlers(-1))
+	// Low-Level API Registration, is used by the high-level one only and is not accessible from outside of the runtime
+	internalAccess := statefun.AccessGolangLocalRequest | statefun.AccessGolangLocalSignal
+	statefun.NewFunctionType(runtime, llAPIVertexCUDNames[0], LLAPIVertexCreate, *statefun.NewFunctionTypeConfig().SetAccessebility(internalAccess).SetMaxIdHandlers(-1))
+	statefun.NewFunctionType(runtime, llAPIVertexCUDNames[1], LLAPIVertexUpdate, *statefun.NewFunctionTypeConfig().SetAccessebility(internalAccess).SetMaxIdHandlers(-1))
+	statefun.NewFunctionType(runtime, llAPIVertexCUDNames[2], LLAPIVertexDelete, *statefun.NewFunctionTypeConfig().SetAccessebility(internalAccess).SetMaxIdHandlers(-1))
 
-	statefun.NewFunctionType(runtime, llAPILinkCUDNames[0], LLAPILinkCreate, *statefun.NewFunctionTypeConfig().SetServiceState(true).SetMaxIdHandlers(-1))
-	statefun.NewFunctionType(runtime, llAPILinkCUDNames[1], LLAPILinkUpdate, *statefun.NewFunctionTypeConfig().SetServiceState(true).SetMaxIdHandlers(-1))
-	statefun.NewFunctionType(runtime, llAPILinkCUDNames[2], LLAPILinkDelete, *statefun.NewFunctionTypeConfig().SetServiceState(true).SetMaxIdHandlers(-1))
+	statefun.NewFunctionType(runtime, llAPILinkCUDNames[0], LLAPILinkCreate, *statefun.NewFunctionTypeConfig().SetAccessebility(internalAccess).SetMaxIdHandlers(-1))
+	statefun.NewFunctionType(runtime, llAPILinkCUDNames[1], LLAPILinkUpdate, *statefun.NewFunctionTypeConfig().SetAccessebility(internalAccess).SetMaxIdHandlers(-1))
+	statefun.NewFunctionType(runtime, llAPILinkCUDNames[2], LLAPILinkDelete, *statefun.NewFunctionTypeConfig().SetAccessebility(internalAccess).SetMaxIdHandlers(-1))
 }
@@ -193,10 +193,17 @@ func LLAPIVertexUpdate(executor sfplugins.StatefunExecutor, contextProcessor *sf
 		case "merge":
 			fallthrough
 		default:
-			newBody = contextProcessor.GetObjectContext()
-			newBody.DeepMerge(objectBody)
-			contextProcessor.SetObjectContext(newBody) // Update an object
-			result.SetByPath("status", easyjson.NewJSON("ok"))
+			err := contextProcessor.UpdateObjectContext(func(body *easyjson.JSON) error { // Concurrent updates of the object are not lost
+				body.DeepMerge(objectBody)
+				newBody = body.Clone().GetPtr()
+				return nil
+			})
+			if err == nil {
+				result.SetByPath("status", easyjson.NewJSON("ok"))
+			} else {
+				errorString += fmt.Sprintf("ERROR LLAPIVertexUpdate %s: %s;", contextProcessor.Self.ID, err)
+				result.SetByPath("status", easyjson.NewJSON("failed"))
+			}
 		}
 	} else {
 		result.SetByPath("status", easyjson.NewJSON("failed"))
@@ -283,7 +290,7 @@ func LLAPIVertexDelete(executor sfplugins.StatefunExecutor, contextProcessor *sf
 	if opStack != nil {
 		oldBody = contextProcessor.GetObjectContext()
 	}
-	contextProcessor.GlobalCache.DeleteValue(contextProcessor.Self.ID, true, -1, "") // Delete object's body
+	contextProcessor.DeleteObjectContext() // Delete object's body and function contexts bound to the object
 	addVertexOpToOpStack(opStack, contextProcessor.Self.Typename, contextProcessor.Self.ID, oldBody, nil)
 
 	result.SetByPath("status", easyjson.NewJSON("ok"))
@@ -643,4 +643,5 @@ func RegisterAllFunctionTypes(runtime *statefun.Runtime, jpgqlEvaluationTimeoutS
 		LLAPIQueryJPGQLDirectCacheResultAggregation,
 		*statefun.NewFunctionTypeConfig().SetOptions(&options).SetServiceState(true).SetMultipleInstancesAllowance(false).SetMaxIdHandlers(-1),
 	)
+	runtime.SetLinksResolver(ResolveOutLinks)
 }
@@ -5,6 +5,7 @@ package jpgql
 import (
 	"fmt"
 	"regexp"
+	"sort"
 	"strings"
 
 	"github.com/foliagecp/sdk/embedded/graph/crud"
@@ -249,3 +250,23 @@ func GetObjectIDsFromLinkTypeAndLinkFilterQueryWithAnyDepthStop(cacheStore *cach
 
 	return resultObjects
 }
+
+// ResolveOutLinks is the graph's links resolver for DownstreamSignal and DownstreamRequest, linkFilterQuery is a JPGQL link filter
+func ResolveOutLinks(cacheStore *cache.Store, objectID string, linkType string, linkFilterQuery string) ([]string, error) {
+	var resultObjects map[string]int
+	if len(linkFilterQuery) == 0 {
+		resultObjects = GetObjectIDsFromLinkType(cacheStore, objectID, linkType)
+	} else {
+		filterData, err := ParseFilter(linkFilterQuery)
+		if err != nil {
+			return nil, fmt.Errorf("link filter %s is invalid: %w", linkFilterQuery, err)
+		}
+		resultObjects = GetObjectIDsFromLinkTypeAndFilterData(cacheStore, objectID, linkType, filterData)
+	}
+	objectIDs := make([]string, 0, len(resultObjects))
+	for id := range resultObjects {
+		objectIDs = append(objectIDs, id)
+	}
+	sort.Strings(objectIDs) // Stable traversal order
+	return objectIDs, nil
+}
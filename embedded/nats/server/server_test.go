@@ -0,0 +1,80 @@
+// Copyright 2023 NJWS Inc.
+
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Store dirs created by Start in the temporary dir of the test
+func tempStoreDirs(t *testing.T) []string {
+	t.Helper()
+	dirs, err := filepath.Glob(filepath.Join(os.TempDir(), "foliage_nats_store_*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dirs
+}
+
+func TestStart(t *testing.T) {
+	t.Setenv("TMPDIR", t.TempDir())
+
+	servers := []*Server{}
+	for i := 0; i < 2; i++ {
+		s, err := Start(NewConfig())
+		if err != nil {
+			t.Fatal(err)
+		}
+		servers = append(servers, s)
+	}
+	if servers[0].ClientURL() == servers[1].ClientURL() {
+		t.Fatalf("both servers listen on %s", servers[0].ClientURL())
+	}
+	if dirs := tempStoreDirs(t); len(dirs) != 2 {
+		t.Fatalf("store dirs are %v, want one per server", dirs)
+	}
+
+	for _, s := range servers {
+		nc, err := s.Connect()
+		if err != nil {
+			t.Fatal(err)
+		}
+		js, err := nc.JetStream()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := js.AccountInfo(); err != nil {
+			t.Fatalf("jetstream is not available: %v", err)
+		}
+		nc.Close()
+		s.Shutdown()
+	}
+	if dirs := tempStoreDirs(t); len(dirs) != 0 {
+		t.Fatalf("store dirs %v are left after shutdown", dirs)
+	}
+}
+
+func TestStartWithStoreDir(t *testing.T) {
+	storeDir := t.TempDir()
+	s, err := Start(NewConfig().SetStoreDir(storeDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Shutdown()
+	if _, err := os.Stat(storeDir); err != nil {
+		t.Fatalf("store dir set in the config is removed: %v", err)
+	}
+}
+
+func TestStartFailureRemovesStoreDir(t *testing.T) {
+	t.Setenv("TMPDIR", t.TempDir())
+
+	if _, err := Start(NewConfig().AddLeafNodeRemote("nats-leaf://%zz")); err == nil {
+		t.Fatal("server with an invalid leafnode remote started")
+	}
+	if dirs := tempStoreDirs(t); len(dirs) != 0 {
+		t.Fatalf("store dirs %v are left after failed start", dirs)
+	}
+}
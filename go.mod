@@ -6,8 +6,10 @@ require (
 	github.com/PaesslerAG/gval v1.2.2
 	github.com/foliagecp/easyjson v0.1.0
 	github.com/goccy/go-graphviz v0.1.1
+	github.com/nats-io/nats-server/v2 v2.9.22
 	github.com/nats-io/nats.go v1.28.0
 	github.com/prometheus/client_golang v1.17.0
+	github.com/santhosh-tekuri/jsonschema/v5 v5.3.1
 	github.com/sirupsen/logrus v1.9.3
 	rogchap.com/v8go v0.9.0
 )
@@ -20,7 +22,8 @@ require (
 	github.com/golang/protobuf v1.5.3 // indirect
 	github.com/klauspost/compress v1.16.7 // indirect
 	github.com/matttproud/golang_protobuf_extensions v1.0.4 // indirect
-	github.com/nats-io/nats-server/v2 v2.9.22 // indirect
+	github.com/minio/highwayhash v1.0.2 // indirect
+	github.com/nats-io/jwt/v2 v2.5.0 // indirect
 	github.com/nats-io/nkeys v0.4.4 // indirect
 	github.com/nats-io/nuid v1.0.1 // indirect
 	github.com/pkg/errors v0.9.1 // indirect
@@ -31,5 +34,6 @@ require (
 	golang.org/x/crypto v0.12.0 // indirect
 	golang.org/x/image v0.6.0 // indirect
 	golang.org/x/sys v0.11.0 // indirect
+	golang.org/x/time v0.3.0 // indirect
 	google.golang.org/protobuf v1.31.0 // indirect
 )
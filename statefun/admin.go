@@ -0,0 +1,584 @@
+// Copyright 2023 NJWS Inc.
+
+package statefun
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/foliagecp/easyjson"
+
+	"github.com/foliagecp/sdk/statefun/backend"
+	lg "github.com/foliagecp/sdk/statefun/logger"
+	"github.com/foliagecp/sdk/statefun/system"
+)
+
+const (
+	AdminSubjectPrefix          = "statefun_admin"
+	AdminAllRuntimes            = "all" // Runtime id of the subject every runtime serves the admin API via
+	AdminRuntimesKVPrefix       = AdminSubjectPrefix + ".runtimes"
+	AdminHeartbeatIntervalSec   = 10
+	AdminRuntimeLifetimeSec     = 3 * AdminHeartbeatIntervalSec // Runtime which has not heartbeated for longer is not listed
+	adminTokenKey               = "token"
+	adminAuthorizationHeaderKey = "Authorization"
+)
+
+/*
+Every runtime serves the admin API via NATS core requests to "statefun_admin.<runtime id>" and "statefun_admin.all" and, if the admin server
+address is set, via HTTP at /admin/<command> with the request as the body. Everything applies to the runtime handling the request only.
+Running runtimes heartbeat their ids in KV at "statefun_admin.runtimes.<runtime id>", see the "runtimes" command and ListRuntimes.
+The runtime id is stable if set via RuntimeConfig.SetRuntimeID.
+
+If the admin token is set via RuntimeConfig.SetAdminToken, NATS requests must have it in the "token" field and HTTP requests
+in the "Authorization: Bearer <token>" header. Mutating commands (gc, pause, resume, update_config) are accepted via HTTP POST only
+and take the request from the body only, the others also take query parameters.
+
+Request: {"command": "<command>", ...}, reply: {"status": "ok", "result": ...} or {"status": "failed", "result": "<error>"}.
+Commands:
+
+	runtimes: ids of the running runtimes
+	function_types: registered function types with their configs, pause state, number of id handlers and single instance lock
+	ids {"typename"}: ids having an id handler with their last message time (unix ns) and number of queued messages (mailbox)
+	gc {"typename", "id"}: closes the id handler, messages already queued are still handled
+	pause {"typename"}: stops receiving JetStream signals, they are kept in the stream until resume {"typename"}.
+		Golang local signals, requests and signals already routed to partitions are still handled
+	update_config {"typename", "config": {...}}: updates the config options applicable at runtime, replies with the updated config:
+		"options": json, "max_deliveries": int, "max_refused_deliveries": int, "terminal_action": "dead_letter"|"drop",
+		"retry_backoff": {"initial_ms": int, "max_ms": int, "multiplier": float}, "overflow": {"policy": "refuse"|"block"|"drop_oldest"|"spill", "timeout_ms": int}
+*/
+
+var terminalActionNames = map[TerminalAction]string{
+	TerminalActionDeadLetter: "dead_letter",
+	TerminalActionDrop:       "drop",
+}
+
+var overflowPolicyNames = map[OverflowPolicy]string{
+	OverflowRefuse:     "refuse",
+	OverflowBlock:      "block",
+	OverflowDropOldest: "drop_oldest",
+	OverflowSpill:      "spill",
+}
+
+var adminMutatingCommands = map[string]bool{
+	"gc":            true,
+	"pause":         true,
+	"resume":        true,
+	"update_config": true,
+}
+
+func getAdminSubject(runtimeID string) string {
+	return fmt.Sprintf("%s.%s", AdminSubjectPrefix, runtimeID)
+}
+
+func getAdminRuntimeKey(runtimeID string) string {
+	return fmt.Sprintf("%s.%s", AdminRuntimesKVPrefix, runtimeID)
+}
+
+func isValidRuntimeID(id string) bool {
+	return len(id) > 0 && id != AdminAllRuntimes && !strings.ContainsAny(id, ".*> \t\r\n")
+}
+
+func (ftc *FunctionTypeConfig) toJSON() easyjson.JSON {
+	j := easyjson.NewJSONObject()
+	j.SetByPath("msg_ack_wait_ms", easyjson.NewJSON(ftc.msgAckWaitMs))
+	j.SetByPath("msg_channel_size", easyjson.NewJSON(ftc.msgChannelSize))
+	j.SetByPath("msg_ack_channel_size", easyjson.NewJSON(ftc.msgAckChannelSize))
+	j.SetByPath("access", easyjson.NewJSON(ftc.accessebility.String()))
+	j.SetByPath("options", ftc.options.Clone())
+	j.SetByPath("multiple_instances_allowed", easyjson.NewJSON(ftc.multipleInstancesAllowed))
+	j.SetByPath("max_id_handlers", easyjson.NewJSON(ftc.maxIdHandlers))
+	j.SetByPath("dead_letter", easyjson.NewJSON(ftc.deadLetterActive))
+	j.SetByPath("max_refused_deliveries", easyjson.NewJSON(ftc.maxRefusedDeliveries))
+	j.SetByPath("max_deliveries", easyjson.NewJSON(ftc.maxDeliveries))
+	j.SetByPath("retry_backoff.initial_ms", easyjson.NewJSON(ftc.retryBackoffInitialMs))
+	j.SetByPath("retry_backoff.max_ms", easyjson.NewJSON(ftc.retryBackoffMaxMs))
+	j.SetByPath("retry_backoff.multiplier", easyjson.NewJSON(ftc.retryBackoffMultiplier))
+	j.SetByPath("terminal_action", easyjson.NewJSON(terminalActionNames[ftc.terminalAction]))
+	j.SetByPath("cron_schedules", easyjson.NewJSON(len(ftc.cronSchedules)))
+	j.SetByPath("idempotency_window_sec", easyjson.NewJSON(ftc.idempotencyWindowSec))
+	j.SetByPath("dedup_guard", easyjson.NewJSON(ftc.dedupGuardActive))
+	j.SetByPath("partitions", easyjson.NewJSON(ftc.partitions))
+	j.SetByPath("overflow.policy", easyjson.NewJSON(overflowPolicyNames[ftc.overflowPolicy]))
+	j.SetByPath("overflow.timeout_ms", easyjson.NewJSON(ftc.overflowTimeoutMs))
+	j.SetByPath("max_ack_pending", easyjson.NewJSON(ftc.maxAckPending))
+	j.SetByPath("context_update_attempts", easyjson.NewJSON(ftc.contextUpdateAttempts))
+	j.SetByPath("context_ttl_sec", easyjson.NewJSON(ftc.contextTTLSec))
+	j.SetByPath("object_bound_context", easyjson.NewJSON(ftc.objectBoundContext))
+	if ftc.contextSchema != nil {
+		j.SetByPath("context_schema_version", easyjson.NewJSON(ftc.contextSchema.version))
+	}
+	j.SetByPath("version", easyjson.NewJSON(ftc.version))
+	return j
+}
+
+func (r *Runtime) getFunctionType(typename string) (*FunctionType, error) {
+	ft, ok := r.registeredFunctionTypes[typename]
+	if !ok {
+		return nil, fmt.Errorf("function type %s is not registered in runtime %s", typename, r.id)
+	}
+	return ft, nil
+}
+
+// Single instance function types run only in the runtime holding their lock
+func (r *Runtime) runsFunctionType(ft *FunctionType) bool {
+	if ft.config.multipleInstancesAllowed {
+		return true
+	}
+	r.resourceMutex.Lock()
+	defer r.resourceMutex.Unlock()
+	_, running := r.singleInstanceFunctionRevisions[ft.name]
+	return running
+}
+
+func (r *Runtime) singleInstanceLockInfo(ft *FunctionType) easyjson.JSON {
+	if ft.config.multipleInstancesAllowed {
+		return easyjson.NewJSONNull()
+	}
+	j := easyjson.NewJSONObject()
+	j.SetByPath("owned", easyjson.NewJSON(r.runsFunctionType(ft)))
+	if entry, err := r.kv.Get(system.GetHashStr(ft.name) + ".mutex"); err == nil {
+		lockedAt := system.BytesToInt64(entry.Value())
+		j.SetByPath("locked_at", easyjson.NewJSON(lockedAt))
+		j.SetByPath("alive", easyjson.NewJSON(lockedAt != 0 && lockedAt+int64(r.config.kvMutexLifeTimeSec)*int64(time.Second) >= system.GetCurrentTimeNs()))
+	}
+	return j
+}
+
+// FunctionTypesInfo returns the function types registered in the runtime as the admin API does
+func (r *Runtime) FunctionTypesInfo() easyjson.JSON {
+	typenames := make([]string, 0, len(r.registeredFunctionTypes))
+	for typename := range r.registeredFunctionTypes {
+		typenames = append(typenames, typename)
+	}
+	sort.Strings(typenames)
+
+	info := easyjson.NewJSONArray()
+	for _, typename := range typenames {
+		ft := r.registeredFunctionTypes[typename]
+		handlers := 0
+		ft.idHandlersChannel.Range(func(_, _ interface{}) bool {
+			handlers++
+			return true
+		})
+		ft.pauseMutex.Lock()
+		paused := ft.paused
+		ft.pauseMutex.Unlock()
+		config := ft.getConfig()
+
+		j := easyjson.NewJSONObject()
+		j.SetByPath("typename", easyjson.NewJSON(typename))
+		j.SetByPath("config", config.toJSON())
+		j.SetByPath("running", easyjson.NewJSON(r.runsFunctionType(ft)))
+		j.SetByPath("paused", easyjson.NewJSON(paused))
+		j.SetByPath("id_handlers", easyjson.NewJSON(handlers))
+		j.SetByPath("single_instance_lock", r.singleInstanceLockInfo(ft))
+		info.AddToArray(j)
+	}
+	return info
+}
+
+// IDHandlersInfo returns the ids of the function type having an id handler as the admin API does
+func (r *Runtime) IDHandlersInfo(typename string) (easyjson.JSON, error) {
+	ft, err := r.getFunctionType(typename)
+	if err != nil {
+		return easyjson.NewJSONNull(), err
+	}
+	ids := []string{}
+	ft.idHandlersLastMsgTime.Range(func(key, _ interface{}) bool {
+		ids = append(ids, key.(string))
+		return true
+	})
+	sort.Strings(ids)
+
+	info := easyjson.NewJSONArray()
+	for _, id := range ids {
+		lastMsgTime, ok := ft.idHandlersLastMsgTime.Load(id)
+		if !ok { // Collected meanwhile
+			continue
+		}
+		mailbox := 0
+		if msgChannel, ok := ft.idHandlersChannel.Load(id); ok {
+			mailbox = len(msgChannel.(chan FunctionTypeMsg))
+		}
+		j := easyjson.NewJSONObject()
+		j.SetByPath("id", easyjson.NewJSON(id))
+		j.SetByPath("last_msg_time", easyjson.NewJSON(lastMsgTime.(int64)))
+		j.SetByPath("mailbox", easyjson.NewJSON(mailbox))
+		info.AddToArray(j)
+	}
+	return info, nil
+}
+
+// CollectIDHandler closes the id handler at once instead of waiting for the id lifetime to pass, queued messages are still handled
+func (r *Runtime) CollectIDHandler(typename string, id string) error {
+	ft, err := r.getFunctionType(typename)
+	if err != nil {
+		return err
+	}
+	ft.idKeyMutex.Lock(id)
+	defer ft.idKeyMutex.Unlock(id)
+	lastMsgTime, ok := ft.idHandlersLastMsgTime.Load(id)
+	if !ok {
+		return fmt.Errorf("function %s with id=%s has no id handler", typename, id)
+	}
+	ft.collectIDHandler(id, lastMsgTime.(int64))
+	return nil
+}
+
+// PauseFunctionType stops receiving JetStream signals of the function type in this runtime until ResumeFunctionType is called
+func (r *Runtime) PauseFunctionType(typename string) error {
+	ft, err := r.getFunctionType(typename)
+	if err != nil {
+		return err
+	}
+	if !r.runsFunctionType(ft) {
+		return fmt.Errorf("single instance function type %s runs in another runtime", typename)
+	}
+	ft.pauseMutex.Lock()
+	defer ft.pauseMutex.Unlock()
+	if ft.paused {
+		return nil
+	}
+	var errs []error
+	for _, sub := range ft.consumerSubs {
+		r.removeSubscription(sub)
+		if err := sub.Unsubscribe(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	ft.consumerSubs = nil
+	ft.paused = true
+	lg.Logf(lg.InfoLevel, "Function type %s is paused\n", typename)
+	return errors.Join(errs...)
+}
+
+// ResumeFunctionType restarts receiving JetStream signals of the paused function type
+func (r *Runtime) ResumeFunctionType(typename string) error {
+	ft, err := r.getFunctionType(typename)
+	if err != nil {
+		return err
+	}
+	ft.pauseMutex.Lock()
+	defer ft.pauseMutex.Unlock()
+	if !ft.paused {
+		return nil
+	}
+	if r.shuttingDown() {
+		return errRuntimeShuttingDown
+	}
+	err = ft.subscribeConsumer()
+	if err == nil && ft.versioned() {
+		err = ft.subscribeVersion()
+	}
+	if err != nil { // Stays paused, the consumer is not left subscribed without the version one
+		for _, sub := range ft.consumerSubs {
+			r.removeSubscription(sub)
+			system.MsgOnErrorReturn(sub.Unsubscribe())
+		}
+		ft.consumerSubs = nil
+		return fmt.Errorf("function type %s cannot be resumed: %w", typename, err)
+	}
+	ft.paused = false
+	lg.Logf(lg.InfoLevel, "Function type %s is resumed\n", typename)
+	return nil
+}
+
+// Must be called with ft.pauseMutex locked or while the runtime is being started
+func (ft *FunctionType) addConsumerSubscription(sub backend.Subscription) error {
+	if err := ft.runtime.addSubscription(sub); err != nil {
+		return err
+	}
+	ft.consumerSubs = append(ft.consumerSubs, sub)
+	return nil
+}
+
+// UpdateFunctionTypeConfig updates the config options applicable at runtime as the admin API does, nothing is updated if any option is invalid
+func (r *Runtime) UpdateFunctionTypeConfig(typename string, update *easyjson.JSON) error {
+	ft, err := r.getFunctionType(typename)
+	if err != nil {
+		return err
+	}
+	if update == nil || !update.IsObject() {
+		return fmt.Errorf("config update must be a json object")
+	}
+	ft.resourceMutex.Lock()
+	defer ft.resourceMutex.Unlock()
+
+	config := ft.config // Updated copy is applied only if the whole update is valid
+	for _, key := range update.ObjectKeys() {
+		value := update.GetByPath(key)
+		var err error
+		switch key {
+		case "options":
+			if !value.IsObject() {
+				err = fmt.Errorf("must be a json object")
+				break
+			}
+			config.options = value.Clone().GetPtr()
+			err = config.optionsSchema.validate("options", config.options)
+		case "max_deliveries":
+			config.maxDeliveries, err = adminInt(value, 0)
+		case "max_refused_deliveries":
+			config.maxRefusedDeliveries, err = adminInt(value, 1)
+		case "terminal_action":
+			config.terminalAction, err = adminEnum(value, terminalActionNames)
+		case "retry_backoff":
+			if value.PathExists("initial_ms") {
+				if config.retryBackoffInitialMs, err = adminInt(value.GetByPath("initial_ms"), 1); err != nil {
+					err = fmt.Errorf("initial_ms %w", err)
+				}
+			}
+			if err == nil && value.PathExists("max_ms") {
+				if config.retryBackoffMaxMs, err = adminInt(value.GetByPath("max_ms"), 1); err != nil {
+					err = fmt.Errorf("max_ms %w", err)
+				}
+			}
+			if err == nil && value.PathExists("multiplier") {
+				multiplier, ok := value.GetByPath("multiplier").AsNumeric()
+				if !ok || multiplier < 1 {
+					err = fmt.Errorf("multiplier must be a number not less than 1")
+				}
+				config.retryBackoffMultiplier = multiplier
+			}
+		case "overflow":
+			if value.PathExists("policy") {
+				if config.overflowPolicy, err = adminEnum(value.GetByPath("policy"), overflowPolicyNames); err != nil {
+					err = fmt.Errorf("policy %w", err)
+				}
+			}
+			if err == nil && value.PathExists("timeout_ms") {
+				if config.overflowTimeoutMs, err = adminInt(value.GetByPath("timeout_ms"), 0); err != nil {
+					err = fmt.Errorf("timeout_ms %w", err)
+				}
+			}
+		default:
+			err = fmt.Errorf("cannot be updated at runtime")
+		}
+		if err != nil {
+			return fmt.Errorf("function type %s config option %s: %w", typename, key, err)
+		}
+	}
+
+	// Assigned one by one, the other fields never change after the runtime is started and are read without locking.
+	// Fields assigned here must be read via getConfig only
+	ft.config.options = config.options
+	ft.config.maxDeliveries = config.maxDeliveries
+	ft.config.maxRefusedDeliveries = config.maxRefusedDeliveries
+	ft.config.terminalAction = config.terminalAction
+	ft.config.retryBackoffInitialMs = config.retryBackoffInitialMs
+	ft.config.retryBackoffMaxMs = config.retryBackoffMaxMs
+	ft.config.retryBackoffMultiplier = config.retryBackoffMultiplier
+	ft.config.overflowPolicy = config.overflowPolicy
+	ft.config.overflowTimeoutMs = config.overflowTimeoutMs
+	lg.Logf(lg.InfoLevel, "Function type %s config is updated: %s\n", typename, update.ToString())
+	return nil
+}
+
+func adminInt(j easyjson.JSON, min int) (int, error) {
+	value, ok := j.AsNumeric()
+	if !ok || value != float64(int(value)) || int(value) < min {
+		return 0, fmt.Errorf("must be an integer not less than %d", min)
+	}
+	return int(value), nil
+}
+
+func adminEnum[T comparable](j easyjson.JSON, names map[T]string) (T, error) {
+	name := j.AsStringDefault("")
+	valid := []string{}
+	for value, n := range names {
+		if n == name {
+			return value, nil
+		}
+		valid = append(valid, n)
+	}
+	sort.Strings(valid)
+	var zero T
+	return zero, fmt.Errorf("must be one of %s", strings.Join(valid, ", "))
+}
+
+func (r *Runtime) adminCommand(request *easyjson.JSON) (easyjson.JSON, error) {
+	typename := request.GetByPath("typename").AsStringDefault("")
+	switch command := request.GetByPath("command").AsStringDefault(""); command {
+	case "runtimes":
+		ids, err := r.ListRuntimes()
+		if err != nil {
+			return easyjson.NewJSONNull(), err
+		}
+		return easyjson.JSONFromArray(ids), nil
+	case "function_types":
+		return r.FunctionTypesInfo(), nil
+	case "ids":
+		return r.IDHandlersInfo(typename)
+	case "gc":
+		return easyjson.NewJSONNull(), r.CollectIDHandler(typename, request.GetByPath("id").AsStringDefault(""))
+	case "pause":
+		return easyjson.NewJSONNull(), r.PauseFunctionType(typename)
+	case "resume":
+		return easyjson.NewJSONNull(), r.ResumeFunctionType(typename)
+	case "update_config":
+		if err := r.UpdateFunctionTypeConfig(typename, request.GetByPath("config").GetPtr()); err != nil {
+			return easyjson.NewJSONNull(), err
+		}
+		config := r.registeredFunctionTypes[typename].getConfig()
+		return config.toJSON(), nil
+	default:
+		return easyjson.NewJSONNull(), fmt.Errorf("unknown admin command \"%s\"", command)
+	}
+}
+
+func (r *Runtime) handleAdminRequest(request *easyjson.JSON) (easyjson.JSON, bool) {
+	result, err := r.adminCommand(request)
+	if err != nil {
+		return adminFailure(err), false
+	}
+	reply := easyjson.NewJSONObject()
+	reply.SetByPath("status", easyjson.NewJSON("ok"))
+	reply.SetByPath("result", result)
+	return reply, true
+}
+
+func (r *Runtime) subscribeAdmin() error {
+	handler := func(msg backend.Msg) {
+		request, ok := easyjson.JSONFromBytes(msg.Data())
+		if !ok {
+			request = easyjson.NewJSONObject()
+		}
+		var reply easyjson.JSON
+		if !r.adminTokenValid(request.GetByPath(adminTokenKey).AsStringDefault("")) {
+			reply = adminFailure(fmt.Errorf("admin token is invalid"))
+		} else {
+			reply, _ = r.handleAdminRequest(&request)
+		}
+		system.MsgOnErrorReturn(msg.Respond(reply.ToBytes()))
+	}
+	for _, subject := range []string{getAdminSubject(r.id), getAdminSubject(AdminAllRuntimes)} {
+		sub, err := r.backend.Subscribe(subject, handler)
+		if err != nil {
+			return fmt.Errorf("admin api subscription failed: %w", err)
+		}
+		if err := r.addSubscription(sub); err != nil {
+			return err
+		}
+	}
+	lg.Logf(lg.InfoLevel, "Admin API is served via %s\n", getAdminSubject(r.id))
+	return nil
+}
+
+func (r *Runtime) adminTokenValid(token string) bool {
+	return len(r.config.adminToken) == 0 || subtle.ConstantTimeCompare([]byte(token), []byte(r.config.adminToken)) == 1
+}
+
+func adminFailure(err error) easyjson.JSON {
+	reply := easyjson.NewJSONObject()
+	reply.SetByPath("status", easyjson.NewJSON("failed"))
+	reply.SetByPath("result", easyjson.NewJSON(err.Error()))
+	return reply
+}
+
+func writeAdminReply(w http.ResponseWriter, status int, reply easyjson.JSON) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, err := w.Write(reply.ToBytes())
+	system.MsgOnErrorReturn(err)
+}
+
+func (r *Runtime) adminHTTPHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/admin/", func(w http.ResponseWriter, req *http.Request) {
+		if !r.adminTokenValid(strings.TrimPrefix(req.Header.Get(adminAuthorizationHeaderKey), "Bearer ")) {
+			writeAdminReply(w, http.StatusUnauthorized, adminFailure(fmt.Errorf("admin token is invalid")))
+			return
+		}
+		command := strings.TrimPrefix(req.URL.Path, "/admin/")
+		mutating := adminMutatingCommands[command]
+		if mutating && req.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			writeAdminReply(w, http.StatusMethodNotAllowed, adminFailure(fmt.Errorf("admin command %s must be sent via POST", command)))
+			return
+		}
+
+		request := easyjson.NewJSONObject()
+		if body, err := io.ReadAll(req.Body); err == nil && len(body) > 0 {
+			if j, ok := easyjson.JSONFromBytes(body); ok && j.IsObject() {
+				request = j
+			}
+		}
+		if !mutating {
+			for key, values := range req.URL.Query() {
+				if len(values) > 0 {
+					request.SetByPath(key, easyjson.NewJSON(values[0]))
+				}
+			}
+		}
+		request.SetByPath("command", easyjson.NewJSON(command))
+
+		reply, ok := r.handleAdminRequest(&request)
+		status := http.StatusOK
+		if !ok {
+			status = http.StatusBadRequest
+		}
+		writeAdminReply(w, status, reply)
+	})
+	var handler http.Handler = mux
+	if r.config.adminServerMiddleware != nil {
+		handler = r.config.adminServerMiddleware(handler)
+	}
+	return handler
+}
+
+func (r *Runtime) startAdminServer() {
+	r.adminServer = startHTTPServer("Admin", r.config.adminServerAddr, r.adminHTTPHandler())
+}
+
+// Keeps the runtime listed by ListRuntimes while it runs
+func (r *Runtime) runAdminHeartbeat() {
+	system.GlobalPrometrics.GetRoutinesCounter().Started("runtime.adminHeartbeat")
+	defer system.GlobalPrometrics.GetRoutinesCounter().Stopped("runtime.adminHeartbeat")
+	ticker := time.NewTicker(AdminHeartbeatIntervalSec * time.Second)
+	defer ticker.Stop()
+	for {
+		if _, err := r.kv.Put(getAdminRuntimeKey(r.id), system.Int64ToBytes(system.GetCurrentTimeNs())); err != nil {
+			lg.Logf(lg.WarnLevel, "Runtime %s cannot heartbeat: %s\n", r.id, err)
+		}
+		select {
+		case <-r.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// ListRuntimes returns ids of the running runtimes which share the KV store with this one, sorted
+func (r *Runtime) ListRuntimes() ([]string, error) {
+	w, err := r.kv.Watch(AdminRuntimesKVPrefix + ".*")
+	if err != nil {
+		return nil, err
+	}
+	defer func() { system.MsgOnErrorReturn(w.Stop()) }()
+
+	ids := []string{}
+	now := system.GetCurrentTimeNs()
+	for {
+		select {
+		case entry, ok := <-w.Updates():
+			if !ok {
+				return nil, fmt.Errorf("runtimes watch was closed")
+			}
+			if entry == nil { // All current runtimes are known
+				sort.Strings(ids)
+				return ids, nil
+			}
+			if heartbeat := system.BytesToInt64(entry.Value()); heartbeat+AdminRuntimeLifetimeSec*int64(time.Second) >= now {
+				ids = append(ids, strings.TrimPrefix(entry.Key(), AdminRuntimesKVPrefix+"."))
+			}
+		case <-time.After(time.Duration(r.config.requestTimeoutSec) * time.Second):
+			return nil, fmt.Errorf("runtimes were not listed in time")
+		}
+	}
+}
@@ -0,0 +1,249 @@
+// Copyright 2023 NJWS Inc.
+
+package statefun
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/foliagecp/easyjson"
+
+	"github.com/foliagecp/sdk/statefun/backend"
+	sfPlugins "github.com/foliagecp/sdk/statefun/plugins"
+	"github.com/foliagecp/sdk/statefun/system"
+)
+
+func TestUpdateFunctionTypeConfig(t *testing.T) {
+	r := newTestRuntime(t, newTestRuntimeConfig(backend.NewInMemory()))
+	NewFunctionType(r.Runtime, "test.config", func(_ sfPlugins.StatefunExecutor, contextProcessor *sfPlugins.StatefunContextProcessor) {
+		reply := easyjson.NewJSONObject()
+		reply.SetByPath("mode", contextProcessor.Options.GetByPath("mode"))
+		contextProcessor.Reply.With(&reply)
+	}, *NewFunctionTypeConfig().
+		SetOptions(testPayload("mode", "fast")).
+		SetOptionsSchema(testSchema(t, `{"properties": {"mode": {"enum": ["fast", "slow"]}}}`)))
+	startTestRuntime(t, r)
+
+	requestMode := func() string {
+		reply, err := r.Request(sfPlugins.GolangLocalRequest, "test.config", "a", nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return reply.GetByPath("mode").AsStringDefault("")
+	}
+
+	// Updated while messages are being handled
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				if _, err := r.Request(sfPlugins.GolangLocalRequest, "test.config", fmt.Sprint(i), nil, nil); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(i)
+	}
+	for _, mode := range []string{"slow", "fast", "slow"} {
+		update := easyjson.NewJSONObject()
+		update.SetByPath("options", *testPayload("mode", mode))
+		update.SetByPath("max_deliveries", easyjson.NewJSON(3))
+		if err := r.UpdateFunctionTypeConfig("test.config", &update); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wg.Wait()
+	if mode := requestMode(); mode != "slow" {
+		t.Fatalf("handler got mode %s, want slow", mode)
+	}
+
+	for _, invalid := range []string{
+		`{"options": {"mode": "other"}}`,
+		`{"options": 1}`,
+		`{"max_deliveries": 5, "terminal_action": "other"}`,
+		`{"version": "2"}`,
+	} {
+		update, _ := easyjson.JSONFromBytes([]byte(invalid))
+		if err := r.UpdateFunctionTypeConfig("test.config", &update); err == nil {
+			t.Fatalf("invalid config update %s was applied", invalid)
+		}
+	}
+	if mode := requestMode(); mode != "slow" {
+		t.Fatalf("handler got mode %s after invalid updates, want slow", mode)
+	}
+	if maxDeliveries := r.registeredFunctionTypes["test.config"].getConfig().maxDeliveries; maxDeliveries != 3 {
+		t.Fatalf("max deliveries is %d after invalid updates, want 3", maxDeliveries)
+	}
+}
+
+func adminRequest(t *testing.T, b backend.Backend, runtimeID string, request string) easyjson.JSON {
+	t.Helper()
+	data, err := b.Request(context.Background(), getAdminSubject(runtimeID), []byte(request))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply, ok := easyjson.JSONFromBytes(data)
+	if !ok {
+		t.Fatalf("admin reply %s is not a json", data)
+	}
+	return reply
+}
+
+func TestAdminAPIViaNats(t *testing.T) {
+	b := backend.NewInMemory()
+	for _, id := range []string{"a", "b"} {
+		r := newTestRuntime(t, newTestRuntimeConfig(b).SetRuntimeID(id).SetAdminToken("secret"))
+		startTestRuntime(t, r)
+	}
+
+	if reply := adminRequest(t, b, "a", `{"command": "runtimes"}`); reply.GetByPath("status").AsStringDefault("") != "failed" {
+		t.Fatalf("request without the token replied with %s", reply.ToString())
+	}
+	waitFor(t, "both runtimes listed", func() bool {
+		reply := adminRequest(t, b, "a", `{"command": "runtimes", "token": "secret"}`)
+		return reply.GetByPath("result").ToString() == `["a","b"]`
+	})
+	if reply := adminRequest(t, b, AdminAllRuntimes, `{"command": "function_types", "token": "secret"}`); reply.GetByPath("status").AsStringDefault("") != "ok" {
+		t.Fatalf("request to all runtimes replied with %s", reply.ToString())
+	}
+
+	for _, id := range []string{"a.b", "a*", AdminAllRuntimes} {
+		if _, err := NewRuntime(*newTestRuntimeConfig(b).SetRuntimeID(id)); err == nil {
+			t.Fatalf("runtime with id %q was created", id)
+		}
+	}
+}
+
+func TestAdminAPIViaHTTP(t *testing.T) {
+	r := newTestRuntime(t, newTestRuntimeConfig(backend.NewInMemory()).SetAdminToken("secret"))
+	NewFunctionType(r.Runtime, "test.admin", func(_ sfPlugins.StatefunExecutor, _ *sfPlugins.StatefunContextProcessor) {}, *NewFunctionTypeConfig())
+	startTestRuntime(t, r)
+	server := httptest.NewServer(r.adminHTTPHandler())
+	defer server.Close()
+
+	paused := func() bool {
+		ft := r.registeredFunctionTypes["test.admin"]
+		ft.pauseMutex.Lock()
+		defer ft.pauseMutex.Unlock()
+		return ft.paused
+	}
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		body       string
+		token      string
+		wantStatus int
+		wantPaused bool
+	}{
+		{name: "without token", method: http.MethodPost, path: "/admin/pause", body: `{"typename": "test.admin"}`, wantStatus: http.StatusUnauthorized},
+		{name: "mutating via GET", method: http.MethodGet, path: "/admin/pause?typename=test.admin", token: "secret", wantStatus: http.StatusMethodNotAllowed},
+		{name: "mutating with query", method: http.MethodPost, path: "/admin/pause?typename=test.admin", token: "secret", wantStatus: http.StatusBadRequest},
+		{name: "reading via GET", method: http.MethodGet, path: "/admin/ids?typename=test.admin", token: "secret", wantStatus: http.StatusOK},
+		{name: "mutating via POST", method: http.MethodPost, path: "/admin/pause", body: `{"typename": "test.admin"}`, token: "secret", wantStatus: http.StatusOK, wantPaused: true},
+	}
+	for _, test := range tests {
+		req, err := http.NewRequest(test.method, server.URL+test.path, strings.NewReader(test.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(test.token) > 0 {
+			req.Header.Set("Authorization", "Bearer "+test.token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		system.MsgOnErrorReturn(resp.Body.Close())
+		if resp.StatusCode != test.wantStatus {
+			t.Fatalf("%s: status %d, want %d", test.name, resp.StatusCode, test.wantStatus)
+		}
+		if paused() != test.wantPaused {
+			t.Fatalf("%s: function type paused is %t, want %t", test.name, paused(), test.wantPaused)
+		}
+	}
+}
+
+// In-memory backend which fails to subscribe consumers of the versions streams while failing is set
+type failingVersionConsumerBackend struct {
+	*backend.InMemory
+	failing atomic.Bool
+}
+
+func (b *failingVersionConsumerBackend) SubscribeConsumer(stream string, cfg backend.ConsumerConfig, handler backend.MsgHandler) (backend.Subscription, error) {
+	if b.failing.Load() && strings.HasPrefix(stream, getVersionsStreamName("test.admin")) {
+		return nil, errors.New("cannot subscribe")
+	}
+	return b.InMemory.SubscribeConsumer(stream, cfg, handler)
+}
+
+func TestResumeFunctionType(t *testing.T) {
+	b := &failingVersionConsumerBackend{InMemory: backend.NewInMemory()}
+	r := newTestRuntime(t, newTestRuntimeConfig(b))
+	calls := newTestCalls()
+	NewFunctionType(r.Runtime, "test.admin", func(_ sfPlugins.StatefunExecutor, contextProcessor *sfPlugins.StatefunContextProcessor) {
+		calls.record(contextProcessor)
+	}, *NewFunctionTypeConfig().SetVersion("v1"))
+	startTestRuntime(t, r)
+	ft := r.registeredFunctionTypes["test.admin"]
+	subscriptions := func() int {
+		r.resourceMutex.Lock()
+		defer r.resourceMutex.Unlock()
+		return len(r.subscriptions)
+	}
+	before := subscriptions()
+
+	if err := r.PauseFunctionType("test.admin"); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Signal(sfPlugins.JetstreamGlobalSignal, "test.admin", "a", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	calls.expectNone(t, 200*time.Millisecond)
+
+	// Resume failing on the version consumer leaves the function type paused without any of its consumers
+	b.failing.Store(true)
+	if err := r.ResumeFunctionType("test.admin"); err == nil {
+		t.Fatal("resume succeeded without the version consumer")
+	}
+	ft.pauseMutex.Lock()
+	paused, consumerSubs := ft.paused, len(ft.consumerSubs)
+	ft.pauseMutex.Unlock()
+	if !paused || consumerSubs != 0 || subscriptions() != before-2 {
+		t.Fatalf("failed resume left paused=%t with %d consumer subscriptions", paused, consumerSubs)
+	}
+	calls.expectNone(t, 200*time.Millisecond)
+
+	b.failing.Store(false)
+	if err := r.ResumeFunctionType("test.admin"); err != nil {
+		t.Fatal(err)
+	}
+	calls.wait(t)
+	if subscriptions() != before {
+		t.Fatalf("%d subscriptions after resume, want %d", subscriptions(), before)
+	}
+
+	// Resume is refused once the shutdown has unsubscribed everything
+	if err := r.PauseFunctionType("test.admin"); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.ResumeFunctionType("test.admin"); !errors.Is(err, errRuntimeShuttingDown) {
+		t.Fatalf("resume after shutdown returned %v", err)
+	}
+	if subscriptions() != 0 {
+		t.Fatalf("%d subscriptions after shutdown", subscriptions())
+	}
+}
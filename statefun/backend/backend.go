@@ -0,0 +1,144 @@
+// Copyright 2023 NJWS Inc.
+
+// Foliage statefun backend package.
+// Provides abstraction over the message bus and the key/value store a runtime works on top of,
+// with NATS JetStream and in-process in-memory implementations
+package backend
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+)
+
+var (
+	ErrKeyNotFound       = errors.New("backend: key not found")
+	ErrWrongLastRevision = errors.New("backend: wrong last revision")
+	ErrNoResponders      = errors.New("backend: no responders available for request")
+	ErrStreamNotFound    = errors.New("backend: stream not found")
+	ErrBackendClosed     = errors.New("backend: closed")
+	ErrNoReplySubject    = errors.New("backend: message has no reply subject")
+	ErrNotStreamMsg      = errors.New("backend: message was not received from a stream consumer")
+	ErrMsgNotFound       = errors.New("backend: stream message not found")
+	ErrConsumerNotFound  = errors.New("backend: consumer not found")
+)
+
+type MsgHandler func(msg Msg)
+
+type Msg interface {
+	Subject() string
+	Data() []byte
+	// Ack acknowledges a message received from a stream consumer
+	Ack() error
+	// Nak negatively acknowledges a message received from a stream consumer, message will be redelivered
+	Nak() error
+	// NakWithDelay negatively acknowledges a message received from a stream consumer, message will be redelivered not earlier than after the delay
+	NakWithDelay(delay time.Duration) error
+	// NumDelivered returns how many times a message received from a stream consumer was delivered, 1 for other messages
+	NumDelivered() uint64
+	// MsgID returns the ID the message was published with via StreamPublishMsgID, empty if there is no one
+	MsgID() string
+	// Respond replies to a message received via request
+	Respond(data []byte) error
+}
+
+type Subscription interface {
+	Unsubscribe() error
+}
+
+type StreamConfig struct {
+	Name       string
+	Subjects   []string
+	Duplicates time.Duration // Window within which a message with an already stored ID is not stored again, 0 - backend default
+}
+
+type StreamMsg struct {
+	Sequence uint64
+	Subject  string
+	Data     []byte
+	Time     time.Time
+}
+
+type ConsumerConfig struct {
+	Name          string // Durable consumer name
+	DeliverGroup  string // Queue group all subscribers of the consumer belong to
+	FilterSubject string
+	AckWait       time.Duration
+	MaxAckPending int // Max messages delivered and not acked yet, no more are delivered until some are acked, 0 - backend default
+}
+
+type Backend interface {
+	// Publish sends a message to all subscribers of the subject and to the stream which captures the subject if one exists
+	Publish(subject string, data []byte) error
+	Request(ctx context.Context, subject string, data []byte) ([]byte, error)
+	Subscribe(subject string, handler MsgHandler) (Subscription, error)
+	// StreamPublish sends a message like Publish does and waits for the stream which captures the subject to store it
+	StreamPublish(subject string, data []byte) error
+	// StreamPublishMsgID publishes like StreamPublish, but the stream does not store the message if one with the same msgID
+	// was stored within the stream's duplicates window. Publishing a duplicate is not an error.
+	StreamPublishMsgID(subject string, data []byte, msgID string) error
+	// EnsureStream creates the stream if it does not exist
+	EnsureStream(cfg StreamConfig) error
+	// StreamMsgs returns up to limit messages stored in the stream starting from the sequence fromSeq
+	StreamMsgs(stream string, fromSeq uint64, limit int) ([]StreamMsg, error)
+	// StreamMsg returns the message stored in the stream by its sequence, ErrMsgNotFound if there is no such one
+	StreamMsg(stream string, seq uint64) (*StreamMsg, error)
+	// StreamLastSeq returns the sequence of the last message stored in the stream, 0 if none was stored
+	StreamLastSeq(stream string) (uint64, error)
+	DeleteStreamMsg(stream string, seq uint64) error
+	// SubscribeConsumer creates the durable stream consumer if it does not exist and joins its deliver group.
+	// Messages are delivered with manual acknowledgement.
+	SubscribeConsumer(stream string, cfg ConsumerConfig, handler MsgHandler) (Subscription, error)
+	// CheckConsumer reports an error if the durable stream consumer does not exist or cannot be reached
+	CheckConsumer(ctx context.Context, stream string, consumer string) error
+	// KeyValue returns the key/value bucket, creates it if it does not exist
+	KeyValue(bucket string) (KeyValue, error)
+	Flush() error
+	// Check reports an error if the backend cannot deliver messages now, e.g. the connection to NATS is lost
+	Check() error
+	Close() error
+}
+
+type KeyValueEntry interface {
+	Key() string
+	Value() []byte
+	Revision() uint64
+}
+
+type KeyWatcher interface {
+	// Updates returns the channel which receives all current values matching the watched keys first,
+	// then nil as a marker of the initial values end, then all the following updates. Deletes are not reported.
+	Updates() <-chan KeyValueEntry
+	Stop() error
+}
+
+type KeyValue interface {
+	Get(key string) (KeyValueEntry, error)
+	Put(key string, value []byte) (uint64, error)
+	// Update puts the value only if the last revision of the key equals lastRevision, returns ErrWrongLastRevision otherwise
+	Update(key string, value []byte, lastRevision uint64) (uint64, error)
+	// Watch watches keys matching the pattern, "*" matches a single token and ">" matches all the tailing tokens
+	Watch(keys string) (KeyWatcher, error)
+	// Erase removes the last value of the key without leaving a delete marker
+	Erase(key string) error
+	// EraseIfRevision erases like Erase does only if the last revision of the key equals lastRevision, returns ErrWrongLastRevision otherwise
+	EraseIfRevision(key string, lastRevision uint64) error
+}
+
+func subjectMatches(pattern string, subject string) bool {
+	patternTokens := strings.Split(pattern, ".")
+	subjectTokens := strings.Split(subject, ".")
+	for i, pt := range patternTokens {
+		if pt == ">" {
+			return len(subjectTokens) > i
+		}
+		if i >= len(subjectTokens) {
+			return false
+		}
+		if pt != "*" && pt != subjectTokens[i] {
+			return false
+		}
+	}
+	return len(patternTokens) == len(subjectTokens)
+}
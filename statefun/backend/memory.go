@@ -0,0 +1,678 @@
+// Copyright 2023 NJWS Inc.
+
+package backend
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	lg "github.com/foliagecp/sdk/statefun/logger"
+	"github.com/foliagecp/sdk/statefun/system"
+)
+
+const (
+	InMemorySubscriptionBufferMaxSize = 65536
+	InMemoryDefaultAckWait            = 30 * time.Second
+	InMemoryDefaultDuplicates         = 2 * time.Minute
+)
+
+// InMemory is an in-process backend which needs no network and no NATS server.
+// Streams, consumers and buckets live as long as the InMemory instance does, so several runtimes
+// sharing the same instance behave as if they were connected to the same NATS server.
+type InMemory struct {
+	mutex   sync.Mutex
+	closed  bool
+	subs    map[*inMemorySubscription]struct{}
+	streams map[string]*inMemoryStream
+	buckets map[string]*inMemoryKeyValue
+}
+
+func NewInMemory() *InMemory {
+	return &InMemory{
+		subs:    map[*inMemorySubscription]struct{}{},
+		streams: map[string]*inMemoryStream{},
+		buckets: map[string]*inMemoryKeyValue{},
+	}
+}
+
+func (b *InMemory) Publish(subject string, data []byte) error {
+	return b.publish(subject, data, "", nil, false)
+}
+
+func (b *InMemory) StreamPublish(subject string, data []byte) error {
+	return b.publish(subject, data, "", nil, true)
+}
+
+func (b *InMemory) StreamPublishMsgID(subject string, data []byte, msgID string) error {
+	return b.publish(subject, data, msgID, nil, true)
+}
+
+func (b *InMemory) publish(subject string, data []byte, msgID string, respond func([]byte) error, streamRequired bool) error {
+	b.mutex.Lock()
+	if b.closed {
+		b.mutex.Unlock()
+		return ErrBackendClosed
+	}
+	dataCopy := append([]byte{}, data...)
+	var targetStream *inMemoryStream
+	for _, stream := range b.streams {
+		if stream.capturesSubject(subject) {
+			targetStream = stream
+			break
+		}
+	}
+	if streamRequired && targetStream == nil {
+		b.mutex.Unlock()
+		return fmt.Errorf("%w: no stream captures subject %s", ErrStreamNotFound, subject)
+	}
+	for sub := range b.subs {
+		if subjectMatches(sub.subject, subject) {
+			sub.deliver(&inMemoryMsg{subject: subject, data: dataCopy, msgID: msgID, respond: respond})
+		}
+	}
+	b.mutex.Unlock()
+
+	if targetStream != nil {
+		targetStream.append(subject, dataCopy, msgID)
+	}
+	return nil
+}
+
+func (b *InMemory) Request(ctx context.Context, subject string, data []byte) ([]byte, error) {
+	b.mutex.Lock()
+	respondersExist := false
+	for sub := range b.subs {
+		if subjectMatches(sub.subject, subject) {
+			respondersExist = true
+			break
+		}
+	}
+	b.mutex.Unlock()
+	if !respondersExist {
+		return nil, fmt.Errorf("%w: %s", ErrNoResponders, subject)
+	}
+
+	replyChannel := make(chan []byte, 1)
+	respond := func(data []byte) error {
+		select {
+		case replyChannel <- append([]byte{}, data...):
+		default: // Only the first reply counts
+		}
+		return nil
+	}
+	if err := b.publish(subject, data, "", respond, false); err != nil {
+		return nil, err
+	}
+
+	select {
+	case reply := <-replyChannel:
+		return reply, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (b *InMemory) Subscribe(subject string, handler MsgHandler) (Subscription, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.closed {
+		return nil, ErrBackendClosed
+	}
+	sub := newInMemorySubscription(subject, handler, func(s *inMemorySubscription) {
+		b.mutex.Lock()
+		delete(b.subs, s)
+		b.mutex.Unlock()
+	})
+	b.subs[sub] = struct{}{}
+	return sub, nil
+}
+
+func (b *InMemory) EnsureStream(cfg StreamConfig) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.closed {
+		return ErrBackendClosed
+	}
+	if _, ok := b.streams[cfg.Name]; ok {
+		return nil
+	}
+	for _, stream := range b.streams {
+		for _, subject := range cfg.Subjects {
+			if stream.capturesSubject(subject) {
+				return fmt.Errorf("subjects of stream %s overlap with stream %s", cfg.Name, stream.cfg.Name)
+			}
+		}
+	}
+	b.streams[cfg.Name] = newInMemoryStream(cfg)
+	return nil
+}
+
+func (b *InMemory) StreamMsgs(stream string, fromSeq uint64, limit int) ([]StreamMsg, error) {
+	s, err := b.getStream(stream)
+	if err != nil {
+		return nil, err
+	}
+	msgs := []StreamMsg{}
+	for len(msgs) < limit {
+		stored := s.nextMsg(fromSeq, "")
+		if stored == nil {
+			break
+		}
+		msgs = append(msgs, stored.toStreamMsg())
+		fromSeq = stored.seq + 1
+	}
+	return msgs, nil
+}
+
+func (b *InMemory) StreamMsg(stream string, seq uint64) (*StreamMsg, error) {
+	s, err := b.getStream(stream)
+	if err != nil {
+		return nil, err
+	}
+	stored := s.msg(seq)
+	if stored == nil {
+		return nil, fmt.Errorf("%w: %s #%d", ErrMsgNotFound, stream, seq)
+	}
+	msg := stored.toStreamMsg()
+	return &msg, nil
+}
+
+func (b *InMemory) StreamLastSeq(stream string) (uint64, error) {
+	s, err := b.getStream(stream)
+	if err != nil {
+		return 0, err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.lastSeq, nil
+}
+
+func (b *InMemory) DeleteStreamMsg(stream string, seq uint64) error {
+	s, err := b.getStream(stream)
+	if err != nil {
+		return err
+	}
+	if !s.deleteMsg(seq) {
+		return fmt.Errorf("%w: %s #%d", ErrMsgNotFound, stream, seq)
+	}
+	return nil
+}
+
+func (b *InMemory) SubscribeConsumer(stream string, cfg ConsumerConfig, handler MsgHandler) (Subscription, error) {
+	s, err := b.getStream(stream)
+	if err != nil {
+		return nil, err
+	}
+	return s.ensureConsumer(cfg).subscribe(handler), nil
+}
+
+func (b *InMemory) CheckConsumer(_ context.Context, stream string, consumer string) error {
+	s, err := b.getStream(stream)
+	if err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.consumers[consumer]; !ok {
+		return fmt.Errorf("%w: %s", ErrConsumerNotFound, consumer)
+	}
+	return nil
+}
+
+func (b *InMemory) getStream(stream string) (*inMemoryStream, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.closed {
+		return nil, ErrBackendClosed
+	}
+	s, ok := b.streams[stream]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrStreamNotFound, stream)
+	}
+	return s, nil
+}
+
+func (b *InMemory) KeyValue(bucket string) (KeyValue, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.closed {
+		return nil, ErrBackendClosed
+	}
+	if kv, ok := b.buckets[bucket]; ok {
+		return kv, nil
+	}
+	kv := newInMemoryKeyValue(bucket)
+	b.buckets[bucket] = kv
+	return kv, nil
+}
+
+func (b *InMemory) Flush() error {
+	return nil
+}
+
+func (b *InMemory) Check() error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.closed {
+		return ErrBackendClosed
+	}
+	return nil
+}
+
+func (b *InMemory) Close() error {
+	b.mutex.Lock()
+	b.closed = true
+	subs := b.subs
+	b.subs = map[*inMemorySubscription]struct{}{}
+	streams := b.streams
+	b.mutex.Unlock()
+
+	for sub := range subs {
+		system.MsgOnErrorReturn(sub.Unsubscribe())
+	}
+	for _, stream := range streams {
+		stream.stop()
+	}
+	return nil
+}
+
+// --------------------------------------------------------------------------------------------------------------------
+
+type inMemoryMsg struct {
+	subject    string
+	data       []byte
+	msgID      string
+	respond    func([]byte) error
+	consumer   *inMemoryConsumer
+	seq        uint64
+	deliveries uint64
+}
+
+func (m *inMemoryMsg) Subject() string {
+	return m.subject
+}
+
+func (m *inMemoryMsg) Data() []byte {
+	return m.data
+}
+
+func (m *inMemoryMsg) Ack() error {
+	if m.consumer == nil {
+		return ErrNotStreamMsg
+	}
+	m.consumer.ack(m.seq)
+	return nil
+}
+
+func (m *inMemoryMsg) Nak() error {
+	if m.consumer == nil {
+		return ErrNotStreamMsg
+	}
+	m.consumer.nak(m.seq, 0)
+	return nil
+}
+
+func (m *inMemoryMsg) NakWithDelay(delay time.Duration) error {
+	if m.consumer == nil {
+		return ErrNotStreamMsg
+	}
+	m.consumer.nak(m.seq, delay)
+	return nil
+}
+
+func (m *inMemoryMsg) NumDelivered() uint64 {
+	if m.consumer == nil {
+		return 1
+	}
+	return m.deliveries
+}
+
+func (m *inMemoryMsg) MsgID() string {
+	return m.msgID
+}
+
+func (m *inMemoryMsg) Respond(data []byte) error {
+	if m.respond == nil {
+		return ErrNoReplySubject
+	}
+	return m.respond(data)
+}
+
+// --------------------------------------------------------------------------------------------------------------------
+
+type inMemorySubscription struct {
+	subject       string
+	handler       MsgHandler
+	in            chan *inMemoryMsg
+	mutex         sync.Mutex
+	unsubscribed  bool
+	onUnsubscribe func(s *inMemorySubscription)
+}
+
+func newInMemorySubscription(subject string, handler MsgHandler, onUnsubscribe func(s *inMemorySubscription)) *inMemorySubscription {
+	onBufferOverflow := func() {
+		lg.Logf(lg.WarnLevel, "In-memory subscription buffer overflow for subject=%s!\n", subject)
+	}
+	in, out := system.CreateDimSizeChannel[*inMemoryMsg](InMemorySubscriptionBufferMaxSize, onBufferOverflow)
+	sub := &inMemorySubscription{subject: subject, handler: handler, in: in, onUnsubscribe: onUnsubscribe}
+	go func() {
+		system.GlobalPrometrics.GetRoutinesCounter().Started("backend.inMemorySubscription")
+		defer system.GlobalPrometrics.GetRoutinesCounter().Stopped("backend.inMemorySubscription")
+		for msg := range out {
+			if sub.isActive() {
+				sub.handler(msg)
+			}
+		}
+	}()
+	return sub
+}
+
+func (s *inMemorySubscription) isActive() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return !s.unsubscribed
+}
+
+func (s *inMemorySubscription) deliver(msg *inMemoryMsg) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.unsubscribed {
+		return false
+	}
+	s.in <- msg
+	return true
+}
+
+func (s *inMemorySubscription) Unsubscribe() error {
+	s.mutex.Lock()
+	if s.unsubscribed {
+		s.mutex.Unlock()
+		return nil
+	}
+	s.unsubscribed = true
+	close(s.in)
+	s.mutex.Unlock()
+
+	if s.onUnsubscribe != nil {
+		s.onUnsubscribe(s)
+	}
+	return nil
+}
+
+// --------------------------------------------------------------------------------------------------------------------
+
+type inMemoryStoredMsg struct {
+	seq     uint64
+	subject string
+	data    []byte
+	msgID   string
+	time    time.Time
+}
+
+func (m *inMemoryStoredMsg) toStreamMsg() StreamMsg {
+	return StreamMsg{Sequence: m.seq, Subject: m.subject, Data: m.data, Time: m.time}
+}
+
+type inMemoryStream struct {
+	cfg       StreamConfig
+	mutex     sync.Mutex
+	msgs      map[uint64]*inMemoryStoredMsg
+	lastSeq   uint64
+	consumers map[string]*inMemoryConsumer
+	msgIDs    map[string]time.Time // Message ID -> time the message was stored at
+}
+
+func newInMemoryStream(cfg StreamConfig) *inMemoryStream {
+	if cfg.Duplicates == 0 {
+		cfg.Duplicates = InMemoryDefaultDuplicates
+	}
+	return &inMemoryStream{
+		cfg:       cfg,
+		msgs:      map[uint64]*inMemoryStoredMsg{},
+		consumers: map[string]*inMemoryConsumer{},
+		msgIDs:    map[string]time.Time{},
+	}
+}
+
+func (s *inMemoryStream) capturesSubject(subject string) bool {
+	for _, streamSubject := range s.cfg.Subjects {
+		if subjectMatches(streamSubject, subject) || subjectMatches(subject, streamSubject) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns 0 if the message is a duplicate and was not stored
+func (s *inMemoryStream) append(subject string, data []byte, msgID string) uint64 {
+	s.mutex.Lock()
+	now := time.Now()
+	if len(msgID) > 0 {
+		for id, storedAt := range s.msgIDs {
+			if now.Sub(storedAt) > s.cfg.Duplicates {
+				delete(s.msgIDs, id)
+			}
+		}
+		if _, ok := s.msgIDs[msgID]; ok {
+			s.mutex.Unlock()
+			return 0
+		}
+		s.msgIDs[msgID] = now
+	}
+	s.lastSeq++
+	seq := s.lastSeq
+	s.msgs[seq] = &inMemoryStoredMsg{seq: seq, subject: subject, data: data, msgID: msgID, time: now}
+	consumers := make([]*inMemoryConsumer, 0, len(s.consumers))
+	for _, c := range s.consumers {
+		consumers = append(consumers, c)
+	}
+	s.mutex.Unlock()
+
+	for _, c := range consumers {
+		c.notify()
+	}
+	return seq
+}
+
+// Returns the first message with sequence >= seq matching the filter subject
+func (s *inMemoryStream) nextMsg(seq uint64, filterSubject string) *inMemoryStoredMsg {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for ; seq <= s.lastSeq; seq++ {
+		if msg, ok := s.msgs[seq]; ok && (len(filterSubject) == 0 || subjectMatches(filterSubject, msg.subject)) {
+			return msg
+		}
+	}
+	return nil
+}
+
+func (s *inMemoryStream) msg(seq uint64) *inMemoryStoredMsg {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.msgs[seq]
+}
+
+func (s *inMemoryStream) deleteMsg(seq uint64) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.msgs[seq]; !ok {
+		return false
+	}
+	delete(s.msgs, seq)
+	return true
+}
+
+func (s *inMemoryStream) ensureConsumer(cfg ConsumerConfig) *inMemoryConsumer {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if c, ok := s.consumers[cfg.Name]; ok {
+		return c
+	}
+	c := newInMemoryConsumer(s, cfg)
+	s.consumers[cfg.Name] = c
+	go c.deliveryLoop()
+	return c
+}
+
+func (s *inMemoryStream) stop() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, c := range s.consumers {
+		c.stop()
+	}
+}
+
+// --------------------------------------------------------------------------------------------------------------------
+
+type inMemoryPendingMsg struct {
+	deliveries  uint64
+	redeliverAt time.Time
+}
+
+type inMemoryConsumer struct {
+	stream        *inMemoryStream
+	cfg           ConsumerConfig
+	mutex         sync.Mutex
+	nextSeq       uint64
+	pending       map[uint64]*inMemoryPendingMsg
+	members       []*inMemorySubscription
+	nextMember    int
+	notifications chan struct{}
+	stopped       chan struct{}
+	stopOnce      sync.Once
+}
+
+func newInMemoryConsumer(stream *inMemoryStream, cfg ConsumerConfig) *inMemoryConsumer {
+	if cfg.AckWait <= 0 {
+		cfg.AckWait = InMemoryDefaultAckWait
+	}
+	return &inMemoryConsumer{
+		stream:        stream,
+		cfg:           cfg,
+		nextSeq:       1,
+		pending:       map[uint64]*inMemoryPendingMsg{},
+		notifications: make(chan struct{}, 1),
+		stopped:       make(chan struct{}),
+	}
+}
+
+func (c *inMemoryConsumer) notify() {
+	select {
+	case c.notifications <- struct{}{}:
+	default:
+	}
+}
+
+func (c *inMemoryConsumer) stop() {
+	c.stopOnce.Do(func() {
+		close(c.stopped)
+	})
+}
+
+func (c *inMemoryConsumer) subscribe(handler MsgHandler) *inMemorySubscription {
+	sub := newInMemorySubscription(c.cfg.FilterSubject, handler, func(s *inMemorySubscription) {
+		c.mutex.Lock()
+		for i, member := range c.members {
+			if member == s {
+				c.members = append(c.members[:i], c.members[i+1:]...)
+				break
+			}
+		}
+		c.mutex.Unlock()
+	})
+	c.mutex.Lock()
+	c.members = append(c.members, sub)
+	c.mutex.Unlock()
+	c.notify()
+	return sub
+}
+
+func (c *inMemoryConsumer) ack(seq uint64) {
+	c.mutex.Lock()
+	delete(c.pending, seq)
+	c.mutex.Unlock()
+	c.notify()
+}
+
+func (c *inMemoryConsumer) nak(seq uint64, delay time.Duration) {
+	c.mutex.Lock()
+	if p, ok := c.pending[seq]; ok {
+		p.redeliverAt = time.Now().Add(delay)
+	}
+	c.mutex.Unlock()
+	c.notify()
+}
+
+// Picks the message to be delivered next: the pending one which must be redelivered or the next new one.
+// Returns nil and the time to wait for if nothing is to be delivered now.
+func (c *inMemoryConsumer) pickNext(now time.Time) (*inMemoryMsg, time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	wait := time.Duration(-1)
+	if len(c.members) == 0 {
+		return nil, wait
+	}
+
+	var redeliverSeq uint64
+	for seq, p := range c.pending {
+		if !p.redeliverAt.After(now) {
+			if redeliverSeq == 0 || seq < redeliverSeq {
+				redeliverSeq = seq
+			}
+		} else if d := p.redeliverAt.Sub(now); wait < 0 || d < wait {
+			wait = d
+		}
+	}
+
+	var stored *inMemoryStoredMsg
+	if redeliverSeq != 0 {
+		if stored = c.stream.msg(redeliverSeq); stored == nil { // Message was deleted from the stream
+			delete(c.pending, redeliverSeq)
+			return nil, 0
+		}
+	} else if c.cfg.MaxAckPending > 0 && len(c.pending) >= c.cfg.MaxAckPending {
+		return nil, wait // Waiting for acks
+	} else if stored = c.stream.nextMsg(c.nextSeq, c.cfg.FilterSubject); stored != nil {
+		c.nextSeq = stored.seq + 1
+		c.pending[stored.seq] = &inMemoryPendingMsg{}
+	} else {
+		return nil, wait
+	}
+
+	p := c.pending[stored.seq]
+	p.deliveries++
+	p.redeliverAt = now.Add(c.cfg.AckWait)
+
+	member := c.members[c.nextMember%len(c.members)]
+	c.nextMember++
+	msg := &inMemoryMsg{subject: stored.subject, data: stored.data, msgID: stored.msgID, consumer: c, seq: stored.seq, deliveries: p.deliveries}
+	if !member.deliver(msg) { // Member has just unsubscribed, message will be redelivered
+		p.redeliverAt = now
+		return nil, 0
+	}
+	return msg, 0
+}
+
+func (c *inMemoryConsumer) deliveryLoop() {
+	system.GlobalPrometrics.GetRoutinesCounter().Started("backend.inMemoryConsumer.deliveryLoop")
+	defer system.GlobalPrometrics.GetRoutinesCounter().Stopped("backend.inMemoryConsumer.deliveryLoop")
+	for {
+		msg, wait := c.pickNext(time.Now())
+		if msg != nil || wait == 0 {
+			continue
+		}
+		var timer <-chan time.Time
+		if wait > 0 {
+			timer = time.After(wait)
+		}
+		select {
+		case <-c.stopped:
+			return
+		case <-c.notifications:
+		case <-timer:
+		}
+	}
+}
@@ -0,0 +1,165 @@
+// Copyright 2023 NJWS Inc.
+
+package backend
+
+import (
+	"sort"
+	"sync"
+
+	lg "github.com/foliagecp/sdk/statefun/logger"
+	"github.com/foliagecp/sdk/statefun/system"
+)
+
+type inMemoryKeyValueEntry struct {
+	key      string
+	value    []byte
+	revision uint64
+}
+
+func (e *inMemoryKeyValueEntry) Key() string {
+	return e.key
+}
+
+func (e *inMemoryKeyValueEntry) Value() []byte {
+	return e.value
+}
+
+func (e *inMemoryKeyValueEntry) Revision() uint64 {
+	return e.revision
+}
+
+type inMemoryKeyValue struct {
+	bucket       string
+	mutex        sync.Mutex
+	entries      map[string]*inMemoryKeyValueEntry
+	lastRevision uint64
+	watchers     map[*inMemoryKeyWatcher]struct{}
+}
+
+func newInMemoryKeyValue(bucket string) *inMemoryKeyValue {
+	return &inMemoryKeyValue{
+		bucket:   bucket,
+		entries:  map[string]*inMemoryKeyValueEntry{},
+		watchers: map[*inMemoryKeyWatcher]struct{}{},
+	}
+}
+
+func (kv *inMemoryKeyValue) Get(key string) (KeyValueEntry, error) {
+	kv.mutex.Lock()
+	defer kv.mutex.Unlock()
+	if entry, ok := kv.entries[key]; ok {
+		return entry, nil
+	}
+	return nil, ErrKeyNotFound
+}
+
+func (kv *inMemoryKeyValue) Put(key string, value []byte) (uint64, error) {
+	kv.mutex.Lock()
+	defer kv.mutex.Unlock()
+	return kv.put(key, value), nil
+}
+
+func (kv *inMemoryKeyValue) Update(key string, value []byte, lastRevision uint64) (uint64, error) {
+	kv.mutex.Lock()
+	defer kv.mutex.Unlock()
+	var currentRevision uint64
+	if entry, ok := kv.entries[key]; ok {
+		currentRevision = entry.revision
+	}
+	if currentRevision != lastRevision {
+		return 0, ErrWrongLastRevision
+	}
+	return kv.put(key, value), nil
+}
+
+// Must be called with kv.mutex locked
+func (kv *inMemoryKeyValue) put(key string, value []byte) uint64 {
+	kv.lastRevision++
+	entry := &inMemoryKeyValueEntry{key: key, value: append([]byte{}, value...), revision: kv.lastRevision}
+	kv.entries[key] = entry
+	for w := range kv.watchers {
+		if subjectMatches(w.keys, key) {
+			w.in <- entry
+		}
+	}
+	return entry.revision
+}
+
+func (kv *inMemoryKeyValue) Watch(keys string) (KeyWatcher, error) {
+	onBufferOverflow := func() {
+		lg.Logf(lg.WarnLevel, "In-memory key watcher buffer overflow for keys=%s!\n", keys)
+	}
+	in, out := system.CreateDimSizeChannel[KeyValueEntry](InMemorySubscriptionBufferMaxSize, onBufferOverflow)
+	w := &inMemoryKeyWatcher{kv: kv, keys: keys, in: in, out: out}
+
+	kv.mutex.Lock()
+	defer kv.mutex.Unlock()
+
+	initialEntries := []*inMemoryKeyValueEntry{}
+	for key, entry := range kv.entries {
+		if subjectMatches(keys, key) {
+			initialEntries = append(initialEntries, entry)
+		}
+	}
+	sort.Slice(initialEntries, func(i, j int) bool { return initialEntries[i].revision < initialEntries[j].revision })
+	for _, entry := range initialEntries {
+		in <- entry
+	}
+	in <- nil
+	kv.watchers[w] = struct{}{}
+
+	return w, nil
+}
+
+func (kv *inMemoryKeyValue) Erase(key string) error {
+	kv.mutex.Lock()
+	defer kv.mutex.Unlock()
+	if _, ok := kv.entries[key]; !ok {
+		return ErrKeyNotFound
+	}
+	delete(kv.entries, key)
+	return nil
+}
+
+func (kv *inMemoryKeyValue) EraseIfRevision(key string, lastRevision uint64) error {
+	kv.mutex.Lock()
+	defer kv.mutex.Unlock()
+	entry, ok := kv.entries[key]
+	if !ok {
+		return ErrKeyNotFound
+	}
+	if entry.revision != lastRevision {
+		return ErrWrongLastRevision
+	}
+	delete(kv.entries, key)
+	return nil
+}
+
+type inMemoryKeyWatcher struct {
+	kv      *inMemoryKeyValue
+	keys    string
+	in      chan KeyValueEntry
+	out     chan KeyValueEntry
+	stopped bool
+}
+
+func (w *inMemoryKeyWatcher) Updates() <-chan KeyValueEntry {
+	return w.out
+}
+
+func (w *inMemoryKeyWatcher) Stop() error {
+	w.kv.mutex.Lock()
+	defer w.kv.mutex.Unlock()
+	if w.stopped {
+		return nil
+	}
+	w.stopped = true
+	delete(w.kv.watchers, w)
+	close(w.in)
+	// Releasing the buffer pusher which may be blocked on an update nobody is going to read anymore
+	go func() {
+		for range w.out {
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,357 @@
+// Copyright 2023 NJWS Inc.
+
+package backend
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+const testWaitTimeout = 5 * time.Second
+
+func receiveEntry(t *testing.T, w KeyWatcher) KeyValueEntry {
+	t.Helper()
+	select {
+	case entry, ok := <-w.Updates():
+		if !ok {
+			t.Fatal("watcher updates channel is closed")
+		}
+		return entry
+	case <-time.After(testWaitTimeout):
+		t.Fatal("no watcher update received in time")
+	}
+	return nil
+}
+
+func receiveMsg(t *testing.T, msgs <-chan Msg) Msg {
+	t.Helper()
+	select {
+	case msg := <-msgs:
+		return msg
+	case <-time.After(testWaitTimeout):
+		t.Fatal("no message received in time")
+	}
+	return nil
+}
+
+func unsubscribeOnCleanup(t *testing.T, sub Subscription) {
+	t.Cleanup(func() {
+		if err := sub.Unsubscribe(); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestSubjectMatches(t *testing.T) {
+	tests := []struct {
+		pattern string
+		subject string
+		matches bool
+	}{
+		{"a.b", "a.b", true},
+		{"a.b", "a.c", false},
+		{"a.*", "a.b", true},
+		{"a.*", "a.b.c", false},
+		{"a.>", "a.b.c", true},
+		{"a.>", "a", false},
+		{"*.b", "a.b", true},
+		{"a.b.c", "a.b", false},
+	}
+	for _, test := range tests {
+		if matches := subjectMatches(test.pattern, test.subject); matches != test.matches {
+			t.Errorf("subjectMatches(%q, %q) = %v, want %v", test.pattern, test.subject, matches, test.matches)
+		}
+	}
+}
+
+func TestInMemoryKeyValueUpdate(t *testing.T) {
+	kv, err := NewInMemory().KeyValue("bucket")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := kv.Get("key"); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("Get of a missing key returned %v, want ErrKeyNotFound", err)
+	}
+	if _, err := kv.Update("key", []byte("v0"), 1); !errors.Is(err, ErrWrongLastRevision) {
+		t.Fatalf("Update of a missing key with revision 1 returned %v, want ErrWrongLastRevision", err)
+	}
+	revision, err := kv.Update("key", []byte("v1"), 0)
+	if err != nil {
+		t.Fatalf("Update of a missing key with revision 0 failed: %v", err)
+	}
+	if _, err := kv.Update("key", []byte("v2"), revision+1); !errors.Is(err, ErrWrongLastRevision) {
+		t.Fatalf("Update with a wrong revision returned %v, want ErrWrongLastRevision", err)
+	}
+	newRevision, err := kv.Update("key", []byte("v2"), revision)
+	if err != nil {
+		t.Fatalf("Update with the last revision failed: %v", err)
+	}
+	if newRevision <= revision {
+		t.Fatalf("Update returned revision %d, want greater than %d", newRevision, revision)
+	}
+	if _, err := kv.Update("key", []byte("v3"), revision); !errors.Is(err, ErrWrongLastRevision) {
+		t.Fatalf("Update with an outdated revision returned %v, want ErrWrongLastRevision", err)
+	}
+
+	entry, err := kv.Get("key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(entry.Value()) != "v2" || entry.Revision() != newRevision {
+		t.Fatalf("Get returned %s at revision %d, want v2 at revision %d", entry.Value(), entry.Revision(), newRevision)
+	}
+
+	if err := kv.EraseIfRevision("key", revision); !errors.Is(err, ErrWrongLastRevision) {
+		t.Fatalf("EraseIfRevision with an outdated revision returned %v, want ErrWrongLastRevision", err)
+	}
+	if err := kv.Erase("key"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := kv.Get("key"); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("Get of an erased key returned %v, want ErrKeyNotFound", err)
+	}
+	if err := kv.Erase("key"); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("Erase of a missing key returned %v, want ErrKeyNotFound", err)
+	}
+
+	revision, err = kv.Put("key", []byte("v4"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := kv.EraseIfRevision("key", revision); err != nil {
+		t.Fatalf("EraseIfRevision with the last revision failed: %v", err)
+	}
+	if err := kv.EraseIfRevision("key", revision); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("EraseIfRevision of a missing key returned %v, want ErrKeyNotFound", err)
+	}
+}
+
+func TestInMemoryKeyValueWatch(t *testing.T) {
+	kv, err := NewInMemory().KeyValue("bucket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := kv.Put("a.1", []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := kv.Put("b.1", []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := kv.Put("a.2", []byte("2")); err != nil {
+		t.Fatal(err)
+	}
+
+	w, err := kv.Watch("a.*")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Current values in revision order, then the nil marker
+	for _, key := range []string{"a.1", "a.2"} {
+		if entry := receiveEntry(t, w); entry == nil || entry.Key() != key {
+			t.Fatalf("initial value %v received, want %s", entry, key)
+		}
+	}
+	if entry := receiveEntry(t, w); entry != nil {
+		t.Fatalf("initial values end marker is %s, want nil", entry.Key())
+	}
+
+	// Following updates of matching keys only
+	if _, err := kv.Put("b.2", []byte("2")); err != nil {
+		t.Fatal(err)
+	}
+	revision, err := kv.Put("a.1", []byte("updated"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry := receiveEntry(t, w)
+	if entry == nil || entry.Key() != "a.1" || string(entry.Value()) != "updated" || entry.Revision() != revision {
+		t.Fatalf("update %v received, want a.1=updated at revision %d", entry, revision)
+	}
+
+	if err := w.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Stop(); err != nil {
+		t.Fatalf("second Stop failed: %v", err)
+	}
+	if _, err := kv.Put("a.3", []byte("3")); err != nil {
+		t.Fatalf("Put after the watcher was stopped failed: %v", err)
+	}
+}
+
+func TestInMemoryPublishSubscribe(t *testing.T) {
+	b := NewInMemory()
+	msgs := make(chan Msg, 1)
+	sub, err := b.Subscribe("subject.*", func(msg Msg) { msgs <- msg })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Publish("subject.1", []byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	if msg := receiveMsg(t, msgs); msg.Subject() != "subject.1" || string(msg.Data()) != "data" {
+		t.Fatalf("received %s: %s, want subject.1: data", msg.Subject(), msg.Data())
+	}
+	if err := b.StreamPublish("subject.1", []byte("data")); !errors.Is(err, ErrStreamNotFound) {
+		t.Fatalf("StreamPublish without a stream returned %v, want ErrStreamNotFound", err)
+	}
+
+	if err := sub.Unsubscribe(); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Publish("subject.1", []byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case msg := <-msgs:
+		t.Fatalf("message %s received after unsubscribing", msg.Data())
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestInMemoryRequest(t *testing.T) {
+	b := NewInMemory()
+	ctx, cancel := context.WithTimeout(context.Background(), testWaitTimeout)
+	defer cancel()
+
+	if _, err := b.Request(ctx, "service.echo", nil); !errors.Is(err, ErrNoResponders) {
+		t.Fatalf("Request without responders returned %v, want ErrNoResponders", err)
+	}
+	if _, err := b.Subscribe("service.echo", func(msg Msg) {
+		if err := msg.Respond(append([]byte("echo "), msg.Data()...)); err != nil {
+			t.Error(err)
+		}
+	}); err != nil {
+		t.Fatal(err)
+	}
+	reply, err := b.Request(ctx, "service.echo", []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(reply) != "echo hello" {
+		t.Fatalf("reply is %q, want \"echo hello\"", reply)
+	}
+}
+
+func TestInMemoryStreamConsumer(t *testing.T) {
+	b := NewInMemory()
+	if err := b.EnsureStream(StreamConfig{Name: "stream", Subjects: []string{"subject.*"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.EnsureStream(StreamConfig{Name: "other", Subjects: []string{"subject.1"}}); err == nil {
+		t.Fatal("stream with overlapping subjects was created")
+	}
+
+	if err := b.StreamPublishMsgID("subject.1", []byte("first"), "id1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.StreamPublishMsgID("subject.1", []byte("duplicate"), "id1"); err != nil {
+		t.Fatalf("publishing a duplicate failed: %v", err)
+	}
+	if err := b.StreamPublish("subject.2", []byte("second")); err != nil {
+		t.Fatal(err)
+	}
+
+	stored, err := b.StreamMsgs("stream", 1, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stored) != 2 || string(stored[0].Data) != "first" || string(stored[1].Data) != "second" {
+		t.Fatalf("stream stores %v, want first and second", stored)
+	}
+
+	msgs := make(chan Msg, 10)
+	consumerConfig := ConsumerConfig{Name: "consumer", DeliverGroup: "group", FilterSubject: "subject.*", AckWait: time.Minute}
+	sub, err := b.SubscribeConsumer("stream", consumerConfig, func(msg Msg) { msgs <- msg })
+	if err != nil {
+		t.Fatal(err)
+	}
+	unsubscribeOnCleanup(t, sub)
+	if err := b.CheckConsumer(context.Background(), "stream", "consumer"); err != nil {
+		t.Fatal(err)
+	}
+
+	first := receiveMsg(t, msgs)
+	if string(first.Data()) != "first" || first.MsgID() != "id1" || first.NumDelivered() != 1 {
+		t.Fatalf("received %s (id %q, delivery %d), want first (id \"id1\", delivery 1)", first.Data(), first.MsgID(), first.NumDelivered())
+	}
+	second := receiveMsg(t, msgs)
+	if string(second.Data()) != "second" {
+		t.Fatalf("received %s, want second", second.Data())
+	}
+
+	// Nacked message is redelivered, acked one is not
+	if err := first.Ack(); err != nil {
+		t.Fatal(err)
+	}
+	if err := second.Nak(); err != nil {
+		t.Fatal(err)
+	}
+	redelivered := receiveMsg(t, msgs)
+	if string(redelivered.Data()) != "second" || redelivered.NumDelivered() != 2 {
+		t.Fatalf("redelivered %s (delivery %d), want second (delivery 2)", redelivered.Data(), redelivered.NumDelivered())
+	}
+	if err := redelivered.Ack(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case msg := <-msgs:
+		t.Fatalf("acked message %s was redelivered", msg.Data())
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestInMemoryConsumerMaxAckPending(t *testing.T) {
+	b := NewInMemory()
+	if err := b.EnsureStream(StreamConfig{Name: "stream", Subjects: []string{"subject.*"}}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := b.StreamPublish("subject.1", []byte{byte('0' + i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	msgs := make(chan Msg, 10)
+	consumerConfig := ConsumerConfig{Name: "consumer", FilterSubject: "subject.*", AckWait: time.Minute, MaxAckPending: 1}
+	sub, err := b.SubscribeConsumer("stream", consumerConfig, func(msg Msg) { msgs <- msg })
+	if err != nil {
+		t.Fatal(err)
+	}
+	unsubscribeOnCleanup(t, sub)
+
+	for i := 0; i < 3; i++ {
+		msg := receiveMsg(t, msgs)
+		if string(msg.Data()) != string([]byte{byte('0' + i)}) {
+			t.Fatalf("received %s, want %d", msg.Data(), i)
+		}
+		select {
+		case extra := <-msgs:
+			t.Fatalf("message %s delivered while another one is not acked", extra.Data())
+		case <-time.After(50 * time.Millisecond):
+		}
+		if err := msg.Ack(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestInMemoryClose(t *testing.T) {
+	b := NewInMemory()
+	if err := b.Check(); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Check(); !errors.Is(err, ErrBackendClosed) {
+		t.Fatalf("Check of a closed backend returned %v, want ErrBackendClosed", err)
+	}
+	if err := b.Publish("subject", nil); !errors.Is(err, ErrBackendClosed) {
+		t.Fatalf("Publish to a closed backend returned %v, want ErrBackendClosed", err)
+	}
+}
@@ -0,0 +1,391 @@
+// Copyright 2023 NJWS Inc.
+
+package backend
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	customNatsKv "github.com/foliagecp/sdk/embedded/nats/kv"
+	"github.com/foliagecp/sdk/statefun/system"
+	"github.com/nats-io/nats.go"
+)
+
+const NatsStreamMsgsWait = 5 * time.Second // How long StreamMsgs waits for a message known to be stored
+
+type Nats struct {
+	nc *nats.Conn
+	js nats.JetStreamContext
+}
+
+func NewNats(natsURL string, options ...nats.Option) (*Nats, error) {
+	nc, err := nats.Connect(natsURL, options...)
+	if err != nil {
+		return nil, err
+	}
+	b, err := NewNatsFromConn(nc)
+	if err != nil {
+		nc.Close()
+		return nil, err
+	}
+	return b, nil
+}
+
+func NewNatsFromConn(nc *nats.Conn) (*Nats, error) {
+	js, err := nc.JetStream(nats.PublishAsyncMaxPending(256))
+	if err != nil {
+		return nil, err
+	}
+	return &Nats{nc: nc, js: js}, nil
+}
+
+func (b *Nats) Publish(subject string, data []byte) error {
+	return b.nc.Publish(subject, data)
+}
+
+func (b *Nats) Request(ctx context.Context, subject string, data []byte) ([]byte, error) {
+	resp, err := b.nc.RequestWithContext(ctx, subject, data)
+	if err != nil {
+		if errors.Is(err, nats.ErrNoResponders) {
+			return nil, fmt.Errorf("%w: %s", ErrNoResponders, subject)
+		}
+		return nil, err
+	}
+	return resp.Data, nil
+}
+
+func (b *Nats) Subscribe(subject string, handler MsgHandler) (Subscription, error) {
+	return b.nc.Subscribe(subject, func(msg *nats.Msg) {
+		handler(&natsMsg{msg})
+	})
+}
+
+func (b *Nats) StreamPublish(subject string, data []byte) error {
+	_, err := b.js.Publish(subject, data)
+	return err
+}
+
+func (b *Nats) StreamPublishMsgID(subject string, data []byte, msgID string) error {
+	_, err := b.js.Publish(subject, data, nats.MsgId(msgID))
+	return err
+}
+
+func (b *Nats) EnsureStream(cfg StreamConfig) error {
+	info, err := b.js.StreamInfo(cfg.Name)
+	if err == nil {
+		if cfg.Duplicates != 0 && info.Config.Duplicates != cfg.Duplicates {
+			streamConfig := info.Config
+			streamConfig.Duplicates = cfg.Duplicates
+			_, err = b.js.UpdateStream(&streamConfig)
+		}
+		return err
+	}
+	if !errors.Is(err, nats.ErrStreamNotFound) {
+		return err
+	}
+	_, err = b.js.AddStream(&nats.StreamConfig{
+		Name:       cfg.Name,
+		Subjects:   cfg.Subjects,
+		Duplicates: cfg.Duplicates,
+	})
+	return err
+}
+
+// Reads the stream with an ephemeral ordered consumer, which skips deleted messages and is removed once the messages are read
+func (b *Nats) StreamMsgs(stream string, fromSeq uint64, limit int) ([]StreamMsg, error) {
+	info, err := b.js.StreamInfo(stream)
+	if err != nil {
+		if errors.Is(err, nats.ErrStreamNotFound) {
+			return nil, fmt.Errorf("%w: %s", ErrStreamNotFound, stream)
+		}
+		return nil, err
+	}
+	msgs := []StreamMsg{}
+	if limit <= 0 || info.State.Msgs == 0 || fromSeq > info.State.LastSeq {
+		return msgs, nil
+	}
+	if fromSeq < info.State.FirstSeq {
+		fromSeq = info.State.FirstSeq
+	}
+
+	sub, err := b.js.SubscribeSync("", nats.BindStream(stream), nats.StartSequence(fromSeq), nats.OrderedConsumer())
+	if err != nil {
+		return nil, err
+	}
+	defer func() { system.MsgOnErrorReturn(sub.Unsubscribe()) }()
+	ci, err := sub.ConsumerInfo()
+	if err != nil {
+		return nil, err
+	}
+	total := ci.NumPending + ci.Delivered.Consumer // Messages stored from fromSeq when the consumer was created
+	for uint64(len(msgs)) < total && len(msgs) < limit {
+		msg, err := sub.NextMsg(NatsStreamMsgsWait)
+		if err != nil {
+			if errors.Is(err, nats.ErrTimeout) { // Rest of the messages were deleted meanwhile
+				break
+			}
+			return nil, err
+		}
+		meta, err := msg.Metadata()
+		if err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, StreamMsg{Sequence: meta.Sequence.Stream, Subject: msg.Subject, Data: msg.Data, Time: meta.Timestamp})
+		if meta.NumPending == 0 {
+			break
+		}
+	}
+	return msgs, nil
+}
+
+func (b *Nats) StreamMsg(stream string, seq uint64) (*StreamMsg, error) {
+	msg, err := b.js.GetMsg(stream, seq)
+	if err != nil {
+		if errors.Is(err, nats.ErrMsgNotFound) {
+			return nil, fmt.Errorf("%w: %s #%d", ErrMsgNotFound, stream, seq)
+		}
+		return nil, err
+	}
+	return &StreamMsg{Sequence: msg.Sequence, Subject: msg.Subject, Data: msg.Data, Time: msg.Time}, nil
+}
+
+func (b *Nats) StreamLastSeq(stream string) (uint64, error) {
+	info, err := b.js.StreamInfo(stream)
+	if err != nil {
+		if errors.Is(err, nats.ErrStreamNotFound) {
+			return 0, fmt.Errorf("%w: %s", ErrStreamNotFound, stream)
+		}
+		return 0, err
+	}
+	return info.State.LastSeq, nil
+}
+
+func (b *Nats) DeleteStreamMsg(stream string, seq uint64) error {
+	err := b.js.DeleteMsg(stream, seq)
+	if errors.Is(err, nats.ErrMsgNotFound) {
+		return fmt.Errorf("%w: %s #%d", ErrMsgNotFound, stream, seq)
+	}
+	return err
+}
+
+func (b *Nats) SubscribeConsumer(stream string, cfg ConsumerConfig, handler MsgHandler) (Subscription, error) {
+	// Create stream consumer if does not exist ---------------------
+	consumerExists := false
+	for info := range b.js.Consumers(stream, nats.MaxWait(10*time.Second)) {
+		if info.Name == cfg.Name {
+			consumerExists = true
+			if cfg.MaxAckPending > 0 && info.Config.MaxAckPending != cfg.MaxAckPending {
+				updated := info.Config
+				updated.MaxAckPending = cfg.MaxAckPending
+				_, err := b.js.UpdateConsumer(stream, &updated)
+				system.MsgOnErrorReturn(err)
+			}
+		}
+	}
+	if !consumerExists {
+		_, err := b.js.AddConsumer(stream, &nats.ConsumerConfig{
+			Name:           cfg.Name,
+			Durable:        cfg.Name,
+			DeliverSubject: cfg.Name,
+			DeliverGroup:   cfg.DeliverGroup,
+			FilterSubject:  cfg.FilterSubject,
+			AckPolicy:      nats.AckExplicitPolicy,
+			AckWait:        cfg.AckWait,
+			MaxAckPending:  cfg.MaxAckPending,
+		})
+		system.MsgOnErrorReturn(err)
+	}
+	// --------------------------------------------------------------
+
+	return b.js.QueueSubscribe(
+		cfg.FilterSubject,
+		cfg.DeliverGroup,
+		func(msg *nats.Msg) {
+			handler(&natsMsg{msg})
+		},
+		nats.Bind(stream, cfg.Name),
+		nats.ManualAck(),
+	)
+}
+
+func (b *Nats) CheckConsumer(ctx context.Context, stream string, consumer string) error {
+	if _, err := b.js.ConsumerInfo(stream, consumer, nats.Context(ctx)); err != nil {
+		if errors.Is(err, nats.ErrConsumerNotFound) {
+			return fmt.Errorf("%w: %s", ErrConsumerNotFound, consumer)
+		}
+		if errors.Is(err, nats.ErrStreamNotFound) {
+			return fmt.Errorf("%w: %s", ErrStreamNotFound, stream)
+		}
+		return err
+	}
+	return nil
+}
+
+func (b *Nats) KeyValue(bucket string) (KeyValue, error) {
+	if kv, err := b.js.KeyValue(bucket); err == nil {
+		return &natsKeyValue{js: b.js, kv: kv}, nil
+	}
+	kv, err := customNatsKv.CreateKeyValue(b.nc, b.js, &nats.KeyValueConfig{
+		Bucket: bucket,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &natsKeyValue{js: b.js, kv: kv}, nil
+}
+
+func (b *Nats) Flush() error {
+	return b.nc.Flush()
+}
+
+func (b *Nats) Check() error {
+	if status := b.nc.Status(); status != nats.CONNECTED {
+		return fmt.Errorf("nats connection is %s", status)
+	}
+	return nil
+}
+
+func (b *Nats) Close() error {
+	b.nc.Close()
+	return nil
+}
+
+// --------------------------------------------------------------------------------------------------------------------
+
+type natsMsg struct {
+	msg *nats.Msg
+}
+
+func (m *natsMsg) Subject() string {
+	return m.msg.Subject
+}
+
+func (m *natsMsg) Data() []byte {
+	return m.msg.Data
+}
+
+func (m *natsMsg) Ack() error {
+	return m.msg.Ack()
+}
+
+func (m *natsMsg) Nak() error {
+	return m.msg.Nak()
+}
+
+func (m *natsMsg) NakWithDelay(delay time.Duration) error {
+	return m.msg.NakWithDelay(delay)
+}
+
+func (m *natsMsg) NumDelivered() uint64 {
+	if meta, err := m.msg.Metadata(); err == nil {
+		return meta.NumDelivered
+	}
+	return 1
+}
+
+func (m *natsMsg) MsgID() string {
+	return m.msg.Header.Get(nats.MsgIdHdr)
+}
+
+func (m *natsMsg) Respond(data []byte) error {
+	return m.msg.Respond(data)
+}
+
+// --------------------------------------------------------------------------------------------------------------------
+
+type natsKeyValue struct {
+	js nats.JetStreamContext
+	kv nats.KeyValue
+}
+
+func (kv *natsKeyValue) Get(key string) (KeyValueEntry, error) {
+	entry, err := kv.kv.Get(key)
+	if err != nil {
+		if errors.Is(err, nats.ErrKeyNotFound) {
+			return nil, ErrKeyNotFound
+		}
+		return nil, err
+	}
+	return entry, nil
+}
+
+func (kv *natsKeyValue) Put(key string, value []byte) (uint64, error) {
+	return kv.kv.Put(key, value)
+}
+
+func (kv *natsKeyValue) Update(key string, value []byte, lastRevision uint64) (uint64, error) {
+	revision, err := kv.kv.Update(key, value, lastRevision)
+	if err != nil {
+		var apiErr *nats.APIError
+		if errors.As(err, &apiErr) && apiErr.ErrorCode == nats.JSErrCodeStreamWrongLastSequence {
+			return 0, fmt.Errorf("%w: %s", ErrWrongLastRevision, err)
+		}
+		return 0, err
+	}
+	return revision, nil
+}
+
+func (kv *natsKeyValue) Watch(keys string) (KeyWatcher, error) {
+	w, err := kv.kv.Watch(keys, nats.IgnoreDeletes())
+	if err != nil {
+		return nil, err
+	}
+	nkw := &natsKeyWatcher{w: w, updates: make(chan KeyValueEntry)}
+	go func() {
+		system.GlobalPrometrics.GetRoutinesCounter().Started("backend.natsKeyWatcher")
+		defer system.GlobalPrometrics.GetRoutinesCounter().Stopped("backend.natsKeyWatcher")
+		defer close(nkw.updates)
+		for entry := range w.Updates() { // Channel is closed by nats when watcher stops
+			nkw.updates <- entry
+		}
+	}()
+	return nkw, nil
+}
+
+func (kv *natsKeyValue) Erase(key string) error {
+	err := customNatsKv.DeleteKeyValueValue(kv.js, kv.kv, key)
+	if errors.Is(err, nats.ErrMsgNotFound) {
+		return ErrKeyNotFound
+	}
+	return err
+}
+
+func (kv *natsKeyValue) EraseIfRevision(key string, lastRevision uint64) error {
+	entry, err := kv.Get(key)
+	if err != nil {
+		return err
+	}
+	if entry.Revision() != lastRevision {
+		return ErrWrongLastRevision
+	}
+	// Revision is the sequence of the value in the bucket's stream, so a value put after the check is never erased
+	err = kv.js.SecureDeleteMsg(fmt.Sprintf("KV_%s", kv.kv.Bucket()), lastRevision)
+	if errors.Is(err, nats.ErrMsgNotFound) {
+		return ErrKeyNotFound
+	}
+	return err
+}
+
+type natsKeyWatcher struct {
+	w       nats.KeyWatcher
+	updates chan KeyValueEntry
+}
+
+func (kw *natsKeyWatcher) Updates() <-chan KeyValueEntry {
+	return kw.updates
+}
+
+func (kw *natsKeyWatcher) Stop() error {
+	err := kw.w.Stop()
+	if errors.Is(err, nats.ErrConnectionClosed) { // Watcher is already stopped together with the connection
+		err = nil
+	}
+	// Releasing the relay routine which may be blocked on an update nobody is going to read anymore
+	go func() {
+		for range kw.updates {
+		}
+	}()
+	return err
+}
@@ -0,0 +1,84 @@
+// Copyright 2023 NJWS Inc.
+
+package backend
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/foliagecp/sdk/embedded/nats/server"
+)
+
+func newTestNats(t *testing.T) *Nats {
+	t.Helper()
+	s, err := server.Start(server.NewConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Shutdown)
+	nc, err := s.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(nc.Close)
+	b, err := NewNatsFromConn(nc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestNatsStreamMsgs(t *testing.T) {
+	b := newTestNats(t)
+	if _, err := b.StreamMsgs("stream", 1, 10); !errors.Is(err, ErrStreamNotFound) {
+		t.Fatalf("reading a missing stream returned %v", err)
+	}
+	if err := b.EnsureStream(StreamConfig{Name: "stream", Subjects: []string{"subject.*"}}); err != nil {
+		t.Fatal(err)
+	}
+	if msgs, err := b.StreamMsgs("stream", 1, 10); err != nil || len(msgs) != 0 {
+		t.Fatalf("empty stream returned %v, %v", msgs, err)
+	}
+	for i := 1; i <= 5; i++ {
+		if err := b.StreamPublish(fmt.Sprintf("subject.%d", i), []byte(fmt.Sprint(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := b.DeleteStreamMsg("stream", 3); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		fromSeq uint64
+		limit   int
+		want    []uint64
+	}{
+		{fromSeq: 0, limit: 10, want: []uint64{1, 2, 4, 5}},
+		{fromSeq: 2, limit: 2, want: []uint64{2, 4}},
+		{fromSeq: 3, limit: 10, want: []uint64{4, 5}},
+		{fromSeq: 6, limit: 10, want: []uint64{}},
+		{fromSeq: 1, limit: 0, want: []uint64{}},
+	}
+	for _, test := range tests {
+		msgs, err := b.StreamMsgs("stream", test.fromSeq, test.limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := make([]uint64, 0, len(msgs))
+		for _, msg := range msgs {
+			if string(msg.Data) != fmt.Sprint(msg.Sequence) || msg.Subject != fmt.Sprintf("subject.%d", msg.Sequence) {
+				t.Fatalf("message #%d is %s on %s", msg.Sequence, msg.Data, msg.Subject)
+			}
+			got = append(got, msg.Sequence)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(test.want) {
+			t.Fatalf("messages from #%d limited by %d are %v, want %v", test.fromSeq, test.limit, got, test.want)
+		}
+	}
+
+	// Consumers reading the stream are removed
+	for name := range b.js.ConsumerNames("stream") {
+		t.Fatalf("consumer %s is left", name)
+	}
+}
@@ -20,11 +20,12 @@ import (
 
 	"github.com/foliagecp/easyjson"
 
-	customNatsKv "github.com/foliagecp/sdk/embedded/nats/kv"
+	"github.com/foliagecp/sdk/statefun/backend"
 	"github.com/foliagecp/sdk/statefun/system"
-	"github.com/nats-io/nats.go"
 )
 
+const LazyWriterStallTimeoutSec = 60 // kvLazyWriter not completing a pass for longer is considered stuck
+
 var (
 	keyValidationRegexp *regexp.Regexp = regexp.MustCompile(`^[a-zA-Z0-9=_-][a-zA-Z0-9=._-]+[a-zA-Z0-9=_-]$|^[a-zA-Z0-9=_-]*$`)
 )
@@ -130,6 +131,12 @@ func (csv *StoreValue) StoreChild(key interface{}, child *StoreValue, safe bool)
 
 func (csv *StoreValue) Put(value interface{}, updateInKV bool, customPutTime int64) {
 	csv.Lock("Put")
+	csv.put(value, updateInKV, customPutTime)
+	csv.Unlock("Put")
+}
+
+// Must be called with csv locked
+func (csv *StoreValue) put(value interface{}, updateInKV bool, customPutTime int64) {
 	key := csv.keyInParent
 
 	csv.value = value
@@ -148,8 +155,6 @@ func (csv *StoreValue) Put(value interface{}, updateInKV bool, customPutTime int
 			return true
 		})
 	}
-
-	csv.Unlock("Put")
 }
 
 func (csv *StoreValue) collectGarbage() {
@@ -262,8 +267,7 @@ type Transaction struct {
 
 type Store struct {
 	cacheConfig *Config
-	js          nats.JetStreamContext
-	kv          nats.KeyValue
+	kv          backend.KeyValue
 	ctx         context.Context
 	cancel      context.CancelFunc
 
@@ -274,14 +278,20 @@ type Store struct {
 	transactions                sync.Map
 	transactionsMutex           *sync.Mutex
 	getKeysByPatternFromKVMutex *sync.Mutex
+
+	lazyWriterPasses uint64          // Counter of completed kvLazyWriter passes through the whole store
+	kvKeyMutex       system.KeyMutex // Store key -> lock of writing the value into the KV store, see SetValueIfRevision
+
+	kvWatchActive               atomic.Bool
+	lazyWriterPassTime          atomic.Int64 // Time the last kvLazyWriter pass was completed at
+	lazyWriterOldestFailedWrite atomic.Int64 // Update time of the oldest value the last kvLazyWriter pass failed to write, 0 - none failed
 }
 
-func NewCacheStore(ctx context.Context, cacheConfig *Config, js nats.JetStreamContext, kv nats.KeyValue) *Store {
+func NewCacheStore(ctx context.Context, cacheConfig *Config, kv backend.KeyValue) *Store {
 	var inited atomic.Bool
 	initChan := make(chan bool)
 	cs := Store{
 		cacheConfig: cacheConfig,
-		js:          js,
 		kv:          kv,
 		rootValue: &StoreValue{
 			parent:                         nil,
@@ -298,21 +308,33 @@ func NewCacheStore(ctx context.Context, cacheConfig *Config, js nats.JetStreamCo
 		valuesInCache:               0,
 		transactionsMutex:           &sync.Mutex{},
 		getKeysByPatternFromKVMutex: &sync.Mutex{},
+		kvKeyMutex:                  system.NewKeyMutex(),
 	}
 
 	cs.ctx, cs.cancel = context.WithCancel(ctx)
+	cs.lazyWriterPassTime.Store(system.GetCurrentTimeNs())
 
 	storeUpdatesHandler := func(cs *Store) {
 		system.GlobalPrometrics.GetRoutinesCounter().Started("cache.storeUpdatesHandler")
 		defer system.GlobalPrometrics.GetRoutinesCounter().Stopped("cache.storeUpdatesHandler")
-		if w, err := kv.Watch(cacheConfig.kvStorePrefix+".>", nats.IgnoreDeletes()); err == nil {
+		defer func() { // Store must not wait for the initial values which will never come
+			if inited.CompareAndSwap(false, true) {
+				close(initChan)
+			}
+		}()
+		if w, err := kv.Watch(cacheConfig.kvStorePrefix + ".>"); err == nil {
+			cs.kvWatchActive.Store(true)
+			defer cs.kvWatchActive.Store(false)
 			activeKVSync := true
 			for activeKVSync {
 				select {
 				case <-cs.ctx.Done():
 					activeKVSync = false
-				case entry := <-w.Updates():
-					if entry != nil {
+				case entry, ok := <-w.Updates():
+					if !ok {
+						lg.Logf(lg.ErrorLevel, "storeUpdatesHandler: KV watcher was closed, cache store stops receiving KV updates\n")
+						activeKVSync = false
+					} else if entry != nil {
 						key := cs.fromStoreKey(entry.Key())
 						valueBytes := entry.Value()
 						if len(valueBytes) >= 9 { // Update or delete signal from KV store
@@ -328,7 +350,7 @@ func NewCacheStore(ctx context.Context, cacheConfig *Config, js nats.JetStreamCo
 									//lg.Logf("---CACHE_KV TF DELETE: %s, %d, %d\n", key, kvRecordTime, appendFlag)
 
 									//system.MsgOnErrorReturn(kv.Delete(entry.Key()))
-									system.MsgOnErrorReturn(customNatsKv.DeleteKeyValueValue(cs.js, cs.kv, entry.Key()))
+									system.MsgOnErrorReturn(cs.kv.Erase(entry.Key()))
 
 									//cs.rootValue.purgeReady
 									//if csv := cs.getLastKeyCacheStoreValue(key); csv != nil {
@@ -338,7 +360,7 @@ func NewCacheStore(ctx context.Context, cacheConfig *Config, js nats.JetStreamCo
 							} else if kvRecordTime == cacheRecordTime { // KV confirmes update
 								if appendFlag == 0 {
 									//system.MsgOnErrorReturn(kv.Delete(entry.Key()))
-									system.MsgOnErrorReturn(customNatsKv.DeleteKeyValueValue(cs.js, cs.kv, entry.Key()))
+									system.MsgOnErrorReturn(cs.kv.Erase(entry.Key()))
 								}
 								if csv := cs.getLastKeyCacheStoreValue(key); csv != nil {
 									csv.Lock("storeUpdatesHandler")
@@ -380,12 +402,14 @@ func NewCacheStore(ctx context.Context, cacheConfig *Config, js nats.JetStreamCo
 		for {
 			select {
 			case <-cs.ctx.Done():
+				return
 			default:
 				cacheStoreValueStack := []*StoreValue{cs.rootValue}
 				suffixPathsStack := []string{""}
 				depthsStack := []int{0}
 
 				lruTimes := []int64{}
+				var oldestFailedWrite int64
 
 				for len(cacheStoreValueStack) > 0 {
 					lastID := len(cacheStoreValueStack) - 1
@@ -404,6 +428,7 @@ func NewCacheStore(ctx context.Context, cacheConfig *Config, js nats.JetStreamCo
 					depthsStack = depthsStack[:lastID]
 
 					noChildred := true
+					pendingWrites := []pendingKVWrite{}
 					currentStoreValue.Range(func(key, value interface{}) bool {
 						noChildred = false
 
@@ -414,21 +439,19 @@ func NewCacheStore(ctx context.Context, cacheConfig *Config, js nats.JetStreamCo
 							newSuffix = currentSuffix + "." + key.(string)
 						}
 
-						var finalBytes []byte = nil
-
 						csvChild := value.(*StoreValue)
-						var valueUpdateTime int64 = 0
 						csvChild.Lock("kvLazyWriter")
 						if csvChild.syncNeeded {
-							valueUpdateTime = csvChild.valueUpdateTime
-							timeBytes := make([]byte, 8)
-							binary.BigEndian.PutUint64(timeBytes, uint64(csvChild.valueUpdateTime))
+							var valueBytes []byte
 							if csvChild.valueExists {
-								header := append(timeBytes, 1) // Add append flag "1"
-								finalBytes = append(header, csvChild.value.([]byte)...)
-							} else {
-								finalBytes = append(timeBytes, 0) // Add delete flag "0"
+								valueBytes = csvChild.value.([]byte)
 							}
+							pendingWrites = append(pendingWrites, pendingKVWrite{
+								csv:             csvChild,
+								key:             newSuffix,
+								kvValue:         toKVValue(valueBytes, csvChild.valueExists, csvChild.valueUpdateTime),
+								valueUpdateTime: csvChild.valueUpdateTime,
+							})
 						} else {
 							if csvChild.valueUpdateTime > 0 && csvChild.valueUpdateTime <= cs.lruTresholdTime && csvChild.purgeState == 0 { // Older than or equal to specific time
 								// currentStoreValue locked by range no locking/unlocking needed
@@ -441,27 +464,16 @@ func NewCacheStore(ctx context.Context, cacheConfig *Config, js nats.JetStreamCo
 						}
 						csvChild.Unlock("kvLazyWriter")
 
-						// Putting value into KV store ------------------
-						if csvChild.syncNeeded {
-							keyStr := key.(string)
-							_, putErr := kv.Put(cs.toStoreKey(newSuffix), finalBytes)
-							if putErr == nil {
-								csvChild.Lock("kvLazyWriter")
-								if valueUpdateTime == csvChild.valueUpdateTime {
-									csvChild.syncNeeded = false
-								}
-								csvChild.Unlock("kvLazyWriter")
-							} else {
-								lg.Logf(lg.ErrorLevel, "Store kvLazyWriter cannot update key=%s\n: %s", keyStr, putErr)
-							}
-						}
-						// ----------------------------------------------
-
 						cacheStoreValueStack = append(cacheStoreValueStack, value.(*StoreValue))
 						suffixPathsStack = append(suffixPathsStack, newSuffix)
 						depthsStack = append(depthsStack, currentDepth+1)
 						return true
 					})
+					for _, pendingWrite := range pendingWrites { // Written with currentStoreValue unlocked, see kvKeyMutex
+						if !cs.writeToKV(pendingWrite) && (oldestFailedWrite == 0 || pendingWrite.valueUpdateTime < oldestFailedWrite) {
+							oldestFailedWrite = pendingWrite.valueUpdateTime
+						}
+					}
 
 					if noChildred {
 						currentStoreValue.collectGarbage()
@@ -486,6 +498,9 @@ func NewCacheStore(ctx context.Context, cacheConfig *Config, js nats.JetStreamCo
 				// ----------------------------------------------------------------*/
 
 				cs.valuesInCache = len(lruTimes)
+				cs.lazyWriterOldestFailedWrite.Store(oldestFailedWrite)
+				atomic.AddUint64(&cs.lazyWriterPasses, 1)
+				cs.lazyWriterPassTime.Store(system.GetCurrentTimeNs())
 
 				if gaugeVec, err := system.GlobalPrometrics.EnsureGaugeVecSimple("cache_values", "", []string{"id"}); err == nil {
 					gaugeVec.With(prometheus.Labels{"id": cs.cacheConfig.id}).Set(float64(cs.valuesInCache))
@@ -719,10 +734,51 @@ func (cs *Store) SetValue(key string, value []byte, updateInKV bool, customSetTi
 	return true
 }
 
+// Flush blocks until all values that were changed in the cache before the call are written into the KV store.
+// Returns error if ctx is done earlier, the store was destroyed or some of those values failed to be written.
+func (cs *Store) Flush(ctx context.Context) error {
+	flushTime := system.GetCurrentTimeNs()
+	// Current pass may have already walked through the changed values, so waiting for the next full one
+	targetPasses := atomic.LoadUint64(&cs.lazyWriterPasses) + 2
+	for atomic.LoadUint64(&cs.lazyWriterPasses) < targetPasses {
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("cache store flush was interrupted: %w", ctx.Err())
+		case <-cs.ctx.Done():
+			return fmt.Errorf("cache store was destroyed before flush completed")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	if oldestFailedWrite := cs.lazyWriterOldestFailedWrite.Load(); oldestFailedWrite != 0 && oldestFailedWrite <= flushTime {
+		return fmt.Errorf("cache store flush failed: values changed before the flush were not written into the KV store")
+	}
+	return nil
+}
+
 func (cs *Store) Destroy() {
 	cs.cancel()
 }
 
+// CheckKVWatch reports an error if the store does not receive updates from the KV store anymore
+func (cs *Store) CheckKVWatch() error {
+	if !cs.kvWatchActive.Load() {
+		return fmt.Errorf("cache store does not watch the KV store")
+	}
+	return nil
+}
+
+// CheckLazyWriter reports an error if the store has stopped writing changed values into the KV store
+func (cs *Store) CheckLazyWriter() error {
+	if cs.ctx.Err() != nil {
+		return fmt.Errorf("cache store was destroyed")
+	}
+	sinceLastPass := time.Duration(system.GetCurrentTimeNs() - cs.lazyWriterPassTime.Load())
+	if sinceLastPass > LazyWriterStallTimeoutSec*time.Second {
+		return fmt.Errorf("cache store lazy writer has not completed a pass for %s", sinceLastPass.Round(time.Second))
+	}
+	return nil
+}
+
 func (cs *Store) DeleteValue(key string, updateInKV bool, customDeleteTime int64, transactionID string) {
 	if customDeleteTime < 0 {
 		customDeleteTime = system.GetCurrentTimeNs()
@@ -755,7 +811,7 @@ func (cs *Store) GetKeysByPattern(pattern string) []string {
 	appendKeysFromKV := func() {
 		cs.getKeysByPatternFromKVMutex.Lock()
 		//lg.Logln("!!! GetKeysByPattern started appendKeysFromKV")
-		if w, err := cs.kv.Watch(cs.toStoreKey(pattern), nats.IgnoreDeletes()); err == nil {
+		if w, err := cs.kv.Watch(cs.toStoreKey(pattern)); err == nil {
 			for entry := range w.Updates() {
 				if entry != nil && len(entry.Value()) >= 9 {
 					keys[cs.fromStoreKey(entry.Key())] = true
@@ -763,6 +819,7 @@ func (cs *Store) GetKeysByPattern(pattern string) []string {
 					break
 				}
 			}
+			system.MsgOnErrorReturn(w.Stop())
 		} else {
 			lg.Logf(lg.ErrorLevel, "GetKeysByPattern kv.Watch error %s\n", err)
 		}
@@ -968,6 +1025,50 @@ func (cs *Store) getLastKeyCacheStoreValue(key string) *StoreValue {
 	return currentStoreLevel
 }
 
+// Value changed in the cache which is to be put into the KV store by kvLazyWriter
+type pendingKVWrite struct {
+	csv             *StoreValue
+	key             string
+	kvValue         []byte
+	valueUpdateTime int64
+}
+
+// Puts the changed value into the KV store unless it was changed again or written through by SetValueIfRevision meanwhile,
+// returns false if the value is still to be written
+func (cs *Store) writeToKV(w pendingKVWrite) bool {
+	storeKey := cs.toStoreKey(w.key)
+	cs.kvKeyMutex.Lock(storeKey)
+	defer cs.kvKeyMutex.Unlock(storeKey)
+
+	w.csv.Lock("kvLazyWriter")
+	writeNeeded := w.csv.syncNeeded && w.csv.valueUpdateTime == w.valueUpdateTime
+	w.csv.Unlock("kvLazyWriter")
+	if !writeNeeded {
+		return true
+	}
+	if _, err := cs.kv.Put(storeKey, w.kvValue); err != nil {
+		lg.Logf(lg.ErrorLevel, "Store kvLazyWriter cannot update key=%s: %s\n", w.key, err)
+		return false
+	}
+	w.csv.Lock("kvLazyWriter")
+	if w.valueUpdateTime == w.csv.valueUpdateTime {
+		w.csv.syncNeeded = false
+	}
+	w.csv.Unlock("kvLazyWriter")
+	return true
+}
+
+// Value as it is stored in the KV store: 8 bytes of the update time, append flag "1" or delete flag "0", the value itself
+func toKVValue(value []byte, exists bool, updateTime int64) []byte {
+	kvValue := make([]byte, 9, 9+len(value))
+	binary.BigEndian.PutUint64(kvValue, uint64(updateTime))
+	if exists {
+		kvValue[8] = 1
+		kvValue = append(kvValue, value...)
+	}
+	return kvValue
+}
+
 func (cs *Store) toStoreKey(key string) string {
 	return cs.cacheConfig.kvStorePrefix + "." + key
 }
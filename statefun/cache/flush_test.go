@@ -0,0 +1,54 @@
+// Copyright 2023 NJWS Inc.
+
+package cache
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/foliagecp/sdk/statefun/backend"
+)
+
+// KV store which fails to put values while failing is set
+type failingPutKV struct {
+	backend.KeyValue
+	failing atomic.Bool
+}
+
+func (kv *failingPutKV) Put(key string, value []byte) (uint64, error) {
+	if kv.failing.Load() {
+		return 0, errors.New("cannot put")
+	}
+	return kv.KeyValue.Put(key, value)
+}
+
+func TestFlush(t *testing.T) {
+	kv := &failingPutKV{KeyValue: newTestKV(t)}
+	cs := newTestStore(t, kv, "a")
+	flush := func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		return cs.Flush(ctx)
+	}
+
+	kv.failing.Store(true)
+	cs.SetValue("k", []byte("1"), true, -1, "")
+	if err := flush(); err == nil {
+		t.Fatal("flush succeeded while the value was not written")
+	}
+
+	kv.failing.Store(false)
+	if err := flush(); err != nil {
+		t.Fatal(err)
+	}
+	entry, err := kv.Get(cs.toStoreKey("k"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value := string(entry.Value()[9:]); value != "1" {
+		t.Fatalf("flushed value is %q, want %q", value, "1")
+	}
+}
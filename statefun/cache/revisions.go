@@ -0,0 +1,192 @@
+// Copyright 2023 NJWS Inc.
+
+package cache
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/foliagecp/sdk/statefun/backend"
+	"github.com/foliagecp/sdk/statefun/system"
+)
+
+/*
+Revision of a value is the time of its last update, 0 for a value which does not exist. Setting a value with the revision it was read with
+fails if the value was changed meanwhile, which makes read-modify-write operations safe without locks. A value updated in KV is written
+through at once on condition that its revision in the KV store has not changed since it was checked, so changes made by other stores
+(runtimes) are detected even before they arrive from the KV store. Values set via SetValue are still written lazily by the last writer.
+*/
+
+var ErrRevisionConflict = errors.New("cache: value was changed since it was read")
+
+// GetValueWithRevision returns the value with its revision, nil and revision 0 if the value does not exist
+func (cs *Store) GetValueWithRevision(key string) ([]byte, int64, error) {
+	_, getErr := cs.GetValue(key) // Loads the value into the cache on cache miss
+	if keyLastToken, parentCacheStoreValue := cs.getLastKeyTokenAndItsParentCacheStoreValue(key, false); len(keyLastToken) > 0 && parentCacheStoreValue != nil {
+		if csv, ok := parentCacheStoreValue.LoadChild(keyLastToken, true); ok {
+			csv.Lock("GetValueWithRevision")
+			defer csv.Unlock("GetValueWithRevision")
+			if csv.valueExists {
+				value, _ := csv.value.([]byte)
+				return value, csv.valueUpdateTime, nil
+			}
+			return nil, 0, nil
+		}
+	}
+	if getErr != nil && !errors.Is(getErr, backend.ErrKeyNotFound) {
+		return nil, 0, getErr
+	}
+	return nil, 0, nil
+}
+
+// SetValueIfRevision sets the value only if its current revision equals the given one, returns the new revision.
+// Fails with ErrRevisionConflict otherwise.
+func (cs *Store) SetValueIfRevision(key string, value []byte, updateInKV bool, revision int64) (int64, error) {
+	if !keyValidationRegexp.MatchString(key) {
+		return 0, fmt.Errorf("key=%s is invalid", key)
+	}
+	if updateInKV {
+		return cs.setValueInKVIfRevision(key, value, revision)
+	}
+	if _, _, err := cs.GetValueWithRevision(key); err != nil { // Current revision must be known even if the value was purged from the cache
+		return 0, err
+	}
+
+	keyLastToken, parentCacheStoreValue := cs.getLastKeyTokenAndItsParentCacheStoreValue(key, true)
+	if len(keyLastToken) == 0 || parentCacheStoreValue == nil {
+		return 0, fmt.Errorf("key=%s is invalid", key)
+	}
+	parentCacheStoreValue.Lock("SetValueIfRevision parent")
+	defer parentCacheStoreValue.Unlock("SetValueIfRevision parent")
+
+	now := system.GetCurrentTimeNs()
+	csv, ok := parentCacheStoreValue.LoadChild(keyLastToken, false)
+	if !ok {
+		if revision != 0 {
+			return 0, fmt.Errorf("%w: key=%s does not exist anymore", ErrRevisionConflict, key)
+		}
+		csvUpdate := &StoreValue{value: value, store: make(map[interface{}]*StoreValue), storeConsistencyWithKVLossTime: 0, valueExists: true, purgeState: 0, syncNeeded: updateInKV, syncedWithKV: !updateInKV, valueUpdateTime: now}
+		parentCacheStoreValue.StoreChild(keyLastToken, csvUpdate, false)
+		return now, nil
+	}
+
+	csv.Lock("SetValueIfRevision")
+	defer csv.Unlock("SetValueIfRevision")
+	var current int64
+	if csv.valueExists {
+		current = csv.valueUpdateTime
+	}
+	if current != revision {
+		return 0, fmt.Errorf("%w: key=%s has revision %d, expected %d", ErrRevisionConflict, key, current, revision)
+	}
+	newRevision := now
+	if newRevision <= csv.valueUpdateTime { // Revisions must differ even for updates within the same nanosecond
+		newRevision = csv.valueUpdateTime + 1
+	}
+	csv.put(value, updateInKV, newRevision)
+	return newRevision, nil
+}
+
+func (cs *Store) setValueInKVIfRevision(key string, value []byte, revision int64) (int64, error) {
+	storeKey := cs.toStoreKey(key)
+	cs.kvKeyMutex.Lock(storeKey)
+	defer cs.kvKeyMutex.Unlock(storeKey)
+
+	current, updateTime, err := cs.cachedRevision(key)
+	if err != nil {
+		return 0, err
+	}
+	var kvRevision uint64
+	entry, err := cs.kv.Get(storeKey)
+	switch {
+	case err == nil:
+		kvRevision = entry.Revision()
+		if kvValue := entry.Value(); len(kvValue) >= 9 {
+			if kvRecordTime := int64(binary.BigEndian.Uint64(kvValue[:8])); kvRecordTime > updateTime { // Changed by other store, not arrived yet
+				updateTime = kvRecordTime
+				current = 0
+				if kvValue[8] == 1 {
+					current = kvRecordTime
+					cs.SetValue(key, kvValue[9:], false, kvRecordTime, "") // Next read gets it without waiting for the KV watch
+				}
+			}
+		}
+	case !errors.Is(err, backend.ErrKeyNotFound):
+		return 0, err
+	}
+	if current != revision {
+		return 0, fmt.Errorf("%w: key=%s has revision %d, expected %d", ErrRevisionConflict, key, current, revision)
+	}
+
+	newRevision := system.GetCurrentTimeNs()
+	if newRevision <= updateTime { // Revisions must differ even for updates within the same nanosecond
+		newRevision = updateTime + 1
+	}
+	if _, err := cs.kv.Update(storeKey, toKVValue(value, true, newRevision), kvRevision); err != nil {
+		if errors.Is(err, backend.ErrWrongLastRevision) {
+			return 0, fmt.Errorf("%w: key=%s was changed in the KV store", ErrRevisionConflict, key)
+		}
+		return 0, err
+	}
+
+	keyLastToken, parentCacheStoreValue := cs.getLastKeyTokenAndItsParentCacheStoreValue(key, true)
+	if len(keyLastToken) == 0 || parentCacheStoreValue == nil {
+		return 0, fmt.Errorf("key=%s is invalid", key)
+	}
+	parentCacheStoreValue.Lock("setValueInKVIfRevision parent")
+	defer parentCacheStoreValue.Unlock("setValueInKVIfRevision parent")
+	if csv, ok := parentCacheStoreValue.LoadChild(keyLastToken, false); ok {
+		csv.Lock("setValueInKVIfRevision")
+		if csv.valueUpdateTime < newRevision { // Otherwise was set again meanwhile
+			csv.put(value, false, newRevision)
+		}
+		csv.Unlock("setValueInKVIfRevision")
+	} else {
+		csvUpdate := &StoreValue{value: value, store: make(map[interface{}]*StoreValue), storeConsistencyWithKVLossTime: 0, valueExists: true, purgeState: 0, syncNeeded: false, syncedWithKV: true, valueUpdateTime: newRevision}
+		parentCacheStoreValue.StoreChild(keyLastToken, csvUpdate, false)
+	}
+	return newRevision, nil
+}
+
+// Returns the revision of the value in the cache and the time of its last change, which differs from the revision for a deleted value
+func (cs *Store) cachedRevision(key string) (revision int64, updateTime int64, err error) {
+	if _, _, err := cs.GetValueWithRevision(key); err != nil { // Loads the value into the cache on cache miss
+		return 0, 0, err
+	}
+	if keyLastToken, parentCacheStoreValue := cs.getLastKeyTokenAndItsParentCacheStoreValue(key, false); len(keyLastToken) > 0 && parentCacheStoreValue != nil {
+		if csv, ok := parentCacheStoreValue.LoadChild(keyLastToken, true); ok {
+			csv.Lock("cachedRevision")
+			defer csv.Unlock("cachedRevision")
+			if csv.valueExists {
+				return csv.valueUpdateTime, csv.valueUpdateTime, nil
+			}
+			return 0, csv.valueUpdateTime, nil
+		}
+	}
+	return 0, 0, nil
+}
+
+// UpdateValue does a read-modify-write of the value: modify gets the current value, nil if it does not exist, and returns the new one.
+// If the value was changed meanwhile modify is called again with the fresh value, up to attempts times in total.
+func (cs *Store) UpdateValue(key string, attempts int, updateInKV bool, modify func(value []byte) ([]byte, error)) (int64, error) {
+	var err error
+	for attempt := 0; attempt < attempts; attempt++ {
+		value, revision, getErr := cs.GetValueWithRevision(key)
+		if getErr != nil {
+			return 0, getErr
+		}
+		newValue, modifyErr := modify(value)
+		if modifyErr != nil {
+			return 0, modifyErr
+		}
+		var newRevision int64
+		if newRevision, err = cs.SetValueIfRevision(key, newValue, updateInKV, revision); err == nil {
+			return newRevision, nil
+		}
+		if !errors.Is(err, ErrRevisionConflict) {
+			return 0, err
+		}
+	}
+	return 0, fmt.Errorf("cannot update key=%s in %d attempts: %w", key, attempts, err)
+}
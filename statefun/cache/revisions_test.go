@@ -0,0 +1,103 @@
+// Copyright 2023 NJWS Inc.
+
+package cache
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/foliagecp/sdk/statefun/backend"
+)
+
+func newTestStore(t *testing.T, kv backend.KeyValue, id string) *Store {
+	cs := NewCacheStore(context.Background(), NewCacheConfig(id), kv)
+	t.Cleanup(cs.Destroy)
+	return cs
+}
+
+func newTestKV(t *testing.T) backend.KeyValue {
+	kv, err := backend.NewInMemory().KeyValue("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return kv
+}
+
+func TestSetValueIfRevision(t *testing.T) {
+	cs := newTestStore(t, newTestKV(t), "a")
+
+	revision, err := cs.SetValueIfRevision("k", []byte("1"), true, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cs.SetValueIfRevision("k", []byte("2"), true, 0); !errors.Is(err, ErrRevisionConflict) {
+		t.Fatalf("value was created twice: %v", err)
+	}
+	value, current, err := cs.GetValueWithRevision("k")
+	if err != nil || current != revision || string(value) != "1" {
+		t.Fatalf("got %q with revision %d: %v, want %q with revision %d", value, current, err, "1", revision)
+	}
+	if _, err := cs.SetValueIfRevision("k", []byte("2"), true, revision); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cs.SetValueIfRevision("k", []byte("3"), true, revision); !errors.Is(err, ErrRevisionConflict) {
+		t.Fatalf("value was set with a stale revision: %v", err)
+	}
+}
+
+func TestSetValueIfRevisionAcrossStores(t *testing.T) {
+	kv := newTestKV(t)
+	cs1 := newTestStore(t, kv, "a")
+	cs2 := newTestStore(t, kv, "b")
+
+	revision, err := cs1.SetValueIfRevision("k", []byte("1"), true, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cs2.SetValueIfRevision("k", []byte("2"), true, 0); !errors.Is(err, ErrRevisionConflict) {
+		t.Fatalf("value created by the other store was overwritten: %v", err)
+	}
+	if _, err := cs2.SetValueIfRevision("k", []byte("2"), true, revision); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cs1.SetValueIfRevision("k", []byte("3"), true, revision); !errors.Is(err, ErrRevisionConflict) {
+		t.Fatalf("value updated by the other store was overwritten: %v", err)
+	}
+}
+
+func TestUpdateValueAcrossStores(t *testing.T) {
+	kv := newTestKV(t)
+	stores := []*Store{newTestStore(t, kv, "a"), newTestStore(t, kv, "b")}
+	const increments = 50
+
+	var wg sync.WaitGroup
+	for _, cs := range stores {
+		cs := cs
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < increments; i++ {
+				_, err := cs.UpdateValue("counter", 1000, true, func(value []byte) ([]byte, error) {
+					n, _ := strconv.Atoi(string(value))
+					return []byte(strconv.Itoa(n + 1)), nil
+				})
+				if err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	entry, err := kv.Get(stores[0].toStoreKey("counter"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := strconv.Atoi(string(entry.Value()[9:])); n != len(stores)*increments {
+		t.Fatalf("counter is %d, want %d", n, len(stores)*increments)
+	}
+}
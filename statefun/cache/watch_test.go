@@ -0,0 +1,85 @@
+// Copyright 2023 NJWS Inc.
+
+package cache
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/foliagecp/sdk/statefun/backend"
+)
+
+// KV store whose watchers can be closed from the outside or cannot be created at all
+type closingWatchKV struct {
+	backend.KeyValue
+	watchErr error
+
+	mutex    sync.Mutex
+	watchers []backend.KeyWatcher
+}
+
+func (kv *closingWatchKV) Watch(keys string) (backend.KeyWatcher, error) {
+	if kv.watchErr != nil {
+		return nil, kv.watchErr
+	}
+	w, err := kv.KeyValue.Watch(keys)
+	if err == nil {
+		kv.mutex.Lock()
+		kv.watchers = append(kv.watchers, w)
+		kv.mutex.Unlock()
+	}
+	return w, err
+}
+
+func (kv *closingWatchKV) closeWatchers() {
+	kv.mutex.Lock()
+	defer kv.mutex.Unlock()
+	for _, w := range kv.watchers {
+		if err := w.Stop(); err != nil {
+			panic(err)
+		}
+	}
+}
+
+func newTestStoreInTime(t *testing.T, kv backend.KeyValue) *Store {
+	t.Helper()
+	created := make(chan *Store, 1)
+	go func() {
+		created <- NewCacheStore(context.Background(), NewCacheConfig("a"), kv)
+	}()
+	select {
+	case cs := <-created:
+		t.Cleanup(cs.Destroy)
+		return cs
+	case <-time.After(5 * time.Second):
+		t.Fatal("cache store was not created in time")
+	}
+	return nil
+}
+
+func TestClosedKVWatch(t *testing.T) {
+	kv := &closingWatchKV{KeyValue: newTestKV(t)}
+	cs := newTestStoreInTime(t, kv)
+	if err := cs.CheckKVWatch(); err != nil {
+		t.Fatal(err)
+	}
+
+	kv.closeWatchers()
+	deadline := time.Now().Add(5 * time.Second)
+	for cs.CheckKVWatch() == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("closed KV watch is reported as active")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestFailedKVWatch(t *testing.T) {
+	cs := newTestStoreInTime(t, &closingWatchKV{KeyValue: newTestKV(t), watchErr: errors.New("cannot watch")})
+	if err := cs.CheckKVWatch(); err == nil {
+		t.Fatal("failed KV watch is reported as active")
+	}
+}
@@ -0,0 +1,226 @@
+// Copyright 2023 NJWS Inc.
+
+package statefun
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/foliagecp/easyjson"
+	"github.com/foliagecp/sdk/statefun/cache"
+	lg "github.com/foliagecp/sdk/statefun/logger"
+	"github.com/foliagecp/sdk/statefun/system"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+/*
+Function contexts of a function type with a context schema carry their schema version under ContextVersionKey,
+contexts stored without it are of version 0. A context of an older version is upgraded by the migrations on read and stored upgraded,
+handlers never see the version key. Empty contexts are considered up to date.
+A message is not handled while the context cannot be upgraded, and a context written by a newer runtime keeps its version when
+an older runtime stores it.
+*/
+
+// ContextVersionKey is the reserved key of a versioned function context which holds the context's schema version
+const ContextVersionKey = "__context_version"
+
+const ContextVersionsCensusIntervalSec = 60
+
+// ContextMigration upgrades a function context of the previous schema version to the next one
+type ContextMigration func(context *easyjson.JSON) (*easyjson.JSON, error)
+
+type contextSchema struct {
+	version    int
+	migrations []ContextMigration // The last one upgrades to version
+}
+
+func (cs *contextSchema) oldestMigratableVersion() int {
+	return cs.version - len(cs.migrations)
+}
+
+func getContextVersion(context *easyjson.JSON) (int, bool) {
+	if !context.IsNonEmptyObject() {
+		return 0, false
+	}
+	version, ok := context.GetByPath(ContextVersionKey).AsNumeric()
+	if !ok {
+		return 0, true
+	}
+	return int(version), true
+}
+
+// Upgrades the context to the current schema version and strips the version key, returns true if the context was upgraded
+func (ft *FunctionType) migrateContext(context *easyjson.JSON) (*easyjson.JSON, bool, error) {
+	schema := ft.config.contextSchema
+	version, versioned := getContextVersion(context)
+	if !versioned {
+		return context, false, nil
+	}
+	migrated := context.Clone()
+	migrated.RemoveByPath(ContextVersionKey)
+	if version >= schema.version { // Newer versions are written by the newer runtimes and are left as they are
+		return &migrated, false, nil
+	}
+	if version < schema.oldestMigratableVersion() {
+		ft.countContextMigration(version, "failed")
+		return &migrated, false, fmt.Errorf("function type %s has no migration for context version %d, oldest migratable version is %d", ft.name, version, schema.oldestMigratableVersion())
+	}
+
+	result := &migrated
+	for v := version; v < schema.version; v++ {
+		next, err := schema.migrations[v-schema.oldestMigratableVersion()](result)
+		if err != nil {
+			ft.countContextMigration(version, "failed")
+			return &migrated, false, fmt.Errorf("function type %s cannot migrate context from version %d to %d: %w", ft.name, v, v+1, err)
+		}
+		if next == nil {
+			next = easyjson.NewJSONObject().GetPtr()
+		}
+		result = next
+	}
+	ft.countContextMigration(version, "migrated")
+	return result, true, nil
+}
+
+// Marks the context with the schema version, contexts which are not json objects cannot be marked
+func (ft *FunctionType) stampContext(context *easyjson.JSON, version int) *easyjson.JSON {
+	if ft.config.contextSchema == nil || context == nil || !context.IsObject() {
+		return context
+	}
+	stamped := context.Clone()
+	stamped.SetByPath(ContextVersionKey, easyjson.NewJSON(version))
+	return &stamped
+}
+
+// Version a context is stored with in place of the stored one: the current version or the newer one of the stored context.
+// Fails if the stored context is of an older version, i.e. it was not upgraded.
+func (ft *FunctionType) contextVersionToStore(stored *easyjson.JSON) (int, error) {
+	current := ft.config.contextSchema.version
+	version, versioned := getContextVersion(stored)
+	if !versioned || version == current {
+		return current, nil
+	}
+	if version > current {
+		return version, nil
+	}
+	return 0, fmt.Errorf("function type %s cannot overwrite context of version %d which was not upgraded to %d", ft.name, version, current)
+}
+
+func (ft *FunctionType) getFunctionContext(id string) *easyjson.JSON {
+	context, _ := ft.getFunctionContextWithRevision(id)
+	return context
+}
+
+func (ft *FunctionType) setFunctionContext(id string, context *easyjson.JSON) {
+	keyValueID := ft.name + "." + id
+	if ft.config.contextSchema == nil {
+		ft.setContext(keyValueID, context)
+		return
+	}
+	version, err := ft.contextVersionToStore(ft.getContext(keyValueID))
+	if err != nil {
+		lg.Logf(lg.ErrorLevel, "Context of %s is not stored: %s\n", keyValueID, err)
+		return
+	}
+	ft.setContext(keyValueID, ft.stampContext(context, version))
+}
+
+func (ft *FunctionType) getFunctionContextWithRevision(id string) (*easyjson.JSON, int64) {
+	context, revision, err := ft.migrateFunctionContext(id)
+	if err != nil {
+		lg.Logf(lg.ErrorLevel, "Context of %s.%s: %s\n", ft.name, id, err)
+	}
+	return context, revision
+}
+
+// Upgraded context is stored only if it was not changed meanwhile, the revision of the stored one is returned.
+// Context which cannot be upgraded is returned as it is along with the error.
+func (ft *FunctionType) migrateFunctionContext(id string) (*easyjson.JSON, int64, error) {
+	keyValueID := ft.name + "." + id
+	context, revision := ft.getContextWithRevision(keyValueID)
+	if ft.config.contextSchema == nil {
+		return context, revision, nil
+	}
+	migrated, upgraded, err := ft.migrateContext(context)
+	if err != nil {
+		return migrated, revision, err
+	}
+	if upgraded {
+		newRevision, err := ft.setContextIfRevision(keyValueID, ft.stampContext(migrated, ft.config.contextSchema.version), revision)
+		if err == nil {
+			return migrated, newRevision, nil
+		}
+		if !errors.Is(err, cache.ErrRevisionConflict) {
+			lg.Logf(lg.ErrorLevel, "Cannot store upgraded context of %s: %s\n", keyValueID, err)
+		}
+	}
+	return migrated, revision, nil
+}
+
+// Upgrades the function context before the handler is called, so the handler never gets a context it does not know the shape of
+func (ft *FunctionType) prepareFunctionContext(id string) error {
+	if ft.config.contextSchema == nil {
+		return nil
+	}
+	_, _, err := ft.migrateFunctionContext(id)
+	return err
+}
+
+func (ft *FunctionType) setFunctionContextIfRevision(id string, context *easyjson.JSON, revision int64) (int64, error) {
+	keyValueID := ft.name + "." + id
+	if ft.config.contextSchema == nil {
+		return ft.setContextIfRevision(keyValueID, context, revision)
+	}
+	version, err := ft.contextVersionToStore(ft.getContext(keyValueID))
+	if err != nil {
+		return 0, err
+	}
+	return ft.setContextIfRevision(keyValueID, ft.stampContext(context, version), revision)
+}
+
+func (ft *FunctionType) updateFunctionContext(id string, modify func(context *easyjson.JSON) error) error {
+	if ft.config.contextSchema == nil {
+		return ft.updateContext(ft.name+"."+id, modify)
+	}
+	return ft.updateContext(ft.name+"."+id, func(context *easyjson.JSON) error {
+		migrated, upgraded, err := ft.migrateContext(context)
+		if err != nil {
+			return err
+		}
+		version := ft.config.contextSchema.version
+		if !upgraded {
+			if version, err = ft.contextVersionToStore(context); err != nil {
+				return err
+			}
+		}
+		if err := modify(migrated); err != nil {
+			return err
+		}
+		*context = *ft.stampContext(migrated, version)
+		return nil
+	})
+}
+
+func (ft *FunctionType) countContextMigration(fromVersion int, result string) {
+	if counterVec, err := system.GlobalPrometrics.EnsureCounterVecSimple("statefun_context_migrations", "Function context schema migrations", []string{"typename", "from_version", "result"}); err == nil {
+		counterVec.With(prometheus.Labels{"typename": ft.name, "from_version": strconv.Itoa(fromVersion), "result": result}).Inc()
+	}
+}
+
+// Counts the stored contexts which are still of older schema versions
+func (ft *FunctionType) censusContextVersions() {
+	old := 0
+	for _, key := range ft.runtime.cacheStore.GetKeysByPattern(ft.name + ".*") {
+		context, err := ft.runtime.cacheStore.GetValueAsJSON(key)
+		if err != nil {
+			continue
+		}
+		if version, versioned := getContextVersion(context); versioned && version < ft.config.contextSchema.version {
+			old++
+		}
+	}
+	if gaugeVec, err := system.GlobalPrometrics.EnsureGaugeVecSimple("statefun_contexts_on_old_version", "Function contexts stored with older schema versions", []string{"typename"}); err == nil {
+		gaugeVec.With(prometheus.Labels{"typename": ft.name}).Set(float64(old))
+	}
+}
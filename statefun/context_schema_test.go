@@ -0,0 +1,123 @@
+// Copyright 2023 NJWS Inc.
+
+package statefun
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/foliagecp/easyjson"
+
+	"github.com/foliagecp/sdk/statefun/backend"
+	sfPlugins "github.com/foliagecp/sdk/statefun/plugins"
+)
+
+// Records the context the handler got and increments its counter
+func contextSchemaTestHandler(calls *testCalls) FunctionLogicHandler {
+	return func(_ sfPlugins.StatefunExecutor, contextProcessor *sfPlugins.StatefunContextProcessor) {
+		functionContext := contextProcessor.GetFunctionContext()
+		calls.calls <- functionContext.Clone().GetPtr()
+		functionContext.SetByPath("counter", easyjson.NewJSON(functionContext.GetByPath("counter").AsNumericDefault(0)+1))
+		contextProcessor.SetFunctionContext(functionContext)
+	}
+}
+
+func storeTestContext(ft *FunctionType, id string, context string) {
+	j, _ := easyjson.JSONFromBytes([]byte(context))
+	ft.setContext(ft.name+"."+id, &j)
+}
+
+func storedTestContext(ft *FunctionType, id string) *easyjson.JSON {
+	return ft.getContext(ft.name + "." + id)
+}
+
+func TestContextMigration(t *testing.T) {
+	calls := newTestCalls()
+	rename := func(context *easyjson.JSON) (*easyjson.JSON, error) {
+		context.SetByPath("counter", context.GetByPath("count"))
+		context.RemoveByPath("count")
+		return context, nil
+	}
+	r := newTestRuntime(t, newTestRuntimeConfig(backend.NewInMemory()))
+	ft := NewFunctionType(r.Runtime, "test.versioned", contextSchemaTestHandler(calls), *NewFunctionTypeConfig().SetContextSchema(2, rename))
+	startTestRuntime(t, r)
+	storeTestContext(ft, "a", `{"__context_version": 1, "count": 5}`)
+
+	if err := r.Signal(sfPlugins.GolangLocalSignal, "test.versioned", "a", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if context := calls.wait(t); context.ToString() != `{"counter":5}` {
+		t.Fatalf("handler got context %s", context.ToString())
+	}
+	waitFor(t, "upgraded context to be stored", func() bool {
+		stored := storedTestContext(ft, "a")
+		return stored.GetByPath(ContextVersionKey).AsNumericDefault(0) == 2 && stored.GetByPath("counter").AsNumericDefault(0) == 6
+	})
+}
+
+func TestContextMigrationFailure(t *testing.T) {
+	calls := newTestCalls()
+	failing := func(context *easyjson.JSON) (*easyjson.JSON, error) {
+		return nil, errors.New("cannot migrate")
+	}
+	r := newTestRuntime(t, newTestRuntimeConfig(backend.NewInMemory()))
+	ft := NewFunctionType(r.Runtime, "test.versioned", contextSchemaTestHandler(calls), *NewFunctionTypeConfig().SetContextSchema(2, failing))
+	startTestRuntime(t, r)
+
+	for _, context := range []string{
+		`{"__context_version": 1, "count": 5}`, // Migration fails
+		`{"__context_version": 0, "count": 5}`, // No migration
+	} {
+		storeTestContext(ft, "a", context)
+		reply, err := r.Request(sfPlugins.GolangLocalRequest, "test.versioned", "a", nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reply.GetByPath(ReplyErrorKey).AsStringDefault("") != "failed" {
+			t.Fatalf("message was handled with context %s, replied with %s", context, reply.ToString())
+		}
+		calls.expectNone(t, 100*time.Millisecond)
+		if stored := storedTestContext(ft, "a"); stored.GetByPath("count").AsNumericDefault(0) != 5 || stored.PathExists("counter") {
+			t.Fatalf("context %s was overwritten with %s", context, stored.ToString())
+		}
+	}
+
+	if _, err := ft.setFunctionContextIfRevision("a", easyjson.NewJSONObject().GetPtr(), ft.runtime.cacheStore.GetValueUpdateTime(ft.name+".a")); err == nil {
+		t.Fatal("context which was not upgraded was overwritten")
+	}
+}
+
+func TestContextOfNewerVersionKeepsVersion(t *testing.T) {
+	calls := newTestCalls()
+	r := newTestRuntime(t, newTestRuntimeConfig(backend.NewInMemory()))
+	ft := NewFunctionType(r.Runtime, "test.versioned", contextSchemaTestHandler(calls), *NewFunctionTypeConfig().SetContextSchema(2))
+	startTestRuntime(t, r)
+	storeTestContext(ft, "a", `{"__context_version": 3, "counter": 1}`)
+
+	for i := 2; i <= 3; i++ {
+		if err := r.Signal(sfPlugins.GolangLocalSignal, "test.versioned", "a", nil, nil); err != nil {
+			t.Fatal(err)
+		}
+		if context := calls.wait(t); context.PathExists(ContextVersionKey) {
+			t.Fatalf("handler got context %s with the version key", context.ToString())
+		}
+		waitFor(t, "context to be stored", func() bool {
+			return int(storedTestContext(ft, "a").GetByPath("counter").AsNumericDefault(0)) == i
+		})
+		if version := storedTestContext(ft, "a").GetByPath(ContextVersionKey).AsNumericDefault(0); version != 3 {
+			t.Fatalf("context of version 3 was stored with version %v", version)
+		}
+	}
+
+	err := ft.updateFunctionContext("a", func(context *easyjson.JSON) error {
+		context.SetByPath("counter", easyjson.NewJSON(10))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version := storedTestContext(ft, "a").GetByPath(ContextVersionKey).AsNumericDefault(0); version != 3 {
+		t.Fatalf("updated context of version 3 was stored with version %v", version)
+	}
+}
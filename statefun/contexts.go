@@ -0,0 +1,199 @@
+// Copyright 2023 NJWS Inc.
+
+package statefun
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/foliagecp/sdk/statefun/backend"
+	lg "github.com/foliagecp/sdk/statefun/logger"
+	"github.com/foliagecp/sdk/statefun/system"
+)
+
+const (
+	ContextsKVPrefix         = "statefun_contexts"
+	ContextsSweepIntervalSec = 10
+)
+
+/*
+Function contexts "<typename>.<id>" of a function type with a context TTL are deleted when the id has not been handling messages
+for longer than the TTL. The time of the last access is stored in KV per id when an id handler starts, periodically while it runs
+and when it is garbage collected, so all runtimes see it. The expired contexts are swept periodically by one of the runtimes,
+a context is deleted only if its access time is erased with the revision the sweep has seen, so one touched meanwhile is kept.
+
+Function types with context deletion with object have their contexts deleted together with the object context (e.g. graph vertex body)
+of the same id, such function types are registered in KV so the object may be deleted by any runtime.
+*/
+
+func getContextAccessKey(typename string, id string) string {
+	return fmt.Sprintf("%s.access.%s.%s", ContextsKVPrefix, system.GetHashStr(typename), id)
+}
+
+func getContextsSweptKey(typename string) string {
+	return fmt.Sprintf("%s.swept.%s", ContextsKVPrefix, system.GetHashStr(typename))
+}
+
+func getObjectBoundContextKey(typename string) string {
+	return fmt.Sprintf("%s.object_bound.%s", ContextsKVPrefix, system.GetHashStr(typename))
+}
+
+// Stores the time the function context of the id was accessed at
+func (ft *FunctionType) touchContext(id string, accessTime int64) {
+	if _, err := ft.runtime.kv.Put(getContextAccessKey(ft.name, id), system.Int64ToBytes(accessTime)); err != nil {
+		lg.Logf(lg.ErrorLevel, "Cannot store access time of function %s context with id=%s: %s\n", ft.name, id, err)
+		return
+	}
+	ft.contextTouches.Store(id, accessTime)
+}
+
+// Touches the context of the running id handler if the last stored access time is getting old
+func (ft *FunctionType) touchContextIfOld(id string, accessTime int64) {
+	if v, ok := ft.contextTouches.Load(id); ok && v.(int64)+int64(ft.config.contextTTLSec)*int64(time.Second)/4 > accessTime {
+		return
+	}
+	ft.touchContext(id, accessTime)
+}
+
+func (ft *FunctionType) deleteContext(id string) {
+	deleteCacheValue(ft.runtime, ft.name+"."+id)
+	if err := ft.runtime.kv.Erase(getContextAccessKey(ft.name, id)); err != nil && !errors.Is(err, backend.ErrKeyNotFound) {
+		lg.Logf(lg.WarnLevel, "Cannot erase access time of function %s context with id=%s: %s\n", ft.name, id, err)
+	}
+	ft.contextTouches.Delete(id)
+}
+
+// Deletes the object context of the id and the function contexts of all function types which must be deleted with the object
+func (r *Runtime) deleteObjectContext(id string) {
+	deleteCacheValue(r, id)
+	r.objectBoundTypenames.Range(func(key, _ interface{}) bool {
+		typename := key.(string)
+		deleteCacheValue(r, typename+"."+id)
+		if err := r.kv.Erase(getContextAccessKey(typename, id)); err != nil && !errors.Is(err, backend.ErrKeyNotFound) {
+			lg.Logf(lg.WarnLevel, "Cannot erase access time of function %s context with id=%s: %s\n", typename, id, err)
+		}
+		return true
+	})
+}
+
+// Value may be absent from the cache but present in KV, the cache store deletes only the values it holds
+func deleteCacheValue(r *Runtime, key string) {
+	_, _ = r.cacheStore.GetValue(key)
+	r.cacheStore.DeleteValue(key, true, -1, "")
+}
+
+func (r *Runtime) runContextsKeeper() {
+	system.GlobalPrometrics.GetRoutinesCounter().Started("runtime.contextsKeeper")
+	defer system.GlobalPrometrics.GetRoutinesCounter().Stopped("runtime.contextsKeeper")
+
+	keys := ContextsKVPrefix + ".object_bound.*"
+	w, err := r.kv.Watch(keys)
+	if err != nil {
+		lg.Logf(lg.ErrorLevel, "Contexts keeper cannot watch object bound function types: %s\n", err)
+		return
+	}
+	defer func() {
+		if w != nil { // Nil if the runtime was shut down while watching again
+			system.MsgOnErrorReturn(w.Stop())
+		}
+	}()
+
+	ticker := time.NewTicker(ContextsSweepIntervalSec * time.Second)
+	defer ticker.Stop()
+	censusTicker := time.NewTicker(ContextVersionsCensusIntervalSec * time.Second)
+	defer censusTicker.Stop()
+	for {
+		select {
+		case <-r.ctx.Done():
+			return
+		case entry, ok := <-w.Updates():
+			if !ok {
+				system.MsgOnErrorReturn(w.Stop())
+				if w, ok = r.rewatchKV(keys, "Contexts keeper"); !ok {
+					return
+				}
+				continue
+			}
+			if entry != nil && len(entry.Value()) > 0 {
+				r.objectBoundTypenames.Store(string(entry.Value()), struct{}{})
+			}
+		case <-ticker.C:
+			for _, ft := range r.registeredFunctionTypes {
+				if ft.config.contextTTLSec > 0 {
+					ft.sweepContextsIfDue()
+				}
+			}
+		case <-censusTicker.C:
+			for _, ft := range r.registeredFunctionTypes {
+				if ft.config.contextSchema != nil {
+					ft.censusContextVersions()
+				}
+			}
+		}
+	}
+}
+
+// Sweeps the contexts unless another runtime is sweeping them or has swept them within the sweep interval
+func (ft *FunctionType) sweepContextsIfDue() {
+	r := ft.runtime
+	sweptKey := getContextsSweptKey(ft.name)
+	revID, err := KeyMutexLock(r, sweptKey, true)
+	if err != nil {
+		if err != mutexLockedError {
+			lg.Logf(lg.ErrorLevel, "Cannot lock contexts sweep of function type %s: %s\n", ft.name, err)
+		}
+		return
+	}
+	defer func() { system.MsgOnErrorReturn(KeyMutexUnlock(r, sweptKey, revID)) }()
+
+	if entry, err := r.kv.Get(sweptKey); err == nil && system.BytesToInt64(entry.Value())+ContextsSweepIntervalSec*int64(time.Second) > system.GetCurrentTimeNs() {
+		return
+	}
+	ft.sweepContexts()
+	_, err = r.kv.Put(sweptKey, system.Int64ToBytes(system.GetCurrentTimeNs()))
+	system.MsgOnErrorReturn(err)
+}
+
+func (ft *FunctionType) sweepContexts() {
+	kv := ft.runtime.kv
+	w, err := kv.Watch(fmt.Sprintf("%s.access.%s.*", ContextsKVPrefix, system.GetHashStr(ft.name)))
+	if err != nil {
+		lg.Logf(lg.ErrorLevel, "Cannot sweep contexts of function type %s: %s\n", ft.name, err)
+		return
+	}
+	entries := []backend.KeyValueEntry{}
+	for entry := range w.Updates() {
+		if entry == nil {
+			break
+		}
+		entries = append(entries, entry)
+	}
+	system.MsgOnErrorReturn(w.Stop())
+
+	now := system.GetCurrentTimeNs()
+	swept := 0
+	for _, entry := range entries {
+		if system.BytesToInt64(entry.Value())+int64(ft.config.contextTTLSec)*int64(time.Second) >= now {
+			continue
+		}
+		tokens := strings.Split(entry.Key(), ".")
+		id := tokens[len(tokens)-1]
+		if _, running := ft.idHandlersChannel.Load(id); running {
+			continue
+		}
+		if err := kv.EraseIfRevision(entry.Key(), entry.Revision()); err != nil { // Accessed meanwhile, if not failed
+			if !errors.Is(err, backend.ErrWrongLastRevision) && !errors.Is(err, backend.ErrKeyNotFound) {
+				lg.Logf(lg.WarnLevel, "Cannot erase access time of function %s context with id=%s: %s\n", ft.name, id, err)
+			}
+			continue
+		}
+		deleteCacheValue(ft.runtime, ft.name+"."+id)
+		ft.contextTouches.Delete(id)
+		swept++
+	}
+	if swept > 0 {
+		lg.Logf(lg.DebugLevel, "Deleted %d expired contexts of function type %s\n", swept, ft.name)
+	}
+}
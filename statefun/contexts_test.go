@@ -0,0 +1,127 @@
+// Copyright 2023 NJWS Inc.
+
+package statefun
+
+import (
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/foliagecp/easyjson"
+
+	"github.com/foliagecp/sdk/statefun/backend"
+	sfPlugins "github.com/foliagecp/sdk/statefun/plugins"
+	"github.com/foliagecp/sdk/statefun/system"
+)
+
+// In-memory backend which KV touches the context access time right before the sweep claims it while touching is set
+type touchingKVBackend struct {
+	*backend.InMemory
+	touching atomic.Bool
+}
+
+func (b *touchingKVBackend) KeyValue(bucket string) (backend.KeyValue, error) {
+	kv, err := b.InMemory.KeyValue(bucket)
+	if err != nil {
+		return nil, err
+	}
+	return &touchingKV{KeyValue: kv, backend: b}, nil
+}
+
+type touchingKV struct {
+	backend.KeyValue
+	backend *touchingKVBackend
+}
+
+func (kv *touchingKV) EraseIfRevision(key string, lastRevision uint64) error {
+	if kv.backend.touching.Load() && strings.HasPrefix(key, ContextsKVPrefix+".access.") {
+		if _, err := kv.KeyValue.Put(key, system.Int64ToBytes(system.GetCurrentTimeNs())); err != nil {
+			return err
+		}
+	}
+	return kv.KeyValue.EraseIfRevision(key, lastRevision)
+}
+
+// Stores the function context
+func contextsTTLTestHandler(_ sfPlugins.StatefunExecutor, contextProcessor *sfPlugins.StatefunContextProcessor) {
+	contextProcessor.SetFunctionContext(easyjson.NewJSONObjectWithKeyValue("n", easyjson.NewJSON(1)).GetPtr())
+}
+
+// Makes the context of the id and waits until the id handler is collected and the context expires
+func expiredTestContext(t *testing.T, r *testRuntime, id string) {
+	t.Helper()
+	if _, err := r.Request(sfPlugins.GolangLocalRequest, "test.ttl", id, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	ft := r.registeredFunctionTypes["test.ttl"]
+	waitFor(t, "context expiration", func() bool {
+		_, running := ft.idHandlersChannel.Load(id)
+		entry, err := r.kv.Get(getContextAccessKey("test.ttl", id))
+		return !running && err == nil && system.BytesToInt64(entry.Value())+int64(1e9) < system.GetCurrentTimeNs()
+	})
+}
+
+func testContextExists(r *testRuntime, id string) bool {
+	_, err := r.cacheStore.GetValue("test.ttl." + id)
+	return err == nil
+}
+
+func TestContextsSweptOncePerInterval(t *testing.T) {
+	b := backend.NewInMemory()
+	r1 := newTestRuntime(t, newTestRuntimeConfig(b).SetFunctionTypeIDLifetimeMs(100))
+	NewFunctionType(r1.Runtime, "test.ttl", contextsTTLTestHandler, *NewFunctionTypeConfig().SetContextTTLSec(1))
+	startTestRuntime(t, r1)
+	r2 := newTestRuntime(t, newTestRuntimeConfig(b).SetFunctionTypeIDLifetimeMs(100))
+	NewFunctionType(r2.Runtime, "test.ttl", contextsTTLTestHandler, *NewFunctionTypeConfig().SetContextTTLSec(1))
+	startTestRuntime(t, r2)
+
+	expiredTestContext(t, r1, "a")
+	r1.registeredFunctionTypes["test.ttl"].sweepContextsIfDue()
+	waitFor(t, "expired context deletion", func() bool { return !testContextExists(r1, "a") })
+
+	// Already swept by the other runtime within the sweep interval
+	expiredTestContext(t, r2, "b")
+	r2.registeredFunctionTypes["test.ttl"].sweepContextsIfDue()
+	if !testContextExists(r2, "b") {
+		t.Fatal("contexts were swept again within the sweep interval")
+	}
+}
+
+func TestContextTouchedWhileSweptIsKept(t *testing.T) {
+	b := &touchingKVBackend{InMemory: backend.NewInMemory()}
+	r := newTestRuntime(t, newTestRuntimeConfig(b).SetFunctionTypeIDLifetimeMs(100))
+	NewFunctionType(r.Runtime, "test.ttl", contextsTTLTestHandler, *NewFunctionTypeConfig().SetContextTTLSec(1))
+	startTestRuntime(t, r)
+
+	expiredTestContext(t, r, "a")
+	b.touching.Store(true)
+	r.registeredFunctionTypes["test.ttl"].sweepContexts()
+	if !testContextExists(r, "a") {
+		t.Fatal("context touched while being swept was deleted")
+	}
+	if _, err := r.kv.Get(getContextAccessKey("test.ttl", "a")); err != nil {
+		t.Fatalf("access time of the touched context was erased: %s", err)
+	}
+
+	b.touching.Store(false)
+	expiredTestContext(t, r, "a")
+	r.registeredFunctionTypes["test.ttl"].sweepContexts()
+	if testContextExists(r, "a") {
+		t.Fatal("expired context was not deleted")
+	}
+}
+
+func TestContextsKeeperWatchesAgainAfterWatchClosed(t *testing.T) {
+	b := newClosingWatchBackend()
+	r := newTestRuntime(t, newTestRuntimeConfig(b))
+	startTestRuntime(t, r)
+
+	waitFor(t, "object bound function types watch", func() bool { return b.closeWatchers(t, ContextsKVPrefix+".object_bound") > 0 })
+	if _, err := r.kv.Put(getObjectBoundContextKey("test.other"), []byte("test.other")); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "object bound function type of other runtime", func() bool {
+		_, ok := r.objectBoundTypenames.Load("test.other")
+		return ok
+	})
+}
@@ -0,0 +1,251 @@
+// Copyright 2023 NJWS Inc.
+
+package statefun
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/foliagecp/easyjson"
+
+	"github.com/foliagecp/sdk/statefun/backend"
+	lg "github.com/foliagecp/sdk/statefun/logger"
+	sfPlugins "github.com/foliagecp/sdk/statefun/plugins"
+	"github.com/foliagecp/sdk/statefun/system"
+)
+
+const (
+	CronKVPrefix = "statefun_cron"
+)
+
+/*
+Cron schedules are stored in the KV bucket, one key per schedule. Every runtime watches all schedules and computes their ticks,
+on each tick runtimes compete for the schedule's KeyMutexLock and the one which locked it signals the target unless the tick
+was already fired by someone else, which is known from the "last_tick" field of the schedule stored in KV.
+
+String values of a schedule's payload template may contain placeholders which are substituted on each tick:
+{{schedule_id}}, {{tick}} - tick time in RFC3339, {{tick_unix}} - tick time in unix seconds.
+*/
+
+type CronSchedule struct {
+	ScheduleID      string
+	Cron            string // See system.ParseCronSchedule for the syntax
+	Typename        string
+	ID              string
+	PayloadTemplate *easyjson.JSON
+	Options         *easyjson.JSON
+}
+
+func getCronKey(scheduleID string) string {
+	return CronKVPrefix + "." + system.GetHashStr(scheduleID)
+}
+
+func (s *CronSchedule) toJSON() easyjson.JSON {
+	j := easyjson.NewJSONObject()
+	j.SetByPath("schedule_id", easyjson.NewJSON(s.ScheduleID))
+	j.SetByPath("cron", easyjson.NewJSON(s.Cron))
+	j.SetByPath("typename", easyjson.NewJSON(s.Typename))
+	j.SetByPath("id", easyjson.NewJSON(s.ID))
+	if s.PayloadTemplate != nil {
+		j.SetByPath("payload", *s.PayloadTemplate)
+	}
+	if s.Options != nil {
+		j.SetByPath("options", *s.Options)
+	}
+	return j
+}
+
+func cronScheduleFromJSON(j *easyjson.JSON) CronSchedule {
+	s := CronSchedule{
+		ScheduleID: j.GetByPath("schedule_id").AsStringDefault(""),
+		Cron:       j.GetByPath("cron").AsStringDefault(""),
+		Typename:   j.GetByPath("typename").AsStringDefault(""),
+		ID:         j.GetByPath("id").AsStringDefault(""),
+	}
+	if j.GetByPath("payload").IsObject() {
+		s.PayloadTemplate = j.GetByPath("payload").GetPtr()
+	}
+	if j.GetByPath("options").IsObject() {
+		s.Options = j.GetByPath("options").GetPtr()
+	}
+	return s
+}
+
+// SetCronSchedule creates or replaces the schedule which signals the target function on each tick
+func (r *Runtime) SetCronSchedule(schedule CronSchedule) error {
+	if len(schedule.ScheduleID) == 0 {
+		return fmt.Errorf("cron schedule id must not be empty")
+	}
+	if _, err := system.ParseCronSchedule(schedule.Cron); err != nil {
+		return err
+	}
+	key := getCronKey(schedule.ScheduleID)
+	j := schedule.toJSON()
+	if entry, err := r.kv.Get(key); err == nil { // Preserving the last tick so the current one is not fired twice
+		if old, ok := easyjson.JSONFromBytes(entry.Value()); ok {
+			j.SetByPath("last_tick", old.GetByPath("last_tick"))
+		}
+	}
+	_, err := r.kv.Put(key, j.ToBytes())
+	return err
+}
+
+func (r *Runtime) DeleteCronSchedule(scheduleID string) error {
+	if err := r.kv.Erase(getCronKey(scheduleID)); err != nil {
+		if errors.Is(err, backend.ErrKeyNotFound) {
+			return fmt.Errorf("cron schedule %s does not exist", scheduleID)
+		}
+		return err
+	}
+	return nil
+}
+
+func (r *Runtime) CronSchedules() ([]CronSchedule, error) {
+	w, err := r.kv.Watch(CronKVPrefix + ".*")
+	if err != nil {
+		return nil, err
+	}
+	defer func() { system.MsgOnErrorReturn(w.Stop()) }()
+	schedules := []CronSchedule{}
+	for entry := range w.Updates() {
+		if entry == nil {
+			break
+		}
+		if j, ok := easyjson.JSONFromBytes(entry.Value()); ok {
+			schedules = append(schedules, cronScheduleFromJSON(&j))
+		}
+	}
+	return schedules, nil
+}
+
+type cronScheduleState struct {
+	cron     string
+	schedule *system.CronSchedule
+	nextTick time.Time
+}
+
+func (r *Runtime) runCronScheduler() {
+	system.GlobalPrometrics.GetRoutinesCounter().Started("runtime.cronScheduler")
+	defer system.GlobalPrometrics.GetRoutinesCounter().Stopped("runtime.cronScheduler")
+
+	keys := CronKVPrefix + ".*"
+	w, err := r.kv.Watch(keys)
+	if err != nil {
+		lg.Logf(lg.ErrorLevel, "Cron scheduler cannot watch schedules: %s\n", err)
+		return
+	}
+	defer func() {
+		if w != nil { // Nil if the runtime was shut down while watching again
+			system.MsgOnErrorReturn(w.Stop())
+		}
+	}()
+
+	states := map[string]*cronScheduleState{} // Schedule KV key -> schedule state
+	ticker := time.NewTicker(TimersCheckIntervalMs * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.ctx.Done():
+			return
+		case entry, ok := <-w.Updates():
+			if !ok {
+				system.MsgOnErrorReturn(w.Stop())
+				if w, ok = r.rewatchKV(keys, "Cron scheduler"); !ok {
+					return
+				}
+				continue
+			}
+			if entry == nil {
+				continue
+			}
+			j, ok := easyjson.JSONFromBytes(entry.Value())
+			if !ok {
+				continue
+			}
+			cron := j.GetByPath("cron").AsStringDefault("")
+			if state, ok := states[entry.Key()]; ok && state.cron == cron {
+				continue // Only the last tick was updated
+			}
+			schedule, err := system.ParseCronSchedule(cron)
+			if err != nil {
+				lg.Logf(lg.ErrorLevel, "Cron schedule %s is invalid: %s\n", j.GetByPath("schedule_id").AsStringDefault(entry.Key()), err)
+				delete(states, entry.Key())
+				continue
+			}
+			states[entry.Key()] = &cronScheduleState{cron: cron, schedule: schedule, nextTick: schedule.Next(time.Now())}
+		case now := <-ticker.C:
+			for key, state := range states {
+				if state.nextTick.IsZero() || state.nextTick.After(now) {
+					continue
+				}
+				done, exists := r.fireCronTick(key, state.nextTick)
+				if !exists {
+					delete(states, key)
+					continue
+				}
+				if done {
+					state.nextTick = state.schedule.Next(now)
+				}
+			}
+		}
+	}
+}
+
+// Returns done=false if the tick must be retried on the next pass, exists=false if the schedule does not exist anymore
+func (r *Runtime) fireCronTick(key string, tick time.Time) (done bool, exists bool) {
+	revID, err := KeyMutexLock(r, key, true)
+	if err != nil {
+		if err != mutexLockedError {
+			lg.Logf(lg.ErrorLevel, "Cannot lock cron schedule %s: %s\n", key, err)
+			return false, true
+		}
+		return true, true // Other runtime is firing the tick
+	}
+	defer func() { system.MsgOnErrorReturn(KeyMutexUnlock(r, key, revID)) }()
+
+	entry, err := r.kv.Get(key)
+	if err != nil {
+		return false, !errors.Is(err, backend.ErrKeyNotFound)
+	}
+	j, ok := easyjson.JSONFromBytes(entry.Value())
+	if !ok {
+		return true, true
+	}
+	if int64(j.GetByPath("last_tick").AsNumericDefault(0)) >= tick.Unix() { // Already fired by other runtime
+		return true, true
+	}
+	schedule := cronScheduleFromJSON(&j)
+
+	var payload *easyjson.JSON
+	if schedule.PayloadTemplate != nil {
+		payload = renderCronPayload(schedule.PayloadTemplate, schedule.ScheduleID, tick)
+	}
+	msgID := fmt.Sprintf("cron.%s.%d", schedule.ScheduleID, tick.Unix())
+	if err := r.signalIdempotent(sfPlugins.JetstreamGlobalSignal, "cron", schedule.ScheduleID, schedule.Typename, schedule.ID, msgID, payload, schedule.Options); err != nil {
+		lg.Logf(lg.ErrorLevel, "Cron schedule %s cannot signal function %s with id=%s, retrying: %s\n", schedule.ScheduleID, schedule.Typename, schedule.ID, err)
+		return false, true // Signal of the retried tick is deduplicated by msgID
+	}
+	j.SetByPath("last_tick", easyjson.NewJSON(tick.Unix()))
+	if _, err := r.kv.Update(key, j.ToBytes(), entry.Revision()); err != nil {
+		lg.Logf(lg.ErrorLevel, "Cannot store last tick of cron schedule %s: %s\n", schedule.ScheduleID, err)
+	}
+	return true, true
+}
+
+func renderCronPayload(template *easyjson.JSON, scheduleID string, tick time.Time) *easyjson.JSON {
+	quoted := func(s string) string {
+		q := easyjson.NewJSON(s).ToString()
+		return q[1 : len(q)-1]
+	}
+	s := template.ToString()
+	s = strings.ReplaceAll(s, "{{schedule_id}}", quoted(scheduleID))
+	s = strings.ReplaceAll(s, "{{tick}}", tick.UTC().Format(time.RFC3339))
+	s = strings.ReplaceAll(s, "{{tick_unix}}", strconv.FormatInt(tick.Unix(), 10))
+	if j, ok := easyjson.JSONFromBytes([]byte(s)); ok {
+		return &j
+	}
+	return template.Clone().GetPtr()
+}
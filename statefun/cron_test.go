@@ -0,0 +1,72 @@
+// Copyright 2023 NJWS Inc.
+
+package statefun
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/foliagecp/easyjson"
+
+	"github.com/foliagecp/sdk/statefun/backend"
+	sfPlugins "github.com/foliagecp/sdk/statefun/plugins"
+)
+
+// In-memory backend which fails to publish the first cron tick
+type failingCronBackend struct {
+	*backend.InMemory
+	mutex       sync.Mutex
+	failedMsgID string
+}
+
+func (b *failingCronBackend) StreamPublishMsgID(subject string, data []byte, msgID string) error {
+	b.mutex.Lock()
+	if strings.HasPrefix(msgID, "cron.") && len(b.failedMsgID) == 0 {
+		b.failedMsgID = msgID
+		b.mutex.Unlock()
+		return errors.New("publish failed")
+	}
+	b.mutex.Unlock()
+	return b.InMemory.StreamPublishMsgID(subject, data, msgID)
+}
+
+func TestCronTickRetriedAfterFailedSignal(t *testing.T) {
+	b := &failingCronBackend{InMemory: backend.NewInMemory()}
+	r := newTestRuntime(t, newTestRuntimeConfig(b))
+	calls := newTestCalls()
+	NewFunctionType(r.Runtime, "test.cron", func(_ sfPlugins.StatefunExecutor, contextProcessor *sfPlugins.StatefunContextProcessor) {
+		calls.record(contextProcessor)
+	}, *NewFunctionTypeConfig())
+	startTestRuntime(t, r)
+
+	payload := easyjson.NewJSONObjectWithKeyValue("tick", easyjson.NewJSON("{{tick_unix}}"))
+	if err := r.SetCronSchedule(CronSchedule{ScheduleID: "s1", Cron: "@every 1s", Typename: "test.cron", ID: "a", PayloadTemplate: &payload}); err != nil {
+		t.Fatal(err)
+	}
+
+	tick := calls.wait(t).GetByPath("tick").AsStringDefault("")
+	b.mutex.Lock()
+	failedMsgID := b.failedMsgID
+	b.mutex.Unlock()
+	if failedMsgID != "cron.s1."+tick {
+		t.Fatalf("first signaled tick is %s, but the tick of %s failed to signal", tick, failedMsgID)
+	}
+}
+
+func TestCronSchedulerWatchesAgainAfterWatchClosed(t *testing.T) {
+	b := newClosingWatchBackend()
+	r := newTestRuntime(t, newTestRuntimeConfig(b))
+	calls := newTestCalls()
+	NewFunctionType(r.Runtime, "test.cron", func(_ sfPlugins.StatefunExecutor, contextProcessor *sfPlugins.StatefunContextProcessor) {
+		calls.record(contextProcessor)
+	}, *NewFunctionTypeConfig())
+	startTestRuntime(t, r)
+
+	waitFor(t, "cron schedules watch", func() bool { return b.closeWatchers(t, CronKVPrefix) > 0 })
+	if err := r.SetCronSchedule(CronSchedule{ScheduleID: "s1", Cron: "@every 1s", Typename: "test.cron", ID: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	calls.wait(t)
+}
@@ -0,0 +1,140 @@
+// Copyright 2023 NJWS Inc.
+
+package statefun
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/foliagecp/sdk/statefun/backend"
+	"github.com/foliagecp/sdk/statefun/system"
+)
+
+const (
+	DeadLetterSubjectPrefix = "deadletter"
+)
+
+type DeadLetter struct {
+	Sequence   uint64 `json:"-"`          // Sequence in the dead-letter stream, used to re-drive or delete the dead letter
+	Subject    string `json:"subject"`    // Subject the original message was sent to
+	Data       []byte `json:"data"`       // Original message data
+	Reason     string `json:"reason"`     // Why the message was not handled
+	Deliveries uint64 `json:"deliveries"` // How many times the message was delivered before it was dead-lettered
+	Time       int64  `json:"time"`       // When the message was dead-lettered, unix ns
+}
+
+func getDeadLetterStreamName(typename string) string {
+	return fmt.Sprintf("%s_dead_letter_stream", system.GetHashStr(typename+".*"))
+}
+
+func getDeadLetterSubject(typename string) string {
+	return fmt.Sprintf("%s.%s.*", DeadLetterSubjectPrefix, typename)
+}
+
+func (ft *FunctionType) ensureDeadLetterStream() error {
+	return ft.runtime.backend.EnsureStream(backend.StreamConfig{
+		Name:     getDeadLetterStreamName(ft.name),
+		Subjects: []string{getDeadLetterSubject(ft.name)},
+	})
+}
+
+// Stores the message into the function type's dead-letter stream, the message must be acked by the caller afterwards
+func (ft *FunctionType) deadLetter(msg backend.Msg, reason string) error {
+	tokens := strings.Split(msg.Subject(), ".")
+	id := tokens[len(tokens)-1]
+	dl := DeadLetter{
+		Subject:    fmt.Sprintf("%s.%s", ft.name, id), // Not a partition subject, so the re-driven message is routed by the current partitions
+		Data:       msg.Data(),
+		Reason:     reason,
+		Deliveries: msg.NumDelivered(),
+		Time:       time.Now().UnixNano(),
+	}
+	data, err := json.Marshal(dl)
+	if err != nil {
+		return err
+	}
+	if err := ft.runtime.backend.StreamPublish(fmt.Sprintf("%s.%s.%s", DeadLetterSubjectPrefix, ft.name, id), data); err != nil {
+		return fmt.Errorf("function type %s cannot store dead letter: %w", ft.name, err)
+	}
+	return nil
+}
+
+// DeadLetters returns up to limit dead letters of the function type starting from the sequence fromSeq
+func (r *Runtime) DeadLetters(typename string, fromSeq uint64, limit int) ([]DeadLetter, error) {
+	msgs, err := r.backend.StreamMsgs(getDeadLetterStreamName(typename), fromSeq, limit)
+	if err != nil {
+		return nil, err
+	}
+	deadLetters := make([]DeadLetter, 0, len(msgs))
+	for _, msg := range msgs {
+		dl, err := parseDeadLetter(msg)
+		if err != nil {
+			return nil, err
+		}
+		deadLetters = append(deadLetters, *dl)
+	}
+	return deadLetters, nil
+}
+
+// RedriveDeadLetter sends the original message of the dead letter back to the function type and removes the dead letter
+func (r *Runtime) RedriveDeadLetter(typename string, seq uint64) error {
+	streamName := getDeadLetterStreamName(typename)
+	msg, err := r.backend.StreamMsg(streamName, seq)
+	if err != nil {
+		return err
+	}
+	dl, err := parseDeadLetter(*msg)
+	if err != nil {
+		return err
+	}
+	if err := r.backend.StreamPublish(dl.Subject, dl.Data); err != nil {
+		return err
+	}
+	return r.backend.DeleteStreamMsg(streamName, seq)
+}
+
+// RedriveDeadLetters re-drives all dead letters the function type has at the moment of the call, returns how many of them were re-driven.
+// Messages dead-lettered again meanwhile are left for the next call.
+func (r *Runtime) RedriveDeadLetters(typename string) (int, error) {
+	lastSeq, err := r.backend.StreamLastSeq(getDeadLetterStreamName(typename))
+	if err != nil {
+		return 0, err
+	}
+	redriven := 0
+	var fromSeq uint64
+	for fromSeq <= lastSeq {
+		deadLetters, err := r.DeadLetters(typename, fromSeq, 256)
+		if err != nil {
+			return redriven, err
+		}
+		if len(deadLetters) == 0 {
+			return redriven, nil
+		}
+		for _, dl := range deadLetters {
+			if dl.Sequence > lastSeq {
+				return redriven, nil
+			}
+			if err := r.RedriveDeadLetter(typename, dl.Sequence); err != nil {
+				return redriven, err
+			}
+			redriven++
+			fromSeq = dl.Sequence + 1
+		}
+	}
+	return redriven, nil
+}
+
+func (r *Runtime) DeleteDeadLetter(typename string, seq uint64) error {
+	return r.backend.DeleteStreamMsg(getDeadLetterStreamName(typename), seq)
+}
+
+func parseDeadLetter(msg backend.StreamMsg) (*DeadLetter, error) {
+	dl := DeadLetter{}
+	if err := json.Unmarshal(msg.Data, &dl); err != nil {
+		return nil, fmt.Errorf("dead letter #%d is corrupted: %w", msg.Sequence, err)
+	}
+	dl.Sequence = msg.Sequence
+	return &dl, nil
+}
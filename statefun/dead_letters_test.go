@@ -0,0 +1,71 @@
+// Copyright 2023 NJWS Inc.
+
+package statefun
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/foliagecp/sdk/statefun/backend"
+	sfPlugins "github.com/foliagecp/sdk/statefun/plugins"
+)
+
+// In-memory backend which deletes stream messages slowly, so messages re-driven by a call are dead-lettered again before the call ends
+type slowDeleteBackend struct {
+	*backend.InMemory
+}
+
+func (b *slowDeleteBackend) DeleteStreamMsg(stream string, seq uint64) error {
+	time.Sleep(50 * time.Millisecond)
+	return b.InMemory.DeleteStreamMsg(stream, seq)
+}
+
+func TestRedriveDeadLetters(t *testing.T) {
+	r := newTestRuntime(t, newTestRuntimeConfig(&slowDeleteBackend{InMemory: backend.NewInMemory()}))
+	calls := newTestCalls()
+	NewRetriableFunctionType(r.Runtime, "test.failing", func(_ sfPlugins.StatefunExecutor, contextProcessor *sfPlugins.StatefunContextProcessor) error {
+		calls.record(contextProcessor)
+		return NewTerminalError(errors.New("always fails"))
+	}, *NewFunctionTypeConfig().SetDeadLetterState(true))
+	startTestRuntime(t, r)
+
+	deadLettersCount := func() int {
+		deadLetters, err := r.DeadLetters("test.failing", 0, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(deadLetters)
+	}
+
+	for i := 0; i < 3; i++ {
+		if err := r.Signal(sfPlugins.JetstreamGlobalSignal, "test.failing", fmt.Sprint(i), testPayload("n", i), nil); err != nil {
+			t.Fatal(err)
+		}
+		calls.wait(t)
+	}
+	waitFor(t, "dead-lettering", func() bool { return deadLettersCount() == 3 })
+
+	// Every re-driven message fails and is dead-lettered again, it must not be re-driven once more by the same call
+	redriven, err := r.RedriveDeadLetters("test.failing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if redriven != 3 {
+		t.Fatalf("%d dead letters were re-driven, want 3", redriven)
+	}
+	for i := 0; i < 3; i++ {
+		calls.wait(t)
+	}
+	waitFor(t, "dead-lettering of re-driven messages", func() bool { return deadLettersCount() == 3 })
+	deadLetters, err := r.DeadLetters("test.failing", 0, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, dl := range deadLetters {
+		if dl.Sequence <= 3 {
+			t.Fatalf("dead letter #%d was not re-driven", dl.Sequence)
+		}
+	}
+}
@@ -0,0 +1,39 @@
+// Copyright 2023 NJWS Inc.
+
+package statefun
+
+import (
+	"time"
+
+	"github.com/foliagecp/easyjson"
+
+	"github.com/foliagecp/sdk/statefun/system"
+)
+
+/*
+Dedup guard remembers idempotency keys of the signals successfully handled by a function with a given id in the
+function's context store key, every key is forgotten after the function type's idempotency window.
+*/
+
+func (ft *FunctionType) getDedupGuardKey(id string) string {
+	return ft.name + "." + id + ".__handled_msg_ids"
+}
+
+func (ft *FunctionType) msgAlreadyHandled(id string, msgID string) bool {
+	handled := ft.getContext(ft.getDedupGuardKey(id))
+	handledAt, ok := handled.GetByPath(system.GetHashStr(msgID)).AsNumeric()
+	return ok && system.GetCurrentTimeNs()-int64(handledAt) < int64(ft.config.idempotencyWindowSec)*int64(time.Second)
+}
+
+func (ft *FunctionType) rememberHandledMsg(id string, msgID string) {
+	key := ft.getDedupGuardKey(id)
+	handled := ft.getContext(key)
+	now := system.GetCurrentTimeNs()
+	for _, h := range handled.ObjectKeys() {
+		if now-int64(handled.GetByPath(h).AsNumericDefault(0)) >= int64(ft.config.idempotencyWindowSec)*int64(time.Second) {
+			handled.RemoveByPath(h)
+		}
+	}
+	handled.SetByPath(system.GetHashStr(msgID), easyjson.NewJSON(now))
+	ft.setContext(key, handled)
+}
@@ -0,0 +1,93 @@
+// Copyright 2023 NJWS Inc.
+
+package statefun
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/foliagecp/sdk/statefun/backend"
+	sfPlugins "github.com/foliagecp/sdk/statefun/plugins"
+)
+
+func TestSignalIdempotent(t *testing.T) {
+	r := newTestRuntime(t, newTestRuntimeConfig(backend.NewInMemory()))
+	calls := newTestCalls()
+	NewFunctionType(r.Runtime, "test.idempotent", func(_ sfPlugins.StatefunExecutor, contextProcessor *sfPlugins.StatefunContextProcessor) {
+		calls.record(contextProcessor)
+	}, *NewFunctionTypeConfig())
+	startTestRuntime(t, r)
+
+	// Retried signal is delivered once
+	for i := 0; i < 3; i++ {
+		if err := r.SignalIdempotent(sfPlugins.JetstreamGlobalSignal, "test.idempotent", "a", "k1", testPayload("n", i), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := calls.wait(t).GetByPath("n").AsNumericDefault(-1); n != 0 {
+		t.Fatalf("function was called with the signal %v, want the first one", n)
+	}
+	calls.expectNone(t, 200*time.Millisecond)
+
+	if err := r.SignalIdempotent(sfPlugins.JetstreamGlobalSignal, "test.idempotent", "a", "k2", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	calls.wait(t)
+
+	if err := r.SignalIdempotent(sfPlugins.JetstreamGlobalSignal, "test.idempotent", "a", "", nil, nil); err == nil {
+		t.Fatal("signal with an empty idempotency key was sent")
+	}
+	if err := r.SignalIdempotent(sfPlugins.GolangLocalSignal, "test.idempotent", "a", "k3", nil, nil); err == nil {
+		t.Fatal("golang local signal with an idempotency key was sent")
+	}
+}
+
+func TestDedupGuard(t *testing.T) {
+	r := newTestRuntime(t, newTestRuntimeConfig(backend.NewInMemory()))
+	calls := newTestCalls()
+	NewRetriableFunctionType(r.Runtime, "test.dedup", func(_ sfPlugins.StatefunExecutor, contextProcessor *sfPlugins.StatefunContextProcessor) error {
+		calls.record(contextProcessor)
+		if contextProcessor.Payload.GetByPath("fail").AsBoolDefault(false) {
+			return errors.New("cannot handle")
+		}
+		return nil
+	}, *NewFunctionTypeConfig().SetDedupGuardState(true))
+	startTestRuntime(t, r)
+	ft := r.registeredFunctionTypes["test.dedup"]
+
+	// Delivers the signal with the idempotency key as JetStream does after a lost ack and waits for the ack
+	deliver := func(id string, msgID string, fail bool) {
+		t.Helper()
+		acked := make(chan bool, 1)
+		ft.sendMsg(id, FunctionTypeMsg{
+			Caller:      &sfPlugins.StatefunAddress{Typename: "ingress", ID: "nats"},
+			Payload:     testPayload("fail", fail),
+			MsgID:       msgID,
+			AckCallback: func(ack bool) { acked <- ack },
+		})
+		select {
+		case ack := <-acked:
+			if !ack {
+				t.Fatalf("signal %s for id %s was not acked", msgID, id)
+			}
+		case <-time.After(testWaitTimeout):
+			t.Fatalf("signal %s for id %s was not acked in time", msgID, id)
+		}
+	}
+
+	deliver("a", "k1", false)
+	calls.wait(t)
+	deliver("a", "k1", false)
+	calls.expectNone(t, 200*time.Millisecond)
+
+	// Keys are remembered per id
+	deliver("b", "k1", false)
+	calls.wait(t)
+
+	// Failed signals are not remembered
+	deliver("a", "k2", true)
+	calls.wait(t)
+	deliver("a", "k2", false)
+	calls.wait(t)
+}
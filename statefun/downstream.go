@@ -0,0 +1,102 @@
+// Copyright 2023 NJWS Inc.
+
+package statefun
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/foliagecp/easyjson"
+
+	sfPlugins "github.com/foliagecp/sdk/statefun/plugins"
+)
+
+// SetLinksResolver sets how DownstreamSignal and DownstreamRequest find the vertices out links lead to,
+// the graph registers its own one
+func (r *Runtime) SetLinksResolver(resolver sfPlugins.LinksResolver) {
+	r.linksResolver = resolver
+}
+
+// Vertices reachable from the id through the out links matching the filter, breadth first, every vertex once, the id excluded
+func (r *Runtime) downstreamVertices(id string, filter sfPlugins.DownstreamFilter) ([]string, error) {
+	if r.linksResolver == nil {
+		return nil, fmt.Errorf("no links resolver is set, cannot find downstream vertices of %s", id)
+	}
+	linkType := filter.LinkType
+	if len(linkType) == 0 {
+		linkType = "*"
+	}
+	maxDepth := filter.MaxDepth
+	if maxDepth <= 0 {
+		maxDepth = 1
+	}
+
+	visited := map[string]struct{}{id: {}}
+	vertices := []string{}
+	level := []string{id}
+	for depth := 0; depth < maxDepth && len(level) > 0; depth++ {
+		nextLevel := []string{}
+		for _, vertexID := range level {
+			targets, err := r.linksResolver(r.cacheStore, vertexID, linkType, filter.Filter)
+			if err != nil {
+				return nil, fmt.Errorf("cannot resolve out links of %s: %w", vertexID, err)
+			}
+			for _, target := range targets {
+				if _, ok := visited[target]; ok {
+					continue
+				}
+				visited[target] = struct{}{}
+				vertices = append(vertices, target)
+				nextLevel = append(nextLevel, target)
+			}
+		}
+		level = nextLevel
+	}
+	return vertices, nil
+}
+
+func (r *Runtime) downstreamSignal(signalProvider sfPlugins.SignalProvider, callerTypename string, callerID string, targetTypename string, filter sfPlugins.DownstreamFilter, payload *easyjson.JSON, options *easyjson.JSON) (int, error) {
+	vertices, err := r.downstreamVertices(callerID, filter)
+	if err != nil {
+		return 0, err
+	}
+	signaled := 0
+	var errs []error
+	for _, vertexID := range vertices {
+		if err := r.signal(signalProvider, callerTypename, callerID, targetTypename, vertexID, payload, options); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		signaled++
+	}
+	return signaled, errors.Join(errs...)
+}
+
+func (r *Runtime) downstreamRequest(ctx context.Context, requestProvider sfPlugins.RequestProvider, callerTypename string, callerID string, targetTypename string, filter sfPlugins.DownstreamFilter, payload *easyjson.JSON, options *easyjson.JSON) (*easyjson.JSON, error) {
+	vertices, err := r.downstreamVertices(callerID, filter)
+	if err != nil {
+		return nil, err
+	}
+	futures := make([]*sfPlugins.RequestFuture, len(vertices))
+	for i, vertexID := range vertices {
+		futures[i] = r.requestAsync(ctx, requestProvider, callerTypename, callerID, targetTypename, vertexID, payload, options)
+	}
+
+	replies := easyjson.NewJSONObject()
+	errs := easyjson.NewJSONObject()
+	for _, result := range sfPlugins.AwaitAll(ctx, futures...) {
+		vertexID := vertices[result.Index]
+		if result.Err != nil {
+			errs.SetByPath(vertexID, easyjson.NewJSON(result.Err.Error()))
+		} else if result.Data != nil {
+			replies.SetByPath(vertexID, *result.Data)
+		} else {
+			replies.SetByPath(vertexID, easyjson.NewJSONNull())
+		}
+	}
+	aggregated := easyjson.NewJSONObject()
+	aggregated.SetByPath("replies", replies)
+	aggregated.SetByPath("errors", errs)
+	return &aggregated, nil
+}
@@ -0,0 +1,181 @@
+// Copyright 2023 NJWS Inc.
+
+package statefun
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/foliagecp/easyjson"
+	"github.com/foliagecp/sdk/statefun/backend"
+	"github.com/foliagecp/sdk/statefun/cache"
+	sfPlugins "github.com/foliagecp/sdk/statefun/plugins"
+)
+
+// Out links by link type, "x" ones make a diamond with a cycle back to a
+var testLinks = map[string]map[string][]string{
+	"x": {"a": {"b", "c"}, "b": {"d"}, "c": {"d"}, "d": {"a"}},
+	"y": {"a": {"e"}, "d": {"f"}},
+}
+
+func testLinksResolver(_ *cache.Store, vertexID string, linkType string, filter string) ([]string, error) {
+	if filter == "broken" {
+		return nil, errors.New("invalid filter")
+	}
+	if linkType != "*" {
+		return testLinks[linkType][vertexID], nil
+	}
+	targets := []string{}
+	for _, linkType := range []string{"x", "y"} {
+		targets = append(targets, testLinks[linkType][vertexID]...)
+	}
+	return targets, nil
+}
+
+// Registers test.downstream.source, which signals or requests test.downstream.target downstream as the payload says,
+// and test.downstream.target, which sends ids it is called with to the channel
+func registerDownstreamFunctionTypes(r *testRuntime) chan string {
+	NewFunctionType(r.Runtime, "test.downstream.source", func(_ sfPlugins.StatefunExecutor, contextProcessor *sfPlugins.StatefunContextProcessor) {
+		filter := sfPlugins.DownstreamFilter{
+			LinkType: contextProcessor.Payload.GetByPath("link_type").AsStringDefault(""),
+			Filter:   contextProcessor.Payload.GetByPath("filter").AsStringDefault(""),
+			MaxDepth: int(contextProcessor.Payload.GetByPath("max_depth").AsNumericDefault(0)),
+		}
+		result := easyjson.NewJSONObject()
+		var err error
+		if contextProcessor.Payload.GetByPath("request").AsBoolDefault(false) {
+			ctx, cancel := context.WithTimeout(contextProcessor.Context, 300*time.Millisecond)
+			defer cancel()
+			var aggregated *easyjson.JSON
+			if aggregated, err = contextProcessor.DownstreamRequest(ctx, sfPlugins.GolangLocalRequest, "test.downstream.target", filter, contextProcessor.Payload, nil); err == nil {
+				result = *aggregated
+			}
+		} else {
+			var signaled int
+			signaled, err = contextProcessor.DownstreamSignal(sfPlugins.GolangLocalSignal, "test.downstream.target", filter, contextProcessor.Payload, nil)
+			result.SetByPath("signaled", easyjson.NewJSON(signaled))
+		}
+		if err != nil {
+			result.SetByPath("error", easyjson.NewJSON(err.Error()))
+		}
+		contextProcessor.Reply.With(&result)
+	}, *NewFunctionTypeConfig())
+
+	called := make(chan string, 100)
+	NewRetriableFunctionType(r.Runtime, "test.downstream.target", func(_ sfPlugins.StatefunExecutor, contextProcessor *sfPlugins.StatefunContextProcessor) error {
+		called <- contextProcessor.Self.ID
+		if !contextProcessor.Payload.GetByPath("request").AsBoolDefault(false) {
+			return nil
+		}
+		switch contextProcessor.Self.ID {
+		case "c":
+			return NewTerminalError(errors.New("cannot handle"))
+		case "d": // Replies after the deadline
+			<-contextProcessor.Context.Done()
+		default:
+			contextProcessor.Reply.With(testPayload("id", contextProcessor.Self.ID))
+		}
+		return nil
+	}, *NewFunctionTypeConfig())
+	return called
+}
+
+func downstreamTestPayload(linkType string, maxDepth int) *easyjson.JSON {
+	payload := testPayload("link_type", linkType)
+	payload.SetByPath("max_depth", easyjson.NewJSON(maxDepth))
+	return payload
+}
+
+func TestDownstreamSignal(t *testing.T) {
+	r := newTestRuntime(t, newTestRuntimeConfig(backend.NewInMemory()))
+	called := registerDownstreamFunctionTypes(r)
+	startTestRuntime(t, r)
+
+	reply, err := r.Request(sfPlugins.GolangLocalRequest, "test.downstream.source", "a", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reply.GetByPath("error").AsStringDefault("")) == 0 {
+		t.Fatal("downstream signal without a links resolver succeeded")
+	}
+	r.SetLinksResolver(testLinksResolver)
+
+	tests := []struct {
+		linkType string
+		maxDepth int
+		want     []string
+	}{
+		{linkType: "*", maxDepth: 0, want: []string{"b", "c", "e"}},
+		{linkType: "x", maxDepth: 1, want: []string{"b", "c"}},
+		{linkType: "x", maxDepth: 2, want: []string{"b", "c", "d"}}, // d is reached twice
+		{linkType: "x", maxDepth: 5, want: []string{"b", "c", "d"}}, // Back link to a is not followed
+		{linkType: "", maxDepth: 3, want: []string{"b", "c", "d", "e", "f"}},
+		{linkType: "z", maxDepth: 3, want: []string{}},
+	}
+	for _, test := range tests {
+		reply, err := r.Request(sfPlugins.GolangLocalRequest, "test.downstream.source", "a", downstreamTestPayload(test.linkType, test.maxDepth), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if signaled := int(reply.GetByPath("signaled").AsNumericDefault(-1)); signaled != len(test.want) || reply.PathExists("error") {
+			t.Fatalf("links %q within %d: signaled %d with error %q, want %d", test.linkType, test.maxDepth, signaled, reply.GetByPath("error").AsStringDefault(""), len(test.want))
+		}
+		got := []string{}
+		for range test.want {
+			select {
+			case id := <-called:
+				got = append(got, id)
+			case <-time.After(testWaitTimeout):
+				t.Fatalf("links %q within %d: only %v signaled in time, want %v", test.linkType, test.maxDepth, got, test.want)
+			}
+		}
+		sort.Strings(got)
+		if fmt.Sprint(got) != fmt.Sprint(test.want) {
+			t.Fatalf("links %q within %d: signaled %v, want %v", test.linkType, test.maxDepth, got, test.want)
+		}
+	}
+
+	payload := downstreamTestPayload("x", 2)
+	payload.SetByPath("filter", easyjson.NewJSON("broken"))
+	if reply, err = r.Request(sfPlugins.GolangLocalRequest, "test.downstream.source", "a", payload, nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(reply.GetByPath("error").AsStringDefault("")) == 0 || reply.GetByPath("signaled").AsNumericDefault(-1) != 0 {
+		t.Fatalf("downstream signal with a failing links resolver replied %s", reply.ToString())
+	}
+}
+
+func TestDownstreamRequest(t *testing.T) {
+	r := newTestRuntime(t, newTestRuntimeConfig(backend.NewInMemory()))
+	registerDownstreamFunctionTypes(r)
+	r.SetLinksResolver(testLinksResolver)
+	startTestRuntime(t, r)
+
+	payload := downstreamTestPayload("x", 2)
+	payload.SetByPath("request", easyjson.NewJSON(true))
+	reply, err := r.Request(sfPlugins.GolangLocalRequest, "test.downstream.source", "a", payload, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply.PathExists("error") {
+		t.Fatalf("downstream request failed: %s", reply.GetByPath("error").AsStringDefault(""))
+	}
+
+	replies := reply.GetByPath("replies")
+	if id := replies.GetByPath("b.id").AsStringDefault(""); id != "b" {
+		t.Fatalf("reply of b is %s", replies.GetByPath("b").ToString())
+	}
+	if status := replies.GetByPath("c").GetByPath(ReplyErrorKey).AsStringDefault(""); status != "failed" {
+		t.Fatalf("reply of failed c is %s", replies.GetByPath("c").ToString())
+	}
+	if replies.PathExists("d") || !reply.GetByPath("errors").PathExists("d") {
+		t.Fatalf("d replied after the deadline, aggregated %s", reply.ToString())
+	}
+	if keys := reply.GetByPath("errors").ObjectKeys(); len(keys) != 1 {
+		t.Fatalf("errors are %s, want only d", reply.GetByPath("errors").ToString())
+	}
+}
@@ -3,6 +3,7 @@
 package statefun
 
 import (
+	"context"
 	"fmt"
 	"strings"
 	"sync"
@@ -14,32 +15,59 @@ import (
 
 	"github.com/foliagecp/easyjson"
 
+	"github.com/foliagecp/sdk/statefun/backend"
 	sfPlugins "github.com/foliagecp/sdk/statefun/plugins"
 	"github.com/foliagecp/sdk/statefun/system"
 )
 
 type FunctionLogicHandler func(sfPlugins.StatefunExecutor, *sfPlugins.StatefunContextProcessor)
 
+// RetriableFunctionLogicHandler returns an error to make the runtime redeliver a signal according to the function type's retry policy,
+// see NewRetryError and NewTerminalError for controlling the retry decision
+type RetriableFunctionLogicHandler func(sfPlugins.StatefunExecutor, *sfPlugins.StatefunContextProcessor) error
+
 type FunctionType struct {
 	runtime                 *Runtime
 	name                    string
 	subject                 string
 	config                  FunctionTypeConfig
-	logicHandler            FunctionLogicHandler
+	logicHandler            RetriableFunctionLogicHandler
+	interceptors            []Interceptor
+	handlerChain            RetriableFunctionLogicHandler // Logic handler wrapped by interceptors
 	idKeyMutex              system.KeyMutex
 	idHandlersChannel       sync.Map
 	idHandlersLastMsgTime   sync.Map
 	executor                *sfPlugins.TypenameExecutorPlugin
 	instancesControlChannel chan struct{}
 	resourceMutex           sync.Mutex
+	idHandlersRunning       sync.WaitGroup
+	stopMutex               sync.RWMutex
+	stopped                 bool
+	msgAckChannel           chan backend.Msg
+	msgAckerStopped         chan struct{}
+	partitioner             *idPartitioner // Not nil if the function type is partitioned
+	contextTouches          sync.Map       // id -> last stored access time of the function context, when context TTL is set
+	versionRouting          atomic.Value   // VersionRouting of a versioned function type
+
+	consumerSubs []backend.Subscription // JetStream consumer subscriptions, unsubscribed while paused
+	paused       bool
+	pauseMutex   sync.Mutex
 }
 
 func NewFunctionType(runtime *Runtime, name string, logicHandler FunctionLogicHandler, config FunctionTypeConfig) *FunctionType {
+	return NewRetriableFunctionType(runtime, name, func(executor sfPlugins.StatefunExecutor, contextProcessor *sfPlugins.StatefunContextProcessor) error {
+		logicHandler(executor, contextProcessor)
+		return nil
+	}, config)
+}
+
+func NewRetriableFunctionType(runtime *Runtime, name string, logicHandler RetriableFunctionLogicHandler, config FunctionTypeConfig) *FunctionType {
 	ft := &FunctionType{
 		runtime:                 runtime,
 		name:                    name,
 		subject:                 name + ".*",
 		logicHandler:            logicHandler,
+		handlerChain:            logicHandler,
 		idKeyMutex:              system.NewKeyMutex(),
 		config:                  config,
 		instancesControlChannel: nil,
@@ -79,7 +107,44 @@ func (ft *FunctionType) sendMsg(id string, msg FunctionTypeMsg) {
 	}
 	// ----------------------------------------------------------------------------------------------------*/
 
+	// Blocked sender waits without holding any lock, so other senders, the garbage collector and stopping are not stalled
+	var blockedUntil time.Time
+	for {
+		sent, refusalType := ft.trySendMsg(id, msg)
+		if sent {
+			return
+		}
+		if refusalType == MsgRefusedFunctionTypeStopped {
+			if msg.RefusalCallback != nil {
+				msg.RefusalCallback(refusalType)
+			}
+			return
+		}
+		if !ft.blocksOnOverflow(id, msg) {
+			ft.overflow(msg, refusalType)
+			return
+		}
+		if blockedUntil.IsZero() {
+			ft.countOverflow(OverflowActionBlocked)
+			blockedUntil = time.Now().Add(time.Duration(ft.getConfig().overflowTimeoutMs) * time.Millisecond)
+		} else if time.Now().After(blockedUntil) {
+			ft.overflow(msg, refusalType)
+			return
+		}
+		time.Sleep(OverflowBlockRetryIntervalMs * time.Millisecond)
+	}
+}
+
+// Puts the message into the id handler's message channel without waiting for room, starts the id handler if it is not running
+func (ft *FunctionType) trySendMsg(id string, msg FunctionTypeMsg) (sent bool, refusalType HandlerMsgRefusalType) {
+	ft.stopMutex.RLock()
+	defer ft.stopMutex.RUnlock()
+	if ft.stopped {
+		return false, MsgRefusedFunctionTypeStopped
+	}
+
 	ft.idKeyMutex.Lock(id)
+	defer ft.idKeyMutex.Unlock(id)
 	// Send msg to type id handler ------------------------------------------------------
 	var msgChannel chan FunctionTypeMsg
 
@@ -87,18 +152,14 @@ func (ft *FunctionType) sendMsg(id string, msg FunctionTypeMsg) {
 		msgChannel = value.(chan FunctionTypeMsg)
 	} else {
 		// Limit typename's max id handlers running -------
-		if ft.instancesControlChannel != nil {
-			select {
-			case ft.instancesControlChannel <- struct{}{}:
-			default: // Limit is reached
-				msg.RefusalCallback()
-				return
-			}
+		if !ft.acquireIDHandlerSlot() { // Limit is reached
+			return false, MsgRefusedMaxIdHandlersReached
 		}
 		// ------------------------------------------------
 
 		msgChannel = make(chan FunctionTypeMsg, ft.config.msgChannelSize)
 
+		ft.idHandlersRunning.Add(1)
 		go ft.idHandlerRoutine(id, msgChannel)
 		ft.idHandlersChannel.Store(id, msgChannel)
 		if ft.executor != nil {
@@ -107,34 +168,35 @@ func (ft *FunctionType) sendMsg(id string, msg FunctionTypeMsg) {
 	}
 	ft.idHandlersLastMsgTime.Store(id, time.Now().UnixNano())
 
-	select {
-	case msgChannel <- msg:
-		// Debug values update ----------------------------
-		gc := atomic.LoadInt64(&ft.runtime.gc)
-
-		if gc == 0 {
-			now := time.Now().UnixNano()
-			atomic.StoreInt64(&ft.runtime.glce, now)
-			atomic.StoreInt64(&ft.runtime.gt0, now)
-		}
-		atomic.AddInt64(&ft.runtime.gc, 1)
-		// ------------------------------------------------
-	default:
-		if msg.RefusalCallback != nil {
-			msg.RefusalCallback()
-		}
+	if !ft.enqueueMsg(msgChannel, msg) {
+		return false, MsgRefusedMsgChannelOverflow
 	}
 	// ----------------------------------------------------------------------------------
-	ft.idKeyMutex.Unlock(id)
+
+	// Debug values update ----------------------------
+	gc := atomic.LoadInt64(&ft.runtime.gc)
+
+	if gc == 0 {
+		now := time.Now().UnixNano()
+		atomic.StoreInt64(&ft.runtime.glce, now)
+		atomic.StoreInt64(&ft.runtime.gt0, now)
+	}
+	atomic.AddInt64(&ft.runtime.gc, 1)
+	// ------------------------------------------------
+	return true, 0
 }
 
 func (ft *FunctionType) idHandlerRoutine(id string, msgChannel chan FunctionTypeMsg) {
 	system.GlobalPrometrics.GetRoutinesCounter().Started("functiontype-idHandlerRoutine")
 	defer system.GlobalPrometrics.GetRoutinesCounter().Stopped("functiontype-idHandlerRoutine")
+	defer ft.idHandlersRunning.Done()
+	if ft.config.contextTTLSec > 0 {
+		ft.touchContext(id, system.GetCurrentTimeNs())
+	}
 	typenameIDContextProcessor := sfPlugins.StatefunContextProcessor{
 		GlobalCache:        ft.runtime.cacheStore,
-		GetFunctionContext: func() *easyjson.JSON { return ft.getContext(ft.name + "." + id) },
-		SetFunctionContext: func(context *easyjson.JSON) { ft.setContext(ft.name+"."+id, context) },
+		GetFunctionContext: func() *easyjson.JSON { return ft.getFunctionContext(id) },
+		SetFunctionContext: func(context *easyjson.JSON) { ft.setFunctionContext(id, context) },
 		GetObjectContext:   func() *easyjson.JSON { return ft.getContext(id) },
 		SetObjectContext:   func(context *easyjson.JSON) { ft.setContext(id, context) },
 		Self:               sfPlugins.StatefunAddress{Typename: ft.name, ID: id},
@@ -142,8 +204,50 @@ func (ft *FunctionType) idHandlerRoutine(id string, msgChannel chan FunctionType
 			return ft.runtime.signal(signalProvider, ft.name, id, targetTypename, targetID, j, o)
 		},
 		Request: func(requestProvider sfPlugins.RequestProvider, targetTypename string, targetID string, j *easyjson.JSON, o *easyjson.JSON) (*easyjson.JSON, error) {
-			return ft.runtime.request(requestProvider, ft.name, id, targetTypename, targetID, j, o)
+			return ft.runtime.request(context.Background(), requestProvider, ft.name, id, targetTypename, targetID, j, o)
+		},
+		RequestCtx: func(ctx context.Context, requestProvider sfPlugins.RequestProvider, targetTypename string, targetID string, j *easyjson.JSON, o *easyjson.JSON) (*easyjson.JSON, error) {
+			return ft.runtime.request(ctx, requestProvider, ft.name, id, targetTypename, targetID, j, o)
+		},
+		RequestAsync: func(ctx context.Context, requestProvider sfPlugins.RequestProvider, targetTypename string, targetID string, j *easyjson.JSON, o *easyjson.JSON) *sfPlugins.RequestFuture {
+			return ft.runtime.requestAsync(ctx, requestProvider, ft.name, id, targetTypename, targetID, j, o)
+		},
+		SignalIdempotent: func(signalProvider sfPlugins.SignalProvider, targetTypename string, targetID string, idempotencyKey string, j *easyjson.JSON, o *easyjson.JSON) error {
+			return ft.runtime.signalIdempotent(signalProvider, ft.name, id, targetTypename, targetID, idempotencyKey, j, o)
+		},
+		SignalAt: func(timerID string, at time.Time, targetTypename string, targetID string, j *easyjson.JSON, o *easyjson.JSON) error {
+			return ft.runtime.signalAt(timerID, at, ft.name, id, targetTypename, targetID, j, o)
+		},
+		SignalAfter: func(timerID string, delay time.Duration, targetTypename string, targetID string, j *easyjson.JSON, o *easyjson.JSON) error {
+			return ft.runtime.signalAt(timerID, time.Now().Add(delay), ft.name, id, targetTypename, targetID, j, o)
+		},
+		CancelTimer: ft.runtime.CancelTimer,
+		GetFunctionContextWithRevision: func() (*easyjson.JSON, int64) {
+			return ft.getFunctionContextWithRevision(id)
+		},
+		SetFunctionContextIfRevision: func(context *easyjson.JSON, revision int64) (int64, error) {
+			return ft.setFunctionContextIfRevision(id, context, revision)
+		},
+		UpdateFunctionContext: func(modify func(context *easyjson.JSON) error) error {
+			return ft.updateFunctionContext(id, modify)
+		},
+		GetObjectContextWithRevision: func() (*easyjson.JSON, int64) {
+			return ft.getContextWithRevision(id)
+		},
+		SetObjectContextIfRevision: func(context *easyjson.JSON, revision int64) (int64, error) {
+			return ft.setContextIfRevision(id, context, revision)
+		},
+		UpdateObjectContext: func(modify func(context *easyjson.JSON) error) error {
+			return ft.updateContext(id, modify)
 		},
+		DownstreamSignal: func(signalProvider sfPlugins.SignalProvider, targetTypename string, filter sfPlugins.DownstreamFilter, j *easyjson.JSON, o *easyjson.JSON) (int, error) {
+			return ft.runtime.downstreamSignal(signalProvider, ft.name, id, targetTypename, filter, j, o)
+		},
+		DownstreamRequest: func(ctx context.Context, requestProvider sfPlugins.RequestProvider, targetTypename string, filter sfPlugins.DownstreamFilter, j *easyjson.JSON, o *easyjson.JSON) (*easyjson.JSON, error) {
+			return ft.runtime.downstreamRequest(ctx, requestProvider, ft.name, id, targetTypename, filter, j, o)
+		},
+		DeleteFunctionContext: func() { ft.deleteContext(id) },
+		DeleteObjectContext:   func() { ft.runtime.deleteObjectContext(id) },
 		// To be assigned later:
 		// Call: ...
 		// Payload: ...
@@ -173,11 +277,34 @@ func (ft *FunctionType) handleMsgForID(id string, msg FunctionTypeMsg, typenameI
 		}
 	}*/
 
+	msgCtx, msgCtxCancel := context.WithCancel(context.Background())
+	if !msg.Deadline.IsZero() {
+		msgCtx, msgCtxCancel = context.WithDeadline(context.Background(), msg.Deadline)
+	}
+	defer msgCtxCancel()
+	if msg.RequestCallback != nil && msgCtx.Err() != nil { // Requester is not waiting for the reply anymore
+		msg.RequestCallback(errorReply("timeout", context.DeadlineExceeded))
+		return
+	}
+	typenameIDContextProcessor.Context = msgCtx
+
+	if ft.config.dedupGuardActive && len(msg.MsgID) > 0 && ft.msgAlreadyHandled(id, msg.MsgID) {
+		lg.Logf(lg.DebugLevel, "Function %s with id=%s has already handled message %s, skipping\n", ft.name, id, msg.MsgID)
+		ft.countHandlerOutcome(HandlerOutcomeDuplicate)
+		if msg.AckCallback != nil {
+			msg.AckCallback(true)
+		}
+		return
+	}
+
 	replyDataChannel := make(chan *easyjson.JSON, 1)
+	var replyIsDefault atomic.Bool
+	typenameIDContextProcessor.Reply = nil
 	if msg.RequestCallback != nil {
 		typenameIDContextProcessor.Reply = &sfPlugins.SyncReply{}
 
 		replyDataChannel <- easyjson.NewJSONObject().GetPtr()
+		replyIsDefault.Store(true)
 		cancelReplyIfExists := func() {
 			select { // Remove old value if exists
 			case <-replyDataChannel:
@@ -185,9 +312,11 @@ func (ft *FunctionType) handleMsgForID(id string, msg FunctionTypeMsg, typenameI
 			}
 		}
 		typenameIDContextProcessor.Reply.CancelDefault = func() {
+			replyIsDefault.Store(false)
 			cancelReplyIfExists()
 		}
 		typenameIDContextProcessor.Reply.With = func(data *easyjson.JSON) {
+			replyIsDefault.Store(false)
 			cancelReplyIfExists()
 			replyDataChannel <- data // Put new value
 		}
@@ -197,9 +326,7 @@ func (ft *FunctionType) handleMsgForID(id string, msg FunctionTypeMsg, typenameI
 	if typenameIDContextProcessor.Payload == nil {
 		typenameIDContextProcessor.Payload = easyjson.NewJSONObject().GetPtr()
 	}
-	ft.resourceMutex.Lock()
-	typenameIDContextProcessor.Options = ft.config.options.Clone().GetPtr()
-	ft.resourceMutex.Unlock()
+	typenameIDContextProcessor.Options = ft.getConfig().options.Clone().GetPtr()
 	if msg.Options != nil {
 		typenameIDContextProcessor.Options.DeepMerge(*msg.Options)
 	}
@@ -237,10 +364,18 @@ func (ft *FunctionType) handleMsgForID(id string, msg FunctionTypeMsg, typenameI
 	start := time.Now()
 
 	// Calling typename handler function --------------------
-	if ft.executor != nil {
-		ft.logicHandler(ft.executor.GetForID(id), typenameIDContextProcessor)
+	var handlerErr error
+	if validationErr := ft.validateMsg(typenameIDContextProcessor); validationErr != nil {
+		if typenameIDContextProcessor.Reply != nil {
+			typenameIDContextProcessor.Reply.With(errorReply("invalid", validationErr))
+		}
+		handlerErr = NewTerminalError(validationErr)
+	} else if contextErr := ft.prepareFunctionContext(id); contextErr != nil {
+		handlerErr = contextErr
+	} else if ft.executor != nil {
+		handlerErr = ft.handlerChain(ft.executor.GetForID(id), typenameIDContextProcessor)
 	} else {
-		ft.logicHandler(nil, typenameIDContextProcessor)
+		handlerErr = ft.handlerChain(nil, typenameIDContextProcessor)
 	}
 	// -------------------------------------------------------
 
@@ -249,17 +384,56 @@ func (ft *FunctionType) handleMsgForID(id string, msg FunctionTypeMsg, typenameI
 		gaugeVec.With(prometheus.Labels{"id": id}).Set(float64(time.Since(start).Microseconds()))
 	}
 
-	if msg.AckCallback != nil {
-		msg.AckCallback(true)
+	if handlerErr == nil {
+		if ft.config.dedupGuardActive && len(msg.MsgID) > 0 {
+			ft.rememberHandledMsg(id, msg.MsgID)
+		}
+		ft.countHandlerOutcome(HandlerOutcomeOk)
+		if msg.AckCallback != nil {
+			msg.AckCallback(true)
+		}
+	} else if msg.FailureCallback != nil {
+		msg.FailureCallback(handlerErr)
+	} else {
+		lg.Logf(lg.ErrorLevel, "Function %s with id=%s failed: %s\n", ft.name, id, handlerErr)
+		ft.countHandlerOutcome(HandlerOutcomeFailed)
+		if msg.AckCallback != nil {
+			msg.AckCallback(true)
+		}
+		if msg.RequestCallback != nil && replyIsDefault.Load() {
+			typenameIDContextProcessor.Reply.With(errorReply("failed", handlerErr))
+		}
 	}
 	if msg.RequestCallback != nil {
-		var replyData *easyjson.JSON = nil
+		replyCtx := msgCtx
+		if msg.Deadline.IsZero() {
+			var replyCtxCancel context.CancelFunc
+			replyCtx, replyCtxCancel = context.WithTimeout(msgCtx, time.Duration(ft.runtime.config.requestTimeoutSec)*time.Second)
+			defer replyCtxCancel()
+		}
+		reply := func(replyData *easyjson.JSON) {
+			if replyIsDefault.Load() && msgCtx.Err() != nil { // Handler returned past the deadline without replying
+				replyData = errorReply("timeout", context.DeadlineExceeded)
+			} else if handlerErr == nil {
+				if err := ft.config.replySchema.validate("reply", replyData); err != nil {
+					lg.Logf(lg.ErrorLevel, "Function %s with id=%s replied with invalid data: %s\n", ft.name, id, err)
+					replyData = errorReply("failed", err)
+				}
+			}
+			msg.RequestCallback(replyData)
+		}
 		select {
-		case replyData = <-replyDataChannel:
-		case <-time.After(time.Duration(ft.runtime.config.requestTimeoutSec) * time.Second):
-			replyData.SetByPath("status", easyjson.NewJSON("timeout"))
+		case replyData := <-replyDataChannel:
+			reply(replyData)
+		case <-replyCtx.Done():
+			select {
+			case replyData := <-replyDataChannel: // Replied right at the deadline
+				reply(replyData)
+			default:
+				lg.Logf(lg.WarnLevel, "Function %s with id=%s did not reply in time\n", ft.name, id)
+				msg.RequestCallback(errorReply("timeout", context.DeadlineExceeded))
+			}
 		}
-		msg.RequestCallback(replyData)
 	}
 
 	/*if !ft.config.balanceNeeded { // Use context mutex lock if function type is not typename balanced
@@ -277,21 +451,15 @@ func (ft *FunctionType) gc(typenameIDLifetimeMs int) (garbageCollected int, hand
 		if lastMsgTime+int64(typenameIDLifetimeMs)*int64(time.Millisecond) < now {
 			ft.idKeyMutex.Lock(id)
 
-			v, _ := ft.idHandlersChannel.Load(id)
-			msgChannel := v.(chan FunctionTypeMsg)
-			close(msgChannel)
-			ft.idHandlersChannel.Delete(id)
-			ft.idHandlersLastMsgTime.Delete(id)
-			if ft.executor != nil {
-				ft.executor.RemoveForID(id)
-			}
-			// TODO: When to delete  function context??? function's context may be needed later!!!!
-			// cacheStore.DeleteValue(ft.name+"."+id, true, -1, "") // Deleting function context
+			ft.collectIDHandler(id, lastMsgTime)
 			garbageCollected++
 			//lg.Logf(">>>>>>>>>>>>>> Garbage collected handler for %s:%s\n", ft.name, id)
 
 			ft.idKeyMutex.Unlock(id)
 		} else {
+			if ft.config.contextTTLSec > 0 {
+				ft.touchContextIfOld(id, lastMsgTime)
+			}
 			handlersRunning++
 		}
 		return true
@@ -307,6 +475,66 @@ func (ft *FunctionType) gc(typenameIDLifetimeMs int) (garbageCollected int, hand
 	return
 }
 
+// Must be called with ft.idKeyMutex locked for id
+func (ft *FunctionType) collectIDHandler(id string, lastMsgTime int64) {
+	ft.removeIDHandler(id)
+	if ft.config.contextTTLSec > 0 { // Function context is kept for the TTL since the last message, see contexts.go
+		ft.touchContext(id, lastMsgTime)
+		ft.contextTouches.Delete(id)
+	}
+}
+
+// Must be called with ft.idKeyMutex locked for id
+func (ft *FunctionType) removeIDHandler(id string) {
+	if v, ok := ft.idHandlersChannel.Load(id); ok {
+		close(v.(chan FunctionTypeMsg))
+		ft.idHandlersChannel.Delete(id)
+	}
+	ft.idHandlersLastMsgTime.Delete(id)
+	if ft.executor != nil {
+		ft.executor.RemoveForID(id)
+	}
+}
+
+// Refuses all new messages and closes all id handlers, already queued messages will still be handled
+func (ft *FunctionType) stop() {
+	ft.stopMutex.Lock()
+	ft.stopped = true
+	ft.stopMutex.Unlock()
+
+	ft.idHandlersChannel.Range(func(key, _ interface{}) bool {
+		id := key.(string)
+		ft.idKeyMutex.Lock(id)
+		ft.removeIDHandler(id)
+		ft.idKeyMutex.Unlock(id)
+		return true
+	})
+}
+
+// Waits for all id handlers to finish and for all handled messages to be acked
+func (ft *FunctionType) waitForStop(ctx context.Context) error {
+	handlersStopped := make(chan struct{})
+	go func() {
+		ft.idHandlersRunning.Wait()
+		close(handlersStopped)
+	}()
+	select {
+	case <-handlersStopped:
+	case <-ctx.Done():
+		return fmt.Errorf("function type %s did not finish handling messages in time: %w", ft.name, ctx.Err())
+	}
+
+	if ft.msgAckChannel != nil {
+		close(ft.msgAckChannel)
+		select {
+		case <-ft.msgAckerStopped:
+		case <-ctx.Done():
+			return fmt.Errorf("function type %s did not ack all handled messages in time: %w", ft.name, ctx.Err())
+		}
+	}
+	return nil
+}
+
 func (ft *FunctionType) getContext(keyValueID string) *easyjson.JSON {
 	if j, err := ft.runtime.cacheStore.GetValueAsJSON(keyValueID); err == nil {
 		return j
@@ -323,6 +551,50 @@ func (ft *FunctionType) setContext(keyValueID string, context *easyjson.JSON) {
 	}
 }
 
+// Revision is 0 if the context does not exist
+func (ft *FunctionType) getContextWithRevision(keyValueID string) (*easyjson.JSON, int64) {
+	value, revision, err := ft.runtime.cacheStore.GetValueWithRevision(keyValueID)
+	if err == nil {
+		if j, ok := easyjson.JSONFromBytes(value); ok {
+			return &j, revision
+		}
+	}
+	j := easyjson.NewJSONObject()
+	return &j, revision
+}
+
+func (ft *FunctionType) setContextIfRevision(keyValueID string, context *easyjson.JSON, revision int64) (int64, error) {
+	if context == nil {
+		return ft.runtime.cacheStore.SetValueIfRevision(keyValueID, nil, true, revision)
+	}
+	return ft.runtime.cacheStore.SetValueIfRevision(keyValueID, context.ToBytes(), true, revision)
+}
+
+func (ft *FunctionType) updateContext(keyValueID string, modify func(context *easyjson.JSON) error) error {
+	_, err := ft.runtime.cacheStore.UpdateValue(keyValueID, ft.config.contextUpdateAttempts, true, func(value []byte) ([]byte, error) {
+		context := easyjson.NewJSONObject()
+		if j, ok := easyjson.JSONFromBytes(value); ok {
+			context = j
+		}
+		if err := modify(&context); err != nil {
+			return nil, err
+		}
+		return context.ToBytes(), nil
+	})
+	return err
+}
+
+// Returns a copy of the config, the fields updatable at runtime must be read from it, see admin.go
+func (ft *FunctionType) getConfig() FunctionTypeConfig {
+	ft.resourceMutex.Lock()
+	defer ft.resourceMutex.Unlock()
+	return ft.config
+}
+
 func (ft *FunctionType) getStreamName() string {
 	return fmt.Sprintf("%s_stream", system.GetHashStr(ft.subject))
 }
+
+func (ft *FunctionType) getConsumerName() string {
+	return strings.ReplaceAll(ft.name, ".", "")
+}
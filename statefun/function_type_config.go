@@ -2,7 +2,12 @@
 
 package statefun
 
-import "github.com/foliagecp/easyjson"
+import (
+	"sort"
+	"strings"
+
+	"github.com/foliagecp/easyjson"
+)
 
 const (
 	MsgAckWaitTimeoutMs      = 10000
@@ -12,19 +17,93 @@ const (
 	MutexLifetimeSec         = 120
 	MultipleInstancesAllowed = false
 	MaxIdHandlers            = 20
+	DeadLetterActive         = false
+	MaxRefusedDeliveries     = 10
+	MaxDeliveries            = 0
+	RetryBackoffInitialMs    = 1000
+	RetryBackoffMaxMs        = 60000
+	RetryBackoffMultiplier   = 2.0
+	DefaultTerminalAction    = TerminalActionDeadLetter
+	IdempotencyWindowSec     = 120
+	DedupGuardActive         = false
+	DefaultAccessebility     = AccessGolangLocalSignal | AccessGolangLocalRequest | AccessJetstreamSignal
+	DefaultOverflowPolicy    = OverflowRefuse
+	OverflowTimeoutMs        = 1000
+	MaxAckPending            = 0
+	ContextUpdateAttempts    = 10
+	ContextTTLSec            = 0
+	ObjectBoundContext       = false
+)
+
+// TerminalAction defines what happens to a signal which handler keeps failing when no more deliveries are allowed
+type TerminalAction int
+
+const (
+	TerminalActionDeadLetter TerminalAction = iota // Drops the signal if the dead-letter stream is not active
+	TerminalActionDrop
+)
+
+// Access is a way a function type can be called, accesses are combined with "|"
+type Access int
+
+const (
+	AccessGolangLocalSignal Access = 1 << iota
+	AccessGolangLocalRequest
+	AccessJetstreamSignal
+	AccessNatsCoreRequest
+
+	AccessAll = AccessGolangLocalSignal | AccessGolangLocalRequest | AccessJetstreamSignal | AccessNatsCoreRequest
 )
 
+func (a Access) String() string {
+	names := []string{}
+	for access, name := range map[Access]string{
+		AccessGolangLocalSignal:  "golang local signal",
+		AccessGolangLocalRequest: "golang local request",
+		AccessJetstreamSignal:    "jetstream signal",
+		AccessNatsCoreRequest:    "nats core request",
+	} {
+		if a&access != 0 {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return strings.Join(names, "|")
+}
+
 type FunctionTypeConfig struct {
 	msgAckWaitMs      int
 	msgChannelSize    int
 	msgAckChannelSize int
 	balanceNeeded     bool
 	//balanced                 bool
-	serviceActive            bool
+	accessebility            Access
 	mutexLifeTimeSec         int
 	options                  *easyjson.JSON
 	multipleInstancesAllowed bool
 	maxIdHandlers            int
+	deadLetterActive         bool
+	maxRefusedDeliveries     int
+	maxDeliveries            int
+	retryBackoffInitialMs    int
+	retryBackoffMaxMs        int
+	retryBackoffMultiplier   float64
+	terminalAction           TerminalAction
+	cronSchedules            []CronSchedule
+	idempotencyWindowSec     int
+	dedupGuardActive         bool
+	payloadSchema            *msgSchema
+	optionsSchema            *msgSchema
+	replySchema              *msgSchema
+	partitions               int
+	overflowPolicy           OverflowPolicy
+	overflowTimeoutMs        int
+	maxAckPending            int
+	contextUpdateAttempts    int
+	contextTTLSec            int
+	objectBoundContext       bool
+	contextSchema            *contextSchema
+	version                  string
 }
 
 func NewFunctionTypeConfig() *FunctionTypeConfig {
@@ -33,10 +112,26 @@ func NewFunctionTypeConfig() *FunctionTypeConfig {
 		msgChannelSize:           MsgChannelSize,
 		msgAckChannelSize:        MsgAckChannelSize,
 		balanceNeeded:            BalanceNeeded,
+		accessebility:            DefaultAccessebility,
 		mutexLifeTimeSec:         MutexLifetimeSec,
 		options:                  easyjson.NewJSONObject().GetPtr(),
 		multipleInstancesAllowed: MultipleInstancesAllowed,
 		maxIdHandlers:            MaxIdHandlers,
+		deadLetterActive:         DeadLetterActive,
+		maxRefusedDeliveries:     MaxRefusedDeliveries,
+		maxDeliveries:            MaxDeliveries,
+		retryBackoffInitialMs:    RetryBackoffInitialMs,
+		retryBackoffMaxMs:        RetryBackoffMaxMs,
+		retryBackoffMultiplier:   RetryBackoffMultiplier,
+		terminalAction:           DefaultTerminalAction,
+		idempotencyWindowSec:     IdempotencyWindowSec,
+		dedupGuardActive:         DedupGuardActive,
+		overflowPolicy:           DefaultOverflowPolicy,
+		overflowTimeoutMs:        OverflowTimeoutMs,
+		maxAckPending:            MaxAckPending,
+		contextUpdateAttempts:    ContextUpdateAttempts,
+		contextTTLSec:            ContextTTLSec,
+		objectBoundContext:       ObjectBoundContext,
 	}
 }
 
@@ -60,13 +155,27 @@ func (ftc *FunctionTypeConfig) SetBalanceNeeded(balanceNeeded bool) *FunctionTyp
 	return ftc
 }
 
-// TODO: if serviceActive == false GOLANG local call should also be not possible!
-// TODO: SetAccessebility([]string = "golang local request" | "golang local signal" | "jetstream signal" | "nats core request")
+// SetServiceState defines whether the function type can be requested via NATS core, adds or removes AccessNatsCoreRequest
 func (ftc *FunctionTypeConfig) SetServiceState(active bool) *FunctionTypeConfig {
-	ftc.serviceActive = active
+	if active {
+		ftc.accessebility |= AccessNatsCoreRequest
+	} else {
+		ftc.accessebility &^= AccessNatsCoreRequest
+	}
 	return ftc
 }
 
+// SetAccessebility defines the only ways the function type can be called, e.g. AccessGolangLocalRequest|AccessGolangLocalSignal
+// for internal functions which must not be reachable from outside of the runtime. Timers and cron schedules signal via JetStream.
+func (ftc *FunctionTypeConfig) SetAccessebility(access Access) *FunctionTypeConfig {
+	ftc.accessebility = access
+	return ftc
+}
+
+func (ftc *FunctionTypeConfig) IsAccessible(access Access) bool {
+	return ftc.accessebility&access == access
+}
+
 func (ftc *FunctionTypeConfig) SetMultipleInstancesAllowance(allowed bool) *FunctionTypeConfig {
 	ftc.multipleInstancesAllowed = allowed
 	return ftc
@@ -86,3 +195,142 @@ func (ftc *FunctionTypeConfig) SetMaxIdHandlers(maxIdHandlers int) *FunctionType
 	ftc.maxIdHandlers = maxIdHandlers
 	return ftc
 }
+
+// SetDeadLetterState defines whether undeliverable signals are moved to the function type's dead-letter stream
+// instead of being dropped or redelivered endlessly, not active by default
+func (ftc *FunctionTypeConfig) SetDeadLetterState(active bool) *FunctionTypeConfig {
+	ftc.deadLetterActive = active
+	return ftc
+}
+
+// SetMaxRefusedDeliveries sets how many times a signal may be delivered and refused before it is moved to the dead-letter stream
+func (ftc *FunctionTypeConfig) SetMaxRefusedDeliveries(maxRefusedDeliveries int) *FunctionTypeConfig {
+	ftc.maxRefusedDeliveries = maxRefusedDeliveries
+	return ftc
+}
+
+// SetMaxDeliveries sets how many times a signal is delivered to a failing handler before the terminal action is applied, 0 - unlimited (default)
+func (ftc *FunctionTypeConfig) SetMaxDeliveries(maxDeliveries int) *FunctionTypeConfig {
+	ftc.maxDeliveries = maxDeliveries
+	return ftc
+}
+
+// SetRetryBackoff sets the redelivery delay after a handler failure: initialMs after the first delivery,
+// multiplied by multiplier after each next one, but not more than maxMs
+func (ftc *FunctionTypeConfig) SetRetryBackoff(initialMs int, maxMs int, multiplier float64) *FunctionTypeConfig {
+	ftc.retryBackoffInitialMs = initialMs
+	ftc.retryBackoffMaxMs = maxMs
+	ftc.retryBackoffMultiplier = multiplier
+	return ftc
+}
+
+// SetTerminalAction sets what happens to a failed signal which is not retried anymore, dead-lettering requires SetDeadLetterState(true)
+func (ftc *FunctionTypeConfig) SetTerminalAction(terminalAction TerminalAction) *FunctionTypeConfig {
+	ftc.terminalAction = terminalAction
+	return ftc
+}
+
+// AddCronSchedule declares the schedule which signals the function type with id on each tick of the cron expression,
+// the schedule is stored in KV when the runtime starts
+func (ftc *FunctionTypeConfig) AddCronSchedule(scheduleID string, cron string, id string, payloadTemplate *easyjson.JSON) *FunctionTypeConfig {
+	schedule := CronSchedule{ScheduleID: scheduleID, Cron: cron, ID: id}
+	if payloadTemplate != nil {
+		schedule.PayloadTemplate = payloadTemplate.Clone().GetPtr()
+	}
+	ftc.cronSchedules = append(ftc.cronSchedules, schedule)
+	return ftc
+}
+
+// SetIdempotencyWindowSec sets how long the function type's stream remembers idempotency keys of signals
+// to drop the ones which were already received
+func (ftc *FunctionTypeConfig) SetIdempotencyWindowSec(idempotencyWindowSec int) *FunctionTypeConfig {
+	ftc.idempotencyWindowSec = idempotencyWindowSec
+	return ftc
+}
+
+// SetDedupGuardState defines whether the function remembers idempotency keys of successfully handled signals per id
+// for the idempotency window and does not handle such signals again, e.g. when redelivered after a lost ack
+func (ftc *FunctionTypeConfig) SetDedupGuardState(active bool) *FunctionTypeConfig {
+	ftc.dedupGuardActive = active
+	return ftc
+}
+
+// SetPayloadSchema sets the JSON Schema incoming payloads are validated against before the handler is called, nil - no validation.
+// Schema is of the draft set by "$schema", 2020-12 by default, and may refer only to itself.
+// Invalid requests are replied with {ReplyErrorKey: "invalid", "status": "invalid", "result": <error>, "violations": [...]}, invalid signals are treated
+// as failed with a terminal error.
+func (ftc *FunctionTypeConfig) SetPayloadSchema(schema *easyjson.JSON) *FunctionTypeConfig {
+	ftc.payloadSchema = newMsgSchema("payload", schema)
+	return ftc
+}
+
+// SetOptionsSchema sets the JSON Schema options are validated against the same way as payloads,
+// options of the function type are merged with the incoming ones before the validation
+func (ftc *FunctionTypeConfig) SetOptionsSchema(schema *easyjson.JSON) *FunctionTypeConfig {
+	ftc.optionsSchema = newMsgSchema("options", schema)
+	return ftc
+}
+
+// SetReplySchema sets the JSON Schema replies of the handler are validated against,
+// an invalid reply is replaced with {ReplyErrorKey: "failed", "status": "failed", "result": <error>, "violations": [...]}
+func (ftc *FunctionTypeConfig) SetReplySchema(schema *easyjson.JSON) *FunctionTypeConfig {
+	ftc.replySchema = newMsgSchema("reply", schema)
+	return ftc
+}
+
+// SetPartitions makes signals for the same id be handled by the same runtime in order by splitting ids into the given number
+// of partitions distributed among the runtimes handling the function type, 0 - any runtime handles any signal.
+// All runtimes must use the same number of partitions for the function type and allow its multiple instances.
+func (ftc *FunctionTypeConfig) SetPartitions(partitions int) *FunctionTypeConfig {
+	ftc.partitions = partitions
+	return ftc
+}
+
+// SetOverflowPolicy defines what happens to a message when the id handler's message channel is full or max id handlers are running,
+// timeoutMs is how long OverflowBlock waits for free room and how late OverflowSpill redelivers JetStream signals
+func (ftc *FunctionTypeConfig) SetOverflowPolicy(policy OverflowPolicy, timeoutMs int) *FunctionTypeConfig {
+	ftc.overflowPolicy = policy
+	ftc.overflowTimeoutMs = timeoutMs
+	return ftc
+}
+
+// SetMaxAckPending limits how many JetStream signals may be delivered to the function type's runtimes and not acked yet,
+// so a burst stays in the stream instead of overflowing id handlers, 0 - backend default
+func (ftc *FunctionTypeConfig) SetMaxAckPending(maxAckPending int) *FunctionTypeConfig {
+	ftc.maxAckPending = maxAckPending
+	return ftc
+}
+
+// SetContextUpdateAttempts sets how many times UpdateFunctionContext and UpdateObjectContext call the modify function
+// when the context keeps being changed concurrently before giving up
+func (ftc *FunctionTypeConfig) SetContextUpdateAttempts(attempts int) *FunctionTypeConfig {
+	ftc.contextUpdateAttempts = attempts
+	return ftc
+}
+
+// SetContextTTLSec makes the function context of an id be deleted when the id has not handled messages for ttlSec, 0 - never
+func (ftc *FunctionTypeConfig) SetContextTTLSec(ttlSec int) *FunctionTypeConfig {
+	ftc.contextTTLSec = ttlSec
+	return ftc
+}
+
+// SetContextDeletionWithObject makes the function context of an id be deleted when the object with the same id
+// (e.g. graph vertex) is deleted via DeleteObjectContext
+func (ftc *FunctionTypeConfig) SetContextDeletionWithObject(deletionWithObject bool) *FunctionTypeConfig {
+	ftc.objectBoundContext = deletionWithObject
+	return ftc
+}
+
+// SetContextSchema declares the schema version of the function context and the migrations upgrading older contexts to it in order:
+// the last migration upgrades to version, the one before it to version-1, etc. Contexts stored without a version are of version 0.
+func (ftc *FunctionTypeConfig) SetContextSchema(version int, migrations ...ContextMigration) *FunctionTypeConfig {
+	ftc.contextSchema = &contextSchema{version: version, migrations: migrations}
+	return ftc
+}
+
+// SetVersion registers the function type as the version, versions run side by side and get ids by the routing table,
+// see Runtime.SetVersionRouting. Version must be a valid subject token, empty - not versioned.
+func (ftc *FunctionTypeConfig) SetVersion(version string) *FunctionTypeConfig {
+	ftc.version = version
+	return ftc
+}
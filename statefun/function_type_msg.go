@@ -1,6 +1,8 @@
 package statefun
 
 import (
+	"time"
+
 	"github.com/foliagecp/easyjson"
 
 	sfPlugins "github.com/foliagecp/sdk/statefun/plugins"
@@ -8,15 +10,43 @@ import (
 
 type HandlerMsgRefusalType int
 
-type RefusalCallbackAction = func()
+const (
+	MsgRefusedFunctionTypeStopped HandlerMsgRefusalType = iota
+	MsgRefusedMaxIdHandlersReached
+	MsgRefusedMsgChannelOverflow
+	MsgRefusedDroppedAsOldest
+)
+
+func (rt HandlerMsgRefusalType) String() string {
+	switch rt {
+	case MsgRefusedFunctionTypeStopped:
+		return "function type is stopped"
+	case MsgRefusedMaxIdHandlersReached:
+		return "max id handlers reached"
+	case MsgRefusedMsgChannelOverflow:
+		return "id handler message channel overflow"
+	case MsgRefusedDroppedAsOldest:
+		return "dropped as the oldest one on id handler message channel overflow"
+	default:
+		return "unknown refusal"
+	}
+}
+
+type RefusalCallbackAction = func(refusalType HandlerMsgRefusalType)
 type RequestCallbackAction = func(data *easyjson.JSON)
 type SignalCallbackAction = func(ack bool)
+type FailureCallbackAction = func(err error)
+type SpillCallbackAction = func() error
 
 type FunctionTypeMsg struct {
 	Caller          *sfPlugins.StatefunAddress
 	Payload         *easyjson.JSON
 	Options         *easyjson.JSON
+	Deadline        time.Time // Deadline of the request, zero time if there is no one
+	MsgID           string    // Idempotency key of the signal, empty if there is no one
 	RefusalCallback RefusalCallbackAction
 	RequestCallback RequestCallbackAction
 	AckCallback     SignalCallbackAction
+	FailureCallback FailureCallbackAction // Called instead of AckCallback when the handler returned an error
+	SpillCallback   SpillCallbackAction   // Leaves the signal to JetStream to be handled later, nil if the message cannot be spilled
 }
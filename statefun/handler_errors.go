@@ -0,0 +1,111 @@
+// Copyright 2023 NJWS Inc.
+
+package statefun
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/foliagecp/sdk/statefun/backend"
+	lg "github.com/foliagecp/sdk/statefun/logger"
+	"github.com/foliagecp/sdk/statefun/system"
+)
+
+const (
+	HandlerOutcomeOk           = "ok"
+	HandlerOutcomeFailed       = "failed" // Requested handler failed, failure was replied to the requester
+	HandlerOutcomeRetried      = "retried"
+	HandlerOutcomeDropped      = "dropped"
+	HandlerOutcomeDeadLettered = "dead_lettered"
+	HandlerOutcomeDuplicate    = "duplicate" // Signal was already handled, suppressed by the dedup guard
+)
+
+// TerminalError makes the runtime apply the function type's terminal action to a signal right away without retrying
+type TerminalError struct {
+	Err error
+}
+
+func NewTerminalError(err error) error {
+	return &TerminalError{Err: err}
+}
+
+func (e *TerminalError) Error() string {
+	return fmt.Sprintf("terminal: %v", e.Err)
+}
+
+func (e *TerminalError) Unwrap() error {
+	return e.Err
+}
+
+// RetryError makes the runtime redeliver a signal after the given delay instead of the one defined by the retry backoff
+type RetryError struct {
+	Err   error
+	Delay time.Duration
+}
+
+func NewRetryError(err error, delay time.Duration) error {
+	return &RetryError{Err: err, Delay: delay}
+}
+
+func (e *RetryError) Error() string {
+	return fmt.Sprintf("retry in %s: %v", e.Delay, e.Err)
+}
+
+func (e *RetryError) Unwrap() error {
+	return e.Err
+}
+
+func (ft *FunctionType) retryBackoff(deliveries uint64) time.Duration {
+	config := ft.getConfig()
+	delayMs := float64(config.retryBackoffInitialMs) * math.Pow(config.retryBackoffMultiplier, float64(deliveries)-1)
+	if delayMs > float64(config.retryBackoffMaxMs) {
+		delayMs = float64(config.retryBackoffMaxMs)
+	}
+	return time.Duration(delayMs) * time.Millisecond
+}
+
+// Decides what to do with a signal which handler returned an error: redeliver it later or apply the terminal action
+func (ft *FunctionType) handleSignalFailure(msg backend.Msg, id string, handlerErr error, ack func()) {
+	deliveries := msg.NumDelivered()
+	config := ft.getConfig()
+
+	var terminalErr *TerminalError
+	if !errors.As(handlerErr, &terminalErr) && (config.maxDeliveries <= 0 || deliveries < uint64(config.maxDeliveries)) {
+		delay := ft.retryBackoff(deliveries)
+		var retryErr *RetryError
+		if errors.As(handlerErr, &retryErr) && retryErr.Delay > 0 {
+			delay = retryErr.Delay
+		}
+		lg.Logf(lg.WarnLevel, "Function %s with id=%s failed on delivery %d, retrying in %s: %s\n", ft.name, id, deliveries, delay, handlerErr)
+		system.MsgOnErrorReturn(msg.NakWithDelay(delay))
+		ft.countHandlerOutcome(HandlerOutcomeRetried)
+		return
+	}
+
+	if config.terminalAction == TerminalActionDeadLetter {
+		if config.deadLetterActive {
+			reason := fmt.Sprintf("handler failed on delivery %d: %s", deliveries, handlerErr)
+			if err := ft.deadLetter(msg, reason); err != nil {
+				lg.Logf(lg.ErrorLevel, "Cannot dead-letter message for function %s with id=%s: %s\n", ft.name, id, err)
+				system.MsgOnErrorReturn(msg.Nak())
+				return
+			}
+			ft.countHandlerOutcome(HandlerOutcomeDeadLettered)
+			ack()
+			return
+		}
+	}
+	lg.Logf(lg.ErrorLevel, "Function %s with id=%s failed on delivery %d, dropping message: %s\n", ft.name, id, deliveries, handlerErr)
+	ft.countHandlerOutcome(HandlerOutcomeDropped)
+	ack()
+}
+
+func (ft *FunctionType) countHandlerOutcome(outcome string) {
+	if counterVec, err := system.GlobalPrometrics.EnsureCounterVecSimple("statefun_handler_outcomes", "Stateful function handler call outcomes", []string{"typename", "outcome"}); err == nil {
+		counterVec.With(prometheus.Labels{"typename": ft.name, "outcome": outcome}).Inc()
+	}
+}
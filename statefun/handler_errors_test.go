@@ -0,0 +1,149 @@
+// Copyright 2023 NJWS Inc.
+
+package statefun
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/foliagecp/sdk/statefun/backend"
+	sfPlugins "github.com/foliagecp/sdk/statefun/plugins"
+)
+
+func TestRetryBackoff(t *testing.T) {
+	ft := &FunctionType{config: *NewFunctionTypeConfig().SetRetryBackoff(100, 1000, 3)}
+	for deliveries, want := range map[uint64]time.Duration{
+		1: 100 * time.Millisecond,
+		2: 300 * time.Millisecond,
+		3: 900 * time.Millisecond,
+		4: time.Second,
+		9: time.Second,
+	} {
+		if delay := ft.retryBackoff(deliveries); delay != want {
+			t.Errorf("retry backoff after delivery %d is %s, want %s", deliveries, delay, want)
+		}
+	}
+}
+
+func TestHandlerErrors(t *testing.T) {
+	tests := []struct {
+		name            string
+		config          *FunctionTypeConfig
+		failures        int   // How many first calls fail
+		err             error // Error the failing calls return
+		wantCalls       int
+		wantDeadLetters int
+	}{
+		{
+			name:      "retried until handled",
+			config:    NewFunctionTypeConfig().SetMaxDeliveries(5),
+			failures:  2,
+			err:       errors.New("temporary"),
+			wantCalls: 3,
+		},
+		{
+			name:            "dead-lettered after max deliveries",
+			config:          NewFunctionTypeConfig().SetMaxDeliveries(3).SetDeadLetterState(true),
+			failures:        -1,
+			err:             errors.New("persistent"),
+			wantCalls:       3,
+			wantDeadLetters: 1,
+		},
+		{
+			name:      "dropped after max deliveries",
+			config:    NewFunctionTypeConfig().SetMaxDeliveries(2).SetTerminalAction(TerminalActionDrop).SetDeadLetterState(true),
+			failures:  -1,
+			err:       errors.New("persistent"),
+			wantCalls: 2,
+		},
+		{
+			name:      "dropped without dead-letter stream",
+			config:    NewFunctionTypeConfig().SetMaxDeliveries(2),
+			failures:  -1,
+			err:       errors.New("persistent"),
+			wantCalls: 2,
+		},
+		{
+			name:      "retried without limit by default",
+			config:    NewFunctionTypeConfig(),
+			failures:  6,
+			err:       errors.New("temporary"),
+			wantCalls: 7,
+		},
+		{
+			name:            "terminal error is not retried",
+			config:          NewFunctionTypeConfig().SetMaxDeliveries(5).SetDeadLetterState(true),
+			failures:        -1,
+			err:             NewTerminalError(errors.New("fatal")),
+			wantCalls:       1,
+			wantDeadLetters: 1,
+		},
+		{
+			name:      "retry error overrides the backoff",
+			config:    NewFunctionTypeConfig().SetMaxDeliveries(5).SetRetryBackoff(60000, 60000, 1),
+			failures:  1,
+			err:       NewRetryError(errors.New("retry soon"), 10*time.Millisecond),
+			wantCalls: 2,
+		},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			r := newTestRuntime(t, newTestRuntimeConfig(backend.NewInMemory()))
+			calls := newTestCalls()
+			var callsCount atomic.Int32
+			config := test.config
+			if test.config.retryBackoffInitialMs == RetryBackoffInitialMs {
+				config = config.SetRetryBackoff(10, 50, 2)
+			}
+			NewRetriableFunctionType(r.Runtime, "test.failing", func(_ sfPlugins.StatefunExecutor, contextProcessor *sfPlugins.StatefunContextProcessor) error {
+				calls.record(contextProcessor)
+				if n := int(callsCount.Add(1)); test.failures < 0 || n <= test.failures {
+					return test.err
+				}
+				return nil
+			}, *config)
+			startTestRuntime(t, r)
+
+			if err := r.Signal(sfPlugins.JetstreamGlobalSignal, "test.failing", "a", nil, nil); err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < test.wantCalls; i++ {
+				calls.wait(t)
+			}
+			calls.expectNone(t, 200*time.Millisecond)
+			if !config.deadLetterActive {
+				return
+			}
+
+			deadLetters, err := r.DeadLetters("test.failing", 0, 10)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(deadLetters) != test.wantDeadLetters {
+				t.Fatalf("%d dead letters, want %d", len(deadLetters), test.wantDeadLetters)
+			}
+			if len(deadLetters) > 0 && deadLetters[0].Deliveries != uint64(test.wantCalls) {
+				t.Fatalf("dead letter was delivered %d times, want %d", deadLetters[0].Deliveries, test.wantCalls)
+			}
+		})
+	}
+}
+
+func TestRequestedHandlerFailure(t *testing.T) {
+	r := newTestRuntime(t, newTestRuntimeConfig(backend.NewInMemory()))
+	NewRetriableFunctionType(r.Runtime, "test.failing", func(_ sfPlugins.StatefunExecutor, _ *sfPlugins.StatefunContextProcessor) error {
+		return errors.New("cannot handle")
+	}, *NewFunctionTypeConfig())
+	startTestRuntime(t, r)
+
+	reply, err := r.Request(sfPlugins.GolangLocalRequest, "test.failing", "a", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply.GetByPath(ReplyErrorKey).AsStringDefault("") != "failed" || reply.GetByPath("result").AsStringDefault("") != "cannot handle" {
+		t.Fatalf("failed handler replied with %s", reply.ToString())
+	}
+}
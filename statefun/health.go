@@ -0,0 +1,142 @@
+// Copyright 2023 NJWS Inc.
+
+package statefun
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/foliagecp/easyjson"
+
+	lg "github.com/foliagecp/sdk/statefun/logger"
+	"github.com/foliagecp/sdk/statefun/system"
+)
+
+/*
+Liveness reports the failures a restart of the runtime fixes: the cache store has stopped receiving updates from the KV store
+or writing its changes into it. A disconnected backend does not fail liveness, it may reconnect.
+Readiness turns true after Start has created the streams and consumers of all function types and the cache store has loaded
+the KV store, then reports whether the backend is connected, the consumers of the function types running in this runtime exist
+and the runtime is live. A runtime being shut down is live but not ready.
+
+If the health server address is set, the runtime serves them via HTTP at /livez and /readyz:
+200 or 503 with {"status": "ok"|"failed", "checks": {"<component>": "ok"|"<error>"}}.
+*/
+
+type HealthReport struct {
+	Healthy bool
+	Checks  map[string]string // Component -> "ok" or the error
+}
+
+func newHealthReport() *HealthReport {
+	return &HealthReport{Healthy: true, Checks: map[string]string{}}
+}
+
+func (hr *HealthReport) add(component string, err error) {
+	if err != nil {
+		hr.Healthy = false
+		hr.Checks[component] = err.Error()
+	} else {
+		hr.Checks[component] = "ok"
+	}
+}
+
+func (hr *HealthReport) toJSON() easyjson.JSON {
+	j := easyjson.NewJSONObject()
+	if hr.Healthy {
+		j.SetByPath("status", easyjson.NewJSON("ok"))
+	} else {
+		j.SetByPath("status", easyjson.NewJSON("failed"))
+	}
+	checks := map[string]interface{}{} // Component names contain dots, so not set by path
+	for component, result := range hr.Checks {
+		checks[component] = result
+	}
+	j.SetByPath("checks", easyjson.NewJSON(checks))
+	return j
+}
+
+// Liveness checks the runtime's components which do not recover by themselves
+func (r *Runtime) Liveness() HealthReport {
+	report := newHealthReport()
+	r.checkLiveness(report)
+	return *report
+}
+
+func (r *Runtime) checkLiveness(report *HealthReport) {
+	if !r.ready.Load() || r.ctx.Err() != nil { // Cache store is being created or destroyed
+		return
+	}
+	report.add("cache_kv_watch", r.cacheStore.CheckKVWatch())
+	report.add("cache_lazy_writer", r.cacheStore.CheckLazyWriter())
+}
+
+// Readiness checks whether the runtime is started and can handle messages
+func (r *Runtime) Readiness(ctx context.Context) HealthReport {
+	report := newHealthReport()
+	if r.ctx.Err() != nil {
+		report.add("runtime", fmt.Errorf("runtime is shutting down"))
+		return *report
+	}
+	if !r.ready.Load() {
+		report.add("runtime", fmt.Errorf("runtime is starting"))
+		return *report
+	}
+	report.add("runtime", nil)
+	if err := r.backend.Check(); err != nil { // Consumers cannot be checked either
+		report.add("backend", err)
+		r.checkLiveness(report)
+		return *report
+	}
+	report.add("backend", nil)
+
+	ctx, cancel := context.WithTimeout(ctx, HealthCheckTimeoutSec*time.Second)
+	defer cancel()
+	for _, ft := range r.registeredFunctionTypes {
+		if !r.runsFunctionType(ft) {
+			continue
+		}
+		report.add("consumer."+ft.name, r.backend.CheckConsumer(ctx, ft.getStreamName(), ft.getConsumerName()))
+		if ft.versioned() {
+			report.add("consumer."+ft.name+"."+ft.config.version, r.backend.CheckConsumer(ctx, getVersionsStreamName(ft.name), ft.getVersionConsumerName()))
+		}
+	}
+
+	r.checkLiveness(report)
+	return *report
+}
+
+func (r *Runtime) startHealthServer() {
+	serveReport := func(w http.ResponseWriter, report HealthReport) {
+		w.Header().Set("Content-Type", "application/json")
+		if !report.Healthy {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		_, err := w.Write(report.toJSON().ToBytes())
+		system.MsgOnErrorReturn(err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/livez", func(w http.ResponseWriter, _ *http.Request) {
+		serveReport(w, r.Liveness())
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, req *http.Request) {
+		serveReport(w, r.Readiness(req.Context()))
+	})
+	r.healthServer = startHTTPServer("Health", r.config.healthServerAddr, mux)
+}
+
+// Server is stopped by Shutdown
+func startHTTPServer(name string, addr string, handler http.Handler) *http.Server {
+	server := &http.Server{Addr: addr, Handler: handler}
+	go func() {
+		system.GlobalPrometrics.GetRoutinesCounter().Started("runtime.httpServer")
+		defer system.GlobalPrometrics.GetRoutinesCounter().Stopped("runtime.httpServer")
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			lg.Logf(lg.ErrorLevel, "%s server on %s stopped: %s\n", name, addr, err)
+		}
+	}()
+	return server
+}
@@ -1,6 +1,8 @@
 package statefun
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"time"
 
@@ -10,10 +12,14 @@ import (
 	"github.com/foliagecp/sdk/statefun/system"
 )
 
-func buildNatsData(callerTypename string, callerID string, payload *easyjson.JSON, options *easyjson.JSON) []byte {
+// deadline - request deadline passed to the target function, zero time if there is no one
+func buildNatsData(callerTypename string, callerID string, payload *easyjson.JSON, options *easyjson.JSON, deadline time.Time) []byte {
 	data := easyjson.NewJSONObject()
 	data.SetByPath("caller_typename", easyjson.NewJSON(callerTypename))
 	data.SetByPath("caller_id", easyjson.NewJSON(callerID))
+	if !deadline.IsZero() {
+		data.SetByPath("deadline", easyjson.NewJSON(deadline.UnixNano()))
+	}
 	if payload != nil {
 		data.SetByPath("payload", *payload)
 	}
@@ -25,17 +31,66 @@ func buildNatsData(callerTypename string, callerID string, payload *easyjson.JSO
 
 func (r *Runtime) signal(signalProvider sfPlugins.SignalProvider, callerTypename string, callerID string, targetTypename string, targetID string, payload *easyjson.JSON, options *easyjson.JSON) error {
 	jetstreamGlobalSignal := func() error {
-		go func() {
-			system.GlobalPrometrics.GetRoutinesCounter().Started("ingress-jetstreamGlobalSignal-gofunc")
-			defer system.GlobalPrometrics.GetRoutinesCounter().Stopped("ingress-jetstreamGlobalSignal-gofunc")
-			system.MsgOnErrorReturn(r.nc.Publish(fmt.Sprintf("%s.%s", targetTypename, targetID), buildNatsData(callerTypename, callerID, payload, options)))
-		}()
+		err := r.backend.StreamPublish(r.streamSubject(targetTypename, targetID), buildNatsData(callerTypename, callerID, payload, options, time.Time{}))
+		if err != nil {
+			return fmt.Errorf("cannot signal function typename \"%s\" with id \"%s\": %w", targetTypename, targetID, err)
+		}
 		return nil
 	}
 
+	natsCoreGlobalSignal := func() error {
+		return r.backend.Publish(r.streamSubject(targetTypename, targetID), buildNatsData(callerTypename, callerID, payload, options, time.Time{}))
+	}
+
+	goLangLocalSignal := func() error {
+		targetFT, ok := r.registeredFunctionTypes[targetTypename]
+		if !ok {
+			return fmt.Errorf("cannot signal function typename \"%s\" locally, not registered", targetTypename)
+		}
+		if !targetFT.config.IsAccessible(AccessGolangLocalSignal) {
+			return fmt.Errorf("function typename \"%s\" is not accessible via %s", targetTypename, AccessGolangLocalSignal)
+		}
+		if _, other := targetFT.otherVersion(targetID); other && targetFT.config.IsAccessible(AccessJetstreamSignal) {
+			return jetstreamGlobalSignal()
+		}
+
+		// Do not send original data, prevents same data concurrent access from different functions
+		functionMsg := FunctionTypeMsg{Caller: &sfPlugins.StatefunAddress{Typename: callerTypename, ID: callerID}}
+		if payload != nil {
+			functionMsg.Payload = payload.Clone().GetPtr()
+		}
+		if options != nil {
+			functionMsg.Options = options.Clone().GetPtr()
+		}
+		// ----------------------------------------------------------------------------------------
+
+		if targetFT.config.IsAccessible(AccessJetstreamSignal) {
+			functionMsg.SpillCallback = func() error {
+				return r.backend.StreamPublish(r.streamSubject(targetTypename, targetID), buildNatsData(callerTypename, callerID, payload, options, time.Time{}))
+			}
+		}
+
+		var refusal error
+		functionMsg.RefusalCallback = func(refusalType HandlerMsgRefusalType) { // Is called synchronously by sendMsg
+			refusal = fmt.Errorf("target function typename \"%s\" with id \"%s\" resufes to handle signal: %s", targetTypename, targetID, refusalType)
+		}
+		targetFT.sendMsg(targetID, functionMsg)
+		return refusal
+	}
+
 	switch signalProvider {
 	case sfPlugins.JetstreamGlobalSignal:
+		if err := r.checkLocalAccess(targetTypename, AccessJetstreamSignal); err != nil {
+			return err
+		}
 		return jetstreamGlobalSignal()
+	case sfPlugins.GolangLocalSignal:
+		return goLangLocalSignal()
+	case sfPlugins.NatsCoreGlobalSignal:
+		if err := r.checkLocalAccess(targetTypename, AccessJetstreamSignal); err != nil { // Is captured by the function type's stream anyway
+			return err
+		}
+		return natsCoreGlobalSignal()
 	default:
 		return fmt.Errorf("unknown signal provider: %d", signalProvider)
 	}
@@ -45,30 +100,79 @@ func (r *Runtime) Signal(signalProvider sfPlugins.SignalProvider, typename strin
 	return r.signal(signalProvider, "ingress", "nats", typename, id, payload, options)
 }
 
-func (r *Runtime) request(requestProvider sfPlugins.RequestProvider, callerTypename string, callerID string, targetTypename string, targetID string, payload *easyjson.JSON, options *easyjson.JSON) (*easyjson.JSON, error) {
+// Unlike signal waits for the stream to store the message, so the caller may retry on error
+func (r *Runtime) signalIdempotent(signalProvider sfPlugins.SignalProvider, callerTypename string, callerID string, targetTypename string, targetID string, idempotencyKey string, payload *easyjson.JSON, options *easyjson.JSON) error {
+	if len(idempotencyKey) == 0 {
+		return fmt.Errorf("idempotency key must not be empty")
+	}
+	switch signalProvider {
+	case sfPlugins.JetstreamGlobalSignal:
+		if err := r.checkLocalAccess(targetTypename, AccessJetstreamSignal); err != nil {
+			return err
+		}
+		return r.backend.StreamPublishMsgID(r.streamSubject(targetTypename, targetID), buildNatsData(callerTypename, callerID, payload, options, time.Time{}), idempotencyKey)
+	default:
+		return fmt.Errorf("signal provider %d does not support idempotency keys", signalProvider)
+	}
+}
+
+// SignalIdempotent signals the function so that signals with the same idempotency key sent within the target function type's
+// idempotency window are delivered only once, so the signal can be safely retried on error.
+// Combine with the function type's dedup guard to also prevent handling the same signal twice on redelivery.
+func (r *Runtime) SignalIdempotent(signalProvider sfPlugins.SignalProvider, typename string, id string, idempotencyKey string, payload *easyjson.JSON, options *easyjson.JSON) error {
+	return r.signalIdempotent(signalProvider, "ingress", "nats", typename, id, idempotencyKey, payload, options)
+}
+
+// Fails early if the target function type is registered in this runtime and is not accessible the way,
+// otherwise access is checked by the runtime handling the function type
+func (r *Runtime) checkLocalAccess(targetTypename string, access Access) error {
+	if targetFT, ok := r.registeredFunctionTypes[targetTypename]; ok && !targetFT.config.IsAccessible(access) {
+		return fmt.Errorf("function typename \"%s\" is not accessible via %s", targetTypename, access)
+	}
+	return nil
+}
+
+func (r *Runtime) request(ctx context.Context, requestProvider sfPlugins.RequestProvider, callerTypename string, callerID string, targetTypename string, targetID string, payload *easyjson.JSON, options *easyjson.JSON) (*easyjson.JSON, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(r.config.requestTimeoutSec)*time.Second)
+		defer cancel()
+	}
+	deadline, _ := ctx.Deadline()
+
 	natsCoreGlobalRequest := func() (*easyjson.JSON, error) {
-		resp, err := r.nc.Request(
+		resp, err := r.backend.Request(
+			ctx,
 			fmt.Sprintf("service.%s.%s", targetTypename, targetID),
-			buildNatsData(callerTypename, callerID, payload, options),
-			time.Duration(r.config.requestTimeoutSec)*time.Second,
+			buildNatsData(callerTypename, callerID, payload, options, deadline),
 		)
 		if err == nil {
-			if j, ok := easyjson.JSONFromBytes(resp.Data); ok {
-				return &j, nil
+			if len(resp) == 0 {
+				return nil, fmt.Errorf("target function typename \"%s\" with id \"%s\" refuses to handle request", targetTypename, targetID)
+			}
+			if j, ok := easyjson.JSONFromBytes(resp); ok {
+				return replyOrTimeout(&j, targetTypename, targetID)
 			}
 			return nil, fmt.Errorf("response from function typename \"%s\" with id \"%s\" is not a json", targetTypename, targetID)
 		}
+		if errors.Is(err, context.DeadlineExceeded) {
+			return nil, fmt.Errorf("timeout occured while requesting function typename \"%s\" with id \"%s\": %w", targetTypename, targetID, err)
+		}
 		return nil, err
 	}
 
 	goLangLocalRequest := func() (*easyjson.JSON, error) {
 		if targetFT, ok := r.registeredFunctionTypes[targetTypename]; ok {
-			// TODO: localGolangServiceActive ???
-			/*if !targetFT.config.serviceActive {
-				return nil, fmt.Errorf("callFunctionGolangSync cannot request function with the typename %s, not running as a service", callerTypename)
-			}*/
+			if !targetFT.config.IsAccessible(AccessGolangLocalRequest) {
+				return nil, fmt.Errorf("function typename \"%s\" is not accessible via %s", targetTypename, AccessGolangLocalRequest)
+			}
+			if _, other := targetFT.otherVersion(targetID); other && targetFT.config.IsAccessible(AccessNatsCoreRequest) {
+				return natsCoreGlobalRequest()
+			}
 
-			resultJSONChannel := make(chan *easyjson.JSON)
+			// Buffered, so the target never blocks on replying to a requester which has already gone
+			resultJSONChannel := make(chan *easyjson.JSON, 1)
+			refusalChannel := make(chan HandlerMsgRefusalType, 1)
 
 			// Do not send original data, prevents same data concurrent access from different functions
 			var payloadCopy *easyjson.JSON = nil
@@ -81,28 +185,28 @@ func (r *Runtime) request(requestProvider sfPlugins.RequestProvider, callerTypen
 			}
 			// ----------------------------------------------------------------------------------------
 			functionMsg := FunctionTypeMsg{
-				Caller:  &sfPlugins.StatefunAddress{Typename: callerTypename, ID: callerID},
-				Payload: payloadCopy,
-				Options: optionsCopy,
+				Caller:   &sfPlugins.StatefunAddress{Typename: callerTypename, ID: callerID},
+				Payload:  payloadCopy,
+				Options:  optionsCopy,
+				Deadline: deadline,
 			}
 
 			functionMsg.RequestCallback = func(data *easyjson.JSON) {
 				resultJSONChannel <- data
 			}
-			functionMsg.RefusalCallback = func() {
-				close(resultJSONChannel)
+			functionMsg.RefusalCallback = func(refusalType HandlerMsgRefusalType) {
+				refusalChannel <- refusalType
 			}
 
 			targetFT.sendMsg(targetID, functionMsg)
 
 			select {
-			case resultJSON, ok := <-resultJSONChannel:
-				if ok {
-					return resultJSON, nil
-				}
-				return nil, fmt.Errorf("target function typename \"%s\" with id \"%s\" resufes to handle request", targetTypename, targetID)
-			case <-time.After(time.Duration(r.config.requestTimeoutSec) * time.Second):
-				return nil, fmt.Errorf("timeout occured while requesting function typename \"%s\" with id \"%s\"", targetTypename, targetID)
+			case resultJSON := <-resultJSONChannel:
+				return replyOrTimeout(resultJSON, targetTypename, targetID)
+			case refusalType := <-refusalChannel:
+				return nil, fmt.Errorf("target function typename \"%s\" with id \"%s\" resufes to handle request: %s", targetTypename, targetID, refusalType)
+			case <-ctx.Done():
+				return nil, fmt.Errorf("timeout occured while requesting function typename \"%s\" with id \"%s\": %w", targetTypename, targetID, ctx.Err())
 			}
 		} else {
 			return nil, fmt.Errorf("callFunctionGolangSync cannot request function with the typename %s, not registered", callerTypename)
@@ -119,6 +223,37 @@ func (r *Runtime) request(requestProvider sfPlugins.RequestProvider, callerTypen
 	}
 }
 
+// Target function replies with timeout when the request's deadline passes before it has replied
+func replyOrTimeout(reply *easyjson.JSON, targetTypename string, targetID string) (*easyjson.JSON, error) {
+	if reply != nil && reply.GetByPath(ReplyErrorKey).AsStringDefault("") == "timeout" {
+		return nil, fmt.Errorf("timeout occured while requesting function typename \"%s\" with id \"%s\": %w", targetTypename, targetID, context.DeadlineExceeded)
+	}
+	return reply, nil
+}
+
 func (r *Runtime) Request(requestProvider sfPlugins.RequestProvider, typename string, id string, payload *easyjson.JSON, options *easyjson.JSON) (*easyjson.JSON, error) {
-	return r.request(requestProvider, "ingress", "go", typename, id, payload, options)
+	return r.RequestCtx(context.Background(), requestProvider, typename, id, payload, options)
+}
+
+// RequestCtx requests the function with the deadline and cancellation of ctx, if ctx has no deadline the default request timeout is applied.
+// The deadline is passed to the target function and is available there via the context processor's Context.
+// Request not replied before the deadline fails with an error wrapping context.DeadlineExceeded.
+func (r *Runtime) RequestCtx(ctx context.Context, requestProvider sfPlugins.RequestProvider, typename string, id string, payload *easyjson.JSON, options *easyjson.JSON) (*easyjson.JSON, error) {
+	return r.request(ctx, requestProvider, "ingress", "go", typename, id, payload, options)
+}
+
+func (r *Runtime) requestAsync(ctx context.Context, requestProvider sfPlugins.RequestProvider, callerTypename string, callerID string, targetTypename string, targetID string, payload *easyjson.JSON, options *easyjson.JSON) *sfPlugins.RequestFuture {
+	future := sfPlugins.NewRequestFuture()
+	go func() {
+		system.GlobalPrometrics.GetRoutinesCounter().Started("ingress-requestAsync-gofunc")
+		defer system.GlobalPrometrics.GetRoutinesCounter().Stopped("ingress-requestAsync-gofunc")
+		future.Resolve(r.request(ctx, requestProvider, callerTypename, callerID, targetTypename, targetID, payload, options))
+	}()
+	return future
+}
+
+// RequestAsync sends the request without waiting for the reply, use sfPlugins.AwaitAll or sfPlugins.AwaitFirstN to gather replies of many requests.
+// Payload and options must not be modified until the future is completed.
+func (r *Runtime) RequestAsync(ctx context.Context, requestProvider sfPlugins.RequestProvider, typename string, id string, payload *easyjson.JSON, options *easyjson.JSON) *sfPlugins.RequestFuture {
+	return r.requestAsync(ctx, requestProvider, "ingress", "go", typename, id, payload, options)
 }
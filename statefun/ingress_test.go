@@ -0,0 +1,381 @@
+// Copyright 2023 NJWS Inc.
+
+package statefun
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/foliagecp/easyjson"
+
+	"github.com/foliagecp/sdk/statefun/backend"
+	sfPlugins "github.com/foliagecp/sdk/statefun/plugins"
+)
+
+func TestRequestDeadline(t *testing.T) {
+	r := newTestRuntime(t, newTestRuntimeConfig(backend.NewInMemory()))
+	handlerErrs := make(chan error, 10)
+	NewFunctionType(r.Runtime, "test.deadline", func(_ sfPlugins.StatefunExecutor, contextProcessor *sfPlugins.StatefunContextProcessor) {
+		<-contextProcessor.Context.Done() // Never replies in time
+		handlerErrs <- contextProcessor.Context.Err()
+	}, *NewFunctionTypeConfig().SetServiceState(true))
+	startTestRuntime(t, r)
+
+	for _, provider := range []sfPlugins.RequestProvider{sfPlugins.GolangLocalRequest, sfPlugins.NatsCoreGlobalRequest} {
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		_, err := r.RequestCtx(ctx, provider, "test.deadline", "a", nil, nil)
+		cancel()
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("request via provider %d past its deadline returned %v", provider, err)
+		}
+		// Deadline is propagated to the handler
+		select {
+		case err := <-handlerErrs:
+			if !errors.Is(err, context.DeadlineExceeded) {
+				t.Fatalf("handler context of request via provider %d ended with %v", provider, err)
+			}
+		case <-time.After(testWaitTimeout):
+			t.Fatalf("handler context of request via provider %d did not end in time", provider)
+		}
+	}
+
+	// Request which deadline has passed before it was handled is replied with timeout without calling the handler
+	replies := make(chan *easyjson.JSON, 1)
+	r.registeredFunctionTypes["test.deadline"].sendMsg("b", FunctionTypeMsg{
+		Caller:          &sfPlugins.StatefunAddress{Typename: "ingress", ID: "go"},
+		Deadline:        time.Now().Add(-time.Second),
+		RequestCallback: func(data *easyjson.JSON) { replies <- data },
+	})
+	select {
+	case reply := <-replies:
+		if _, err := replyOrTimeout(reply, "test.deadline", "b"); !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("expired request was replied with %s", reply.ToString())
+		}
+	case <-time.After(testWaitTimeout):
+		t.Fatal("expired request was not replied in time")
+	}
+	select {
+	case err := <-handlerErrs:
+		t.Fatalf("handler was called for an expired request, its context ended with %v", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestRequestCancellation(t *testing.T) {
+	r := newTestRuntime(t, newTestRuntimeConfig(backend.NewInMemory()))
+	release := make(chan struct{})
+	defer close(release)
+	deadlines := make(chan time.Time, 10)
+	NewFunctionType(r.Runtime, "test.cancel", func(_ sfPlugins.StatefunExecutor, contextProcessor *sfPlugins.StatefunContextProcessor) {
+		deadline, _ := contextProcessor.Context.Deadline()
+		deadlines <- deadline
+		<-release
+	}, *NewFunctionTypeConfig().SetServiceState(true))
+	startTestRuntime(t, r)
+
+	for i, provider := range []sfPlugins.RequestProvider{sfPlugins.GolangLocalRequest, sfPlugins.NatsCoreGlobalRequest} {
+		deadline := time.Now().Add(time.Minute)
+		ctx, cancel := context.WithDeadline(context.Background(), deadline)
+		go func() {
+			<-deadlines
+			cancel()
+		}()
+		_, err := r.RequestCtx(ctx, provider, "test.cancel", fmt.Sprint(i), nil, nil)
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("canceled request via provider %d returned %v", provider, err)
+		}
+	}
+
+	// Caller's deadline is the handler's one, up to the precision of a JSON number
+	deadline := time.Now().Add(time.Minute)
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	go func() {
+		_, _ = r.RequestCtx(ctx, sfPlugins.NatsCoreGlobalRequest, "test.cancel", "c", nil, nil)
+	}()
+	select {
+	case got := <-deadlines:
+		if got.Sub(deadline).Abs() > time.Millisecond {
+			t.Fatalf("handler got deadline %s, want %s", got, deadline)
+		}
+	case <-time.After(testWaitTimeout):
+		t.Fatal("function was not called in time")
+	}
+}
+
+// Function type which replies with its id once the id is released
+func newReleasedFunctionType(r *testRuntime, typename string, ids ...string) map[string]chan struct{} {
+	release := map[string]chan struct{}{}
+	for _, id := range ids {
+		release[id] = make(chan struct{})
+	}
+	NewFunctionType(r.Runtime, typename, func(_ sfPlugins.StatefunExecutor, contextProcessor *sfPlugins.StatefunContextProcessor) {
+		select {
+		case <-release[contextProcessor.Self.ID]:
+			contextProcessor.Reply.With(testPayload("id", contextProcessor.Self.ID))
+		case <-contextProcessor.Context.Done():
+		}
+	}, *NewFunctionTypeConfig().SetServiceState(true))
+	return release
+}
+
+func TestRequestAsyncAwaitAll(t *testing.T) {
+	r := newTestRuntime(t, newTestRuntimeConfig(backend.NewInMemory()))
+	release := newReleasedFunctionType(r, "test.async", "a", "b", "c")
+	startTestRuntime(t, r)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	futures := []*sfPlugins.RequestFuture{
+		r.RequestAsync(ctx, sfPlugins.GolangLocalRequest, "test.async", "a", nil, nil),
+		r.RequestAsync(ctx, sfPlugins.NatsCoreGlobalRequest, "test.async", "b", nil, nil),
+		r.RequestAsync(ctx, sfPlugins.GolangLocalRequest, "test.async", "c", nil, nil),
+		r.RequestAsync(ctx, sfPlugins.GolangLocalRequest, "test.unknown", "d", nil, nil),
+	}
+	close(release["c"])
+	<-futures[2].Done()
+	close(release["b"])
+	// "a" is never released and is cut by the shared deadline
+
+	results := sfPlugins.AwaitAll(ctx, futures...)
+	for i, result := range results {
+		if result.Index != i {
+			t.Fatalf("result %d has index %d", i, result.Index)
+		}
+	}
+	if !errors.Is(results[0].Err, context.DeadlineExceeded) {
+		t.Fatalf("request past the shared deadline returned %v", results[0].Err)
+	}
+	for i, id := range map[int]string{1: "b", 2: "c"} {
+		if results[i].Err != nil || results[i].Data.GetByPath("id").AsStringDefault("") != id {
+			t.Fatalf("request to %s returned %v, %v", id, results[i].Data, results[i].Err)
+		}
+	}
+	if results[3].Err == nil {
+		t.Fatal("request to an unregistered function type succeeded")
+	}
+}
+
+func TestRequestAsyncAwaitFirstN(t *testing.T) {
+	r := newTestRuntime(t, newTestRuntimeConfig(backend.NewInMemory()))
+	release := newReleasedFunctionType(r, "test.async", "a", "b", "c", "d", "e")
+	startTestRuntime(t, r)
+	request := func(ctx context.Context, ids ...string) []*sfPlugins.RequestFuture {
+		futures := []*sfPlugins.RequestFuture{}
+		for _, id := range ids {
+			futures = append(futures, r.RequestAsync(ctx, sfPlugins.GolangLocalRequest, "test.async", id, nil, nil))
+		}
+		return futures
+	}
+
+	// Results are in the order of completion
+	futures := request(context.Background(), "a", "b", "c")
+	close(release["c"])
+	<-futures[2].Done()
+	awaited := make(chan []sfPlugins.RequestResult, 1)
+	go func() {
+		results, err := sfPlugins.AwaitFirstN(context.Background(), 2, futures...)
+		if err != nil {
+			t.Error(err)
+		}
+		awaited <- results
+	}()
+	time.Sleep(100 * time.Millisecond) // Result of c is taken first
+	close(release["a"])
+	results := <-awaited
+	if len(results) != 2 || results[0].Index != 2 || results[1].Index != 0 {
+		t.Fatalf("first results are %+v, want the ones of c and a", results)
+	}
+	close(release["b"])
+
+	// Fails as soon as n successful results are not possible anymore
+	futures = append(request(context.Background(), "d"), r.RequestAsync(context.Background(), sfPlugins.GolangLocalRequest, "test.unknown", "x", nil, nil))
+	if _, err := sfPlugins.AwaitFirstN(context.Background(), 2, futures...); err == nil {
+		t.Fatal("awaiting more results than possible succeeded")
+	}
+
+	// Canceled await returns the results collected so far
+	ctx, cancel := context.WithCancel(context.Background())
+	futures = request(ctx, "d", "e")
+	close(release["e"])
+	<-futures[1].Done()
+	cancel()
+	results, err := sfPlugins.AwaitFirstN(ctx, 2, futures...)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("canceled await returned %v", err)
+	}
+	if len(results) > 1 || (len(results) == 1 && results[0].Index != 1) {
+		t.Fatalf("canceled await returned results %+v, want at most the one of e", results)
+	}
+	close(release["d"])
+}
+
+func TestRequestAsyncFromHandler(t *testing.T) {
+	r := newTestRuntime(t, newTestRuntimeConfig(backend.NewInMemory()))
+	release := newReleasedFunctionType(r, "test.async", "a", "b", "c")
+	NewFunctionType(r.Runtime, "test.fanout", func(_ sfPlugins.StatefunExecutor, contextProcessor *sfPlugins.StatefunContextProcessor) {
+		futures := []*sfPlugins.RequestFuture{}
+		for _, id := range []string{"a", "b", "c"} {
+			futures = append(futures, contextProcessor.RequestAsync(contextProcessor.Context, sfPlugins.GolangLocalRequest, "test.async", id, nil, nil))
+		}
+		ids := []string{}
+		for _, result := range sfPlugins.AwaitAll(contextProcessor.Context, futures...) {
+			ids = append(ids, result.Data.GetByPath("id").AsStringDefault(""))
+		}
+		reply := easyjson.NewJSONObject()
+		reply.SetByPath("ids", easyjson.JSONFromArray(ids))
+		contextProcessor.Reply.With(&reply)
+	}, *NewFunctionTypeConfig())
+	startTestRuntime(t, r)
+
+	for _, id := range []string{"c", "b", "a"} {
+		close(release[id])
+	}
+	reply, err := r.Request(sfPlugins.GolangLocalRequest, "test.fanout", "x", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ids := reply.GetByPath("ids").ToString(); ids != `["a","b","c"]` {
+		t.Fatalf("fan-out replied with ids %s", ids)
+	}
+}
+
+func TestAccessModes(t *testing.T) {
+	b := backend.NewInMemory()
+	r := newTestRuntime(t, newTestRuntimeConfig(b))
+	accesses := []Access{AccessGolangLocalSignal, AccessGolangLocalRequest, AccessJetstreamSignal, AccessNatsCoreRequest}
+	calls := map[Access]*testCalls{}
+	for _, access := range accesses {
+		access := access
+		calls[access] = newTestCalls()
+		NewFunctionType(r.Runtime, fmt.Sprintf("test.access%d", access), func(_ sfPlugins.StatefunExecutor, contextProcessor *sfPlugins.StatefunContextProcessor) {
+			calls[access].record(contextProcessor)
+		}, *NewFunctionTypeConfig().SetAccessebility(access))
+	}
+	startTestRuntime(t, r)
+	// Runtime without the function types, which access is checked only by the runtime handling them
+	remote := newTestRuntime(t, newTestRuntimeConfig(b))
+	startTestRuntime(t, remote)
+
+	paths := []struct {
+		name   string
+		access Access
+		remote bool // Call is not refused to the caller, the message is dropped by the handling runtime instead
+		call   func(typename string) error
+	}{
+		{name: "golang local signal", access: AccessGolangLocalSignal, call: func(typename string) error {
+			return r.Signal(sfPlugins.GolangLocalSignal, typename, "a", nil, nil)
+		}},
+		{name: "golang local request", access: AccessGolangLocalRequest, call: func(typename string) error {
+			_, err := r.Request(sfPlugins.GolangLocalRequest, typename, "a", nil, nil)
+			return err
+		}},
+		{name: "jetstream signal", access: AccessJetstreamSignal, call: func(typename string) error {
+			return r.Signal(sfPlugins.JetstreamGlobalSignal, typename, "a", nil, nil)
+		}},
+		{name: "nats core signal", access: AccessJetstreamSignal, call: func(typename string) error {
+			return r.Signal(sfPlugins.NatsCoreGlobalSignal, typename, "a", nil, nil)
+		}},
+		{name: "nats core request", access: AccessNatsCoreRequest, call: func(typename string) error {
+			_, err := r.Request(sfPlugins.NatsCoreGlobalRequest, typename, "a", nil, nil)
+			return err
+		}},
+		{name: "remote jetstream signal", access: AccessJetstreamSignal, remote: true, call: func(typename string) error {
+			return remote.Signal(sfPlugins.JetstreamGlobalSignal, typename, "a", nil, nil)
+		}},
+		{name: "remote nats core request", access: AccessNatsCoreRequest, call: func(typename string) error {
+			_, err := remote.Request(sfPlugins.NatsCoreGlobalRequest, typename, "a", nil, nil)
+			return err
+		}},
+	}
+	for _, access := range accesses {
+		typename := fmt.Sprintf("test.access%d", access)
+		for _, path := range paths {
+			err := path.call(typename)
+			if path.access == access {
+				if err != nil {
+					t.Fatalf("%s of function type accessible via %s failed: %v", path.name, access, err)
+				}
+				calls[access].wait(t)
+				continue
+			}
+			if err == nil && !path.remote {
+				t.Fatalf("%s of function type accessible only via %s succeeded", path.name, access)
+			}
+			calls[access].expectNone(t, 100*time.Millisecond)
+		}
+	}
+}
+
+// In-memory backend counting messages published to the subjects of function types
+type countingPublishBackend struct {
+	*backend.InMemory
+	published atomic.Int32
+}
+
+func (b *countingPublishBackend) Publish(subject string, data []byte) error {
+	b.count(subject)
+	return b.InMemory.Publish(subject, data)
+}
+
+func (b *countingPublishBackend) StreamPublish(subject string, data []byte) error {
+	b.count(subject)
+	return b.InMemory.StreamPublish(subject, data)
+}
+
+func (b *countingPublishBackend) count(subject string) {
+	if strings.HasPrefix(subject, "test.") {
+		b.published.Add(1)
+	}
+}
+
+func TestSignalProviders(t *testing.T) {
+	b := &countingPublishBackend{InMemory: backend.NewInMemory()}
+	r := newTestRuntime(t, newTestRuntimeConfig(b))
+	calls := newTestCalls()
+	NewFunctionType(r.Runtime, "test.signals", func(_ sfPlugins.StatefunExecutor, contextProcessor *sfPlugins.StatefunContextProcessor) {
+		calls.record(contextProcessor)
+	}, *NewFunctionTypeConfig())
+	startTestRuntime(t, r)
+
+	// Golang local signal is enqueued without publishing
+	if err := r.Signal(sfPlugins.GolangLocalSignal, "test.signals", "a", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	calls.wait(t)
+	if published := b.published.Load(); published != 0 {
+		t.Fatalf("golang local signal published %d messages", published)
+	}
+	if err := r.Signal(sfPlugins.GolangLocalSignal, "test.unknown", "a", nil, nil); err == nil {
+		t.Fatal("golang local signal to an unregistered function type succeeded")
+	}
+
+	// JetStream signal fails if no stream stores it
+	if err := r.Signal(sfPlugins.JetstreamGlobalSignal, "test.unknown", "a", nil, nil); err == nil {
+		t.Fatal("jetstream signal without a stream succeeded")
+	}
+
+	// JetStream signal is stored until a runtime with the function type handles it
+	if err := r.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	sender := newTestRuntime(t, newTestRuntimeConfig(b))
+	startTestRuntime(t, sender)
+	if err := sender.Signal(sfPlugins.JetstreamGlobalSignal, "test.signals", "b", testPayload("n", 1), nil); err != nil {
+		t.Fatal(err)
+	}
+	calls.expectNone(t, 100*time.Millisecond)
+	handler := newTestRuntime(t, newTestRuntimeConfig(b))
+	NewFunctionType(handler.Runtime, "test.signals", func(_ sfPlugins.StatefunExecutor, contextProcessor *sfPlugins.StatefunContextProcessor) {
+		calls.record(contextProcessor)
+	}, *NewFunctionTypeConfig())
+	startTestRuntime(t, handler)
+	if n := calls.wait(t).GetByPath("n").AsNumericDefault(0); n != 1 {
+		t.Fatalf("stored signal was handled with n=%v", n)
+	}
+}
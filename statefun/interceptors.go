@@ -0,0 +1,35 @@
+// Copyright 2023 NJWS Inc.
+
+package statefun
+
+import (
+	sfPlugins "github.com/foliagecp/sdk/statefun/plugins"
+)
+
+// Interceptor wraps the call of a function type's handler. It may do something before and after calling next
+// or short-circuit the call by not calling next at all, e.g. replying via contextProcessor.Reply.With if the function
+// was requested or returning an error which is treated the same way as the one returned by the handler itself.
+type Interceptor func(executor sfPlugins.StatefunExecutor, contextProcessor *sfPlugins.StatefunContextProcessor, next RetriableFunctionLogicHandler) error
+
+// AddInterceptor adds the interceptor for all function types of the runtime, must be called before the runtime is started.
+// Runtime's interceptors are called before the function type's ones, each group in the order of adding.
+func (r *Runtime) AddInterceptor(interceptor Interceptor) {
+	r.interceptors = append(r.interceptors, interceptor)
+}
+
+// AddInterceptor adds the interceptor for the function type, must be called before the runtime is started
+func (ft *FunctionType) AddInterceptor(interceptor Interceptor) {
+	ft.interceptors = append(ft.interceptors, interceptor)
+}
+
+func (ft *FunctionType) buildHandlerChain() {
+	interceptors := append(append([]Interceptor{}, ft.runtime.interceptors...), ft.interceptors...)
+	chain := ft.logicHandler
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		interceptor, next := interceptors[i], chain
+		chain = func(executor sfPlugins.StatefunExecutor, contextProcessor *sfPlugins.StatefunContextProcessor) error {
+			return interceptor(executor, contextProcessor, next)
+		}
+	}
+	ft.handlerChain = chain
+}
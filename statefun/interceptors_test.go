@@ -0,0 +1,83 @@
+// Copyright 2023 NJWS Inc.
+
+package statefun
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/foliagecp/sdk/statefun/backend"
+	sfPlugins "github.com/foliagecp/sdk/statefun/plugins"
+)
+
+func TestInterceptors(t *testing.T) {
+	r := newTestRuntime(t, newTestRuntimeConfig(backend.NewInMemory()))
+	var mutex sync.Mutex
+	trace := []string{}
+	record := func(event string) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		trace = append(trace, event)
+	}
+	takeTrace := func() string {
+		mutex.Lock()
+		defer mutex.Unlock()
+		joined := strings.Join(trace, ",")
+		trace = nil
+		return joined
+	}
+	// Records calls around next, short-circuits with a reply or an error if the payload says so
+	interceptor := func(name string) Interceptor {
+		return func(executor sfPlugins.StatefunExecutor, contextProcessor *sfPlugins.StatefunContextProcessor, next RetriableFunctionLogicHandler) error {
+			record(name)
+			defer record("/" + name)
+			switch contextProcessor.Payload.GetByPath("stop_at").AsStringDefault("") {
+			case name + ":reply":
+				contextProcessor.Reply.With(testPayload("by", name))
+				return nil
+			case name + ":error":
+				return NewTerminalError(errors.New("refused by " + name))
+			}
+			return next(executor, contextProcessor)
+		}
+	}
+
+	r.AddInterceptor(interceptor("r1"))
+	ft := NewFunctionType(r.Runtime, "test.intercepted", func(_ sfPlugins.StatefunExecutor, contextProcessor *sfPlugins.StatefunContextProcessor) {
+		record("handler")
+		contextProcessor.Reply.With(testPayload("by", "handler"))
+	}, *NewFunctionTypeConfig())
+	ft.AddInterceptor(interceptor("f1"))
+	ft.AddInterceptor(interceptor("f2"))
+	r.AddInterceptor(interceptor("r2")) // Runtime's interceptors go first regardless of when they were added
+	startTestRuntime(t, r)
+
+	tests := []struct {
+		stopAt    string
+		wantBy    string
+		wantTrace string
+	}{
+		{wantBy: "handler", wantTrace: "r1,r2,f1,f2,handler,/f2,/f1,/r2,/r1"},
+		{stopAt: "r2:reply", wantBy: "r2", wantTrace: "r1,r2,/r2,/r1"},
+		{stopAt: "f1:reply", wantBy: "f1", wantTrace: "r1,r2,f1,/f1,/r2,/r1"},
+		{stopAt: "f2:error", wantTrace: "r1,r2,f1,f2,/f2,/f1,/r2,/r1"},
+	}
+	for _, test := range tests {
+		reply, err := r.Request(sfPlugins.GolangLocalRequest, "test.intercepted", "a", testPayload("stop_at", test.stopAt), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(test.wantBy) > 0 {
+			if by := reply.GetByPath("by").AsStringDefault(""); by != test.wantBy {
+				t.Fatalf("stopped at %q: replied by %q, want %q", test.stopAt, by, test.wantBy)
+			}
+		} else if reply.GetByPath(ReplyErrorKey).AsStringDefault("") != "failed" {
+			t.Fatalf("stopped at %q: replied with %s, want a failure", test.stopAt, reply.ToString())
+		}
+		if trace := takeTrace(); trace != test.wantTrace {
+			t.Fatalf("stopped at %q: calls are %s, want %s", test.stopAt, trace, test.wantTrace)
+		}
+	}
+}
@@ -5,7 +5,6 @@ package statefun
 import (
 	"errors"
 	"fmt"
-	"strings"
 	"sync"
 	"time"
 
@@ -13,8 +12,8 @@ import (
 
 	rt "runtime"
 
+	"github.com/foliagecp/sdk/statefun/backend"
 	"github.com/foliagecp/sdk/statefun/system"
-	"github.com/nats-io/nats.go"
 )
 
 var (
@@ -35,11 +34,11 @@ func KeyMutexLock(runtime *Runtime, key string, errorOnLocked bool) (uint64, err
 		}
 		return 0, err
 	}
-	mutexMereLock := func(entry nats.KeyValueEntry, now int64) (uint64, error) {
+	mutexMereLock := func(entry backend.KeyValueEntry, now int64) (uint64, error) {
 		// Try to lock mutex by updating it with current time value using revision obtained during last Get
 		lockRevisionID, err := kv.Update(entry.Key(), system.Int64ToBytes(now), entry.Revision())
 		if err != nil { // If no error appeared
-			if strings.Contains(err.Error(), "nats: wrong last sequence") { // If error "wrong revision" appeared
+			if errors.Is(err, backend.ErrWrongLastRevision) { // If error "wrong revision" appeared
 				//le.Logf(lg.ErrorLevel, "%s: ERROR mutexMereLock: tried to lock with wrong revisionId\n", caller)
 				return 0, nil
 			}
@@ -48,11 +47,15 @@ func KeyMutexLock(runtime *Runtime, key string, errorOnLocked bool) (uint64, err
 		le.Logf(lg.TraceLevel, "============== Locked %s\n", entry.Key())
 		return lockRevisionID, nil // Successfully locked
 	}
-	getKeyWatch := func(keyMutex string) (nats.KeyWatcher, error) {
+	getKeyWatch := func(keyMutex string) (backend.KeyWatcher, error) {
 		kwWatchMutex.Lock()
-		return kv.Watch(keyMutex, nats.IgnoreDeletes())
+		w, err := kv.Watch(keyMutex)
+		if err != nil {
+			kwWatchMutex.Unlock()
+		}
+		return w, err
 	}
-	releaseKeyWatch := func(w nats.KeyWatcher) {
+	releaseKeyWatch := func(w backend.KeyWatcher) {
 		system.MsgOnErrorReturn(w.Stop())
 		kwWatchMutex.Unlock()
 	}
@@ -92,7 +95,7 @@ func KeyMutexLock(runtime *Runtime, key string, errorOnLocked bool) (uint64, err
 
 		entry, err := kv.Get(keyMutex) // Getting last mutex state for key
 		if err != nil {
-			if err == nats.ErrKeyNotFound {
+			if errors.Is(err, backend.ErrKeyNotFound) {
 				mutexResetLockNeeded = true
 			} else {
 				//keyValueMutexOperationMutex.Unlock()
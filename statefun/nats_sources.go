@@ -8,14 +8,17 @@ import (
 	lg "github.com/foliagecp/sdk/statefun/logger"
 
 	"github.com/foliagecp/easyjson"
+	"github.com/foliagecp/sdk/statefun/backend"
 	sfPlugins "github.com/foliagecp/sdk/statefun/plugins"
 	"github.com/foliagecp/sdk/statefun/system"
-
-	"github.com/nats-io/nats.go"
 )
 
 func AddRequestSourceNatsCore(ft *FunctionType) error {
-	_, err := ft.runtime.nc.Subscribe(fmt.Sprintf("service.%s", ft.subject), func(msg *nats.Msg) {
+	sub, err := ft.runtime.backend.Subscribe(fmt.Sprintf("service.%s", ft.subject), func(msg backend.Msg) {
+		tokens := strings.Split(msg.Subject(), ".")
+		if _, other := ft.otherVersion(tokens[len(tokens)-1]); other { // Runtimes of the version answer
+			return
+		}
 		system.MsgOnErrorReturn(handleNatsMsg(ft, msg, true, nil))
 	})
 
@@ -23,70 +26,89 @@ func AddRequestSourceNatsCore(ft *FunctionType) error {
 		lg.Logf(lg.ErrorLevel, "Invalid request reply subscription for function type %s: %s\n", ft.name, err)
 		return err
 	}
-
-	return nil
+	return ft.runtime.addSubscription(sub)
 }
 
 func AddSignalSourceJetstreamQueuePushConsumer(ft *FunctionType) error {
-	consumerName := strings.ReplaceAll(ft.name, ".", "")
-	consumerGroup := consumerName + "-group"
 	lg.Logf(lg.TraceLevel, "Handling function type %s\n", ft.name)
 
-	// Create stream consumer if does not exist ---------------------
-	consumerExists := false
-	for info := range ft.runtime.js.Consumers(ft.getStreamName(), nats.MaxWait(10*time.Second)) {
-		if info.Name == consumerName {
-			consumerExists = true
-		}
-	}
-	if !consumerExists {
-		_, err := ft.runtime.js.AddConsumer(ft.getStreamName(), &nats.ConsumerConfig{
-			Name:           consumerName,
-			Durable:        consumerName,
-			DeliverSubject: consumerName,
-			DeliverGroup:   consumerGroup,
-			FilterSubject:  ft.subject,
-			AckPolicy:      nats.AckExplicitPolicy,
-			AckWait:        time.Duration(ft.config.msgAckWaitMs) * time.Millisecond, // AckWait should be long due to async message Ack
-		})
-		system.MsgOnErrorReturn(err)
-	}
-	// --------------------------------------------------------------
-
 	// For auto message acking msg ----------------------------------
-	msgAcker := func(msgAckChannel chan *nats.Msg) {
+	msgAcker := func(msgAckChannel chan backend.Msg, msgAckerStopped chan struct{}) {
 		system.GlobalPrometrics.GetRoutinesCounter().Started("AddSignalSourceJetstreamQueuePushConsumer-msgAcker")
 		defer system.GlobalPrometrics.GetRoutinesCounter().Stopped("AddSignalSourceJetstreamQueuePushConsumer-msgAcker")
+		defer close(msgAckerStopped)
 		for msg := range msgAckChannel {
 			system.MsgOnErrorReturn(msg.Ack())
 		}
 	}
-	msgAckChannel := make(chan *nats.Msg, ft.config.msgAckChannelSize)
-	go msgAcker(msgAckChannel)
+	msgAckChannel := make(chan backend.Msg, ft.config.msgAckChannelSize)
+	ft.msgAckChannel = msgAckChannel
+	ft.msgAckerStopped = make(chan struct{})
+	go msgAcker(msgAckChannel, ft.msgAckerStopped)
 	// --------------------------------------------------------------
 
-	_, err := ft.runtime.js.QueueSubscribe(
-		ft.subject,
-		consumerGroup,
-		func(msg *nats.Msg) {
-			system.MsgOnErrorReturn(handleNatsMsg(ft, msg, false, msgAckChannel))
+	return ft.subscribeConsumer()
+}
+
+func (ft *FunctionType) subscribeConsumer() error {
+	consumerName := ft.getConsumerName()
+	sub, err := ft.runtime.backend.SubscribeConsumer(
+		ft.getStreamName(),
+		backend.ConsumerConfig{
+			Name:          consumerName,
+			DeliverGroup:  consumerName + "-group",
+			FilterSubject: ft.subject,
+			AckWait:       time.Duration(ft.config.msgAckWaitMs) * time.Millisecond, // AckWait should be long due to async message Ack
+			MaxAckPending: ft.config.maxAckPending,
+		},
+		func(msg backend.Msg) {
+			if ft.config.partitions > 0 {
+				system.MsgOnErrorReturn(ft.routeToPartition(msg))
+				return
+			}
+			if ft.versioned() {
+				tokens := strings.Split(msg.Subject(), ".")
+				id := tokens[len(tokens)-1]
+				if version, other := ft.otherVersion(id); other {
+					system.MsgOnErrorReturn(ft.routeToVersion(msg, id, version))
+					return
+				}
+			}
+			system.MsgOnErrorReturn(handleNatsMsg(ft, msg, false, ft.msgAckChannel))
 		},
-		nats.Bind(ft.getStreamName(), consumerName),
-		nats.ManualAck(),
 	)
 	if err != nil {
 		lg.Logf(lg.ErrorLevel, "Invalid signal subscription for function type %s: %s\n", ft.name, err)
 		return err
 	}
-	return nil
+	return ft.addConsumerSubscription(sub)
 }
 
-func handleNatsMsg(ft *FunctionType, msg *nats.Msg, requestReply bool, msgAckChannel chan *nats.Msg) (err error) {
-	tokens := strings.Split(msg.Subject, ".")
+func handleNatsMsg(ft *FunctionType, msg backend.Msg, requestReply bool, msgAckChannel chan backend.Msg) (err error) {
+	tokens := strings.Split(msg.Subject(), ".")
 	id := tokens[len(tokens)-1]
 
-	data, ok := easyjson.JSONFromBytes(msg.Data)
+	access := AccessJetstreamSignal
+	if requestReply {
+		access = AccessNatsCoreRequest
+	}
+	if !ft.config.IsAccessible(access) {
+		if requestReply {
+			system.MsgOnErrorReturn(msg.Respond([]byte{}))
+		} else {
+			system.MsgOnErrorReturn(msg.Ack())
+		}
+		return fmt.Errorf("function %s with id=%s is not accessible via %s, message dropped", ft.name, id, access)
+	}
+
+	data, ok := easyjson.JSONFromBytes(msg.Data())
 	if !ok {
+		if !requestReply && ft.config.deadLetterActive {
+			if err := ft.deadLetter(msg, "data is not a JSON"); err != nil {
+				system.MsgOnErrorReturn(msg.Nak())
+				return err
+			}
+		}
 		system.MsgOnErrorReturn(msg.Ack())
 		return fmt.Errorf("nats.Msg for function %s with id=%s is not a JSON\n", ft.name, id)
 	}
@@ -113,17 +135,26 @@ func handleNatsMsg(ft *FunctionType, msg *nats.Msg, requestReply bool, msgAckCha
 		caller.ID, _ = data.GetByPath("caller_id").AsString()
 	}
 
+	var deadline time.Time
+	if deadlineNs, ok := data.GetByPath("deadline").AsNumeric(); ok {
+		deadline = time.Unix(0, int64(deadlineNs))
+	}
+
 	// Create function message ------------------------
 	functionMsg := FunctionTypeMsg{
-		Caller:  &caller,
-		Payload: payload,
-		Options: msgOptions,
+		Caller:   &caller,
+		Payload:  payload,
+		Options:  msgOptions,
+		Deadline: deadline,
+	}
+	if !requestReply {
+		functionMsg.MsgID = msg.MsgID()
 	}
 	if requestReply {
 		functionMsg.RequestCallback = func(data *easyjson.JSON) {
 			system.MsgOnErrorReturn(msg.Respond(data.ToBytes()))
 		}
-		functionMsg.RefusalCallback = func() {
+		functionMsg.RefusalCallback = func(_ HandlerMsgRefusalType) {
 			system.MsgOnErrorReturn(msg.Respond([]byte{}))
 		}
 	} else {
@@ -136,7 +167,26 @@ func handleNatsMsg(ft *FunctionType, msg *nats.Msg, requestReply bool, msgAckCha
 				system.MsgOnErrorReturn(msg.Nak())
 			}
 		}
-		functionMsg.RefusalCallback = func() {
+		functionMsg.SpillCallback = func() error {
+			return msg.NakWithDelay(time.Duration(ft.getConfig().overflowTimeoutMs) * time.Millisecond)
+		}
+		functionMsg.FailureCallback = func(err error) {
+			ft.handleSignalFailure(msg, id, err, func() {
+				if msgAckChannel != nil {
+					msgAckChannel <- msg
+				}
+			})
+		}
+		functionMsg.RefusalCallback = func(refusalType HandlerMsgRefusalType) {
+			if config := ft.getConfig(); refusalType != MsgRefusedFunctionTypeStopped && config.deadLetterActive && msg.NumDelivered() >= uint64(config.maxRefusedDeliveries) {
+				reason := fmt.Sprintf("refused %d times, last time due to: %s", msg.NumDelivered(), refusalType)
+				err := ft.deadLetter(msg, reason)
+				if err == nil {
+					system.MsgOnErrorReturn(msg.Ack())
+					return
+				}
+				lg.Logf(lg.ErrorLevel, "Cannot dead-letter message for function %s with id=%s: %s\n", ft.name, id, err)
+			}
 			system.MsgOnErrorReturn(msg.Nak())
 		}
 	}
@@ -0,0 +1,116 @@
+// Copyright 2023 NJWS Inc.
+
+package statefun
+
+import (
+	lg "github.com/foliagecp/sdk/statefun/logger"
+	"github.com/foliagecp/sdk/statefun/system"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// OverflowPolicy defines what happens to a message when the id handler's message channel is full or max id handlers are running
+type OverflowPolicy int
+
+const (
+	// Message is refused at once, a JetStream signal is redelivered
+	OverflowRefuse OverflowPolicy = iota
+	// Sender waits for free room up to the overflow timeout, then the message is refused.
+	// A handler signaling its own id does not wait.
+	OverflowBlock
+	// The oldest message queued for the id is dropped to make room: a signal is acked without being handled, a request is refused.
+	// Falls back to refusing when max id handlers are running.
+	OverflowDropOldest
+	// Signal is left to JetStream to be handled later: a JetStream signal is redelivered after the overflow timeout,
+	// a Golang local signal is published to the function type's stream. Requests block like with OverflowBlock.
+	OverflowSpill
+)
+
+const (
+	OverflowActionRefused = "refused"
+	OverflowActionBlocked = "blocked" // Sender waited for free room, the message was not necessarily accepted
+	OverflowActionDropped = "dropped"
+	OverflowActionSpilled = "spilled"
+)
+
+// How often a blocked sender retries to queue the message
+const OverflowBlockRetryIntervalMs = 5
+
+// A handler signaling its own id never waits for itself to make room
+func (ft *FunctionType) blocksOnOverflow(id string, msg FunctionTypeMsg) bool {
+	if msg.Caller != nil && msg.Caller.Typename == ft.name && msg.Caller.ID == id {
+		return false
+	}
+	policy := ft.getConfig().overflowPolicy
+	return policy == OverflowBlock || (policy == OverflowSpill && msg.SpillCallback == nil)
+}
+
+// Takes a slot of the max id handlers limit for a new id handler, returns false if the limit is reached
+func (ft *FunctionType) acquireIDHandlerSlot() bool {
+	if ft.instancesControlChannel == nil {
+		return true
+	}
+	select {
+	case ft.instancesControlChannel <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// Puts the message into the id handler's message channel without waiting, dropping the oldest one if the policy says so,
+// returns false if it did not fit
+func (ft *FunctionType) enqueueMsg(msgChannel chan FunctionTypeMsg, msg FunctionTypeMsg) bool {
+	select {
+	case msgChannel <- msg:
+		return true
+	default:
+	}
+
+	if ft.getConfig().overflowPolicy == OverflowDropOldest {
+		select {
+		case oldest := <-msgChannel:
+			ft.dropMsg(oldest)
+		default: // Id handler has just taken one
+		}
+		select {
+		case msgChannel <- msg:
+			return true
+		default:
+		}
+	}
+	return false
+}
+
+// Handles the message which could not be queued
+func (ft *FunctionType) overflow(msg FunctionTypeMsg, refusalType HandlerMsgRefusalType) {
+	if ft.getConfig().overflowPolicy == OverflowSpill && msg.SpillCallback != nil {
+		err := msg.SpillCallback()
+		if err == nil {
+			ft.countOverflow(OverflowActionSpilled)
+			return
+		}
+		lg.Logf(lg.ErrorLevel, "Function type %s cannot spill message to JetStream: %s\n", ft.name, err)
+	}
+	ft.countOverflow(OverflowActionRefused)
+	if msg.RefusalCallback != nil {
+		msg.RefusalCallback(refusalType)
+	}
+}
+
+func (ft *FunctionType) dropMsg(msg FunctionTypeMsg) {
+	lg.Logf(lg.WarnLevel, "Function type %s dropped the oldest message due to message channel overflow\n", ft.name)
+	ft.countOverflow(OverflowActionDropped)
+	if msg.RequestCallback != nil {
+		if msg.RefusalCallback != nil {
+			msg.RefusalCallback(MsgRefusedDroppedAsOldest)
+		}
+	} else if msg.AckCallback != nil {
+		msg.AckCallback(true)
+	}
+}
+
+func (ft *FunctionType) countOverflow(action string) {
+	if counterVec, err := system.GlobalPrometrics.EnsureCounterVecSimple("statefun_msg_overflows", "Stateful function message overflows", []string{"typename", "action"}); err == nil {
+		counterVec.With(prometheus.Labels{"typename": ft.name, "action": action}).Inc()
+	}
+}
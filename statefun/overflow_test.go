@@ -0,0 +1,154 @@
+// Copyright 2023 NJWS Inc.
+
+package statefun
+
+import (
+	"testing"
+	"time"
+
+	"github.com/foliagecp/sdk/statefun/backend"
+	sfPlugins "github.com/foliagecp/sdk/statefun/plugins"
+)
+
+// Records the call and waits for proceed
+func overflowTestHandler(calls *testCalls, proceed chan struct{}) FunctionLogicHandler {
+	return func(_ sfPlugins.StatefunExecutor, contextProcessor *sfPlugins.StatefunContextProcessor) {
+		calls.record(contextProcessor)
+		<-proceed
+	}
+}
+
+// Signals id "a" until its handler is busy and its mailbox is full
+func fillMailbox(t *testing.T, r *testRuntime, calls *testCalls) {
+	for n := 1; n <= 2; n++ {
+		if err := r.Signal(sfPlugins.GolangLocalSignal, "test.overflow", "a", testPayload("n", n), nil); err != nil {
+			t.Fatal(err)
+		}
+		if n == 1 {
+			calls.wait(t)
+		}
+	}
+}
+
+// Signals in background, the result is received from the returned channel
+func signalAsync(r *testRuntime, id string) chan error {
+	result := make(chan error, 1)
+	go func() { result <- r.Signal(sfPlugins.GolangLocalSignal, "test.overflow", id, nil, nil) }()
+	return result
+}
+
+func receiveSignalResult(t *testing.T, result chan error, within time.Duration) error {
+	select {
+	case err := <-result:
+		return err
+	case <-time.After(within):
+		t.Fatalf("signal did not finish within %s", within)
+		return nil
+	}
+}
+
+func TestOverflowRefuse(t *testing.T) {
+	calls := newTestCalls()
+	proceed := make(chan struct{})
+	r := newTestRuntime(t, newTestRuntimeConfig(backend.NewInMemory()))
+	NewFunctionType(r.Runtime, "test.overflow", overflowTestHandler(calls, proceed), *NewFunctionTypeConfig().SetMsgChannelSize(1))
+	startTestRuntime(t, r)
+	defer close(proceed)
+	fillMailbox(t, r, calls)
+
+	if err := r.Signal(sfPlugins.GolangLocalSignal, "test.overflow", "a", nil, nil); err == nil {
+		t.Fatal("signal to the full mailbox was accepted")
+	}
+}
+
+func TestOverflowBlockWaitsForRoom(t *testing.T) {
+	calls := newTestCalls()
+	proceed := make(chan struct{})
+	r := newTestRuntime(t, newTestRuntimeConfig(backend.NewInMemory()))
+	NewFunctionType(r.Runtime, "test.overflow", overflowTestHandler(calls, proceed), *NewFunctionTypeConfig().SetMsgChannelSize(1).SetOverflowPolicy(OverflowBlock, 5000))
+	startTestRuntime(t, r)
+	fillMailbox(t, r, calls)
+
+	blocked := signalAsync(r, "a")
+	time.Sleep(100 * time.Millisecond)
+	if err := receiveSignalResult(t, signalAsync(r, "b"), time.Second); err != nil { // Other ids are not stalled by the blocked sender
+		t.Fatal(err)
+	}
+	calls.wait(t)
+
+	close(proceed)
+	if err := receiveSignalResult(t, blocked, testWaitTimeout); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		calls.wait(t)
+	}
+}
+
+func TestOverflowBlockTimeout(t *testing.T) {
+	calls := newTestCalls()
+	proceed := make(chan struct{})
+	r := newTestRuntime(t, newTestRuntimeConfig(backend.NewInMemory()))
+	NewFunctionType(r.Runtime, "test.overflow", overflowTestHandler(calls, proceed), *NewFunctionTypeConfig().SetMsgChannelSize(1).SetOverflowPolicy(OverflowBlock, 200))
+	startTestRuntime(t, r)
+	defer close(proceed)
+	fillMailbox(t, r, calls)
+
+	start := time.Now()
+	if err := receiveSignalResult(t, signalAsync(r, "a"), testWaitTimeout); err == nil {
+		t.Fatal("signal to the full mailbox was accepted")
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Fatalf("signal was refused after %s, before the overflow timeout", elapsed)
+	}
+}
+
+func TestOverflowBlockedSenderDoesNotStallStop(t *testing.T) {
+	calls := newTestCalls()
+	proceed := make(chan struct{})
+	r := newTestRuntime(t, newTestRuntimeConfig(backend.NewInMemory()))
+	ft := NewFunctionType(r.Runtime, "test.overflow", overflowTestHandler(calls, proceed), *NewFunctionTypeConfig().SetMsgChannelSize(1).SetOverflowPolicy(OverflowBlock, 5000))
+	startTestRuntime(t, r)
+	defer close(proceed)
+	fillMailbox(t, r, calls)
+
+	blocked := signalAsync(r, "a")
+	time.Sleep(100 * time.Millisecond)
+	stopped := make(chan struct{})
+	go func() {
+		ft.stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("function type was not stopped while a sender is blocked")
+	}
+	if err := receiveSignalResult(t, blocked, time.Second); err == nil {
+		t.Fatal("blocked signal was accepted by the stopped function type")
+	}
+}
+
+func TestOverflowSelfSignalDoesNotBlock(t *testing.T) {
+	r := newTestRuntime(t, newTestRuntimeConfig(backend.NewInMemory()))
+	results := make(chan error, 2)
+	NewFunctionType(r.Runtime, "test.overflow", func(_ sfPlugins.StatefunExecutor, contextProcessor *sfPlugins.StatefunContextProcessor) {
+		if contextProcessor.Payload.GetByPath("self").AsBoolDefault(false) {
+			return
+		}
+		for i := 0; i < 2; i++ {
+			results <- contextProcessor.Signal(sfPlugins.GolangLocalSignal, "test.overflow", contextProcessor.Self.ID, testPayload("self", true), nil)
+		}
+	}, *NewFunctionTypeConfig().SetMsgChannelSize(1).SetOverflowPolicy(OverflowBlock, 5000))
+	startTestRuntime(t, r)
+
+	if err := r.Signal(sfPlugins.GolangLocalSignal, "test.overflow", "a", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := receiveSignalResult(t, results, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := receiveSignalResult(t, results, time.Second); err == nil { // Mailbox is full, the handler itself cannot make room
+		t.Fatal("self signal to the full mailbox was accepted")
+	}
+}
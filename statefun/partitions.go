@@ -0,0 +1,461 @@
+// Copyright 2023 NJWS Inc.
+
+package statefun
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/foliagecp/easyjson"
+
+	"github.com/foliagecp/sdk/statefun/backend"
+	lg "github.com/foliagecp/sdk/statefun/logger"
+	"github.com/foliagecp/sdk/statefun/system"
+)
+
+const (
+	PartitionSubjectPrefix = "partition"
+	PartitionsKVPrefix     = "statefun_partitions"
+)
+
+/*
+A partitioned function type splits its ids by a hash into N partitions, every partition is handled by a single runtime at a time,
+so all signals for an id are handled by the same runtime in the order they were received.
+Signals sent to "<typename>.<id>" are routed by the function type's queue consumer to "partition.<typename>.<partition>.<id>",
+runtimes which have the function type registered publish to the partition subject directly.
+
+Every runtime handling the function type heartbeats its membership in KV and holds leases of its fair share of partitions,
+the share is recomputed when a runtime joins or leaves. A lease of a runtime that died is not renewed and expires
+after partitionLeaseLifetimeSec, then the partition is taken over by the live runtimes.
+*/
+
+// Partition of the id among the given number of partitions
+func getIDPartition(id string, partitions int) int {
+	h := fnv.New32a()
+	h.Write([]byte(id))
+	return int(h.Sum32() % uint32(partitions))
+}
+
+func getPartitionSubject(typename string, partition string, id string) string {
+	return fmt.Sprintf("%s.%s.%s.%s", PartitionSubjectPrefix, typename, partition, id)
+}
+
+func getPartitionsStreamName(typename string) string {
+	return fmt.Sprintf("%s_partitions_stream", system.GetHashStr(typename+".*"))
+}
+
+func getPartitionLeaseKey(typename string, partition int) string {
+	return fmt.Sprintf("%s.%s.leases.%d", PartitionsKVPrefix, system.GetHashStr(typename), partition)
+}
+
+func getPartitionMemberKey(typename string, runtimeID string) string {
+	return fmt.Sprintf("%s.%s.members.%s", PartitionsKVPrefix, system.GetHashStr(typename), runtimeID)
+}
+
+// Subject a jetstream signal to the function is published to
+func (r *Runtime) streamSubject(typename string, id string) string {
+	if ft, ok := r.registeredFunctionTypes[typename]; ok && ft.config.partitions > 0 {
+		return getPartitionSubject(typename, strconv.Itoa(getIDPartition(id, ft.config.partitions)), id)
+	} else if ok && ft.versioned() {
+		if version := ft.targetVersion(id); len(version) > 0 {
+			return getVersionSubject(typename, version, id)
+		}
+	}
+	return fmt.Sprintf("%s.%s", typename, id)
+}
+
+func (ft *FunctionType) ensurePartitionsStream() error {
+	return ft.runtime.backend.EnsureStream(backend.StreamConfig{
+		Name:       getPartitionsStreamName(ft.name),
+		Subjects:   []string{getPartitionSubject(ft.name, "*", "*")},
+		Duplicates: time.Duration(ft.config.idempotencyWindowSec) * time.Second,
+	})
+}
+
+// Moves the message received by the function type's queue consumer to the partition of its id
+func (ft *FunctionType) routeToPartition(msg backend.Msg) error {
+	tokens := strings.Split(msg.Subject(), ".")
+	id := tokens[len(tokens)-1]
+	subject := getPartitionSubject(ft.name, strconv.Itoa(getIDPartition(id, ft.config.partitions)), id)
+
+	var err error
+	if msgID := msg.MsgID(); len(msgID) > 0 {
+		err = ft.runtime.backend.StreamPublishMsgID(subject, msg.Data(), msgID)
+	} else {
+		err = ft.runtime.backend.StreamPublish(subject, msg.Data())
+	}
+	if err != nil {
+		system.MsgOnErrorReturn(msg.Nak())
+		return fmt.Errorf("function %s cannot route message for id=%s to its partition: %w", ft.name, id, err)
+	}
+	return msg.Ack()
+}
+
+// --------------------------------------------------------------------------------------------------------------------
+
+type partitionLease struct {
+	revision     uint64
+	subscription backend.Subscription
+	mutex        sync.Mutex
+	inFlight     int           // Received messages of the partition which are not acked or nacked yet
+	unsubscribed bool          // Messages received after that are nacked
+	drained      chan struct{} // Closed once unsubscribed and no messages are in flight
+}
+
+func newPartitionLease(revision uint64) *partitionLease {
+	return &partitionLease{revision: revision, drained: make(chan struct{})}
+}
+
+// Returns false if the lease does not take messages anymore
+func (l *partitionLease) msgReceived() bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.unsubscribed {
+		return false
+	}
+	l.inFlight++
+	return true
+}
+
+func (l *partitionLease) msgDone() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.inFlight--
+	if l.unsubscribed && l.inFlight == 0 {
+		close(l.drained)
+	}
+}
+
+func (l *partitionLease) unsubscribe() error {
+	err := l.subscription.Unsubscribe()
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if !l.unsubscribed {
+		l.unsubscribed = true
+		if l.inFlight == 0 {
+			close(l.drained)
+		}
+	}
+	return err
+}
+
+// Message of a partition which is in flight until acked or nacked
+type partitionMsg struct {
+	backend.Msg
+	lease *partitionLease
+	once  sync.Once
+}
+
+func (m *partitionMsg) done() {
+	m.once.Do(m.lease.msgDone)
+}
+
+func (m *partitionMsg) Ack() error {
+	defer m.done()
+	return m.Msg.Ack()
+}
+
+func (m *partitionMsg) Nak() error {
+	defer m.done()
+	return m.Msg.Nak()
+}
+
+func (m *partitionMsg) NakWithDelay(delay time.Duration) error {
+	defer m.done()
+	return m.Msg.NakWithDelay(delay)
+}
+
+type idPartitioner struct {
+	ft        *FunctionType
+	mutex     sync.Mutex
+	stopped   bool
+	leases    map[int]*partitionLease // Partition -> lease held by this runtime
+	releasing map[int]*partitionLease // Partition -> lease held until the messages of the partition in flight are done
+	members   map[string]int64        // Member KV key -> time of the member's last heartbeat
+}
+
+func newIDPartitioner(ft *FunctionType) *idPartitioner {
+	return &idPartitioner{
+		ft:        ft,
+		leases:    map[int]*partitionLease{},
+		releasing: map[int]*partitionLease{},
+		members:   map[string]int64{},
+	}
+}
+
+func (p *idPartitioner) run() {
+	system.GlobalPrometrics.GetRoutinesCounter().Started("idPartitioner")
+	defer system.GlobalPrometrics.GetRoutinesCounter().Stopped("idPartitioner")
+
+	r := p.ft.runtime
+	w, err := r.kv.Watch(fmt.Sprintf("%s.%s.members.*", PartitionsKVPrefix, system.GetHashStr(p.ft.name)))
+	if err != nil {
+		lg.Logf(lg.ErrorLevel, "Partitioner of function type %s cannot watch members: %s\n", p.ft.name, err)
+		return
+	}
+	defer func() { system.MsgOnErrorReturn(w.Stop()) }()
+
+	membersKnown := false
+	ticker := time.NewTicker(time.Duration(r.config.partitionLeaseLifetimeSec) * time.Second / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.ctx.Done():
+			return
+		case entry, ok := <-w.Updates():
+			if !ok {
+				lg.Logf(lg.WarnLevel, "Partitioner of function type %s stopped watching members\n", p.ft.name)
+				return
+			}
+			if entry == nil { // All current members are known, taking the share
+				membersKnown = true
+				p.rebalance()
+				continue
+			}
+			heartbeat := system.BytesToInt64(entry.Value())
+			p.mutex.Lock()
+			_, known := p.members[entry.Key()]
+			p.members[entry.Key()] = heartbeat
+			p.mutex.Unlock()
+			if membersKnown && (!known || heartbeat == 0) { // A runtime joined or left, recomputing shares without waiting for the next tick
+				p.rebalance()
+			}
+		case <-ticker.C:
+			if membersKnown {
+				p.rebalance()
+			}
+		}
+	}
+}
+
+func (p *idPartitioner) rebalance() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.stopped {
+		return
+	}
+	r := p.ft.runtime
+	partitions := p.ft.config.partitions
+	now := system.GetCurrentTimeNs()
+	lifetime := int64(r.config.partitionLeaseLifetimeSec) * int64(time.Second)
+
+	memberKey := getPartitionMemberKey(p.ft.name, r.id)
+	if _, err := r.kv.Put(memberKey, system.Int64ToBytes(now)); err != nil {
+		lg.Logf(lg.ErrorLevel, "Partitioner of function type %s cannot heartbeat: %s\n", p.ft.name, err)
+	}
+	p.members[memberKey] = now
+
+	for partition, lease := range p.leases {
+		if !p.renew(partition, lease, now) {
+			system.MsgOnErrorReturn(lease.unsubscribe())
+			delete(p.leases, partition)
+		}
+	}
+	for partition, lease := range p.releasing {
+		if !p.renew(partition, lease, now) {
+			delete(p.releasing, partition)
+		}
+	}
+
+	// Fair share of this runtime among the live ones ---------------
+	live := make([]string, 0, len(p.members))
+	for key, heartbeat := range p.members {
+		if heartbeat+lifetime < now {
+			delete(p.members, key)
+			if err := r.kv.Erase(key); err != nil && !errors.Is(err, backend.ErrKeyNotFound) {
+				lg.Logf(lg.WarnLevel, "Partitioner of function type %s cannot erase dead member %s: %s\n", p.ft.name, key, err)
+			}
+			continue
+		}
+		live = append(live, key)
+	}
+	sort.Strings(live)
+	index := sort.SearchStrings(live, memberKey)
+	share := partitions / len(live)
+	if index < partitions%len(live) {
+		share++
+	}
+	// --------------------------------------------------------------
+
+	for len(p.leases) > share {
+		last := -1
+		for partition := range p.leases {
+			if partition > last {
+				last = partition
+			}
+		}
+		p.release(last)
+	}
+	start := index * partitions / len(live) // Runtimes start from different partitions to compete less
+	for i := 0; i < partitions && len(p.leases) < share; i++ {
+		partition := (start + i) % partitions
+		_, leased := p.leases[partition]
+		_, releasing := p.releasing[partition]
+		if !leased && !releasing {
+			p.acquire(partition, now)
+		}
+	}
+}
+
+func (p *idPartitioner) leaseValue(now int64) []byte {
+	lease := easyjson.NewJSONObject()
+	if now != 0 {
+		lease.SetByPath("owner", easyjson.NewJSON(p.ft.runtime.id))
+	} else {
+		lease.SetByPath("owner", easyjson.NewJSON(""))
+	}
+	lease.SetByPath("renewed_at", easyjson.NewJSON(now))
+	return lease.ToBytes()
+}
+
+func (p *idPartitioner) acquire(partition int, now int64) {
+	r := p.ft.runtime
+	key := getPartitionLeaseKey(p.ft.name, partition)
+
+	var revision uint64
+	entry, err := r.kv.Get(key)
+	switch {
+	case errors.Is(err, backend.ErrKeyNotFound):
+		revision, err = r.kv.Put(key, p.leaseValue(now))
+	case err != nil:
+	default:
+		if lease, ok := easyjson.JSONFromBytes(entry.Value()); ok {
+			renewedAt := int64(lease.GetByPath("renewed_at").AsNumericDefault(0))
+			if len(lease.GetByPath("owner").AsStringDefault("")) > 0 && renewedAt+int64(r.config.partitionLeaseLifetimeSec)*int64(time.Second) >= now {
+				return // Held by other runtime
+			}
+		}
+		revision, err = r.kv.Update(key, p.leaseValue(now), entry.Revision())
+	}
+	if err != nil {
+		if !errors.Is(err, backend.ErrWrongLastRevision) {
+			lg.Logf(lg.ErrorLevel, "Cannot acquire partition %d of function type %s: %s\n", partition, p.ft.name, err)
+		}
+		return
+	}
+
+	lease := newPartitionLease(revision)
+	lease.subscription, err = p.subscribe(partition, lease)
+	if err != nil {
+		lg.Logf(lg.ErrorLevel, "Cannot subscribe to partition %d of function type %s: %s\n", partition, p.ft.name, err)
+		system.MsgOnErrorReturn(r.kv.Update(key, p.leaseValue(0), revision))
+		return
+	}
+	p.leases[partition] = lease
+	lg.Logf(lg.DebugLevel, "Runtime %s acquired partition %d of function type %s\n", r.id, partition, p.ft.name)
+}
+
+// Returns false if the lease was lost
+func (p *idPartitioner) renew(partition int, lease *partitionLease, now int64) bool {
+	revision, err := p.ft.runtime.kv.Update(getPartitionLeaseKey(p.ft.name, partition), p.leaseValue(now), lease.revision)
+	if err != nil {
+		lg.Logf(lg.WarnLevel, "Runtime %s lost partition %d of function type %s: %s\n", p.ft.runtime.id, partition, p.ft.name, err)
+		return false
+	}
+	lease.revision = revision
+	return true
+}
+
+// Stops receiving messages of the partition, the lease is kept and renewed until the messages already received are acked or nacked,
+// so no other runtime handles the same ids meanwhile
+func (p *idPartitioner) release(partition int) {
+	lease := p.leases[partition]
+	delete(p.leases, partition)
+	system.MsgOnErrorReturn(lease.unsubscribe())
+	p.releasing[partition] = lease
+	go func() {
+		select {
+		case <-lease.drained:
+		case <-p.ft.runtime.ctx.Done(): // Released by releaseAll on shutdown
+			return
+		}
+		p.mutex.Lock()
+		defer p.mutex.Unlock()
+		if p.releasing[partition] != lease { // Lost meanwhile
+			return
+		}
+		delete(p.releasing, partition)
+		if _, err := p.ft.runtime.kv.Update(getPartitionLeaseKey(p.ft.name, partition), p.leaseValue(0), lease.revision); err != nil {
+			lg.Logf(lg.WarnLevel, "Cannot release partition %d of function type %s: %s\n", partition, p.ft.name, err)
+			return
+		}
+		lg.Logf(lg.DebugLevel, "Runtime %s released partition %d of function type %s\n", p.ft.runtime.id, partition, p.ft.name)
+	}()
+}
+
+func (p *idPartitioner) subscribe(partition int, lease *partitionLease) (backend.Subscription, error) {
+	ft := p.ft
+	consumerName := fmt.Sprintf("%s_partition_%d", strings.ReplaceAll(ft.name, ".", ""), partition)
+	return ft.runtime.backend.SubscribeConsumer(
+		getPartitionsStreamName(ft.name),
+		backend.ConsumerConfig{
+			Name:          consumerName,
+			DeliverGroup:  consumerName + "-group",
+			FilterSubject: getPartitionSubject(ft.name, strconv.Itoa(partition), "*"),
+			AckWait:       time.Duration(ft.config.msgAckWaitMs) * time.Millisecond,
+			MaxAckPending: ft.config.maxAckPending,
+		},
+		func(msg backend.Msg) {
+			if !lease.msgReceived() { // Delivered right before the unsubscription
+				system.MsgOnErrorReturn(msg.Nak())
+				return
+			}
+			system.MsgOnErrorReturn(handleNatsMsg(ft, &partitionMsg{Msg: msg, lease: lease}, false, ft.msgAckChannel))
+		},
+	)
+}
+
+// Stops receiving messages of all partitions, leases are kept until releaseAll so no other runtime takes them over
+// while already received messages are being handled
+func (p *idPartitioner) unsubscribeAll() (errs []error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.stopped = true
+	for _, lease := range p.leases {
+		if err := lease.unsubscribe(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return
+}
+
+func (p *idPartitioner) releaseAll() (errs []error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	r := p.ft.runtime
+	for _, leases := range []map[int]*partitionLease{p.leases, p.releasing} {
+		for partition, lease := range leases {
+			if _, err := r.kv.Update(getPartitionLeaseKey(p.ft.name, partition), p.leaseValue(0), lease.revision); err != nil {
+				errs = append(errs, fmt.Errorf("cannot release partition %d of function type %s: %w", partition, p.ft.name, err))
+			}
+		}
+	}
+	p.leases = map[int]*partitionLease{}
+	p.releasing = map[int]*partitionLease{}
+	if _, err := r.kv.Put(getPartitionMemberKey(p.ft.name, r.id), system.Int64ToBytes(0)); err != nil { // Other members see this one left at once
+		errs = append(errs, err)
+	}
+	return
+}
+
+// PartitionsOwned returns partitions of the function type this runtime currently handles
+func (r *Runtime) PartitionsOwned(typename string) []int {
+	ft, ok := r.registeredFunctionTypes[typename]
+	if !ok || ft.partitioner == nil {
+		return nil
+	}
+	ft.partitioner.mutex.Lock()
+	defer ft.partitioner.mutex.Unlock()
+	owned := make([]int, 0, len(ft.partitioner.leases))
+	for partition := range ft.partitioner.leases {
+		owned = append(owned, partition)
+	}
+	sort.Ints(owned)
+	return owned
+}
@@ -0,0 +1,68 @@
+// Copyright 2023 NJWS Inc.
+
+package statefun
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/foliagecp/easyjson"
+
+	"github.com/foliagecp/sdk/statefun/backend"
+	sfPlugins "github.com/foliagecp/sdk/statefun/plugins"
+)
+
+// Records the call and waits for proceed
+func partitionsTestHandler(calls *testCalls, proceed chan struct{}) FunctionLogicHandler {
+	return func(_ sfPlugins.StatefunExecutor, contextProcessor *sfPlugins.StatefunContextProcessor) {
+		calls.record(contextProcessor)
+		<-proceed
+	}
+}
+
+func partitionOwner(t *testing.T, r *testRuntime, partition int) string {
+	entry, err := r.kv.Get(getPartitionLeaseKey("test.partitioned", partition))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lease, _ := easyjson.JSONFromBytes(entry.Value())
+	return lease.GetByPath("owner").AsStringDefault("")
+}
+
+func TestPartitionReleasedAfterInFlightMsgs(t *testing.T) {
+	b := backend.NewInMemory()
+	calls := newTestCalls()
+	proceed := make(chan struct{})
+	r1 := newTestRuntime(t, newTestRuntimeConfig(b).SetPartitionLeaseLifetimeSec(1))
+	NewFunctionType(r1.Runtime, "test.partitioned", partitionsTestHandler(calls, proceed), *NewFunctionTypeConfig().SetPartitions(2).SetMultipleInstancesAllowance(true))
+	startTestRuntime(t, r1)
+	waitFor(t, "all partitions owned by the first runtime", func() bool { return len(r1.PartitionsOwned("test.partitioned")) == 2 })
+
+	id := "a"
+	for i := 0; getIDPartition(id, 2) != 1; i++ { // The last partition is released first
+		id = fmt.Sprint("a", i)
+	}
+	if err := r1.Signal(sfPlugins.JetstreamGlobalSignal, "test.partitioned", id, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	calls.wait(t)
+
+	r2 := newTestRuntime(t, newTestRuntimeConfig(b).SetPartitionLeaseLifetimeSec(1))
+	NewFunctionType(r2.Runtime, "test.partitioned", partitionsTestHandler(calls, proceed), *NewFunctionTypeConfig().SetPartitions(2).SetMultipleInstancesAllowance(true))
+	startTestRuntime(t, r2)
+	waitFor(t, "partition 1 released by the first runtime", func() bool {
+		owned := r1.PartitionsOwned("test.partitioned")
+		return len(owned) == 1 && owned[0] == 0
+	})
+	time.Sleep(time.Second) // Several rebalances of the second runtime
+	if owner := partitionOwner(t, r1, 1); owner != r1.ID() {
+		t.Fatalf("partition 1 with a message in flight is owned by %q", owner)
+	}
+
+	close(proceed)
+	waitFor(t, "partition 1 owned by the second runtime", func() bool {
+		owned := r2.PartitionsOwned("test.partitioned")
+		return len(owned) == 1 && owned[0] == 1
+	})
+}
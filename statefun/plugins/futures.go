@@ -0,0 +1,114 @@
+// Copyright 2023 NJWS Inc.
+
+package plugins
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/foliagecp/easyjson"
+)
+
+type RequestResult struct {
+	Index int // Index of the future in the list of awaited ones
+	Data  *easyjson.JSON
+	Err   error
+}
+
+// RequestFuture is a result of an asynchronous request which becomes available once the request completes
+type RequestFuture struct {
+	done chan struct{}
+	data *easyjson.JSON
+	err  error
+}
+
+func NewRequestFuture() *RequestFuture {
+	return &RequestFuture{done: make(chan struct{})}
+}
+
+// Resolve completes the future, must be called exactly once
+func (f *RequestFuture) Resolve(data *easyjson.JSON, err error) {
+	f.data = data
+	f.err = err
+	close(f.done)
+}
+
+// Done is closed when the request is completed
+func (f *RequestFuture) Done() <-chan struct{} {
+	return f.done
+}
+
+// Result blocks until the request is completed
+func (f *RequestFuture) Result() (*easyjson.JSON, error) {
+	<-f.done
+	return f.data, f.err
+}
+
+func (f *RequestFuture) Await(ctx context.Context) (*easyjson.JSON, error) {
+	select {
+	case <-f.done:
+		return f.data, f.err
+	case <-ctx.Done():
+		select {
+		case <-f.done: // Completed result wins over the expired context
+			return f.data, f.err
+		default:
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// AwaitAll waits for all futures until ctx is done, results are in the order of futures.
+// Results of the futures which did not complete in time hold the error of ctx.
+func AwaitAll(ctx context.Context, futures ...*RequestFuture) []RequestResult {
+	results := make([]RequestResult, len(futures))
+	for i, f := range futures {
+		results[i].Index = i
+		results[i].Data, results[i].Err = f.Await(ctx)
+	}
+	return results
+}
+
+// AwaitFirstN waits until n futures complete successfully and returns their results in the order of completion.
+// Fails if ctx is done or too many futures failed for n successful ones to be possible, results collected so far are returned anyway.
+func AwaitFirstN(ctx context.Context, n int, futures ...*RequestFuture) ([]RequestResult, error) {
+	if n > len(futures) {
+		return nil, fmt.Errorf("cannot await %d results of %d requests", n, len(futures))
+	}
+	if n <= 0 {
+		return []RequestResult{}, nil
+	}
+
+	stop := make(chan struct{})
+	defer close(stop)
+	completed := make(chan int, len(futures))
+	for i, f := range futures {
+		go func(i int, f *RequestFuture) {
+			select {
+			case <-f.Done():
+				completed <- i
+			case <-stop:
+			}
+		}(i, f)
+	}
+
+	results := make([]RequestResult, 0, n)
+	failed := 0
+	for len(results) < n {
+		select {
+		case i := <-completed:
+			data, err := futures[i].Result()
+			if err != nil {
+				failed++
+				if len(futures)-failed < n {
+					return results, fmt.Errorf("cannot await %d results, %d of %d requests failed, last error: %w", n, failed, len(futures), err)
+				}
+				continue
+			}
+			results = append(results, RequestResult{Index: i, Data: data})
+		case <-ctx.Done():
+			return results, ctx.Err()
+		}
+	}
+	return results, nil
+}
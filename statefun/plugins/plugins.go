@@ -5,7 +5,9 @@
 package plugins
 
 import (
+	"context"
 	"sync"
+	"time"
 
 	lg "github.com/foliagecp/sdk/statefun/logger"
 
@@ -22,7 +24,9 @@ type StatefunAddress struct {
 type SignalProvider int
 
 const (
-	JetstreamGlobalSignal SignalProvider = iota
+	JetstreamGlobalSignal SignalProvider = iota // Durable, signal is stored in the target function type's stream before returning
+	GolangLocalSignal                           // Not durable, signal is passed directly to the function type registered in the same runtime
+	NatsCoreGlobalSignal                        // Not durable, fire and forget publish to the subject, e.g. to reply to a NATS client
 )
 
 type RequestProvider int
@@ -37,6 +41,16 @@ type SyncReply struct {
 	CancelDefault func()
 }
 
+// DownstreamFilter selects the out links followed by DownstreamSignal and DownstreamRequest
+type DownstreamFilter struct {
+	LinkType string // Type of the links to follow, empty or "*" - any
+	Filter   string // JPGQL link filter, e.g. "tags('t1') && name('n1')", empty - any link of the type
+	MaxDepth int    // How many links away from Self.ID vertices are reached, 1 (direct neighbours) if not positive
+}
+
+// LinksResolver returns ids of the vertices the out links of the vertex matching the link type and the filter lead to
+type LinksResolver func(cacheStore *cache.Store, vertexID string, linkType string, filter string) ([]string, error)
+
 type StatefunContextProcessor struct {
 	GlobalCache        *cache.Store
 	GetFunctionContext func() *easyjson.JSON
@@ -45,14 +59,51 @@ type StatefunContextProcessor struct {
 	SetObjectContext   func(*easyjson.JSON)
 	ObjectMutexLock    func(errorOnLocked bool) error
 	ObjectMutexUnlock  func() error
-	// TODO: DownstreamSignal(<function type>, <links filters>, <payload>, <options>)
-	Signal  func(SignalProvider, string, string, *easyjson.JSON, *easyjson.JSON) error
-	Request func(RequestProvider, string, string, *easyjson.JSON, *easyjson.JSON) (*easyjson.JSON, error)
-	Self    StatefunAddress
-	Caller  StatefunAddress
-	Payload *easyjson.JSON
-	Options *easyjson.JSON
-	Reply   *SyncReply // when requested in function: nil - function was signaled, !nil - function was requested
+	Signal             func(SignalProvider, string, string, *easyjson.JSON, *easyjson.JSON) error
+	Request            func(RequestProvider, string, string, *easyjson.JSON, *easyjson.JSON) (*easyjson.JSON, error)
+	Self               StatefunAddress
+	Caller             StatefunAddress
+	Payload            *easyjson.JSON
+	Options            *easyjson.JSON
+	Reply              *SyncReply // when requested in function: nil - function was signaled, !nil - function was requested
+
+	// Context of the current call, carries the deadline of the request if the function was requested with one.
+	// Is cancelled when the call ends.
+	Context context.Context
+	// RequestCtx requests with the deadline and cancellation of ctx, pass Context to propagate the deadline of the current call
+	RequestCtx func(context.Context, RequestProvider, string, string, *easyjson.JSON, *easyjson.JSON) (*easyjson.JSON, error)
+	// RequestAsync does not block, use AwaitAll or AwaitFirstN to fan-out requests and gather replies
+	RequestAsync func(context.Context, RequestProvider, string, string, *easyjson.JSON, *easyjson.JSON) *RequestFuture
+	// SignalIdempotent signals with the idempotency key (4th argument), signals with the same key are delivered only once
+	SignalIdempotent func(SignalProvider, string, string, string, *easyjson.JSON, *easyjson.JSON) error
+
+	// Durable timers: signal to <typename, id> at the time or after the delay, identified by the timer id
+	SignalAt    func(timerID string, at time.Time, typename string, id string, payload *easyjson.JSON, options *easyjson.JSON) error
+	SignalAfter func(timerID string, delay time.Duration, typename string, id string, payload *easyjson.JSON, options *easyjson.JSON) error
+	CancelTimer func(timerID string) error
+
+	// Optimistic concurrency for contexts: revision is 0 if the context does not exist, setting with a revision fails
+	// with cache.ErrRevisionConflict if the context was changed since it was read with the revision.
+	// Update*Context re-reads the context and calls modify again on conflict a bounded number of times.
+	GetFunctionContextWithRevision func() (*easyjson.JSON, int64)
+	SetFunctionContextIfRevision   func(context *easyjson.JSON, revision int64) (int64, error)
+	UpdateFunctionContext          func(modify func(context *easyjson.JSON) error) error
+	GetObjectContextWithRevision   func() (*easyjson.JSON, int64)
+	SetObjectContextIfRevision     func(context *easyjson.JSON, revision int64) (int64, error)
+	UpdateObjectContext            func(modify func(context *easyjson.JSON) error) error
+
+	// DownstreamSignal signals the function type on every vertex reachable from Self.ID through the out links matching the filter,
+	// every vertex once, Self.ID excluded. Returns how many vertices were signaled.
+	DownstreamSignal func(signalProvider SignalProvider, typename string, filter DownstreamFilter, payload *easyjson.JSON, options *easyjson.JSON) (int, error)
+	// DownstreamRequest requests the vertices DownstreamSignal would signal concurrently and aggregates their replies:
+	// {"replies": {<vertex id>: <reply>}, "errors": {<vertex id>: <error>}}
+	DownstreamRequest func(ctx context.Context, requestProvider RequestProvider, typename string, filter DownstreamFilter, payload *easyjson.JSON, options *easyjson.JSON) (*easyjson.JSON, error)
+
+	// DeleteFunctionContext deletes the function context of the current id everywhere
+	DeleteFunctionContext func()
+	// DeleteObjectContext deletes the object context of the current id together with the function contexts
+	// of all function types configured to be deleted with the object
+	DeleteObjectContext func()
 }
 
 type StatefunExecutor interface {
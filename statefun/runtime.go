@@ -6,28 +6,53 @@ package statefun
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"slices"
+	"net/http"
+	"sync"
 	"sync/atomic"
 	"time"
 
+	natsServer "github.com/foliagecp/sdk/embedded/nats/server"
 	lg "github.com/foliagecp/sdk/statefun/logger"
+	"github.com/nats-io/nats.go"
 	"github.com/prometheus/client_golang/prometheus"
 
-	"github.com/foliagecp/sdk/embedded/nats/kv"
+	"github.com/foliagecp/sdk/statefun/backend"
 	"github.com/foliagecp/sdk/statefun/cache"
+	sfPlugins "github.com/foliagecp/sdk/statefun/plugins"
 	"github.com/foliagecp/sdk/statefun/system"
-	"github.com/nats-io/nats.go"
 )
 
+const KVRewatchIntervalMs = 1000
+
+var errRuntimeShuttingDown = errors.New("runtime is shutting down")
+
 type Runtime struct {
-	config     RuntimeConfig
-	nc         *nats.Conn
-	js         nats.JetStreamContext
-	kv         nats.KeyValue
-	cacheStore *cache.Store
+	id                 string // Unique id of the runtime instance
+	config             RuntimeConfig
+	backend            backend.Backend
+	backendOwned       bool               // Backend was created by the runtime itself and must be closed on shutdown
+	embeddedNatsServer *natsServer.Server // Embedded nats server started by the runtime
+	kv                 backend.KeyValue
+	cacheStore         *cache.Store
 
 	registeredFunctionTypes map[string]*FunctionType
+	interceptors            []Interceptor
+	objectBoundTypenames    sync.Map // Function types which contexts are deleted with the object, of all runtimes
+	linksResolver           sfPlugins.LinksResolver
+
+	ctx                             context.Context
+	cancel                          context.CancelFunc
+	subscriptions                   []backend.Subscription
+	subscriptionsClosed             bool // Shutdown has unsubscribed everything, new subscriptions are refused
+	singleInstanceFunctionRevisions map[string]uint64
+	resourceMutex                   sync.Mutex
+	shutdownOnce                    sync.Once
+	shutdownErr                     error
+	ready                           atomic.Bool // Start has created all streams and consumers
+	healthServer                    *http.Server
+	adminServer                     *http.Server
 
 	gt0  int64 // Global time 0 - time of the very first message receving by any function type
 	glce int64 // Global last call ended - time of last call of last function handling id of any function type
@@ -36,40 +61,56 @@ type Runtime struct {
 
 func NewRuntime(config RuntimeConfig) (r *Runtime, err error) {
 	r = &Runtime{
-		config:                  config,
-		registeredFunctionTypes: make(map[string]*FunctionType),
-	}
-
-	r.nc, err = nats.Connect(config.natsURL)
-	if err != nil {
-		return
+		id:                              config.runtimeID,
+		config:                          config,
+		registeredFunctionTypes:         make(map[string]*FunctionType),
+		singleInstanceFunctionRevisions: make(map[string]uint64),
 	}
-
-	r.js, err = r.nc.JetStream(nats.PublishAsyncMaxPending(256))
-	if err != nil {
-		return
+	if len(r.id) == 0 {
+		r.id = system.GetUniqueStrID()
+	} else if !isValidRuntimeID(r.id) {
+		return nil, fmt.Errorf("runtime id \"%s\" is invalid, it must be a single subject token", r.id)
 	}
+	r.ctx, r.cancel = context.WithCancel(context.Background())
 
-	// Create application key value store bucket if does not exist --
-	kvExists := false
-	if kv, err := r.js.KeyValue(config.keyValueStoreBucketName); err == nil {
-		r.kv = kv
-		kvExists = true
-	}
-	if !kvExists {
-		r.kv, err = kv.CreateKeyValue(r.nc, r.js, &nats.KeyValueConfig{
-			Bucket: config.keyValueStoreBucketName,
-		})
-		/*r.kv, err = r.js.CreateKeyValue(&nats.KeyValueConfig{
-			Bucket: config.keyValueStoreBucketName,
-		})*/
+	if config.backend != nil {
+		r.backend = config.backend
+	} else if config.embeddedNatsServer != nil {
+		if r.embeddedNatsServer, err = natsServer.Start(config.embeddedNatsServer); err != nil {
+			err = fmt.Errorf("embedded nats server was not started: %w", err)
+			return
+		}
+		lg.Logf(lg.InfoLevel, "Embedded nats server is listening on %s\n", r.embeddedNatsServer.ClientURL())
+		var nc *nats.Conn
+		if nc, err = r.embeddedNatsServer.Connect(); err == nil {
+			r.backend, err = backend.NewNatsFromConn(nc)
+			if err != nil {
+				nc.Close()
+			}
+		}
+		if err != nil {
+			r.embeddedNatsServer.Shutdown()
+			return
+		}
+		r.backendOwned = true
+	} else {
+		r.backend, err = backend.NewNats(config.natsURL)
 		if err != nil {
 			return
 		}
-		kvExists = true
+		r.backendOwned = true
 	}
-	if !kvExists {
-		err = fmt.Errorf("Nats KV was not inited")
+
+	// Create application key value store bucket if does not exist --
+	r.kv, err = r.backend.KeyValue(config.keyValueStoreBucketName)
+	if err != nil {
+		err = fmt.Errorf("KV was not inited: %w", err)
+		if r.backendOwned {
+			r.backend.Close()
+		}
+		if r.embeddedNatsServer != nil {
+			r.embeddedNatsServer.Shutdown()
+		}
 		return
 	}
 	// --------------------------------------------------------------
@@ -77,49 +118,76 @@ func NewRuntime(config RuntimeConfig) (r *Runtime, err error) {
 	return
 }
 
-func (r *Runtime) Start(cacheConfig *cache.Config, onAfterStart func(runtime *Runtime) error) (err error) {
+// Start creates streams and consumers for all registered function types and blocks until ctx is done or Shutdown is called.
+// When ctx is done the runtime is gracefully shut down within the configured shutdown timeout.
+func (r *Runtime) Start(ctx context.Context, cacheConfig *cache.Config, onAfterStart func(runtime *Runtime) error) (err error) {
+	go func() {
+		select {
+		case <-ctx.Done():
+			r.cancel()
+		case <-r.ctx.Done():
+		}
+	}()
+
+	if len(r.config.healthServerAddr) > 0 {
+		r.startHealthServer()
+	}
+
+	for _, functionType := range r.registeredFunctionTypes {
+		functionType.buildHandlerChain()
+	}
+
 	// Create streams if does not exist ------------------------------
 	/* Each stream contains a single subject (topic).
 	 * Differently named stream with overlapping subjects cannot exist!
 	 */
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-	var existingStreams []string
-	for info := range r.js.StreamsInfo(nats.Context(ctx)) {
-		existingStreams = append(existingStreams, info.Config.Name)
-	}
 	for _, functionType := range r.registeredFunctionTypes {
-		if !slices.Contains(existingStreams, functionType.getStreamName()) {
-			_, err := r.js.AddStream(&nats.StreamConfig{
-				Name:     functionType.getStreamName(),
-				Subjects: []string{functionType.subject},
-			})
-			system.MsgOnErrorReturn(err)
+		system.MsgOnErrorReturn(r.backend.EnsureStream(backend.StreamConfig{
+			Name:       functionType.getStreamName(),
+			Subjects:   []string{functionType.subject},
+			Duplicates: time.Duration(functionType.config.idempotencyWindowSec) * time.Second,
+		}))
+		if functionType.config.deadLetterActive {
+			system.MsgOnErrorReturn(functionType.ensureDeadLetterStream())
+		}
+		if functionType.config.partitions > 0 {
+			system.MsgOnErrorReturn(functionType.ensurePartitionsStream())
+		}
+		if len(functionType.config.version) > 0 && !isValidVersion(functionType.config.version) {
+			lg.Logf(lg.ErrorLevel, "Function type %s version \"%s\" is invalid, running it unversioned\n", functionType.name, functionType.config.version)
+			functionType.config.version = ""
+		}
+		if functionType.versioned() {
+			system.MsgOnErrorReturn(functionType.ensureVersionsStream())
+			system.MsgOnErrorReturn(functionType.watchVersionRouting())
 		}
 	}
 	// --------------------------------------------------------------
 
 	lg.Logln(lg.TraceLevel, "Initializing the cache store...")
-	r.cacheStore = cache.NewCacheStore(context.Background(), cacheConfig, r.js, r.kv)
+	r.cacheStore = cache.NewCacheStore(context.Background(), cacheConfig, r.kv)
 	lg.Logln(lg.TraceLevel, "Cache store inited!")
 
 	// Functions running in a single instance controller --------------------------------
-	singleInstanceFunctionRevisions := map[string]uint64{}
-	singleInstanceFunctionLocksUpdater := func(sifr map[string]uint64) {
+	singleInstanceFunctionLocksUpdater := func() {
 		system.GlobalPrometrics.GetRoutinesCounter().Started("singleInstanceFunctionLocksUpdater")
 		defer system.GlobalPrometrics.GetRoutinesCounter().Stopped("singleInstanceFunctionLocksUpdater")
-		if len(sifr) > 0 {
-			for {
-				time.Sleep(time.Duration(r.config.kvMutexLifeTimeSec) / 2 * time.Second)
-				for ftName, revId := range sifr {
-					newRevId, err := KeyMutexLockUpdate(r, system.GetHashStr(ftName), revId)
-					if err != nil {
-						lg.Logf(lg.ErrorLevel, "KeyMutexLockUpdate for single instance function type %s failed: %s", ftName, err.Error())
-					} else {
-						sifr[ftName] = newRevId
-					}
+		for {
+			select {
+			case <-r.ctx.Done():
+				return
+			case <-time.After(time.Duration(r.config.kvMutexLifeTimeSec) / 2 * time.Second):
+			}
+			r.resourceMutex.Lock()
+			for ftName, revId := range r.singleInstanceFunctionRevisions {
+				newRevId, err := KeyMutexLockUpdate(r, system.GetHashStr(ftName), revId)
+				if err != nil {
+					lg.Logf(lg.ErrorLevel, "KeyMutexLockUpdate for single instance function type %s failed: %s", ftName, err.Error())
+				} else {
+					r.singleInstanceFunctionRevisions[ftName] = newRevId
 				}
 			}
+			r.resourceMutex.Unlock()
 		}
 	}
 	// ----------------------------------------------------------------------------------
@@ -133,20 +201,56 @@ func (r *Runtime) Start(cacheConfig *cache.Config, onAfterStart func(runtime *Ru
 					lg.Logf(lg.WarnLevel, "Function type %s is already running somewhere and multipleInstancesAllowed==false, skipping", ft.name)
 					continue
 				} else {
-					return err
+					return errors.Join(err, r.shutdownWithTimeout())
 				}
 			}
-			singleInstanceFunctionRevisions[ftName] = revId
+			r.resourceMutex.Lock()
+			r.singleInstanceFunctionRevisions[ftName] = revId
+			r.resourceMutex.Unlock()
 		}
 
 		system.MsgOnErrorReturn(AddSignalSourceJetstreamQueuePushConsumer(ft))
-		if ft.config.serviceActive {
+		if ft.versioned() {
+			system.MsgOnErrorReturn(ft.subscribeVersion())
+		}
+		if ft.config.partitions > 0 {
+			ft.partitioner = newIDPartitioner(ft)
+			go ft.partitioner.run()
+		}
+		if ft.config.IsAccessible(AccessNatsCoreRequest) {
 			system.MsgOnErrorReturn(AddRequestSourceNatsCore(ft))
 		}
 	}
 	// --------------------------------------------------------------
 
-	go singleInstanceFunctionLocksUpdater(singleInstanceFunctionRevisions)
+	go singleInstanceFunctionLocksUpdater()
+	go r.runTimersScheduler()
+
+	for _, ft := range r.registeredFunctionTypes {
+		for _, schedule := range ft.config.cronSchedules {
+			schedule.Typename = ft.name
+			system.MsgOnErrorReturn(r.SetCronSchedule(schedule))
+		}
+	}
+	go r.runCronScheduler()
+
+	for _, ft := range r.registeredFunctionTypes {
+		if ft.config.objectBoundContext {
+			r.objectBoundTypenames.Store(ft.name, struct{}{})
+			_, err := r.kv.Put(getObjectBoundContextKey(ft.name), []byte(ft.name))
+			system.MsgOnErrorReturn(err)
+		}
+	}
+	go r.runContextsKeeper()
+
+	go r.runAdminHeartbeat()
+	system.MsgOnErrorReturn(r.subscribeAdmin())
+	if len(r.config.adminServerAddr) > 0 {
+		r.startAdminServer()
+	}
+
+	r.ready.Store(true)
+	lg.Logln(lg.InfoLevel, "Runtime is ready")
 
 	if onAfterStart != nil {
 		go func() {
@@ -155,12 +259,168 @@ func (r *Runtime) Start(cacheConfig *cache.Config, onAfterStart func(runtime *Ru
 			system.MsgOnErrorReturn(onAfterStart(r))
 		}()
 	}
-	system.MsgOnErrorReturn(r.runGarbageCellector())
+	r.runGarbageCellector()
 
-	return
+	return r.shutdownWithTimeout()
+}
+
+// Shuts the runtime down within the configured shutdown timeout
+func (r *Runtime) shutdownWithTimeout() error {
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), time.Duration(r.config.shutdownTimeoutSec)*time.Second)
+	defer shutdownCancel()
+	return r.Shutdown(shutdownCtx)
 }
 
-func (r *Runtime) runGarbageCellector() (err error) {
+// Shutdown gracefully stops the runtime: stops all signal and request consumers, lets already received messages
+// be handled by id handlers, flushes the cache store into the KV store, releases single instance function type locks
+// and closes the backend connection if the runtime created it. Only the first call does the job, others wait for it and return its result.
+func (r *Runtime) Shutdown(ctx context.Context) error {
+	r.shutdownOnce.Do(func() {
+		r.shutdownErr = r.shutdown(ctx)
+	})
+	return r.shutdownErr
+}
+
+func (r *Runtime) shutdown(ctx context.Context) error {
+	lg.Logln(lg.InfoLevel, "Shutting down the runtime...")
+	r.cancel()
+
+	var errs []error
+
+	// Admin and health requests must not reach the runtime being torn down
+	for _, server := range []*http.Server{r.adminServer, r.healthServer} {
+		if server != nil {
+			if err := server.Shutdown(ctx); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+
+	// Stop receiving new messages --------------------------------
+	r.resourceMutex.Lock()
+	for _, sub := range r.subscriptions {
+		if err := sub.Unsubscribe(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	r.subscriptions = nil
+	r.subscriptionsClosed = true
+	r.resourceMutex.Unlock()
+	for _, ft := range r.registeredFunctionTypes {
+		if ft.partitioner != nil {
+			errs = append(errs, ft.partitioner.unsubscribeAll()...)
+		}
+	}
+	// ------------------------------------------------------------
+
+	// Let in-flight id handlers finish ---------------------------
+	for _, ft := range r.registeredFunctionTypes {
+		ft.stop()
+	}
+	for _, ft := range r.registeredFunctionTypes {
+		if err := ft.waitForStop(ctx); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	// ------------------------------------------------------------
+
+	if r.cacheStore != nil {
+		if err := r.cacheStore.Flush(ctx); err != nil {
+			errs = append(errs, err)
+		}
+		r.cacheStore.Destroy()
+	}
+
+	for _, ft := range r.registeredFunctionTypes {
+		if ft.partitioner != nil {
+			errs = append(errs, ft.partitioner.releaseAll()...)
+		}
+	}
+
+	// Release single instance function type locks ----------------
+	r.resourceMutex.Lock()
+	for ftName, revId := range r.singleInstanceFunctionRevisions {
+		if err := KeyMutexUnlock(r, system.GetHashStr(ftName), revId); err != nil {
+			errs = append(errs, fmt.Errorf("cannot release single instance lock for function type %s: %w", ftName, err))
+		}
+	}
+	r.singleInstanceFunctionRevisions = map[string]uint64{}
+	r.resourceMutex.Unlock()
+	// ------------------------------------------------------------
+
+	if err := r.kv.Erase(getAdminRuntimeKey(r.id)); err != nil && !errors.Is(err, backend.ErrKeyNotFound) {
+		errs = append(errs, fmt.Errorf("cannot unregister runtime %s: %w", r.id, err))
+	}
+
+	if err := r.backend.Flush(); err != nil {
+		errs = append(errs, err)
+	}
+	if r.backendOwned {
+		if err := r.backend.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if r.embeddedNatsServer != nil {
+		r.embeddedNatsServer.Shutdown()
+	}
+
+	lg.Logln(lg.InfoLevel, "Runtime is shut down")
+	return errors.Join(errs...)
+}
+
+// ID returns the id of the runtime instance, set via RuntimeConfig.SetRuntimeID or unique otherwise
+func (r *Runtime) ID() string {
+	return r.id
+}
+
+// Registers the subscription to be unsubscribed on shutdown, unsubscribes it at once if the shutdown has already done that
+func (r *Runtime) addSubscription(sub backend.Subscription) error {
+	r.resourceMutex.Lock()
+	defer r.resourceMutex.Unlock()
+	if r.subscriptionsClosed {
+		system.MsgOnErrorReturn(sub.Unsubscribe())
+		return errRuntimeShuttingDown
+	}
+	r.subscriptions = append(r.subscriptions, sub)
+	return nil
+}
+
+func (r *Runtime) shuttingDown() bool {
+	r.resourceMutex.Lock()
+	defer r.resourceMutex.Unlock()
+	return r.subscriptionsClosed || r.ctx.Err() != nil
+}
+
+func (r *Runtime) removeSubscription(sub backend.Subscription) {
+	r.resourceMutex.Lock()
+	defer r.resourceMutex.Unlock()
+	for i, s := range r.subscriptions {
+		if s == sub {
+			r.subscriptions = append(r.subscriptions[:i], r.subscriptions[i+1:]...)
+			return
+		}
+	}
+}
+
+// Watches the KV keys again after the previous watcher was closed, e.g. with the connection, retries until the runtime is shut down.
+// Initial values are received again.
+func (r *Runtime) rewatchKV(keys string, watcherName string) (backend.KeyWatcher, bool) {
+	lg.Logf(lg.WarnLevel, "%s stopped watching %s, watching again\n", watcherName, keys)
+	for {
+		w, err := r.kv.Watch(keys)
+		if err == nil {
+			return w, true
+		}
+		lg.Logf(lg.ErrorLevel, "%s cannot watch %s: %s\n", watcherName, keys, err)
+		select {
+		case <-r.ctx.Done():
+			return nil, false
+		case <-time.After(KVRewatchIntervalMs * time.Millisecond):
+		}
+	}
+}
+
+func (r *Runtime) runGarbageCellector() {
 	for {
 		// Start function subscriptions ---------------------------------
 		var totalIdsGrbageCollected int
@@ -198,7 +458,11 @@ func (r *Runtime) runGarbageCellector() (err error) {
 		}
 		// --------------------------------------------------------------
 
-		time.Sleep(1 * time.Second)
+		select {
+		case <-r.ctx.Done():
+			return
+		case <-time.After(1 * time.Second):
+		}
 	}
 }
 
@@ -0,0 +1,490 @@
+// Copyright 2023 NJWS Inc.
+
+package statefun
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/foliagecp/easyjson"
+
+	natsServer "github.com/foliagecp/sdk/embedded/nats/server"
+	"github.com/foliagecp/sdk/statefun/backend"
+	"github.com/foliagecp/sdk/statefun/cache"
+	lg "github.com/foliagecp/sdk/statefun/logger"
+	sfPlugins "github.com/foliagecp/sdk/statefun/plugins"
+)
+
+const testWaitTimeout = 10 * time.Second
+
+func TestMain(m *testing.M) {
+	lg.SetOutputLevel(lg.ErrorLevel)
+	os.Exit(m.Run())
+}
+
+type testRuntime struct {
+	*Runtime
+	done chan error // Receives the result of Start
+}
+
+func newTestRuntimeConfig(b backend.Backend) *RuntimeConfig {
+	return NewRuntimeConfig().SetBackend(b).SetShutdownTimeoutSec(5).SetRequestTimeoutSec(5)
+}
+
+// Creates a runtime on top of the backend, function types are to be registered before startTestRuntime is called
+func newTestRuntime(t *testing.T, config *RuntimeConfig) *testRuntime {
+	t.Helper()
+	r, err := NewRuntime(*config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testRuntime{Runtime: r, done: make(chan error, 1)}
+}
+
+// Starts the runtime and waits until it is ready, the runtime is shut down on the test cleanup
+func startTestRuntime(t *testing.T, r *testRuntime) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	ready := make(chan struct{})
+	go func() {
+		r.done <- r.Start(ctx, cache.NewCacheConfig(r.ID()), func(*Runtime) error {
+			close(ready)
+			return nil
+		})
+	}()
+	t.Cleanup(func() {
+		cancel()
+		r.waitForShutdown(t)
+	})
+	select {
+	case <-ready:
+	case err := <-r.done:
+		r.done <- err
+		t.Fatalf("runtime did not start: %v", err)
+	case <-time.After(testWaitTimeout):
+		t.Fatal("runtime did not start in time")
+	}
+}
+
+// Waits for Start to return and fails the test if the runtime was not shut down cleanly
+func (r *testRuntime) waitForShutdown(t *testing.T) {
+	t.Helper()
+	select {
+	case err := <-r.done:
+		r.done <- err // For the cleanup
+		if err != nil {
+			t.Errorf("runtime shutdown failed: %v", err)
+		}
+	case <-time.After(testWaitTimeout):
+		t.Error("runtime did not shut down in time")
+	}
+}
+
+// Records payloads the function type is called with
+type testCalls struct {
+	calls chan *easyjson.JSON
+}
+
+func newTestCalls() *testCalls {
+	return &testCalls{calls: make(chan *easyjson.JSON, 1024)}
+}
+
+func (c *testCalls) record(contextProcessor *sfPlugins.StatefunContextProcessor) {
+	c.calls <- contextProcessor.Payload.Clone().GetPtr()
+}
+
+func (c *testCalls) wait(t *testing.T) *easyjson.JSON {
+	t.Helper()
+	select {
+	case payload := <-c.calls:
+		return payload
+	case <-time.After(testWaitTimeout):
+		t.Fatal("function was not called in time")
+	}
+	return nil
+}
+
+func (c *testCalls) expectNone(t *testing.T, within time.Duration) {
+	t.Helper()
+	select {
+	case payload := <-c.calls:
+		t.Fatalf("function was unexpectedly called with %s", payload.ToString())
+	case <-time.After(within):
+	}
+}
+
+func testPayload(key string, value interface{}) *easyjson.JSON {
+	j := easyjson.NewJSONObject()
+	j.SetByPath(key, easyjson.NewJSON(value))
+	return &j
+}
+
+// Polls the condition until it is true or the wait timeout passes
+func waitFor(t *testing.T, description string, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(testWaitTimeout)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("%s did not happen in time", description)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRuntimeSignalAndRequest(t *testing.T) {
+	r := newTestRuntime(t, newTestRuntimeConfig(backend.NewInMemory()))
+	calls := newTestCalls()
+	NewFunctionType(r.Runtime, "test.echo", func(_ sfPlugins.StatefunExecutor, contextProcessor *sfPlugins.StatefunContextProcessor) {
+		calls.record(contextProcessor)
+		if contextProcessor.Reply != nil {
+			reply := easyjson.NewJSONObject()
+			reply.SetByPath("id", easyjson.NewJSON(contextProcessor.Self.ID))
+			reply.SetByPath("payload", *contextProcessor.Payload)
+			contextProcessor.Reply.With(&reply)
+		}
+	}, *NewFunctionTypeConfig().SetServiceState(true))
+	startTestRuntime(t, r)
+
+	for _, provider := range []sfPlugins.SignalProvider{sfPlugins.JetstreamGlobalSignal, sfPlugins.GolangLocalSignal, sfPlugins.NatsCoreGlobalSignal} {
+		if err := r.Signal(provider, "test.echo", "a", testPayload("provider", int(provider)), nil); err != nil {
+			t.Fatalf("signal via provider %d failed: %v", provider, err)
+		}
+		if payload := calls.wait(t); int(payload.GetByPath("provider").AsNumericDefault(-1)) != int(provider) {
+			t.Fatalf("function was called with %s, want provider %d", payload.ToString(), provider)
+		}
+	}
+
+	for _, provider := range []sfPlugins.RequestProvider{sfPlugins.GolangLocalRequest, sfPlugins.NatsCoreGlobalRequest} {
+		reply, err := r.Request(provider, "test.echo", "b", testPayload("value", "hello"), nil)
+		if err != nil {
+			t.Fatalf("request via provider %d failed: %v", provider, err)
+		}
+		if reply.GetByPath("id").AsStringDefault("") != "b" || reply.GetByPath("payload.value").AsStringDefault("") != "hello" {
+			t.Fatalf("request via provider %d replied with %s", provider, reply.ToString())
+		}
+		calls.wait(t)
+	}
+
+	if _, err := r.Request(sfPlugins.GolangLocalRequest, "test.unknown", "b", nil, nil); err == nil {
+		t.Fatal("request of an unregistered function type succeeded")
+	}
+}
+
+func TestRuntimeFunctionContext(t *testing.T) {
+	r := newTestRuntime(t, newTestRuntimeConfig(backend.NewInMemory()))
+	NewFunctionType(r.Runtime, "test.counter", func(_ sfPlugins.StatefunExecutor, contextProcessor *sfPlugins.StatefunContextProcessor) {
+		functionContext := contextProcessor.GetFunctionContext()
+		counter := functionContext.GetByPath("counter").AsNumericDefault(0) + 1
+		functionContext.SetByPath("counter", easyjson.NewJSON(counter))
+		contextProcessor.SetFunctionContext(functionContext)
+		contextProcessor.Reply.With(functionContext)
+	}, *NewFunctionTypeConfig())
+	startTestRuntime(t, r)
+
+	for i := 1; i <= 3; i++ {
+		reply, err := r.Request(sfPlugins.GolangLocalRequest, "test.counter", "a", nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if counter := int(reply.GetByPath("counter").AsNumericDefault(0)); counter != i {
+			t.Fatalf("counter is %d after %d calls", counter, i)
+		}
+	}
+	reply, err := r.Request(sfPlugins.GolangLocalRequest, "test.counter", "b", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if counter := int(reply.GetByPath("counter").AsNumericDefault(0)); counter != 1 {
+		t.Fatalf("counter of another id is %d, want 1", counter)
+	}
+}
+
+func TestRuntimeFunctionContextUpdatedByTwoRuntimes(t *testing.T) {
+	b := backend.NewInMemory()
+	calls := newTestCalls()
+	runtimes := make([]*testRuntime, 2)
+	for i := range runtimes {
+		runtimes[i] = newTestRuntime(t, newTestRuntimeConfig(b))
+		NewFunctionType(runtimes[i].Runtime, "test.counter", func(_ sfPlugins.StatefunExecutor, contextProcessor *sfPlugins.StatefunContextProcessor) {
+			err := contextProcessor.UpdateFunctionContext(func(functionContext *easyjson.JSON) error {
+				functionContext.SetByPath("counter", easyjson.NewJSON(functionContext.GetByPath("counter").AsNumericDefault(0)+1))
+				return nil
+			})
+			if err != nil {
+				t.Error(err)
+			}
+			calls.record(contextProcessor)
+		}, *NewFunctionTypeConfig().SetMultipleInstancesAllowance(true).SetContextUpdateAttempts(1000))
+		startTestRuntime(t, runtimes[i])
+	}
+
+	const signals = 20
+	for i := 0; i < signals; i++ {
+		for _, r := range runtimes {
+			if err := r.Signal(sfPlugins.GolangLocalSignal, "test.counter", "a", nil, nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	for i := 0; i < signals*len(runtimes); i++ {
+		calls.wait(t)
+	}
+	for _, r := range runtimes {
+		ft := r.registeredFunctionTypes["test.counter"]
+		waitFor(t, "counter updates from both runtimes", func() bool {
+			return int(ft.getFunctionContext("a").GetByPath("counter").AsNumericDefault(0)) == signals*len(runtimes)
+		})
+	}
+}
+
+func TestRuntimeShutdown(t *testing.T) {
+	r := newTestRuntime(t, newTestRuntimeConfig(backend.NewInMemory()))
+	handled := make(chan string, 16)
+	release := make(chan struct{})
+	NewFunctionType(r.Runtime, "test.slow", func(_ sfPlugins.StatefunExecutor, contextProcessor *sfPlugins.StatefunContextProcessor) {
+		<-release
+		handled <- contextProcessor.Self.ID
+	}, *NewFunctionTypeConfig())
+	startTestRuntime(t, r)
+
+	for _, id := range []string{"a", "b"} {
+		if err := r.Signal(sfPlugins.GolangLocalSignal, "test.slow", id, nil, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	shutdownDone := make(chan error, 1)
+	go func() {
+		shutdownDone <- r.Shutdown(context.Background())
+	}()
+	ft := r.registeredFunctionTypes["test.slow"]
+	waitFor(t, "function type stop", func() bool {
+		ft.stopMutex.RLock()
+		defer ft.stopMutex.RUnlock()
+		return ft.stopped
+	})
+	if err := r.Signal(sfPlugins.GolangLocalSignal, "test.slow", "c", nil, nil); err == nil {
+		t.Fatal("signal was accepted while shutting down")
+	}
+	select {
+	case err := <-shutdownDone:
+		t.Fatalf("shutdown finished before in-flight signals were handled: %v", err)
+	default:
+	}
+
+	close(release)
+	if err := <-shutdownDone; err != nil {
+		t.Fatalf("shutdown failed: %v", err)
+	}
+	if len(handled) != 2 {
+		t.Fatalf("%d in-flight signals were handled before shutdown finished, want 2", len(handled))
+	}
+	r.waitForShutdown(t)
+	if err := r.Shutdown(context.Background()); err != nil {
+		t.Fatalf("repeated shutdown failed: %v", err)
+	}
+}
+
+func TestRuntimeShutdownTimeout(t *testing.T) {
+	r := newTestRuntime(t, newTestRuntimeConfig(backend.NewInMemory()))
+	release := make(chan struct{})
+	defer close(release)
+	NewFunctionType(r.Runtime, "test.stuck", func(_ sfPlugins.StatefunExecutor, _ *sfPlugins.StatefunContextProcessor) {
+		<-release
+	}, *NewFunctionTypeConfig())
+	startTestRuntime(t, r)
+
+	if err := r.Signal(sfPlugins.GolangLocalSignal, "test.stuck", "a", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := r.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("shutdown of a stuck handler returned %v, want deadline exceeded", err)
+	}
+	<-r.done // Start returns the same error
+	r.done <- nil
+}
+
+func TestRuntimeSingleInstanceFunctionType(t *testing.T) {
+	b := backend.NewInMemory()
+	calls := [2]*testCalls{newTestCalls(), newTestCalls()}
+	runtimes := [2]*testRuntime{}
+	for i := range runtimes {
+		i := i
+		runtimes[i] = newTestRuntime(t, newTestRuntimeConfig(b))
+		NewFunctionType(runtimes[i].Runtime, "test.single", func(_ sfPlugins.StatefunExecutor, contextProcessor *sfPlugins.StatefunContextProcessor) {
+			calls[i].record(contextProcessor)
+		}, *NewFunctionTypeConfig())
+		startTestRuntime(t, runtimes[i])
+	}
+
+	if !runtimes[0].runsFunctionType(runtimes[0].registeredFunctionTypes["test.single"]) {
+		t.Fatal("first runtime does not run the single instance function type")
+	}
+	if runtimes[1].runsFunctionType(runtimes[1].registeredFunctionTypes["test.single"]) {
+		t.Fatal("second runtime runs the single instance function type too")
+	}
+	for i := 0; i < 5; i++ {
+		if err := runtimes[1].Signal(sfPlugins.JetstreamGlobalSignal, "test.single", fmt.Sprint(i), nil, nil); err != nil {
+			t.Fatal(err)
+		}
+		calls[0].wait(t)
+	}
+	calls[1].expectNone(t, 100*time.Millisecond)
+}
+
+func TestRuntimeStartReleasesResourcesOnFailure(t *testing.T) {
+	b := &failingKVBackend{InMemory: backend.NewInMemory()}
+	r := newTestRuntime(t, newTestRuntimeConfig(b))
+	NewFunctionType(r.Runtime, "test.multiple", func(_ sfPlugins.StatefunExecutor, _ *sfPlugins.StatefunContextProcessor) {}, *NewFunctionTypeConfig().SetMultipleInstancesAllowance(true))
+	NewFunctionType(r.Runtime, "test.single", func(_ sfPlugins.StatefunExecutor, _ *sfPlugins.StatefunContextProcessor) {}, *NewFunctionTypeConfig())
+	b.failMutexes(true)
+
+	err := r.Start(context.Background(), cache.NewCacheConfig(r.ID()), nil)
+	if !errors.Is(err, errTestKVFailure) {
+		t.Fatalf("Start without the single instance lock returned %v, want the kv failure", err)
+	}
+	if r.ctx.Err() == nil {
+		t.Fatal("runtime was not shut down after Start failed")
+	}
+	if len(r.subscriptions) != 0 {
+		t.Fatalf("%d subscriptions are left after Start failed", len(r.subscriptions))
+	}
+	if err := b.Check(); !errors.Is(err, backend.ErrBackendClosed) && err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRuntimeWithEmbeddedNatsServer(t *testing.T) {
+	t.Setenv("TMPDIR", t.TempDir())
+	r := newTestRuntime(t, NewRuntimeConfig().SetEmbeddedNatsServer(natsServer.NewConfig()).SetShutdownTimeoutSec(5).SetRequestTimeoutSec(5))
+	calls := newTestCalls()
+	NewFunctionType(r.Runtime, "test.embedded", func(_ sfPlugins.StatefunExecutor, contextProcessor *sfPlugins.StatefunContextProcessor) {
+		calls.record(contextProcessor)
+		if contextProcessor.Reply != nil {
+			contextProcessor.Reply.With(contextProcessor.Payload)
+		}
+	}, *NewFunctionTypeConfig().SetServiceState(true))
+	startTestRuntime(t, r)
+
+	if err := r.Signal(sfPlugins.JetstreamGlobalSignal, "test.embedded", "a", testPayload("n", 1), nil); err != nil {
+		t.Fatal(err)
+	}
+	calls.wait(t)
+	reply, err := r.Request(sfPlugins.NatsCoreGlobalRequest, "test.embedded", "a", testPayload("n", 2), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply.GetByPath("n").AsNumericDefault(0) != 2 {
+		t.Fatalf("request replied with %s", reply.ToString())
+	}
+	calls.wait(t)
+
+	if err := r.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if dirs, _ := filepath.Glob(filepath.Join(os.TempDir(), "foliage_nats_store_*")); len(dirs) != 0 {
+		t.Fatalf("store dirs %v of the embedded server are left after shutdown", dirs)
+	}
+}
+
+// In-memory backend which key/value mutices can be made failing
+type failingKVBackend struct {
+	*backend.InMemory
+	mutex   sync.Mutex
+	failing bool
+}
+
+var errTestKVFailure = errors.New("test kv failure")
+
+func (b *failingKVBackend) failMutexes(failing bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.failing = failing
+}
+
+func (b *failingKVBackend) KeyValue(bucket string) (backend.KeyValue, error) {
+	kv, err := b.InMemory.KeyValue(bucket)
+	if err != nil {
+		return nil, err
+	}
+	return &failingKV{KeyValue: kv, backend: b}, nil
+}
+
+type failingKV struct {
+	backend.KeyValue
+	backend *failingKVBackend
+}
+
+func (kv *failingKV) Get(key string) (backend.KeyValueEntry, error) {
+	kv.backend.mutex.Lock()
+	failing := kv.backend.failing
+	kv.backend.mutex.Unlock()
+	if failing && strings.HasSuffix(key, ".mutex") {
+		return nil, errTestKVFailure
+	}
+	return kv.KeyValue.Get(key)
+}
+
+// In-memory backend which KV watchers can be closed as if the connection was lost
+type closingWatchBackend struct {
+	*backend.InMemory
+	mutex    sync.Mutex
+	watchers map[string][]backend.KeyWatcher // Watched keys -> watchers
+}
+
+func newClosingWatchBackend() *closingWatchBackend {
+	return &closingWatchBackend{InMemory: backend.NewInMemory(), watchers: map[string][]backend.KeyWatcher{}}
+}
+
+func (b *closingWatchBackend) KeyValue(bucket string) (backend.KeyValue, error) {
+	kv, err := b.InMemory.KeyValue(bucket)
+	if err != nil {
+		return nil, err
+	}
+	return &closingWatchKV{KeyValue: kv, backend: b}, nil
+}
+
+// Closes all watchers of the keys starting with the prefix, returns how many were closed
+func (b *closingWatchBackend) closeWatchers(t *testing.T, prefix string) int {
+	t.Helper()
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	closed := 0
+	for keys, watchers := range b.watchers {
+		if !strings.HasPrefix(keys, prefix) {
+			continue
+		}
+		for _, w := range watchers {
+			if err := w.Stop(); err != nil {
+				t.Fatal(err)
+			}
+			closed++
+		}
+		delete(b.watchers, keys)
+	}
+	return closed
+}
+
+type closingWatchKV struct {
+	backend.KeyValue
+	backend *closingWatchBackend
+}
+
+func (kv *closingWatchKV) Watch(keys string) (backend.KeyWatcher, error) {
+	w, err := kv.KeyValue.Watch(keys)
+	if err == nil {
+		kv.backend.mutex.Lock()
+		kv.backend.watchers[keys] = append(kv.backend.watchers[keys], w)
+		kv.backend.mutex.Unlock()
+	}
+	return w, err
+}
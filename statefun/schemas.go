@@ -0,0 +1,144 @@
+// Copyright 2023 NJWS Inc.
+
+package statefun
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/foliagecp/easyjson"
+	"github.com/santhosh-tekuri/jsonschema/v5"
+
+	lg "github.com/foliagecp/sdk/statefun/logger"
+	sfPlugins "github.com/foliagecp/sdk/statefun/plugins"
+)
+
+// Resource the schema is compiled from, schemas may refer only to themselves
+const msgSchemaURL = "msg_schema.json"
+
+// SchemaViolation is a value of the message which does not match the schema
+type SchemaViolation struct {
+	Path    string // Dot separated, prefixed with the part of the message being validated, e.g. "payload.origin_type"
+	Message string
+}
+
+type SchemaValidationError struct {
+	Violations []SchemaViolation
+}
+
+func (e *SchemaValidationError) Error() string {
+	messages := make([]string, 0, len(e.Violations))
+	for _, v := range e.Violations {
+		messages = append(messages, v.Path+": "+v.Message)
+	}
+	return "json schema validation failed: " + strings.Join(messages, "; ")
+}
+
+type msgSchema struct {
+	schema *jsonschema.Schema
+	err    error // Schema compilation error, every message is rejected if the schema is invalid
+}
+
+func newMsgSchema(name string, schema *easyjson.JSON) *msgSchema {
+	if schema == nil {
+		return nil
+	}
+	compiled, err := compileMsgSchema(schema.ToBytes())
+	if err != nil {
+		err = fmt.Errorf("%s schema is invalid: %w", name, err)
+		lg.Logf(lg.ErrorLevel, "%s, all messages will be rejected\n", err)
+	}
+	return &msgSchema{schema: compiled, err: err}
+}
+
+func compileMsgSchema(schema []byte) (*jsonschema.Schema, error) {
+	compiler := jsonschema.NewCompiler()
+	compiler.LoadURL = func(url string) (io.ReadCloser, error) {
+		return nil, fmt.Errorf("$ref to %s is not allowed, schema may refer only to itself", url)
+	}
+	if err := compiler.AddResource(msgSchemaURL, bytes.NewReader(schema)); err != nil {
+		return nil, err
+	}
+	return compiler.Compile(msgSchemaURL)
+}
+
+func (ms *msgSchema) validate(part string, j *easyjson.JSON) error {
+	if ms == nil {
+		return nil
+	}
+	if ms.err != nil {
+		return ms.err
+	}
+	document := easyjson.NewJSONObject().GetPtr()
+	if j != nil {
+		document = j
+	}
+	decoder := json.NewDecoder(bytes.NewReader(document.ToBytes()))
+	decoder.UseNumber() // Keeps the precision of numbers
+	var v interface{}
+	if err := decoder.Decode(&v); err != nil {
+		return &SchemaValidationError{Violations: []SchemaViolation{{Path: part, Message: "is not a json"}}}
+	}
+	err := ms.schema.Validate(v)
+	var validationErr *jsonschema.ValidationError
+	if errors.As(err, &validationErr) {
+		return &SchemaValidationError{Violations: schemaViolations(part, validationErr, nil)}
+	}
+	return err
+}
+
+// Collects the leaves of the validation error tree, which are the actual violations
+func schemaViolations(part string, validationErr *jsonschema.ValidationError, violations []SchemaViolation) []SchemaViolation {
+	if len(validationErr.Causes) == 0 {
+		path := part
+		for _, token := range strings.Split(validationErr.InstanceLocation, "/")[1:] { // JSON pointer
+			path += "." + strings.NewReplacer("~1", "/", "~0", "~").Replace(token)
+		}
+		return append(violations, SchemaViolation{Path: path, Message: validationErr.Message})
+	}
+	for _, cause := range validationErr.Causes {
+		violations = schemaViolations(part, cause, violations)
+	}
+	return violations
+}
+
+func (ft *FunctionType) validateMsg(contextProcessor *sfPlugins.StatefunContextProcessor) error {
+	if err := ft.config.payloadSchema.validate("payload", contextProcessor.Payload); err != nil {
+		return err
+	}
+	return ft.config.optionsSchema.validate("options", contextProcessor.Options)
+}
+
+// ReplyErrorKey is the reserved key of a reply the runtime sends instead of the handler's one, holds the reply's status
+const ReplyErrorKey = "__reply_error"
+
+/*
+	{
+		"__reply_error": "invalid" | "failed" | "timeout",
+		"status": "invalid" | "failed" | "timeout",
+		"result": string, // error
+		"violations": [{"path": string, "message": string}, ...] // if the message was validated against a schema
+	}
+*/
+func errorReply(status string, err error) *easyjson.JSON {
+	reply := easyjson.NewJSONObject()
+	reply.SetByPath(ReplyErrorKey, easyjson.NewJSON(status))
+	reply.SetByPath("status", easyjson.NewJSON(status))
+	reply.SetByPath("result", easyjson.NewJSON(err.Error()))
+	var validationErr *SchemaValidationError
+	if errors.As(err, &validationErr) {
+		violations := easyjson.NewJSONArray()
+		for _, v := range validationErr.Violations {
+			violation := easyjson.NewJSONObject()
+			violation.SetByPath("path", easyjson.NewJSON(v.Path))
+			violation.SetByPath("message", easyjson.NewJSON(v.Message))
+			violations.AddToArray(violation)
+		}
+		reply.SetByPath("violations", violations)
+	}
+	return &reply
+}
@@ -0,0 +1,92 @@
+// Copyright 2023 NJWS Inc.
+
+package statefun
+
+import (
+	"testing"
+	"time"
+
+	"github.com/foliagecp/easyjson"
+
+	"github.com/foliagecp/sdk/statefun/backend"
+	sfPlugins "github.com/foliagecp/sdk/statefun/plugins"
+)
+
+func testSchema(t *testing.T, schema string) *easyjson.JSON {
+	j, ok := easyjson.JSONFromBytes([]byte(schema))
+	if !ok {
+		t.Fatalf("schema %s is not a json", schema)
+	}
+	return &j
+}
+
+func TestMsgSchemas(t *testing.T) {
+	r := newTestRuntime(t, newTestRuntimeConfig(backend.NewInMemory()))
+	calls := newTestCalls()
+	NewFunctionType(r.Runtime, "test.schemas", func(_ sfPlugins.StatefunExecutor, contextProcessor *sfPlugins.StatefunContextProcessor) {
+		calls.record(contextProcessor)
+		reply := easyjson.NewJSONObject()
+		reply.SetByPath("n", contextProcessor.Payload.GetByPath("n"))
+		contextProcessor.Reply.With(&reply)
+	}, *NewFunctionTypeConfig().
+		SetPayloadSchema(testSchema(t, `{"type": "object", "required": ["n"], "properties": {"n": {"$ref": "#/$defs/n"}}, "$defs": {"n": {"type": "integer"}}}`)).
+		SetOptionsSchema(testSchema(t, `{"properties": {"mode": {"type": "string", "pattern": "^(fast|slow)$"}}}`)).
+		SetReplySchema(testSchema(t, `{"properties": {"n": {"maximum": 10}}}`)))
+	startTestRuntime(t, r)
+
+	tests := []struct {
+		name           string
+		payload        *easyjson.JSON
+		options        *easyjson.JSON
+		wantReplyError string
+		wantPath       string
+	}{
+		{name: "valid", payload: testPayload("n", 1), options: testPayload("mode", "fast")},
+		{name: "invalid payload", payload: testPayload("n", "1"), wantReplyError: "invalid", wantPath: "payload.n"},
+		{name: "missing payload", wantReplyError: "invalid", wantPath: "payload"},
+		{name: "invalid options", payload: testPayload("n", 1), options: testPayload("mode", "other"), wantReplyError: "invalid", wantPath: "options.mode"},
+		{name: "invalid reply", payload: testPayload("n", 11), wantReplyError: "failed", wantPath: "reply.n"},
+	}
+	for _, test := range tests {
+		reply, err := r.Request(sfPlugins.GolangLocalRequest, "test.schemas", "a", test.payload, test.options)
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		if replyError := reply.GetByPath(ReplyErrorKey).AsStringDefault(""); replyError != test.wantReplyError {
+			t.Fatalf("%s: replied with %s", test.name, reply.ToString())
+		}
+		if len(test.wantPath) > 0 && reply.GetByPath("violations").GetByPath("0").GetByPath("path").AsStringDefault("") != test.wantPath {
+			t.Fatalf("%s: replied with violations %s, want path %s", test.name, reply.GetByPath("violations").ToString(), test.wantPath)
+		}
+		if test.wantReplyError == "invalid" {
+			calls.expectNone(t, 100*time.Millisecond)
+		} else {
+			calls.wait(t)
+		}
+	}
+}
+
+func TestInvalidMsgSchemaRejectsMessages(t *testing.T) {
+	for _, schema := range []string{
+		`{"pattern": "("}`,
+		`{"type": 1}`,
+		`{"$ref": "#/$defs/missing"}`,
+		`{"$ref": "http://example.com/schema.json"}`,
+	} {
+		r := newTestRuntime(t, newTestRuntimeConfig(backend.NewInMemory()))
+		calls := newTestCalls()
+		NewFunctionType(r.Runtime, "test.schemas", func(_ sfPlugins.StatefunExecutor, contextProcessor *sfPlugins.StatefunContextProcessor) {
+			calls.record(contextProcessor)
+		}, *NewFunctionTypeConfig().SetPayloadSchema(testSchema(t, schema)))
+		startTestRuntime(t, r)
+
+		reply, err := r.Request(sfPlugins.GolangLocalRequest, "test.schemas", "a", testPayload("n", 1), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reply.GetByPath(ReplyErrorKey).AsStringDefault("") != "invalid" {
+			t.Fatalf("message was not rejected by schema %s, replied with %s", schema, reply.ToString())
+		}
+		calls.expectNone(t, 100*time.Millisecond)
+	}
+}
@@ -0,0 +1,173 @@
+// Copyright 2023 NJWS Inc.
+
+package system
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var cronDescriptors = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+type cronField struct {
+	min, max int
+}
+
+var cronFields = []cronField{
+	{0, 59}, // Minute
+	{0, 23}, // Hour
+	{1, 31}, // Day of month
+	{1, 12}, // Month
+	{0, 7},  // Day of week, 0 and 7 are both Sunday
+}
+
+// CronSchedule is a parsed cron expression, all times are evaluated in UTC so every runtime computes the same ticks
+type CronSchedule struct {
+	every       time.Duration
+	minutes     uint64
+	hours       uint64
+	daysOfMonth uint64
+	months      uint64
+	daysOfWeek  uint64
+	domStar     bool
+	dowStar     bool
+}
+
+// ParseCronSchedule parses a standard 5-field cron expression "minute hour day-of-month month day-of-week"
+// supporting "*", lists, ranges and steps, or one of the descriptors: @yearly, @monthly, @weekly, @daily, @hourly, @every <duration>
+func ParseCronSchedule(expr string) (*CronSchedule, error) {
+	expr = strings.TrimSpace(expr)
+	if strings.HasPrefix(expr, "@every ") {
+		every, err := time.ParseDuration(strings.TrimSpace(strings.TrimPrefix(expr, "@every ")))
+		if err != nil {
+			return nil, fmt.Errorf("invalid cron expression %s: %w", expr, err)
+		}
+		if every < time.Second {
+			return nil, fmt.Errorf("invalid cron expression %s: interval must be at least 1s", expr)
+		}
+		return &CronSchedule{every: every}, nil
+	}
+	if descriptor, ok := cronDescriptors[expr]; ok {
+		expr = descriptor
+	}
+
+	tokens := strings.Fields(expr)
+	if len(tokens) != len(cronFields) {
+		return nil, fmt.Errorf("invalid cron expression %s: expected %d fields, got %d", expr, len(cronFields), len(tokens))
+	}
+	bits := make([]uint64, len(cronFields))
+	for i, token := range tokens {
+		b, err := parseCronField(token, cronFields[i])
+		if err != nil {
+			return nil, fmt.Errorf("invalid cron expression %s: %w", expr, err)
+		}
+		bits[i] = b
+	}
+	cs := &CronSchedule{
+		minutes:     bits[0],
+		hours:       bits[1],
+		daysOfMonth: bits[2],
+		months:      bits[3],
+		daysOfWeek:  bits[4],
+		domStar:     tokens[2] == "*" || tokens[2] == "?",
+		dowStar:     tokens[4] == "*" || tokens[4] == "?",
+	}
+	if cs.daysOfWeek&(1<<7) != 0 {
+		cs.daysOfWeek |= 1
+	}
+	return cs, nil
+}
+
+func parseCronField(token string, field cronField) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(token, ",") {
+		rangePart, step := part, 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			s, err := strconv.Atoi(part[i+1:])
+			if err != nil || s <= 0 {
+				return 0, fmt.Errorf("invalid step in %s", part)
+			}
+			rangePart, step = part[:i], s
+		}
+
+		var from, to int
+		switch {
+		case rangePart == "*" || rangePart == "?":
+			from, to = field.min, field.max
+		case strings.Contains(rangePart, "-"):
+			bounds := strings.SplitN(rangePart, "-", 2)
+			var err1, err2 error
+			from, err1 = strconv.Atoi(bounds[0])
+			to, err2 = strconv.Atoi(bounds[1])
+			if err1 != nil || err2 != nil {
+				return 0, fmt.Errorf("invalid range %s", rangePart)
+			}
+		default:
+			v, err := strconv.Atoi(rangePart)
+			if err != nil {
+				return 0, fmt.Errorf("invalid value %s", rangePart)
+			}
+			from, to = v, v
+			if step > 1 { // "a/n" means from a to the max
+				to = field.max
+			}
+		}
+		if from < field.min || to > field.max || from > to {
+			return 0, fmt.Errorf("%s is out of range %d-%d", part, field.min, field.max)
+		}
+		for v := from; v <= to; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+func (cs *CronSchedule) dayMatches(t time.Time) bool {
+	domMatch := cs.daysOfMonth&(1<<uint(t.Day())) != 0
+	dowMatch := cs.daysOfWeek&(1<<uint(t.Weekday())) != 0
+	if cs.domStar || cs.dowStar {
+		return domMatch && dowMatch
+	}
+	return domMatch || dowMatch
+}
+
+// Next returns the first tick strictly after t
+func (cs *CronSchedule) Next(t time.Time) time.Time {
+	t = t.UTC()
+	if cs.every > 0 {
+		return t.Truncate(cs.every).Add(cs.every)
+	}
+
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	yearLimit := t.Year() + 5
+	for t.Year() <= yearLimit {
+		if cs.months&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+			continue
+		}
+		if !cs.dayMatches(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, time.UTC)
+			continue
+		}
+		if cs.hours&(1<<uint(t.Hour())) == 0 {
+			t = t.Truncate(time.Hour).Add(time.Hour)
+			continue
+		}
+		if cs.minutes&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{} // Never, e.g. "0 0 30 2 *"
+}
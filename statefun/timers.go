@@ -0,0 +1,171 @@
+// Copyright 2023 NJWS Inc.
+
+package statefun
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/foliagecp/easyjson"
+
+	"github.com/foliagecp/sdk/statefun/backend"
+	lg "github.com/foliagecp/sdk/statefun/logger"
+	"github.com/foliagecp/sdk/statefun/system"
+)
+
+const (
+	TimersKVPrefix        = "statefun_timers"
+	TimersCheckIntervalMs = 100
+)
+
+/*
+Timers are stored in the KV bucket, one key per timer, so they survive runtime restarts.
+Every runtime watches all timers and when a timer is due tries to claim it by updating its KV record with the last known revision.
+Only the runtime which succeeded in claiming fires the timer and erases it afterwards. A claim of a runtime that died
+before erasing the timer expires after kvMutexLifeTimeSec and the timer can be claimed again.
+*/
+
+func getTimerKey(timerID string) string {
+	return TimersKVPrefix + "." + system.GetHashStr(timerID)
+}
+
+// SignalAt durably schedules a jetstream signal to the function typename with id at the given time.
+// Scheduling a timer with the id of an existing one replaces the existing timer.
+func (r *Runtime) SignalAt(timerID string, at time.Time, typename string, id string, payload *easyjson.JSON, options *easyjson.JSON) error {
+	return r.signalAt(timerID, at, "ingress", "timer", typename, id, payload, options)
+}
+
+func (r *Runtime) SignalAfter(timerID string, delay time.Duration, typename string, id string, payload *easyjson.JSON, options *easyjson.JSON) error {
+	return r.SignalAt(timerID, time.Now().Add(delay), typename, id, payload, options)
+}
+
+func (r *Runtime) CancelTimer(timerID string) error {
+	if err := r.kv.Erase(getTimerKey(timerID)); err != nil {
+		if errors.Is(err, backend.ErrKeyNotFound) {
+			return fmt.Errorf("timer %s does not exist or has already fired", timerID)
+		}
+		return err
+	}
+	return nil
+}
+
+func (r *Runtime) signalAt(timerID string, at time.Time, callerTypename string, callerID string, targetTypename string, targetID string, payload *easyjson.JSON, options *easyjson.JSON) error {
+	if len(timerID) == 0 {
+		return fmt.Errorf("timer id must not be empty")
+	}
+	timer := easyjson.NewJSONObject()
+	timer.SetByPath("timer_id", easyjson.NewJSON(timerID))
+	timer.SetByPath("fire_at", easyjson.NewJSON(at.UnixNano()))
+	timer.SetByPath("claimed_at", easyjson.NewJSON(0))
+	timer.SetByPath("typename", easyjson.NewJSON(targetTypename))
+	timer.SetByPath("id", easyjson.NewJSON(targetID))
+	timer.SetByPath("data", easyjson.NewJSON(string(buildNatsData(callerTypename, callerID, payload, options, time.Time{}))))
+	_, err := r.kv.Put(getTimerKey(timerID), timer.ToBytes())
+	return err
+}
+
+func (r *Runtime) runTimersScheduler() {
+	system.GlobalPrometrics.GetRoutinesCounter().Started("runtime.timersScheduler")
+	defer system.GlobalPrometrics.GetRoutinesCounter().Stopped("runtime.timersScheduler")
+
+	keys := TimersKVPrefix + ".*"
+	w, err := r.kv.Watch(keys)
+	if err != nil {
+		lg.Logf(lg.ErrorLevel, "Timers scheduler cannot watch timers: %s\n", err)
+		return
+	}
+	defer func() {
+		if w != nil { // Nil if the runtime was shut down while watching again
+			system.MsgOnErrorReturn(w.Stop())
+		}
+	}()
+
+	fireTimes := map[string]int64{} // Timer KV key -> time the timer must fire at
+	ticker := time.NewTicker(TimersCheckIntervalMs * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.ctx.Done():
+			return
+		case entry, ok := <-w.Updates():
+			if !ok {
+				system.MsgOnErrorReturn(w.Stop())
+				if w, ok = r.rewatchKV(keys, "Timers scheduler"); !ok {
+					return
+				}
+				continue
+			}
+			if entry == nil {
+				continue
+			}
+			if timer, ok := easyjson.JSONFromBytes(entry.Value()); ok {
+				fireTimes[entry.Key()] = int64(timer.GetByPath("fire_at").AsNumericDefault(0))
+			}
+		case <-ticker.C:
+			now := system.GetCurrentTimeNs()
+			for key, fireAt := range fireTimes {
+				if fireAt <= now {
+					if r.fireTimer(key) {
+						delete(fireTimes, key)
+					}
+				}
+			}
+		}
+	}
+}
+
+// Returns true if the timer does not need to be tracked anymore by this runtime
+func (r *Runtime) fireTimer(key string) bool {
+	entry, err := r.kv.Get(key)
+	if err != nil {
+		return errors.Is(err, backend.ErrKeyNotFound) // Timer was cancelled or fired by someone else
+	}
+	timer, ok := easyjson.JSONFromBytes(entry.Value())
+	if !ok {
+		lg.Logf(lg.ErrorLevel, "Timer %s is corrupted, erasing\n", key)
+		system.MsgOnErrorReturn(r.kv.Erase(key))
+		return true
+	}
+	now := system.GetCurrentTimeNs()
+	if int64(timer.GetByPath("fire_at").AsNumericDefault(0)) > now { // Timer was rescheduled
+		return false
+	}
+	claimedAt := int64(timer.GetByPath("claimed_at").AsNumericDefault(0))
+	if claimedAt != 0 && claimedAt+int64(r.config.kvMutexLifeTimeSec)*int64(time.Second) > now { // Someone else is firing the timer
+		return false
+	}
+
+	// Claiming the timer ---------------------------------------------
+	timer.SetByPath("claimed_at", easyjson.NewJSON(now))
+	revision, err := r.kv.Update(key, timer.ToBytes(), entry.Revision())
+	if err != nil {
+		if !errors.Is(err, backend.ErrWrongLastRevision) {
+			lg.Logf(lg.ErrorLevel, "Cannot claim timer %s: %s\n", key, err)
+		}
+		return false
+	}
+	// ----------------------------------------------------------------
+
+	timerID := timer.GetByPath("timer_id").AsStringDefault("")
+	typename := timer.GetByPath("typename").AsStringDefault("")
+	id := timer.GetByPath("id").AsStringDefault("")
+	data := timer.GetByPath("data").AsStringDefault("")
+	msgID := fmt.Sprintf("timer.%s.%d", timerID, int64(timer.GetByPath("fire_at").AsNumericDefault(0))) // Prevents double firing when a claim expires while publishing
+	if err := r.backend.StreamPublishMsgID(fmt.Sprintf("%s.%s", typename, id), []byte(data), msgID); err != nil {
+		lg.Logf(lg.ErrorLevel, "Timer %s cannot signal function %s with id=%s: %s\n", timerID, typename, id, err)
+		timer.SetByPath("claimed_at", easyjson.NewJSON(0)) // Releasing the claim to retry later
+		system.MsgOnErrorReturn(r.kv.Update(key, timer.ToBytes(), revision))
+		return false
+	}
+	lg.Logf(lg.TraceLevel, "Timer %s fired for function %s with id=%s\n", timerID, typename, id)
+	if err := r.kv.EraseIfRevision(key, revision); err != nil {
+		if errors.Is(err, backend.ErrWrongLastRevision) { // Timer was rescheduled while firing
+			return false
+		}
+		if !errors.Is(err, backend.ErrKeyNotFound) {
+			lg.Logf(lg.ErrorLevel, "Cannot erase fired timer %s: %s\n", timerID, err)
+		}
+	}
+	return true
+}
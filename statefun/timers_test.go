@@ -0,0 +1,118 @@
+// Copyright 2023 NJWS Inc.
+
+package statefun
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/foliagecp/sdk/statefun/backend"
+	sfPlugins "github.com/foliagecp/sdk/statefun/plugins"
+)
+
+func TestTimerFiresOnce(t *testing.T) {
+	r := newTestRuntime(t, newTestRuntimeConfig(backend.NewInMemory()))
+	calls := newTestCalls()
+	NewFunctionType(r.Runtime, "test.timer", func(_ sfPlugins.StatefunExecutor, contextProcessor *sfPlugins.StatefunContextProcessor) {
+		calls.record(contextProcessor)
+	}, *NewFunctionTypeConfig())
+	startTestRuntime(t, r)
+
+	start := time.Now()
+	if err := r.SignalAfter("timer1", 200*time.Millisecond, "test.timer", "a", testPayload("n", 1), nil); err != nil {
+		t.Fatal(err)
+	}
+	if payload := calls.wait(t); payload.GetByPath("n").AsNumericDefault(0) != 1 {
+		t.Fatalf("timer signaled with %s", payload.ToString())
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Fatalf("timer fired after %s, before it was due", elapsed)
+	}
+	calls.expectNone(t, 300*time.Millisecond)
+	if err := r.CancelTimer("timer1"); err == nil {
+		t.Fatal("fired timer was cancelled")
+	}
+}
+
+func TestTimerCancelAndReschedule(t *testing.T) {
+	r := newTestRuntime(t, newTestRuntimeConfig(backend.NewInMemory()))
+	calls := newTestCalls()
+	NewFunctionType(r.Runtime, "test.timer", func(_ sfPlugins.StatefunExecutor, contextProcessor *sfPlugins.StatefunContextProcessor) {
+		calls.record(contextProcessor)
+	}, *NewFunctionTypeConfig())
+	startTestRuntime(t, r)
+
+	if err := r.SignalAfter("cancelled", 200*time.Millisecond, "test.timer", "a", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.CancelTimer("cancelled"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := r.SignalAfter("rescheduled", 200*time.Millisecond, "test.timer", "a", testPayload("n", 1), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.SignalAfter("rescheduled", 400*time.Millisecond, "test.timer", "a", testPayload("n", 2), nil); err != nil {
+		t.Fatal(err)
+	}
+	if payload := calls.wait(t); payload.GetByPath("n").AsNumericDefault(0) != 2 {
+		t.Fatalf("rescheduled timer signaled with %s", payload.ToString())
+	}
+	calls.expectNone(t, 300*time.Millisecond)
+}
+
+// In-memory backend which reschedules a timer right after it was fired and before it is erased
+type reschedulingBackend struct {
+	*backend.InMemory
+	once       sync.Once
+	reschedule func()
+}
+
+func (b *reschedulingBackend) StreamPublishMsgID(subject string, data []byte, msgID string) error {
+	if err := b.InMemory.StreamPublishMsgID(subject, data, msgID); err != nil {
+		return err
+	}
+	b.once.Do(b.reschedule)
+	return nil
+}
+
+func TestTimerRescheduledWhileFiring(t *testing.T) {
+	b := &reschedulingBackend{InMemory: backend.NewInMemory()}
+	r := newTestRuntime(t, newTestRuntimeConfig(b))
+	calls := newTestCalls()
+	NewFunctionType(r.Runtime, "test.timer", func(_ sfPlugins.StatefunExecutor, contextProcessor *sfPlugins.StatefunContextProcessor) {
+		calls.record(contextProcessor)
+	}, *NewFunctionTypeConfig())
+	startTestRuntime(t, r)
+	b.reschedule = func() {
+		if err := r.SignalAfter("timer1", 200*time.Millisecond, "test.timer", "a", testPayload("n", 2), nil); err != nil {
+			t.Error(err)
+		}
+	}
+
+	if err := r.SignalAfter("timer1", 0, "test.timer", "a", testPayload("n", 1), nil); err != nil {
+		t.Fatal(err)
+	}
+	for n := 1; n <= 2; n++ {
+		if payload := calls.wait(t); int(payload.GetByPath("n").AsNumericDefault(0)) != n {
+			t.Fatalf("timer signaled with %s, want n=%d", payload.ToString(), n)
+		}
+	}
+}
+
+func TestTimersSchedulerWatchesAgainAfterWatchClosed(t *testing.T) {
+	b := newClosingWatchBackend()
+	r := newTestRuntime(t, newTestRuntimeConfig(b))
+	calls := newTestCalls()
+	NewFunctionType(r.Runtime, "test.timer", func(_ sfPlugins.StatefunExecutor, contextProcessor *sfPlugins.StatefunContextProcessor) {
+		calls.record(contextProcessor)
+	}, *NewFunctionTypeConfig())
+	startTestRuntime(t, r)
+
+	waitFor(t, "timers watch", func() bool { return b.closeWatchers(t, TimersKVPrefix) > 0 })
+	if err := r.SignalAfter("timer1", 100*time.Millisecond, "test.timer", "a", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	calls.wait(t)
+}
@@ -0,0 +1,98 @@
+// Copyright 2023 NJWS Inc.
+
+package statefun
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/foliagecp/easyjson"
+
+	sfPlugins "github.com/foliagecp/sdk/statefun/plugins"
+)
+
+// TypedFunctionLogicHandler gets the payload decoded into Req, the returned Resp is replied if the function was requested.
+// Returned error is treated the same way as the one of RetriableFunctionLogicHandler.
+type TypedFunctionLogicHandler[Req any, Resp any] func(executor sfPlugins.StatefunExecutor, contextProcessor *sfPlugins.StatefunContextProcessor, request Req) (Resp, error)
+
+// Validator is implemented by typed requests which need to be validated after decoding
+type Validator interface {
+	Validate() error
+}
+
+// NewTypedFunctionType registers the function type which payload is decoded from JSON into Req and validated if Req implements
+// Validator. Payloads which cannot be decoded or are invalid are not retried and are replied as "invalid". Callers may still signal and request the function
+// with any JSON payload, e.g. over NATS, as long as it decodes into Req.
+func NewTypedFunctionType[Req any, Resp any](runtime *Runtime, name string, logicHandler TypedFunctionLogicHandler[Req, Resp], config FunctionTypeConfig) *FunctionType {
+	return NewRetriableFunctionType(runtime, name, func(executor sfPlugins.StatefunExecutor, contextProcessor *sfPlugins.StatefunContextProcessor) error {
+		request, err := decodeTyped[Req](contextProcessor.Payload)
+		if err != nil {
+			err = fmt.Errorf("invalid payload for function type %s: %w", name, err)
+			if contextProcessor.Reply != nil {
+				contextProcessor.Reply.With(errorReply("invalid", err))
+			}
+			return NewTerminalError(err)
+		}
+		response, err := logicHandler(executor, contextProcessor, request)
+		if err != nil {
+			return err
+		}
+		if contextProcessor.Reply != nil {
+			reply, err := encodeTyped(response)
+			if err != nil {
+				return NewTerminalError(fmt.Errorf("function type %s cannot encode reply: %w", name, err))
+			}
+			contextProcessor.Reply.With(reply)
+		}
+		return nil
+	}, config)
+}
+
+// RequestTyped requests the function with the request encoded into JSON payload and decodes the reply into Resp,
+// replies the runtime sends instead of the handler's one, e.g. on handler failure or invalid request, are returned as errors
+func RequestTyped[Req any, Resp any](ctx context.Context, runtime *Runtime, requestProvider sfPlugins.RequestProvider, typename string, id string, request Req, options *easyjson.JSON) (Resp, error) {
+	var response Resp
+	payload, err := encodeTyped(request)
+	if err != nil {
+		return response, fmt.Errorf("cannot encode request to function type %s: %w", typename, err)
+	}
+	reply, err := runtime.RequestCtx(ctx, requestProvider, typename, id, payload, options)
+	if err != nil {
+		return response, err
+	}
+	if status, ok := reply.GetByPath(ReplyErrorKey).AsString(); ok {
+		return response, fmt.Errorf("function typename \"%s\" with id \"%s\" replied %s: %s", typename, id, status, reply.GetByPath("result").AsStringDefault(""))
+	}
+	return decodeTyped[Resp](reply)
+}
+
+func decodeTyped[T any](j *easyjson.JSON) (T, error) {
+	var v T
+	if j != nil {
+		if err := json.Unmarshal(j.ToBytes(), &v); err != nil {
+			return v, err
+		}
+	}
+	if validator, ok := any(&v).(Validator); ok {
+		if err := validator.Validate(); err != nil {
+			return v, err
+		}
+	} else if validator, ok := any(v).(Validator); ok {
+		if err := validator.Validate(); err != nil {
+			return v, err
+		}
+	}
+	return v, nil
+}
+
+func encodeTyped[T any](v T) (*easyjson.JSON, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	if j, ok := easyjson.JSONFromBytes(data); ok {
+		return &j, nil
+	}
+	return nil, fmt.Errorf("%s is not a json", string(data))
+}
@@ -0,0 +1,70 @@
+// Copyright 2023 NJWS Inc.
+
+package statefun
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/foliagecp/easyjson"
+
+	"github.com/foliagecp/sdk/statefun/backend"
+	sfPlugins "github.com/foliagecp/sdk/statefun/plugins"
+)
+
+type typedTestRequest struct {
+	Name string `json:"name"`
+	Fail bool   `json:"fail"`
+}
+
+func (r typedTestRequest) Validate() error {
+	if r.Name == "invalid" {
+		return errors.New("name is invalid")
+	}
+	return nil
+}
+
+type typedTestResponse struct {
+	Status string `json:"status"`
+}
+
+func TestRequestTyped(t *testing.T) {
+	r := newTestRuntime(t, newTestRuntimeConfig(backend.NewInMemory()))
+	schema := easyjson.NewJSONObject()
+	schema.SetByPath("type", easyjson.NewJSON("object"))
+	schema.SetByPath("required", easyjson.JSONFromArray([]string{"name"}))
+	NewTypedFunctionType(r.Runtime, "test.typed", func(_ sfPlugins.StatefunExecutor, _ *sfPlugins.StatefunContextProcessor, request typedTestRequest) (typedTestResponse, error) {
+		if request.Fail {
+			return typedTestResponse{}, errors.New("cannot handle")
+		}
+		return typedTestResponse{Status: "failed"}, nil // Own status field must not be mistaken for a failure
+	}, *NewFunctionTypeConfig().SetPayloadSchema(&schema))
+	startTestRuntime(t, r)
+
+	response, err := RequestTyped[typedTestRequest, typedTestResponse](context.Background(), r.Runtime, sfPlugins.GolangLocalRequest, "test.typed", "a", typedTestRequest{Name: "a"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.Status != "failed" {
+		t.Fatalf("typed request replied with %+v", response)
+	}
+
+	tests := []struct {
+		name        string
+		request     any
+		wantReplied string
+	}{
+		{name: "failed handler", request: typedTestRequest{Name: "a", Fail: true}, wantReplied: "failed"},
+		{name: "schema violation", request: map[string]any{}, wantReplied: "invalid"},
+		{name: "undecodable payload", request: map[string]any{"name": 1}, wantReplied: "invalid"},
+		{name: "validator failure", request: typedTestRequest{Name: "invalid"}, wantReplied: "invalid"},
+	}
+	for _, test := range tests {
+		_, err := RequestTyped[any, typedTestResponse](context.Background(), r.Runtime, sfPlugins.GolangLocalRequest, "test.typed", "a", test.request, nil)
+		if err == nil || !strings.Contains(err.Error(), "replied "+test.wantReplied) {
+			t.Fatalf("%s: request returned %v, want replied %s", test.name, err, test.wantReplied)
+		}
+	}
+}
@@ -0,0 +1,265 @@
+// Copyright 2023 NJWS Inc.
+
+package statefun
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"strings"
+	"time"
+
+	"github.com/foliagecp/easyjson"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/foliagecp/sdk/statefun/backend"
+	lg "github.com/foliagecp/sdk/statefun/logger"
+	"github.com/foliagecp/sdk/statefun/system"
+)
+
+const (
+	VersionSubjectPrefix = "version"
+	VersionsKVPrefix     = "statefun_versions"
+)
+
+/*
+Runtimes may register different versions of the same function type side by side. All of them share the function type's
+queue consumer, which routes every signal to the version chosen by the function type's routing table stored in KV:
+to "version.<typename>.<version>.<id>" handled by the consumer of that version. Runtimes which have the function type
+registered publish to the version subject directly. NATS core requests are answered only by the runtimes of the chosen version,
+Golang local signals and requests for an id of another version are sent to it via JetStream and NATS core respectively
+if the function type is accessible so.
+
+Canary: {"stable": "v1", "canary": "v2", "percentage": 10} sends 10% of ids (always the same ones) to v2, "ids" sends the listed ones.
+Blue/green: "percentage": 100 switches all ids to v2, then v2 becomes stable. Rollback is setting the table back,
+it applies at once to all the messages not routed yet. No routing table - every version handles whatever it receives.
+Versioned function types cannot be partitioned, partitions take precedence.
+*/
+
+// VersionRouting is the routing table of a versioned function type
+type VersionRouting struct {
+	Stable     string   // Version handling all ids not routed to the canary, empty - no routing
+	Canary     string   // Version handling the percentage of ids and the listed ids, empty - no canary
+	Percentage int      // 0..100
+	IDs        []string // Ids handled by the canary regardless of the percentage
+}
+
+// Version returns the version which must handle the id, empty if any version may
+func (vr VersionRouting) Version(id string) string {
+	if len(vr.Canary) > 0 {
+		for _, canaryID := range vr.IDs {
+			if canaryID == id {
+				return vr.Canary
+			}
+		}
+		h := fnv.New32a()
+		h.Write([]byte(id))
+		if int(h.Sum32()%100) < vr.Percentage {
+			return vr.Canary
+		}
+	}
+	return vr.Stable
+}
+
+func (vr VersionRouting) toJSON() easyjson.JSON {
+	j := easyjson.NewJSONObject()
+	j.SetByPath("stable", easyjson.NewJSON(vr.Stable))
+	j.SetByPath("canary", easyjson.NewJSON(vr.Canary))
+	j.SetByPath("percentage", easyjson.NewJSON(vr.Percentage))
+	j.SetByPath("ids", easyjson.JSONFromArray(vr.IDs))
+	return j
+}
+
+func versionRoutingFromJSON(j easyjson.JSON) VersionRouting {
+	vr := VersionRouting{
+		Stable:     j.GetByPath("stable").AsStringDefault(""),
+		Canary:     j.GetByPath("canary").AsStringDefault(""),
+		Percentage: int(j.GetByPath("percentage").AsNumericDefault(0)),
+	}
+	vr.IDs, _ = j.GetByPath("ids").AsArrayString()
+	return vr
+}
+
+func getVersionSubject(typename string, version string, id string) string {
+	return fmt.Sprintf("%s.%s.%s.%s", VersionSubjectPrefix, typename, version, id)
+}
+
+func getVersionsStreamName(typename string) string {
+	return fmt.Sprintf("%s_versions_stream", system.GetHashStr(typename+".*"))
+}
+
+func getVersionRoutingKey(typename string) string {
+	return fmt.Sprintf("%s.%s.routing", VersionsKVPrefix, system.GetHashStr(typename))
+}
+
+func isValidVersion(version string) bool {
+	return len(version) > 0 && !strings.ContainsAny(version, ".*> \t\r\n")
+}
+
+func (ft *FunctionType) versioned() bool {
+	return len(ft.config.version) > 0 && ft.config.partitions == 0
+}
+
+// Version which must handle the id, empty if any version may
+func (ft *FunctionType) targetVersion(id string) string {
+	if routing, ok := ft.versionRouting.Load().(VersionRouting); ok {
+		return routing.Version(id)
+	}
+	return ""
+}
+
+// Returns the version which must handle the id if it is not the one of this runtime
+func (ft *FunctionType) otherVersion(id string) (string, bool) {
+	if !ft.versioned() {
+		return "", false
+	}
+	version := ft.targetVersion(id)
+	return version, len(version) > 0 && version != ft.config.version
+}
+
+func (ft *FunctionType) ensureVersionsStream() error {
+	return ft.runtime.backend.EnsureStream(backend.StreamConfig{
+		Name:       getVersionsStreamName(ft.name),
+		Subjects:   []string{getVersionSubject(ft.name, "*", "*")},
+		Duplicates: time.Duration(ft.config.idempotencyWindowSec) * time.Second,
+	})
+}
+
+// Loads the routing table and keeps it up to date until the runtime is stopped
+func (ft *FunctionType) watchVersionRouting() error {
+	key := getVersionRoutingKey(ft.name)
+	w, err := ft.runtime.kv.Watch(key)
+	if err != nil {
+		return err
+	}
+	for entry := range w.Updates() { // Current table is loaded before any message is received
+		if entry == nil {
+			break
+		}
+		ft.storeVersionRouting(entry.Value())
+	}
+
+	go func() {
+		system.GlobalPrometrics.GetRoutinesCounter().Started("functiontype-versionRoutingWatcher")
+		defer system.GlobalPrometrics.GetRoutinesCounter().Stopped("functiontype-versionRoutingWatcher")
+		defer func() {
+			if w != nil { // Nil if the runtime was shut down while watching again
+				system.MsgOnErrorReturn(w.Stop())
+			}
+		}()
+		for {
+			select {
+			case <-ft.runtime.ctx.Done():
+				return
+			case entry, ok := <-w.Updates():
+				if !ok { // Routing changes would be missed otherwise, current table is loaded again
+					system.MsgOnErrorReturn(w.Stop())
+					if w, ok = ft.runtime.rewatchKV(key, "Version routing watcher of function type "+ft.name); !ok {
+						return
+					}
+					continue
+				}
+				if entry != nil {
+					ft.storeVersionRouting(entry.Value())
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+func (ft *FunctionType) storeVersionRouting(value []byte) {
+	if j, ok := easyjson.JSONFromBytes(value); ok {
+		routing := versionRoutingFromJSON(j)
+		ft.versionRouting.Store(routing)
+		lg.Logf(lg.InfoLevel, "Function type %s version routing: stable=%s canary=%s percentage=%d ids=%d\n", ft.name, routing.Stable, routing.Canary, routing.Percentage, len(routing.IDs))
+	} else {
+		ft.versionRouting.Store(VersionRouting{})
+	}
+}
+
+func (ft *FunctionType) getVersionConsumerName() string {
+	return fmt.Sprintf("%s_version_%s", ft.getConsumerName(), ft.config.version)
+}
+
+func (ft *FunctionType) subscribeVersion() error {
+	consumerName := ft.getVersionConsumerName()
+	sub, err := ft.runtime.backend.SubscribeConsumer(
+		getVersionsStreamName(ft.name),
+		backend.ConsumerConfig{
+			Name:          consumerName,
+			DeliverGroup:  consumerName + "-group",
+			FilterSubject: getVersionSubject(ft.name, ft.config.version, "*"),
+			AckWait:       time.Duration(ft.config.msgAckWaitMs) * time.Millisecond,
+			MaxAckPending: ft.config.maxAckPending,
+		},
+		func(msg backend.Msg) { // Already routed, handled even if the routing has changed meanwhile
+			system.MsgOnErrorReturn(handleNatsMsg(ft, msg, false, ft.msgAckChannel))
+		},
+	)
+	if err != nil {
+		lg.Logf(lg.ErrorLevel, "Invalid version %s subscription for function type %s: %s\n", ft.config.version, ft.name, err)
+		return err
+	}
+	return ft.addConsumerSubscription(sub)
+}
+
+// Moves the message received by the function type's queue consumer to the version which must handle its id
+func (ft *FunctionType) routeToVersion(msg backend.Msg, id string, version string) error {
+	subject := getVersionSubject(ft.name, version, id)
+	var err error
+	if msgID := msg.MsgID(); len(msgID) > 0 {
+		err = ft.runtime.backend.StreamPublishMsgID(subject, msg.Data(), msgID)
+	} else {
+		err = ft.runtime.backend.StreamPublish(subject, msg.Data())
+	}
+	if err != nil {
+		system.MsgOnErrorReturn(msg.Nak())
+		return fmt.Errorf("function %s cannot route message for id=%s to version %s: %w", ft.name, id, version, err)
+	}
+	ft.countVersionRoute(version)
+	return msg.Ack()
+}
+
+func (ft *FunctionType) countVersionRoute(version string) {
+	if counterVec, err := system.GlobalPrometrics.EnsureCounterVecSimple("statefun_version_routes", "Stateful function messages routed to other versions", []string{"typename", "version"}); err == nil {
+		counterVec.With(prometheus.Labels{"typename": ft.name, "version": version}).Inc()
+	}
+}
+
+// SetVersionRouting stores the routing table of the versioned function type, all runtimes apply it at once
+func (r *Runtime) SetVersionRouting(typename string, routing VersionRouting) error {
+	for _, version := range []string{routing.Stable, routing.Canary} {
+		if len(version) > 0 && !isValidVersion(version) {
+			return fmt.Errorf("version \"%s\" is invalid", version)
+		}
+	}
+	if routing.Percentage < 0 || routing.Percentage > 100 {
+		return fmt.Errorf("percentage must be within 0..100, got %d", routing.Percentage)
+	}
+	_, err := r.kv.Put(getVersionRoutingKey(typename), routing.toJSON().ToBytes())
+	return err
+}
+
+// GetVersionRouting returns the routing table of the versioned function type, an empty one if it is not set
+func (r *Runtime) GetVersionRouting(typename string) (VersionRouting, error) {
+	entry, err := r.kv.Get(getVersionRoutingKey(typename))
+	if err != nil {
+		if errors.Is(err, backend.ErrKeyNotFound) {
+			return VersionRouting{}, nil
+		}
+		return VersionRouting{}, err
+	}
+	if j, ok := easyjson.JSONFromBytes(entry.Value()); ok {
+		return versionRoutingFromJSON(j), nil
+	}
+	return VersionRouting{}, fmt.Errorf("version routing of function type %s is not a json", typename)
+}
+
+// Version returns the version of the function type registered in this runtime, empty if it is not versioned
+func (r *Runtime) Version(typename string) string {
+	if ft, ok := r.registeredFunctionTypes[typename]; ok {
+		return ft.config.version
+	}
+	return ""
+}
@@ -0,0 +1,147 @@
+// Copyright 2023 NJWS Inc.
+
+package statefun
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/foliagecp/sdk/statefun/backend"
+	sfPlugins "github.com/foliagecp/sdk/statefun/plugins"
+)
+
+func TestVersionRoutingWatchedAgainAfterWatchClosed(t *testing.T) {
+	b := newClosingWatchBackend()
+	r := newTestRuntime(t, newTestRuntimeConfig(b))
+	NewFunctionType(r.Runtime, "test.versions", func(_ sfPlugins.StatefunExecutor, _ *sfPlugins.StatefunContextProcessor) {}, *NewFunctionTypeConfig().SetVersion("v1"))
+	startTestRuntime(t, r)
+	ft := r.registeredFunctionTypes["test.versions"]
+
+	waitFor(t, "version routing watch", func() bool { return b.closeWatchers(t, VersionsKVPrefix) > 0 })
+	if err := r.SetVersionRouting("test.versions", VersionRouting{Stable: "v1", Canary: "v2", IDs: []string{"a"}}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "version routing applied", func() bool { return ft.targetVersion("a") == "v2" })
+
+	// Rollback still applies
+	if err := r.SetVersionRouting("test.versions", VersionRouting{Stable: "v1"}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "version routing rolled back", func() bool { return ft.targetVersion("a") == "v1" })
+}
+
+func TestVersionRoutingVersion(t *testing.T) {
+	ids := make([]string, 1000)
+	for i := range ids {
+		ids[i] = fmt.Sprint(i)
+	}
+	canaryShare := func(routing VersionRouting) int {
+		canary := 0
+		for _, id := range ids {
+			if routing.Version(id) == routing.Canary {
+				canary++
+			}
+		}
+		return canary * 100 / len(ids)
+	}
+
+	if share := canaryShare(VersionRouting{Stable: "v1", Canary: "v2"}); share != 0 {
+		t.Fatalf("canary got %d%% of ids with 0%%", share)
+	}
+	if share := canaryShare(VersionRouting{Stable: "v1", Canary: "v2", Percentage: 100}); share != 100 {
+		t.Fatalf("canary got %d%% of ids with 100%%", share)
+	}
+	routing := VersionRouting{Stable: "v1", Canary: "v2", Percentage: 30}
+	if share := canaryShare(routing); share < 25 || share > 35 {
+		t.Fatalf("canary got %d%% of ids with 30%%", share)
+	}
+	// The same ids stay on the canary while the percentage grows
+	wider := VersionRouting{Stable: "v1", Canary: "v2", Percentage: 60}
+	for _, id := range ids {
+		if routing.Version(id) == "v2" && wider.Version(id) != "v2" {
+			t.Fatalf("id %s left the canary when the percentage grew", id)
+		}
+	}
+
+	listed := VersionRouting{Stable: "v1", Canary: "v2", IDs: []string{"7"}}
+	if listed.Version("7") != "v2" || listed.Version("8") != "v1" {
+		t.Fatalf("listed id is routed to %s, other one to %s", listed.Version("7"), listed.Version("8"))
+	}
+	if version := (VersionRouting{Canary: "v2", IDs: []string{"7"}}).Version("8"); version != "" {
+		t.Fatalf("id is routed to %s without a stable version", version)
+	}
+}
+
+func TestVersionRouting(t *testing.T) {
+	b := backend.NewInMemory()
+	handled := make(chan string, 100) // "<version>:<id>"
+	runtimes := map[string]*testRuntime{}
+	for _, version := range []string{"v1", "v2"} {
+		version := version
+		r := newTestRuntime(t, newTestRuntimeConfig(b))
+		NewFunctionType(r.Runtime, "test.versions", func(_ sfPlugins.StatefunExecutor, contextProcessor *sfPlugins.StatefunContextProcessor) {
+			handled <- version + ":" + contextProcessor.Self.ID
+			if contextProcessor.Reply != nil {
+				contextProcessor.Reply.With(testPayload("version", version))
+			}
+		}, *NewFunctionTypeConfig().SetVersion(version).SetServiceState(true).SetMultipleInstancesAllowance(true))
+		startTestRuntime(t, r)
+		runtimes[version] = r
+	}
+	setRouting := func(routing VersionRouting, id string, want string) {
+		t.Helper()
+		if err := runtimes["v1"].SetVersionRouting("test.versions", routing); err != nil {
+			t.Fatal(err)
+		}
+		for _, r := range runtimes {
+			ft := r.registeredFunctionTypes["test.versions"]
+			waitFor(t, "version routing applied", func() bool { return ft.targetVersion(id) == want })
+		}
+	}
+	expectHandled := func(want string) {
+		t.Helper()
+		select {
+		case got := <-handled:
+			if got != want {
+				t.Fatalf("handled %s, want %s", got, want)
+			}
+		case <-time.After(testWaitTimeout):
+			t.Fatalf("%s was not handled in time", want)
+		}
+	}
+
+	setRouting(VersionRouting{Stable: "v1", Canary: "v2", IDs: []string{"b"}}, "b", "v2")
+	for _, provider := range []sfPlugins.SignalProvider{sfPlugins.JetstreamGlobalSignal, sfPlugins.GolangLocalSignal} {
+		for _, id := range []string{"a", "b"} {
+			if err := runtimes["v1"].Signal(provider, "test.versions", id, nil, nil); err != nil {
+				t.Fatal(err)
+			}
+			expectHandled(map[string]string{"a": "v1:a", "b": "v2:b"}[id])
+		}
+	}
+	for _, provider := range []sfPlugins.RequestProvider{sfPlugins.NatsCoreGlobalRequest, sfPlugins.GolangLocalRequest} {
+		reply, err := runtimes["v1"].Request(provider, "test.versions", "b", nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if version := reply.GetByPath("version").AsStringDefault(""); version != "v2" {
+			t.Fatalf("request via provider %d was answered by %s, want v2", provider, version)
+		}
+		expectHandled("v2:b")
+	}
+
+	// Rollback applies at once
+	setRouting(VersionRouting{Stable: "v1"}, "b", "v1")
+	if err := runtimes["v2"].Signal(sfPlugins.JetstreamGlobalSignal, "test.versions", "b", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	expectHandled("v1:b")
+
+	// Blue/green switch
+	setRouting(VersionRouting{Stable: "v1", Canary: "v2", Percentage: 100}, "a", "v2")
+	if err := runtimes["v1"].Signal(sfPlugins.JetstreamGlobalSignal, "test.versions", "a", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	expectHandled("v2:a")
+}
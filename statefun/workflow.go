@@ -0,0 +1,286 @@
+// Copyright 2023 NJWS Inc.
+
+package statefun
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/foliagecp/easyjson"
+	"github.com/prometheus/client_golang/prometheus"
+
+	lg "github.com/foliagecp/sdk/statefun/logger"
+	sfPlugins "github.com/foliagecp/sdk/statefun/plugins"
+	"github.com/foliagecp/sdk/statefun/system"
+)
+
+/*
+A workflow is a function type which runs its steps one after another for every workflow instance (id). Progress is kept in the
+instance's function context, every step is run by a separate JetStream signal the instance sends to itself, so an instance
+interrupted by a runtime restart continues from the step it was at when the signal is redelivered. Steps are run at least once
+and must tolerate being repeated. A failed step is retried, then the compensations of all the completed steps are run in reverse order.
+
+Instance function context:
+
+	status: string // One of WorkflowStatus*
+	step: int // Index of the step being run or compensated
+	attempt: int // Attempt of the current step's action or compensation
+	seq: int // Number of the last continuation signal, older ones are ignored
+	input: json // Input the instance was started with
+	state: json // Data the steps keep for the next steps and compensations
+	error: string // Error of the step which made the instance compensate
+	compensation_error: string // Error of the compensation which made the instance fail
+	history: [{"step": string, "event": string, "at": int, "error": string}]
+	started_at, updated_at: int
+
+Commands (payload "command"): "start" (with "input"), "continue" (internal), "resume", "get". Requested commands reply with the instance.
+*/
+
+const (
+	WorkflowStatusRunning      = "running"
+	WorkflowStatusCompensating = "compensating"
+	WorkflowStatusCompleted    = "completed"
+	WorkflowStatusCompensated  = "compensated"
+	WorkflowStatusFailed       = "failed" // Compensation failed too, see ResumeWorkflow
+)
+
+// WorkflowAction is an action or a compensation of a workflow step.
+// Returned TerminalError skips the remaining retries.
+type WorkflowAction func(ctx *WorkflowContext) error
+
+type WorkflowContext struct {
+	Processor *sfPlugins.StatefunContextProcessor // Of the workflow instance, Request and Signal are made on its behalf
+	Input     *easyjson.JSON                      // Input the instance was started with
+	State     *easyjson.JSON                      // Persisted after the action succeeds, shared by all steps and compensations
+	Attempt   int                                 // Attempt of the current action or compensation, starting from 0
+}
+
+type WorkflowStep struct {
+	Name         string
+	Action       WorkflowAction
+	Compensate   WorkflowAction // Undoes the action when a later step fails, nil - nothing to undo
+	Retries      int            // How many times a failed action or compensation is retried
+	RetryDelayMs int
+}
+
+type workflow struct {
+	name  string
+	steps []WorkflowStep
+}
+
+// NewWorkflow registers the workflow function type, the function type must be accessible via JetStream signals
+func NewWorkflow(runtime *Runtime, name string, steps []WorkflowStep, config FunctionTypeConfig) *FunctionType {
+	w := &workflow{name: name, steps: steps}
+	return NewRetriableFunctionType(runtime, name, w.handle, config)
+}
+
+func (w *workflow) handle(_ sfPlugins.StatefunExecutor, contextProcessor *sfPlugins.StatefunContextProcessor) error {
+	instance := contextProcessor.GetFunctionContext()
+	status := instance.GetByPath("status").AsStringDefault("")
+
+	var err error
+	switch command := contextProcessor.Payload.GetByPath("command").AsStringDefault(""); command {
+	case "start":
+		if len(status) > 0 { // Already started
+			break
+		}
+		now := system.GetCurrentTimeNs()
+		instance = easyjson.NewJSONObject().GetPtr()
+		instance.SetByPath("status", easyjson.NewJSON(WorkflowStatusRunning))
+		instance.SetByPath("step", easyjson.NewJSON(0))
+		instance.SetByPath("attempt", easyjson.NewJSON(0))
+		instance.SetByPath("seq", easyjson.NewJSON(0))
+		instance.SetByPath("input", contextProcessor.Payload.GetByPath("input"))
+		instance.SetByPath("state", easyjson.NewJSONObject())
+		instance.SetByPath("history", easyjson.NewJSONArray())
+		instance.SetByPath("started_at", easyjson.NewJSON(now))
+		err = w.schedule(contextProcessor, instance, 0)
+	case "continue":
+		seq := int(instance.GetByPath("seq").AsNumericDefault(0))
+		msgSeq := int(contextProcessor.Payload.GetByPath("seq").AsNumericDefault(-1))
+		if msgSeq > seq { // Instance was updated by other runtime, its cache has not caught up yet
+			return NewRetryError(fmt.Errorf("workflow %s instance %s state is behind continuation %d", w.name, contextProcessor.Self.ID, msgSeq), 100*time.Millisecond)
+		}
+		if msgSeq < seq { // Duplicate of an already handled continuation
+			break
+		}
+		err = w.continueInstance(contextProcessor, instance)
+	case "resume":
+		switch status {
+		case WorkflowStatusFailed:
+			instance.SetByPath("status", easyjson.NewJSON(WorkflowStatusCompensating))
+			instance.SetByPath("attempt", easyjson.NewJSON(0))
+			err = w.schedule(contextProcessor, instance, 0)
+		case WorkflowStatusRunning, WorkflowStatusCompensating:
+			err = w.schedule(contextProcessor, instance, 0)
+		}
+	case "get":
+	default:
+		err = NewTerminalError(fmt.Errorf("workflow %s got unknown command \"%s\"", w.name, command))
+	}
+
+	if contextProcessor.Reply != nil {
+		if err != nil {
+			return err
+		}
+		contextProcessor.Reply.With(contextProcessor.GetFunctionContext())
+	}
+	return err
+}
+
+// Runs the current step's action or compensation
+func (w *workflow) continueInstance(contextProcessor *sfPlugins.StatefunContextProcessor, instance *easyjson.JSON) error {
+	status := instance.GetByPath("status").AsStringDefault("")
+	if status != WorkflowStatusRunning && status != WorkflowStatusCompensating {
+		return nil
+	}
+	stepIndex := int(instance.GetByPath("step").AsNumericDefault(0))
+	attempt := int(instance.GetByPath("attempt").AsNumericDefault(0))
+	compensating := status == WorkflowStatusCompensating
+	if stepIndex < 0 || stepIndex >= len(w.steps) {
+		return w.finish(contextProcessor, instance, map[bool]string{false: WorkflowStatusCompleted, true: WorkflowStatusCompensated}[compensating])
+	}
+	step := w.steps[stepIndex]
+
+	action := step.Action
+	if compensating {
+		action = step.Compensate
+	}
+	state := instance.GetByPath("state").Clone()
+	var actionErr error
+	if action != nil {
+		actionErr = action(&WorkflowContext{
+			Processor: contextProcessor,
+			Input:     instance.GetByPath("input").GetPtr(),
+			State:     &state,
+			Attempt:   attempt,
+		})
+	}
+
+	if actionErr == nil {
+		instance.SetByPath("state", state)
+		instance.SetByPath("attempt", easyjson.NewJSON(0))
+		if compensating {
+			w.record(instance, step.Name, "compensated", nil)
+			instance.SetByPath("step", easyjson.NewJSON(stepIndex-1))
+			if stepIndex-1 < 0 {
+				return w.finish(contextProcessor, instance, WorkflowStatusCompensated)
+			}
+		} else {
+			w.record(instance, step.Name, "done", nil)
+			instance.SetByPath("step", easyjson.NewJSON(stepIndex+1))
+			if stepIndex+1 >= len(w.steps) {
+				return w.finish(contextProcessor, instance, WorkflowStatusCompleted)
+			}
+		}
+		return w.schedule(contextProcessor, instance, 0)
+	}
+
+	var terminalErr *TerminalError
+	if !errors.As(actionErr, &terminalErr) && attempt < step.Retries {
+		w.record(instance, step.Name, map[bool]string{false: "failed", true: "compensation_failed"}[compensating], actionErr)
+		instance.SetByPath("attempt", easyjson.NewJSON(attempt+1))
+		return w.schedule(contextProcessor, instance, time.Duration(step.RetryDelayMs)*time.Millisecond)
+	}
+
+	instance.SetByPath("attempt", easyjson.NewJSON(0))
+	if compensating {
+		lg.Logf(lg.ErrorLevel, "Workflow %s instance %s cannot compensate step %s: %s\n", w.name, contextProcessor.Self.ID, step.Name, actionErr)
+		w.record(instance, step.Name, "compensation_failed", actionErr)
+		instance.SetByPath("compensation_error", easyjson.NewJSON(actionErr.Error()))
+		return w.finish(contextProcessor, instance, WorkflowStatusFailed)
+	}
+	lg.Logf(lg.WarnLevel, "Workflow %s instance %s step %s failed, compensating: %s\n", w.name, contextProcessor.Self.ID, step.Name, actionErr)
+	w.record(instance, step.Name, "failed", actionErr)
+	instance.SetByPath("error", easyjson.NewJSON(actionErr.Error()))
+	instance.SetByPath("status", easyjson.NewJSON(WorkflowStatusCompensating))
+	instance.SetByPath("step", easyjson.NewJSON(stepIndex-1)) // Failed step itself is not compensated
+	if stepIndex-1 < 0 {
+		return w.finish(contextProcessor, instance, WorkflowStatusCompensated)
+	}
+	return w.schedule(contextProcessor, instance, 0)
+}
+
+// Persists the instance and signals it to continue after the delay
+func (w *workflow) schedule(contextProcessor *sfPlugins.StatefunContextProcessor, instance *easyjson.JSON, delay time.Duration) error {
+	previous := contextProcessor.GetFunctionContext()
+
+	seq := int(instance.GetByPath("seq").AsNumericDefault(0)) + 1
+	instance.SetByPath("seq", easyjson.NewJSON(seq))
+	instance.SetByPath("updated_at", easyjson.NewJSON(system.GetCurrentTimeNs()))
+	contextProcessor.SetFunctionContext(instance)
+
+	payload := easyjson.NewJSONObject()
+	payload.SetByPath("command", easyjson.NewJSON("continue"))
+	payload.SetByPath("seq", easyjson.NewJSON(seq))
+	var err error
+	if delay > 0 {
+		timerID := fmt.Sprintf("workflow.%s.%s.%d", w.name, contextProcessor.Self.ID, seq)
+		err = contextProcessor.SignalAfter(timerID, delay, contextProcessor.Self.Typename, contextProcessor.Self.ID, &payload, nil)
+	} else {
+		err = contextProcessor.Signal(sfPlugins.JetstreamGlobalSignal, contextProcessor.Self.Typename, contextProcessor.Self.ID, &payload, nil)
+	}
+	if err != nil { // Message being handled is redelivered and does the same again
+		contextProcessor.SetFunctionContext(previous)
+		return fmt.Errorf("workflow %s instance %s cannot continue: %w", w.name, contextProcessor.Self.ID, err)
+	}
+	return nil
+}
+
+func (w *workflow) finish(contextProcessor *sfPlugins.StatefunContextProcessor, instance *easyjson.JSON, status string) error {
+	instance.SetByPath("status", easyjson.NewJSON(status))
+	instance.SetByPath("updated_at", easyjson.NewJSON(system.GetCurrentTimeNs()))
+	contextProcessor.SetFunctionContext(instance)
+	if counterVec, err := system.GlobalPrometrics.EnsureCounterVecSimple("statefun_workflows_finished", "Workflow instances finished", []string{"typename", "status"}); err == nil {
+		counterVec.With(prometheus.Labels{"typename": w.name, "status": status}).Inc()
+	}
+	return nil
+}
+
+func (w *workflow) record(instance *easyjson.JSON, step string, event string, err error) {
+	record := easyjson.NewJSONObject()
+	record.SetByPath("step", easyjson.NewJSON(step))
+	record.SetByPath("event", easyjson.NewJSON(event))
+	record.SetByPath("at", easyjson.NewJSON(system.GetCurrentTimeNs()))
+	if err != nil {
+		record.SetByPath("error", easyjson.NewJSON(err.Error()))
+	}
+	history := instance.GetByPath("history")
+	history.AddToArray(record)
+	instance.SetByPath("history", history)
+}
+
+// StartWorkflow starts the workflow instance, starting an already started instance does nothing
+func (r *Runtime) StartWorkflow(name string, id string, input *easyjson.JSON) error {
+	payload := easyjson.NewJSONObject()
+	payload.SetByPath("command", easyjson.NewJSON("start"))
+	if input != nil {
+		payload.SetByPath("input", *input)
+	} else {
+		payload.SetByPath("input", easyjson.NewJSONObject())
+	}
+	return r.SignalIdempotent(sfPlugins.JetstreamGlobalSignal, name, id, fmt.Sprintf("workflow.start.%s.%s", name, id), &payload, nil)
+}
+
+// ResumeWorkflow makes the running or compensating instance continue, e.g. when it was stopped between persisting its progress
+// and signaling itself, and retries the compensation of the failed one
+func (r *Runtime) ResumeWorkflow(name string, id string) error {
+	payload := easyjson.NewJSONObjectWithKeyValue("command", easyjson.NewJSON("resume"))
+	return r.Signal(sfPlugins.JetstreamGlobalSignal, name, id, &payload, nil)
+}
+
+// GetWorkflow returns the workflow instance's function context, must be called after the runtime is started
+func (r *Runtime) GetWorkflow(name string, id string) (*easyjson.JSON, error) {
+	return r.cacheStore.GetValueAsJSON(name + "." + id)
+}
+
+// ListWorkflows returns ids of the workflow's instances, must be called after the runtime is started
+func (r *Runtime) ListWorkflows(name string) []string {
+	ids := []string{}
+	for _, key := range r.cacheStore.GetKeysByPattern(name + ".*") {
+		ids = append(ids, strings.TrimPrefix(key, name+"."))
+	}
+	return ids
+}
@@ -0,0 +1,173 @@
+// Copyright 2023 NJWS Inc.
+
+package statefun
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/foliagecp/easyjson"
+
+	"github.com/foliagecp/sdk/statefun/backend"
+	sfPlugins "github.com/foliagecp/sdk/statefun/plugins"
+)
+
+// Records actions and compensations the workflow steps run, in order
+type testWorkflowEvents chan string
+
+func (e testWorkflowEvents) action(name string, err func(ctx *WorkflowContext) error) WorkflowAction {
+	return func(ctx *WorkflowContext) error {
+		e <- fmt.Sprintf("%s:%d", name, ctx.Attempt)
+		if err != nil {
+			return err(ctx)
+		}
+		return nil
+	}
+}
+
+func (e testWorkflowEvents) expect(t *testing.T, want ...string) {
+	t.Helper()
+	for _, w := range want {
+		select {
+		case got := <-e:
+			if got != w {
+				t.Fatalf("workflow ran %s, want %s", got, w)
+			}
+		case <-time.After(testWaitTimeout):
+			t.Fatalf("workflow did not run %s in time", w)
+		}
+	}
+	select {
+	case got := <-e:
+		t.Fatalf("workflow unexpectedly ran %s", got)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func waitForWorkflowStatus(t *testing.T, r *testRuntime, name string, id string, status string) *easyjson.JSON {
+	t.Helper()
+	var instance *easyjson.JSON
+	waitFor(t, "workflow "+status, func() bool {
+		var err error
+		instance, err = r.GetWorkflow(name, id)
+		return err == nil && instance.GetByPath("status").AsStringDefault("") == status
+	})
+	return instance
+}
+
+func TestWorkflowCompleted(t *testing.T) {
+	r := newTestRuntime(t, newTestRuntimeConfig(backend.NewInMemory()))
+	events := make(testWorkflowEvents, 100)
+	NewWorkflow(r.Runtime, "test.workflow", []WorkflowStep{
+		{Name: "a", Action: events.action("a", func(ctx *WorkflowContext) error {
+			ctx.State.SetByPath("a", ctx.Input.GetByPath("n"))
+			return nil
+		})},
+		{Name: "b", Action: events.action("b", func(ctx *WorkflowContext) error {
+			ctx.State.SetByPath("b", easyjson.NewJSON(ctx.State.GetByPath("a").AsNumericDefault(0)+1))
+			return nil
+		})},
+	}, *NewFunctionTypeConfig())
+	startTestRuntime(t, r)
+
+	if err := r.StartWorkflow("test.workflow", "w", testPayload("n", 1)); err != nil {
+		t.Fatal(err)
+	}
+	events.expect(t, "a:0", "b:0")
+	instance := waitForWorkflowStatus(t, r, "test.workflow", "w", WorkflowStatusCompleted)
+	if instance.GetByPath("state.b").AsNumericDefault(0) != 2 {
+		t.Fatalf("steps did not share the state, instance is %s", instance.ToString())
+	}
+	if history := instance.GetByPath("history"); history.ArraySize() != 2 || history.ArrayElement(1).GetByPath("event").AsStringDefault("") != "done" {
+		t.Fatalf("workflow history is %s", history.ToString())
+	}
+
+	// Starting an already started instance does nothing
+	if err := r.StartWorkflow("test.workflow", "w", testPayload("n", 10)); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Signal(sfPlugins.JetstreamGlobalSignal, "test.workflow", "w", testPayload("command", "start"), nil); err != nil {
+		t.Fatal(err)
+	}
+	events.expect(t)
+	if ids := r.ListWorkflows("test.workflow"); len(ids) != 1 || ids[0] != "w" {
+		t.Fatalf("workflow instances are %v", ids)
+	}
+}
+
+func TestWorkflowCompensation(t *testing.T) {
+	r := newTestRuntime(t, newTestRuntimeConfig(backend.NewInMemory()))
+	events := make(testWorkflowEvents, 100)
+	NewWorkflow(r.Runtime, "test.workflow", []WorkflowStep{
+		{Name: "a", Action: events.action("a", nil), Compensate: events.action("undo a", nil)},
+		{Name: "b", Action: events.action("b", nil), Compensate: events.action("undo b", nil)},
+		{Name: "c", Action: events.action("c", func(*WorkflowContext) error {
+			return errors.New("cannot do c")
+		}), Compensate: events.action("undo c", nil), Retries: 1, RetryDelayMs: 10},
+	}, *NewFunctionTypeConfig())
+	startTestRuntime(t, r)
+
+	if err := r.StartWorkflow("test.workflow", "w", nil); err != nil {
+		t.Fatal(err)
+	}
+	// Failed step is retried and is not compensated itself
+	events.expect(t, "a:0", "b:0", "c:0", "c:1", "undo b:0", "undo a:0")
+	instance := waitForWorkflowStatus(t, r, "test.workflow", "w", WorkflowStatusCompensated)
+	if instance.GetByPath("error").AsStringDefault("") != "cannot do c" {
+		t.Fatalf("workflow error is not kept, instance is %s", instance.ToString())
+	}
+}
+
+func TestWorkflowTerminalErrorIsNotRetried(t *testing.T) {
+	r := newTestRuntime(t, newTestRuntimeConfig(backend.NewInMemory()))
+	events := make(testWorkflowEvents, 100)
+	NewWorkflow(r.Runtime, "test.workflow", []WorkflowStep{
+		{Name: "a", Action: events.action("a", func(*WorkflowContext) error {
+			return NewTerminalError(errors.New("cannot do a"))
+		}), Retries: 5},
+	}, *NewFunctionTypeConfig())
+	startTestRuntime(t, r)
+
+	if err := r.StartWorkflow("test.workflow", "w", nil); err != nil {
+		t.Fatal(err)
+	}
+	events.expect(t, "a:0")
+	waitForWorkflowStatus(t, r, "test.workflow", "w", WorkflowStatusCompensated)
+}
+
+func TestWorkflowResumeFailedCompensation(t *testing.T) {
+	r := newTestRuntime(t, newTestRuntimeConfig(backend.NewInMemory()))
+	events := make(testWorkflowEvents, 100)
+	var compensationFixed atomic.Bool
+	NewWorkflow(r.Runtime, "test.workflow", []WorkflowStep{
+		{Name: "a", Action: events.action("a", nil), Compensate: events.action("undo a", func(*WorkflowContext) error {
+			if compensationFixed.Load() {
+				return nil
+			}
+			return errors.New("cannot undo a")
+		})},
+		{Name: "b", Action: events.action("b", func(*WorkflowContext) error {
+			return errors.New("cannot do b")
+		})},
+	}, *NewFunctionTypeConfig())
+	startTestRuntime(t, r)
+
+	if err := r.StartWorkflow("test.workflow", "w", nil); err != nil {
+		t.Fatal(err)
+	}
+	events.expect(t, "a:0", "b:0", "undo a:0")
+	instance := waitForWorkflowStatus(t, r, "test.workflow", "w", WorkflowStatusFailed)
+	if instance.GetByPath("compensation_error").AsStringDefault("") != "cannot undo a" {
+		t.Fatalf("compensation error is not kept, instance is %s", instance.ToString())
+	}
+
+	compensationFixed.Store(true)
+	if err := r.ResumeWorkflow("test.workflow", "w"); err != nil {
+		t.Fatal(err)
+	}
+	events.expect(t, "undo a:0")
+	waitForWorkflowStatus(t, r, "test.workflow", "w", WorkflowStatusCompensated)
+}
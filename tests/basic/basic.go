@@ -3,7 +3,10 @@
 package main
 
 import (
+	"context"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/foliagecp/easyjson"
@@ -189,7 +192,9 @@ func Start() {
 		if TriggersTest {
 			registerTriggerFunctions(runtime)
 		}
-		if err := runtime.Start(cache.NewCacheConfig("main_cache"), afterStart); err != nil {
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		if err := runtime.Start(ctx, cache.NewCacheConfig("main_cache"), afterStart); err != nil {
 			lg.Logf(lg.ErrorLevel, "Cannot start due to an error: %s\n", err)
 		}
 	} else {